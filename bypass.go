@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync/atomic"
+
+// SetBypass takes the cache out of the serving path if on is true, and puts
+// it back if it's false. While bypassed, the Get methods and GetTTL always
+// miss, and Set and its variants, Modify, IncrBy, AppendValue and
+// UpdateIfVersion do nothing and return false, so a misbehaving cache can be
+// switched off at runtime without reconfiguring or restarting anything.
+//
+// Nothing is freed: the items stay in the cache, and expire and are evicted
+// as usual. Del and the other methods removing items still work, so values
+// invalidated while the cache is bypassed aren't served once it's back.
+func (c *Cache[K, V]) SetBypass(on bool) {
+	if c == nil {
+		return
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.bypass, v)
+}
+
+// Bypassed returns true if the cache is bypassed, see SetBypass.
+func (c *Cache[K, V]) Bypassed() bool {
+	return c != nil && c.bypassed()
+}
+
+func (c *Cache[K, V]) bypassed() bool {
+	return atomic.LoadInt32(&c.bypass) == 1
+}
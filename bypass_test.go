@@ -0,0 +1,49 @@
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheBypass(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, time.Hour)
+	retrySet(t, c, 2, 2, 1, 0)
+	c.SetBypass(true)
+	require.True(t, c.Bypassed())
+
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	_, _, ok = c.GetWithMeta(1)
+	require.False(t, ok)
+	_, _, ok = c.GetStale(1)
+	require.False(t, ok)
+	_, ok = c.GetTTL(1)
+	require.False(t, ok)
+	require.False(t, c.Set(3, 3, 1))
+	_, ok = IncrBy(c, 1, 1, 0)
+	require.False(t, ok)
+	// Deletes still apply.
+	c.Del(2)
+	c.Wait()
+
+	c.SetBypass(false)
+	require.False(t, c.Bypassed())
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	_, ok = c.Get(3)
+	require.False(t, ok)
+}
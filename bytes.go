@@ -0,0 +1,53 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"github.com/cespare/xxhash/v2"
+	"github.com/paivagustavo/ristretto/z"
+)
+
+// CacheBytes is a Cache of byte slices keyed by strings, the most common use of
+// the cache. Create it with NewCacheBytes.
+type CacheBytes = Cache[string, []byte]
+
+// BytesConfig is passed to NewCacheBytes for creating new CacheBytes instances.
+type BytesConfig = Config[string, []byte]
+
+// NewCacheBytes returns a new CacheBytes instance and any configuration errors,
+// if any. Unlike NewCache, if config.Cost is nil the cost of a value is its
+// length, so values can be added with a cost of 0, and unless another way of
+// hashing the keys is set, they're hashed without going through the generic
+// z.KeyToHash.
+func NewCacheBytes(config *BytesConfig) (*CacheBytes, error) {
+	cfg := *config
+	if cfg.Cost == nil {
+		cfg.Cost = bytesCost
+	}
+	if cfg.KeyToHash == nil && cfg.Hasher == nil && !cfg.SipHash && !cfg.WideConflict {
+		cfg.KeyToHash = stringKeyToHash
+	}
+	return NewCache(&cfg)
+}
+
+func bytesCost(value []byte) int64 {
+	return int64(len(value))
+}
+
+func stringKeyToHash(key string) (uint64, uint64) {
+	return z.MemHashString(key), xxhash.Sum64String(key)
+}
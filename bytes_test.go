@@ -0,0 +1,50 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/paivagustavo/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheBytes(t *testing.T) {
+	c, err := NewCacheBytes(&BytesConfig{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set("a", []byte("abcd"), 0))
+	c.Wait()
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("abcd"), val)
+	require.Equal(t, int64(4), c.CostUsed())
+
+	// Values are too big for the cache if their length is larger than MaxCost.
+	require.True(t, c.Set("b", make([]byte, 11), 0))
+	c.Wait()
+	_, ok = c.Get("b")
+	require.False(t, ok)
+
+	key, conflict := stringKeyToHash("a")
+	zKey, zConflict := z.KeyToHash("a")
+	require.Equal(t, zKey, key)
+	require.Equal(t, zConflict, conflict)
+}
+
+func TestCacheBytesHashing(t *testing.T) {
+	for _, cfg := range []BytesConfig{
+		{SipHash: true},
+		{WideConflict: true},
+		{Hasher: HasherFunc[string](stringKeyToHash)},
+	} {
+		cfg.NumCounters, cfg.MaxCost, cfg.BufferItems = 100, 10, 64
+		c, err := NewCacheBytes(&cfg)
+		require.NoError(t, err)
+		c.Close()
+	}
+}
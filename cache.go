@@ -21,8 +21,10 @@ package ristretto
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"runtime/pprof"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,23 +38,44 @@ var (
 	setBufSize = 32 * 1024
 )
 
+var (
+	// ErrClosed is returned by SetAndWait when the cache is closed.
+	ErrClosed = errors.New("cache is closed")
+	// ErrSetDropped is returned by SetAndWait when the Set buffer is full, so
+	// the item was dropped before reaching the policy.
+	ErrSetDropped = errors.New("set was dropped")
+	// errSetSkipped is returned by set when the value is discarded before
+	// being buffered, for any reason other than a full Set buffer.
+	errSetSkipped = errors.New("set was skipped")
+)
+
+// numKeyLocks is the number of mutexes LockKey spreads the keys over.
+const numKeyLocks = 1024
+
 type itemCallback[V any] func(Item[V])
 
-const itemSize = int64(unsafe.Sizeof(storeItem[struct{}]{}))
+const itemSize = int64(unsafe.Sizeof(mapEntry[struct{}]{}))
 
 // Cache is a thread-safe implementation of a hashmap with a TinyLFU admission
 // policy and a Sampled LFU eviction policy. You can use the same Cache instance
 // from as many goroutines as you want.
 type Cache[K any, V any] struct {
+	// version is the last version given to an entry. It's the first field so
+	// it's 64-bit aligned for use with atomic.
+	version uint64
+	// droppedSets is the number of Sets dropped since the last cleanup tick,
+	// reported to the logger if too large.
+	droppedSets uint64
 	// store is the central concurrent hashmap where key-value items are stored.
 	store store[V]
 	// policy determines what gets let in to the cache and what gets kicked out.
 	policy policy[V]
-	// getBuf is a custom ring buffer implementation that gets pushed to when
-	// keys are read.
-	getBuf *ringBuffer
+	// getBuf is a custom ring buffer implementation, or an MPSC buffer if
+	// Config.AccessBuffer says so, that gets pushed to when keys are read.
+	getBuf accessBuffer
 	// setBuf is a buffer allowing us to batch/drop Sets during times of high
-	// contention.
+	// contention. Items are sent by value, so it doesn't need a heap allocation
+	// per Set.
 	setBuf chan Item[V]
 	// onEvict is called for item evictions.
 	onEvict itemCallback[V]
@@ -60,10 +83,25 @@ type Cache[K any, V any] struct {
 	onReject itemCallback[V]
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit func(V)
+	// listeners are called for item evictions, see AddListener.
+	listeners listeners[V]
+	// watchers are called for the changes to single keys, see WatchKey.
+	watchers keyWatchers[V]
+	// stats receives the hits, misses and evictions, see Config.Stats.
+	stats StatsRecorder
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	keyToHash func(K) (uint64, uint64)
+	// cleared is closed once the items of the last Clear are reported. Each
+	// Clear reports its items after the ones of the previous Clear.
+	cleared chan struct{}
+	clearMu sync.Mutex
+	// hashSeed is mixed into the key hashes, see Config.HashSeed.
+	hashSeed uint64
+	// conflictHi returns the high half of the 128-bit conflict hash of a key.
+	// It's nil unless Config.WideConflict is set.
+	conflictHi func(K) uint64
 	// stop is used to stop the processItems goroutine.
 	stop chan struct{}
 	// indicates whether cache is closed.
@@ -75,6 +113,75 @@ type Cache[K any, V any] struct {
 	ignoreInternalCost bool
 	// cleanupTicker is used to periodically check for entries whose TTL has passed.
 	cleanupTicker *time.Ticker
+	// evictExpiredOnGet dictates whether Get removes the expired items it finds.
+	evictExpiredOnGet bool
+	// expiryWake is signaled when the earliest expiration changes if
+	// Config.PreciseExpiration is set, and nil otherwise.
+	expiryWake <-chan struct{}
+	// trackAccess tells whether lookups record when the items are read, see
+	// Config.TrackAccess.
+	trackAccess bool
+	// trackVersions tells whether the items are given versions, see
+	// Config.TrackVersions.
+	trackVersions bool
+	// trackWrites tells whether the store records when the items are added
+	// and written, see Config.TrackWrites.
+	trackWrites bool
+	// maxItemCost is the max cost of a single item, see Config.MaxItemCost.
+	maxItemCost int64
+	// highWatermark and lowWatermark are the shares of the max cost set by
+	// Config.HighWatermark and Config.LowWatermark.
+	highWatermark float64
+	lowWatermark  float64
+	// headroomTarget is the share of the max cost set by
+	// Config.HeadroomTarget.
+	headroomTarget float64
+	// expiry computes the TTLs of the items, see Config.Expiry.
+	expiry Expiry[K, V]
+	// settings holds the *settings that Reconfigure can change while the
+	// cache is in use. reconfigMu serializes the calls to Reconfigure.
+	settings   atomic.Value
+	reconfigMu sync.Mutex
+	// contention records the waits on internal locks during contention
+	// profiles, see ProfileContention.
+	contention *contention
+	// tombstones remembers the keys deleted recently, see Config.TombstoneTTL.
+	tombstones *tombstones
+	// deltas remembers the keys removed since the last snapshot, see
+	// Config.SnapshotDeltas.
+	deltas *deltaLog
+	// mutations reports the changes to Config.OnMutation and the
+	// subscriptions.
+	mutations *mutations[V]
+	// follower is set by Config.Follower, and lastSeq is the sequence number
+	// of the last mutation applied by ApplyMutation.
+	follower bool
+	lastSeq  uint64
+	// paused is 1 while the cache is paused by Pause, in which case the
+	// processItems goroutine isn't running, and pausedCh holds a channel that
+	// is closed then. They're only changed holding pauseMu.
+	// queueWhilePaused is set by Config.QueueWritesWhilePaused.
+	paused           int32
+	pausedCh         atomic.Value
+	pauseMu          sync.Mutex
+	queueWhilePaused bool
+	// bypass is 1 while the cache is bypassed, see SetBypass.
+	bypass int32
+	// logger receives the internal warnings, see Config.Logger.
+	logger Logger
+	// onWarning is called with the internal warnings, see Config.OnWarning.
+	onWarning func(Warning)
+	// onTrace is called when internal operations start, see Config.Trace.
+	onTrace func(TraceOp) func()
+	// name is the name of the cache passed in Config.
+	name string
+	// numCounters and bufferItems are the values passed in Config.
+	numCounters int64
+	bufferItems int64
+	// loader runs Config.Loader, see GetOrLoad.
+	loader *loader[K, V]
+	// keyLocks are the striped mutexes used by LockKey.
+	keyLocks []sync.Mutex
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
@@ -82,6 +189,11 @@ type Cache[K any, V any] struct {
 
 // Config is passed to NewCache for creating new Cache instances.
 type Config[K any, V any] struct {
+	// Name identifies the cache. It's used to label the internal goroutines of
+	// the cache in profiles, so processes with several caches can attribute
+	// their CPU usage, and is returned by Name for the caches listed by Caches.
+	// It's optional.
+	Name string
 	// NumCounters determines the number of counters (keys) to keep that hold
 	// access frequency information. It's generally a good idea to have more
 	// counters than the max cache capacity, as this will improve eviction
@@ -103,21 +215,126 @@ type Config[K any, V any] struct {
 	// eviction process will take care of making room for the new item and not
 	// overflowing the MaxCost value.
 	MaxCost int64
-	// BufferItems determines the size of Get buffers.
+	// MaxItems is the max number of items in the cache, enforced in addition
+	// to MaxCost. When it's reached, adding an item evicts others just like
+	// when MaxCost is reached. It's useful when the per-item overhead matters
+	// more than the cost of the values. A zero value means no limit.
+	MaxItems int64
+	// MaxItemCost is the max cost of a single item, including the internal
+	// cost unless IgnoreInternalCost is set. Larger items are rejected right
+	// away, with RejectTooBig as their RejectReason, instead of evicting many
+	// items to make room for them. A zero value means no limit other than
+	// MaxCost.
+	MaxItemCost int64
+	// HighWatermark, if greater than zero, is the share of MaxCost past which
+	// the cache evicts items proactively, right after processing a Set, until
+	// the cost used goes down to LowWatermark. The next Sets then find room
+	// without evicting items one by one. It must be at most 1.
+	HighWatermark float64
+	// LowWatermark is the share of MaxCost the cache evicts items down to
+	// once HighWatermark is passed. It must be at most HighWatermark, which it
+	// defaults to.
+	LowWatermark float64
+	// HeadroomTarget, if greater than zero, is the share of MaxCost the cache
+	// keeps the cost used under by evicting items in the background, a small
+	// batch at a time and only while no Sets are waiting. New items then
+	// usually find room without evicting others. It must be at most 1.
+	HeadroomTarget float64
+	// BufferItems determines the initial and minimum size of Get buffers. The
+	// buffers grow up to 16 times this size while Get counter increments are
+	// being dropped, and shrink back when they aren't.
 	//
 	// Unless you have a rare use case, using `64` as the BufferItems value
 	// results in good performance.
 	BufferItems int64
+	// BufferFlushInterval is the max time a Get buffer holds Get counter
+	// increments before handing them to the policy, even if it isn't full. The
+	// buffer is only checked when a Get uses it, so this is a best effort
+	// bound. It makes low-traffic caches update their access frequencies
+	// sooner. A zero value means buffers are only flushed when full.
+	BufferFlushInterval time.Duration
+	// AccessBuffer selects how Gets are buffered before the policy records
+	// them. See AccessBufferLossy, the default, AccessBufferMPSC and
+	// AccessBufferPerP.
+	AccessBuffer AccessBuffer
+	// Admission, if set, replaces the default TinyLFU admission policy, which
+	// decides whether new items are worth evicting others for. NumCounters
+	// is only used by the default admission policy.
+	Admission Admission
+	// SketchAging is how the default admission policy ages access
+	// frequencies. SketchHalving, the default, suits workloads whose
+	// popularity changes slowly, while SketchWindow forgets faster when it
+	// shifts sharply.
+	SketchAging SketchAging
+	// SketchAgingInterval, if set, makes the default admission policy age
+	// access frequencies every SketchAgingInterval instead of every
+	// NumCounters accesses, so caches with little traffic still forget stale
+	// popularity at a predictable rate.
+	SketchAgingInterval time.Duration
+	// NewStore, if set, is called to create the Store of each shard of the
+	// cache, instead of keeping the items in Go maps.
+	NewStore func() Store[V]
+	// Eviction, if set, replaces the default sampled LFU eviction policy, which
+	// chooses the items evicted to make room for new ones.
+	Eviction Eviction
 	// Metrics determines whether cache statistics are kept during the cache's
 	// lifetime. There *is* some overhead to keeping statistics, so you should
 	// only set this flag to true when testing or throughput performance isn't a
 	// major factor.
 	Metrics bool
+	// Stats, if set, is told about every hit, miss and eviction as it happens,
+	// so they can be sent straight to the telemetry of the application. It
+	// works with or without Metrics, and each event is recorded once either
+	// way. See StatsRecorder.
+	Stats StatsRecorder
 	// OnEvict is called for every eviction and passes the hashed key, value,
 	// and cost to the function.
 	OnEvict func(item Item[V])
+	// OnEvictInfo is called for every eviction, like OnEvict, but only with
+	// the key, cost and reason of the item. It saves copying the value when
+	// it's large and isn't needed, for example to count or log evictions.
+	OnEvictInfo func(info EvictInfo)
+	// CanEvict, if set, is called with the hash of a key before the policy
+	// evicts it to make room for another, and can return false to keep it
+	// for now, for example while its value is being streamed to a client.
+	// The policy then looks for other victims, and rejects the new item if
+	// too many keys are vetoed. It's called with the policy locked, so it
+	// must be fast and must not use the cache. Items still expire.
+	CanEvict func(keyHash uint64) bool
+	// GhostItems, if greater than zero, is the number of evicted key hashes
+	// the policy remembers. A key among them is admitted again without
+	// having to prove more frequent than the items it evicts, so a key
+	// evicted moments ago and asked for again isn't rejected while its
+	// frequency builds back up. It helps when the working set is slightly
+	// bigger than the cache. Each costs about 40 bytes.
+	GhostItems int64
+	// EvictCostlierOnTie set to true makes the default eviction policy evict
+	// the costliest of the sampled keys when several are the least frequently
+	// used, instead of any of them. Each eviction then frees more room, so
+	// fewer are needed to fit a new item. It doesn't apply to Config.Eviction.
+	EvictCostlierOnTie bool
+	// RandomTieAdmission set to true makes the default admission policy admit
+	// a new key only half the time when it's as frequent as the item it would
+	// evict, instead of always. When the frequencies saturate, new keys then
+	// don't always replace the items in the cache, but still get in
+	// eventually. It doesn't apply to Config.Admission.
+	RandomTieAdmission bool
 	// OnReject is called for every rejection done via the policy.
 	OnReject func(item Item[V])
+	// Logger, if set, receives warnings about internal conditions that degrade
+	// the cache, such as many Sets being dropped because the Set buffer is full
+	// or TTL cleanups taking longer than their interval.
+	Logger Logger
+	// OnWarning, if set, is called with the same warnings sent to Logger, so
+	// they can be handled programmatically, for example to raise an alert. It's
+	// called from an internal goroutine, so it must not block.
+	OnWarning func(Warning)
+	// Trace, if set, is called when an internal operation that can add
+	// latency starts, such as Wait or a TTL cleanup pass, and the function it
+	// returns, if any, is called when the operation ends. It can be used to
+	// record spans or events in a tracing system. Operations other than Wait
+	// run in internal goroutines.
+	Trace func(op TraceOp) func()
 	// OnExit is called whenever a value is removed from cache. This can be
 	// used to do manual memory deallocation. Would also be called on eviction
 	// and rejection of the value.
@@ -126,15 +343,158 @@ type Config[K any, V any] struct {
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	KeyToHash func(K) (uint64, uint64)
+	// Hasher, if set, hashes the keys instead of z.KeyToHash, which only
+	// supports integers, strings and byte slices. It allows keys of any type,
+	// such as structs, UUIDs or composite keys, to be hashed directly. It can't
+	// be set along with KeyToHash.
+	Hasher Hasher[K]
+	// SipHash makes the cache hash the keys with SipHash-2-4 keyed with a
+	// random key of the process, see z.SipKeyToHash, instead of z.KeyToHash.
+	// Keys chosen by an attacker, such as ones taken from requests, then can't
+	// be crafted to share a hash or a shard and degrade the cache (hash
+	// flooding). It's slower, taking about twice as long for short strings. It
+	// can't be set along with KeyToHash or Hasher.
+	SipHash bool
+	// HashSeed, if not zero, is mixed into the hashes of the keys, so caches
+	// with different seeds hash the same keys differently and don't skew
+	// their shards the same way. Snapshots and mutations identify keys by
+	// their hashes, so they can only be loaded or applied by a cache with the
+	// same seed.
+	HashSeed uint64
+	// RandomHashSeed makes the cache pick a random HashSeed, which HashSeed
+	// returns, so its hashes can't be predicted, even across restarts. It
+	// can't be set along with HashSeed.
+	RandomHashSeed bool
+	// WideConflict makes the conflict hash that tells apart keys with the same
+	// hash 128 bits wide instead of 64, so a key is practically never mistaken
+	// for another one, even across billions of distinct keys over the life of
+	// the process. The high halves of the hashes are kept in a map of their
+	// own, taking about 20 more bytes per item, and the keys are hashed twice
+	// on each operation. The keys must be hashed by z.KeyToHash or by a Hasher
+	// that implements WideHasher.
+	//
+	// Items restored from a snapshot or applied from mutations only have the
+	// 64-bit conflict hash until they're written again.
+	WideConflict bool
+	// TrackAccess set to true makes the cache record when each item was last
+	// read, which GetWithInfo returns along with when it was added and
+	// written, for example to find the items that sit idle. It implies
+	// TrackWrites, and takes a small allocation per item added and a read of
+	// the clock per lookup.
+	TrackAccess bool
+	// TrackVersions set to true makes the cache give each value a version,
+	// which SetWithVersion and GetWithVersion return, for UpdateIfVersion and
+	// DelIfVersion to detect concurrent writes. It takes a map entry per item.
+	// Without it, the versions are 0, UpdateIfVersion and DelIfVersion always
+	// fail, and SetAndWait can't tell if another write replaced its value.
+	TrackVersions bool
+	// TrackWrites set to true makes the cache record when each item was added
+	// and when its value was last written, which GetFresh needs, and
+	// GetWithInfo and the evictions report. It takes a map entry per item.
+	// TrackAccess and SnapshotDeltas imply it.
+	TrackWrites bool
 	// Cost evaluates a value and outputs a corresponding cost. This function
 	// is ran after Set is called for a new item or an item update with a cost
 	// param of 0.
+	//
+	// If Cost is nil and V implements Coster, the Cost method of the values is
+	// used instead.
 	Cost func(value V) int64
 	// IgnoreInternalCost set to true indicates to the cache that the cost of
 	// internally storing the value should be ignored. This is useful when the
 	// cost passed to set is not using bytes as units. Keep in mind that setting
 	// this to true will increase the memory usage.
 	IgnoreInternalCost bool
+	// MaxCleanupItems caps the number of expired items removed by a single
+	// TTL cleanup pass. Items over the cap are carried over to the next pass,
+	// so a large number of items expiring at once doesn't stall the cache
+	// behind one long sweep. A zero value means no limit.
+	MaxCleanupItems int
+	// CleanupWorkers is the number of goroutines a TTL cleanup pass spreads
+	// the expired items over, so caches where many items expire at once don't
+	// fall behind a single goroutine. Each worker gets at least a few hundred
+	// items, so small passes still run on one goroutine. OnEvict is called for
+	// the items after they're removed, from a single goroutine. A zero value
+	// means a single goroutine.
+	CleanupWorkers int
+	// EvictExpiredOnGet set to true makes a Get call that finds an expired item
+	// have it removed right away, instead of leaving it to the periodic TTL
+	// cleanup. This releases expired values promptly even if the cleanup falls
+	// behind. The item goes through the Set buffer, so it's removed, and
+	// OnEvict called, by the goroutine processing the Sets like any eviction.
+	EvictExpiredOnGet bool
+	// PreciseExpiration set to true makes the items expire, and OnEvict be
+	// called for them, as soon as their TTL passes rather than on the next TTL
+	// cleanup pass, which can come seconds later. This suits uses where a late
+	// expiration matters, like revoking sessions, at the cost of keeping the
+	// expiring items ordered in a heap.
+	PreciseExpiration bool
+	// MaxTTL is the upper bound for the TTL of any item. Larger TTLs passed to
+	// SetWithTTL are clamped to MaxTTL. Items set without a TTL are not
+	// affected. A zero value means no limit.
+	MaxTTL time.Duration
+	// DefaultTTL is the TTL given to items added with Set. Items added with
+	// SetWithTTL use the TTL passed to it instead. A zero value means items
+	// added with Set never expire.
+	DefaultTTL time.Duration
+	// Expiry, if set, computes the TTL of each item when it's added, updated
+	// or read, from its key and value, so the expiration can depend on the
+	// value itself, for example the expiry claim of a token. It's called by
+	// the Set and Get methods; Modify and UpdateIfVersion keep their own TTL
+	// rules. See Expiry.
+	Expiry Expiry[K, V]
+	// TombstoneTTL, if set, makes Del, DelIf and DelIfVersion leave a
+	// tombstone for the key that lasts TombstoneTTL. Until it expires, Sets
+	// and Modify calls for the key are rejected, with RejectTombstone as their
+	// RejectReason, so a slow writer that read the old data before the
+	// delete can't put it back in the cache.
+	TombstoneTTL time.Duration
+	// SnapshotDeltas makes the cache remember the keys removed since the last
+	// Save or SaveDelta, so SaveDelta can write only what changed since. The
+	// memory it takes grows with the keys removed between snapshots.
+	SnapshotDeltas bool
+	// OnMutation, if set, is called with every change applied to the cache,
+	// once it's applied: the items admitted or updated, and the keys deleted,
+	// expired or evicted. The mutations are numbered and passed in order, so
+	// they can be replicated elsewhere or audited. It's called while holding
+	// a lock, often from the goroutine applying the Sets, so it must be fast
+	// and must not call the cache; hand the mutations to another goroutine
+	// if they need more work.
+	OnMutation func(mutation Mutation[V])
+	// Follower makes the cache read-only: the methods that change items,
+	// such as Set, Modify and Del, do nothing and return false, and the items
+	// only change through ApplyMutation, to follow the mutations of another
+	// cache.
+	Follower bool
+	// QueueWritesWhilePaused makes the cache accept writes while it's paused
+	// by Pause, buffering the Sets of new keys until it's resumed, instead of
+	// rejecting them.
+	QueueWritesWhilePaused bool
+	// Loader, if set, is called by GetOrLoad to load the values of the keys
+	// that aren't cached. The Loaded it returns says how the value is
+	// cached. It's called at most once at a time for each key.
+	Loader func(key K) (Loaded[V], error)
+	// MaxBackgroundLoads is the most calls to Loader run at once in the
+	// background, by Prefetch and for Loaded.RefreshAfter. The other loads
+	// wait for their turn. If zero, it's GOMAXPROCS.
+	MaxBackgroundLoads int
+}
+
+// Coster is implemented by values that know their own cost. See Config.Cost.
+type Coster interface {
+	Cost() int64
+}
+
+// costerCost returns a function calling the Cost method of the values if V
+// implements Coster, or nil otherwise.
+func costerCost[V any]() func(V) int64 {
+	var zero V
+	if _, ok := any(zero).(Coster); !ok {
+		return nil
+	}
+	return func(value V) int64 {
+		return any(value).(Coster).Cost()
+	}
 }
 
 type itemFlag byte
@@ -143,6 +503,15 @@ const (
 	itemNew itemFlag = iota
 	itemDelete
 	itemUpdate
+	// itemStored is a new item that is already in the store and only needs
+	// to go through the policy.
+	itemStored
+	// itemExpire is a key found expired by Get, removed if it's still
+	// expired, see Config.EvictExpiredOnGet.
+	itemExpire
+	// itemShrink evicts items until the cost used fits the max cost again,
+	// after Reserve.
+	itemShrink
 )
 
 // Item is passed to setBuf so items can eventually be added to the cache.
@@ -150,10 +519,91 @@ type Item[V any] struct {
 	flag       itemFlag
 	Key        uint64
 	Conflict   uint64
+	conflictHi uint64 // See Config.WideConflict.
 	Value      V
 	Cost       int64
 	Expiration time.Time
-	wg         *sync.WaitGroup
+	// Meta is the user-defined metadata passed to SetWithMeta.
+	Meta uint32
+	// created and written are when the item was added to the store and
+	// last written, see storeNow.
+	created uint32
+	written uint32
+	// Version is the version of the value, see SetWithVersion. It's 0 unless
+	// Config.TrackVersions is set.
+	Version uint64
+	// RejectReason tells why the item was rejected. It's only set for the
+	// items passed to Config.OnReject.
+	RejectReason RejectReason
+	// EvictReason tells why the item was evicted. It's only set for the items
+	// passed to Config.OnEvict and the listeners.
+	EvictReason EvictReason
+	wg          *sync.WaitGroup
+}
+
+// RejectReason tells why an item passed to Config.OnReject was rejected.
+type RejectReason byte
+
+const (
+	// RejectPolicy means the admission policy didn't let the item in.
+	RejectPolicy RejectReason = iota + 1
+	// RejectTooBig means the cost of the item is larger than
+	// Config.MaxItemCost.
+	RejectTooBig
+	// RejectConflict means another key with the same hash is in the cache.
+	RejectConflict
+	// RejectTombstone means the key was deleted less than Config.TombstoneTTL
+	// ago.
+	RejectTombstone
+)
+
+// EvictReason tells why an item passed to Config.OnEvict was evicted.
+type EvictReason byte
+
+const (
+	// EvictPolicy means the eviction policy picked the item to make room for
+	// another.
+	EvictPolicy EvictReason = iota + 1
+	// EvictExpired means the TTL of the item passed.
+	EvictExpired
+	// EvictCleared means the cache was cleared.
+	EvictCleared
+)
+
+// EvictInfo describes an evicted item, without its value. It's passed to
+// Config.OnEvictInfo.
+type EvictInfo struct {
+	Key      uint64
+	Conflict uint64
+	Cost     int64
+	Reason   EvictReason
+	// Frequency is the access frequency the admission policy estimated for
+	// the item when it was evicted.
+	Frequency int64
+	// Age is how long the item was in the cache, to the second. It's zero
+	// unless Config.TrackWrites is set, or if the item was never stored, such
+	// as an item still buffered when the cache was cleared.
+	Age time.Duration
+	// TTL is the time the item had left before expiring, or zero if it
+	// didn't expire or already expired.
+	TTL time.Duration
+}
+
+// evictInfo returns the EvictInfo of an evicted item.
+func (c *Cache[K, V]) evictInfo(item Item[V]) EvictInfo {
+	now := time.Now()
+	info := EvictInfo{
+		Key:       item.Key,
+		Conflict:  item.Conflict,
+		Cost:      item.Cost,
+		Reason:    item.EvictReason,
+		Frequency: c.policy.Estimate(item.Key),
+		Age:       storeAge(item.created, now),
+	}
+	if !item.Expiration.IsZero() && item.Expiration.After(now) {
+		info.TTL = item.Expiration.Sub(now)
+	}
+	return info
 }
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
@@ -165,19 +615,131 @@ func NewCache[K any, V any](config *Config[K, V]) (*Cache[K, V], error) {
 		return nil, errors.New("MaxCost can't be zero")
 	case config.BufferItems == 0:
 		return nil, errors.New("BufferItems can't be zero")
+	case config.MaxCleanupItems < 0:
+		return nil, errors.New("MaxCleanupItems can't be negative")
+	case config.CleanupWorkers < 0:
+		return nil, errors.New("CleanupWorkers can't be negative")
+	case config.MaxTTL < 0:
+		return nil, errors.New("MaxTTL can't be negative")
+	case config.DefaultTTL < 0:
+		return nil, errors.New("DefaultTTL can't be negative")
+	case config.MaxItems < 0:
+		return nil, errors.New("MaxItems can't be negative")
+	case config.MaxItemCost < 0:
+		return nil, errors.New("MaxItemCost can't be negative")
+	case config.HighWatermark < 0 || config.HighWatermark > 1:
+		return nil, errors.New("HighWatermark must be between 0 and 1")
+	case config.LowWatermark < 0 || config.LowWatermark > config.HighWatermark:
+		return nil, errors.New("LowWatermark must be between 0 and HighWatermark")
+	case config.HeadroomTarget < 0 || config.HeadroomTarget > 1:
+		return nil, errors.New("HeadroomTarget must be between 0 and 1")
+	case config.BufferFlushInterval < 0:
+		return nil, errors.New("BufferFlushInterval can't be negative")
+	case config.SketchAging > SketchWindow:
+		return nil, errors.New("SketchAging is not valid")
+	case config.SketchAgingInterval < 0:
+		return nil, errors.New("SketchAgingInterval can't be negative")
+	case config.GhostItems < 0:
+		return nil, errors.New("GhostItems can't be negative")
+	case config.TombstoneTTL < 0:
+		return nil, errors.New("TombstoneTTL can't be negative")
+	case config.MaxBackgroundLoads < 0:
+		return nil, errors.New("MaxBackgroundLoads can't be negative")
+	case config.AccessBuffer > AccessBufferPerP:
+		return nil, errors.New("AccessBuffer is not valid")
+	case config.KeyToHash != nil && config.Hasher != nil:
+		return nil, errors.New("KeyToHash and Hasher can't both be set")
+	case config.SipHash && (config.KeyToHash != nil || config.Hasher != nil):
+		return nil, errors.New("SipHash can't be set along with KeyToHash or Hasher")
+	case config.RandomHashSeed && config.HashSeed != 0:
+		return nil, errors.New("RandomHashSeed can't be set along with HashSeed")
+	case config.WideConflict && config.KeyToHash != nil:
+		return nil, errors.New("WideConflict needs z.KeyToHash or a WideHasher")
+	}
+	var wideHasher WideHasher[K]
+	if config.WideConflict && config.Hasher != nil {
+		var ok bool
+		if wideHasher, ok = config.Hasher.(WideHasher[K]); !ok {
+			return nil, errors.New("WideConflict needs z.KeyToHash or a WideHasher")
+		}
+	}
+	// The policy starts its goroutine when created, so create it with the
+	// profiler labels set for the goroutine to inherit them.
+	var policy policy[V]
+	pprof.Do(context.Background(), workerLabels(config.Name, "policy"), func(context.Context) {
+		policy = newPolicy[V](config.NumCounters, config.MaxCost, policyOptions{
+			maxItems:  config.MaxItems,
+			admission: config.Admission,
+			eviction:  config.Eviction,
+			aging:     config.SketchAging,
+
+			agingInterval:   config.SketchAgingInterval,
+			canEvict:        config.CanEvict,
+			ghostItems:      config.GhostItems,
+			costlierVictims: config.EvictCostlierOnTie,
+			randomTies:      config.RandomTieAdmission,
+		})
+	})
+	prof := &contention{}
+	sm := newShardedMap[V](config.NewStore, prof)
+	if config.TrackAccess {
+		sm.trackAccess()
+	}
+	if config.TrackVersions {
+		sm.trackVersions()
+	}
+	if config.TrackWrites || config.TrackAccess || config.SnapshotDeltas {
+		sm.trackWrites()
+	}
+	if config.WideConflict {
+		sm.wideConflict()
+	}
+	var expiryWake <-chan struct{}
+	if config.PreciseExpiration {
+		expiryWake = sm.preciseExpiration()
 	}
-	policy := newPolicy[V](config.NumCounters, config.MaxCost)
 	cache := &Cache[K, V]{
-		store:              newStore[V](),
+		name:               config.Name,
+		contention:         prof,
+		onTrace:            config.Trace,
+		logger:             config.Logger,
+		onWarning:          config.OnWarning,
+		store:              sm,
 		policy:             policy,
-		getBuf:             newRingBuffer(policy, config.BufferItems),
 		setBuf:             make(chan Item[V], setBufSize),
 		keyToHash:          config.KeyToHash,
 		stop:               make(chan struct{}),
 		cost:               config.Cost,
 		ignoreInternalCost: config.IgnoreInternalCost,
-		cleanupTicker:      time.NewTicker(time.Duration(bucketDurationSecs) * time.Second / 2),
+		cleanupTicker:      time.NewTicker(cleanupInterval()),
+		evictExpiredOnGet:  config.EvictExpiredOnGet,
+		expiryWake:         expiryWake,
+		trackAccess:        config.TrackAccess,
+		trackVersions:      config.TrackVersions,
+		trackWrites:        config.TrackWrites || config.TrackAccess || config.SnapshotDeltas,
+		maxItemCost:        config.MaxItemCost,
+		highWatermark:      config.HighWatermark,
+		lowWatermark:       config.LowWatermark,
+		headroomTarget:     config.HeadroomTarget,
+		tombstones:         newTombstones(config.TombstoneTTL),
+		deltas:             newDeltaLog(config.SnapshotDeltas),
+		mutations:          &mutations[V]{fn: config.OnMutation},
+		follower:           config.Follower,
+		expiry:             config.Expiry,
+		stats:              config.Stats,
+		queueWhilePaused:   config.QueueWritesWhilePaused,
+		loader:             newLoader(config.Loader, config.MaxBackgroundLoads),
+		keyLocks:           make([]sync.Mutex, numKeyLocks),
+		numCounters:        config.NumCounters,
+		bufferItems:        config.BufferItems,
 	}
+	cache.pausedCh.Store(make(chan struct{}))
+	cache.settings.Store(&settings{
+		defaultTTL:      config.DefaultTTL,
+		maxTTL:          config.MaxTTL,
+		maxCleanupItems: config.MaxCleanupItems,
+		cleanupWorkers:  config.CleanupWorkers,
+	})
 	cache.onExit = func(v V) {
 		if config.OnExit != nil {
 			config.OnExit(v)
@@ -187,6 +749,22 @@ func NewCache[K any, V any](config *Config[K, V]) (*Cache[K, V], error) {
 		if config.OnEvict != nil {
 			config.OnEvict(item)
 		}
+		if config.OnEvictInfo != nil {
+			config.OnEvictInfo(cache.evictInfo(item))
+		}
+		cache.listeners.call(item)
+		cache.watchers.call(item.Key, item.Conflict, keyEvent(item.EvictReason), item.Value)
+		if cache.stats != nil {
+			cache.stats.RecordEviction(item.EvictReason, item.Cost)
+		}
+		if item.EvictReason != EvictCleared {
+			// Clear records a single clear, before the cleared items are
+			// reported.
+			cache.deltas.del(item.Key, item.Conflict)
+		}
+		if op := evictMutation(item.EvictReason); op != 0 {
+			cache.mutated(op, item.Key, item.Conflict)
+		}
 		cache.onExit(item.Value)
 	}
 	cache.onReject = func(item Item[V]) {
@@ -195,48 +773,362 @@ func NewCache[K any, V any](config *Config[K, V]) (*Cache[K, V], error) {
 		}
 		cache.onExit(item.Value)
 	}
+	switch config.AccessBuffer {
+	case AccessBufferMPSC:
+		cache.getBuf = newMPSCBuffer(policy, config.BufferItems)
+	case AccessBufferPerP:
+		cache.getBuf = newPerPBuffer(policy, config.BufferItems)
+	default:
+		cache.getBuf = newRingBuffer(policy, config.BufferItems, config.BufferFlushInterval)
+	}
+	if config.Hasher != nil {
+		cache.keyToHash = config.Hasher.Hash
+	}
+	if config.SipHash {
+		sipKey := z.ProcessSipKey()
+		cache.keyToHash = func(key K) (uint64, uint64) {
+			return z.SipKeyToHash(sipKey, key)
+		}
+	}
 	if cache.keyToHash == nil {
 		cache.keyToHash = z.KeyToHash[K]
 	}
+	cache.hashSeed = config.HashSeed
+	if config.RandomHashSeed {
+		cache.hashSeed = randomSeed()
+	}
+	if cache.hashSeed != 0 {
+		cache.keyToHash = seededKeyToHash(cache.keyToHash, cache.hashSeed)
+	}
+	switch {
+	case wideHasher != nil:
+		cache.conflictHi = wideHasher.ConflictHi
+	case config.WideConflict:
+		cache.conflictHi = z.KeyToConflictHi[K]
+	}
+	if cache.cost == nil {
+		cache.cost = costerCost[V]()
+	}
+	if cache.lowWatermark == 0 {
+		cache.lowWatermark = cache.highWatermark
+	}
 	if config.Metrics {
 		cache.collectMetrics()
 	}
 	// NOTE: benchmarks seem to show that performance decreases the more
 	//       goroutines we have running cache.processItems(), so 1 should
 	//       usually be sufficient
-	go cache.processItems()
+	cache.goWorker("processItems", cache.processItems)
+	if cache.loader != nil {
+		cache.goWorker("refresh", cache.refreshPeriodically)
+	}
+	register(cache)
 	return cache, nil
 }
 
+// workerLabels returns the profiler labels of the internal goroutine named
+// worker of the cache with the given name.
+func workerLabels(name, worker string) pprof.LabelSet {
+	return pprof.Labels("ristretto_cache", name, "ristretto_worker", worker)
+}
+
+// goWorker runs fn in a new goroutine labeled with the name of the cache and the
+// worker, so the goroutines of different caches can be told apart in profiles.
+func (c *Cache[K, V]) goWorker(worker string, fn func()) {
+	go pprof.Do(context.Background(), workerLabels(c.name, worker), func(context.Context) {
+		fn()
+	})
+}
+
+// Wait blocks until the Sets buffered so far are applied and the items cleared
+// by earlier Clear calls are reported.
 func (c *Cache[K, V]) Wait() {
 	if c == nil || c.isClosed {
 		return
 	}
+	defer c.trace(TraceWait)()
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	c.setBuf <- Item[V]{wg: wg}
-	wg.Wait()
+	if c.pushSet(Item[V]{wg: wg}) {
+		wg.Wait()
+	}
+	c.waitCleared()
+}
+
+// WaitContext works like Wait but returns ctx.Err() if ctx is done before the
+// buffered Sets are applied and the cleared items reported. They're still
+// applied and reported later on.
+func (c *Cache[K, V]) WaitContext(ctx context.Context) error {
+	if c == nil || c.isClosed {
+		return nil
+	}
+	defer c.trace(TraceWait)()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	if c.pushSetUntil(Item[V]{wg: wg}, ctx.Done()) {
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.waitClearedContext(ctx)
 }
 
 // Get returns the value (if any) and a boolean representing whether the
 // value was found or not. The value can be nil and the boolean can be true at
 // the same time.
 func (c *Cache[K, V]) Get(key K) (V, bool) {
-	if c == nil || c.isClosed {
+	if c == nil || c.isClosed || c.bypassed() {
 		var v V
 		return v, false
 	}
 	keyHash, conflictHash := c.keyToHash(key)
 	c.getBuf.Push(keyHash)
-	value, ok := c.store.Get(keyHash, conflictHash)
-	if ok {
-		c.Metrics.add(hit, keyHash, 1)
+	var value V
+	var ok bool
+	if c.conflictHi == nil && !c.trackAccess && c.expiry == nil {
+		value, ok = c.store.Get(keyHash, conflictHash)
 	} else {
-		c.Metrics.add(miss, keyHash, 1)
+		var item storeItem[V]
+		item, ok = c.getItem(key, keyHash, conflictHash)
+		c.touch(keyHash, ok)
+		c.expireAfterRead(key, keyHash, item, ok)
+		value = item.value
 	}
+	c.recordGet(keyHash, conflictHash, ok)
 	return value, ok
 }
 
+// GetWithMeta works like Get but also returns the metadata the value was set
+// with using SetWithMeta.
+func (c *Cache[K, V]) GetWithMeta(key K) (V, uint32, bool) {
+	if c == nil || c.isClosed || c.bypassed() {
+		var v V
+		return v, 0, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.getBuf.Push(keyHash)
+	item, ok := c.getItem(key, keyHash, conflictHash)
+	c.touch(keyHash, ok)
+	c.expireAfterRead(key, keyHash, item, ok)
+	c.recordGet(keyHash, conflictHash, ok)
+	return item.value, item.meta, ok
+}
+
+// GetWithVersion works like Get but also returns the current version of the
+// value, to be used with UpdateIfVersion. The version is 0 unless
+// Config.TrackVersions is set.
+func (c *Cache[K, V]) GetWithVersion(key K) (V, uint64, bool) {
+	if c == nil || c.isClosed || c.bypassed() {
+		var v V
+		return v, 0, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.getBuf.Push(keyHash)
+	item, ok := c.getItem(key, keyHash, conflictHash)
+	c.touch(keyHash, ok)
+	c.expireAfterRead(key, keyHash, item, ok)
+	c.recordGet(keyHash, conflictHash, ok)
+	return item.value, item.version, ok
+}
+
+// GetFresh works like Get but treats values written more than maxAge ago as
+// missing, even if they haven't expired, for callers that need fresher values
+// than the TTL of the items guarantees. Write times are tracked to the second.
+// It requires Config.TrackWrites, without which every value is fresh.
+func (c *Cache[K, V]) GetFresh(key K, maxAge time.Duration) (V, bool) {
+	if c == nil || c.isClosed || c.bypassed() {
+		var v V
+		return v, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.getBuf.Push(keyHash)
+	item, ok := c.getItem(key, keyHash, conflictHash)
+	if ok && storeAge(item.written, time.Now()) > maxAge {
+		item, ok = storeItem[V]{}, false
+	}
+	c.touch(keyHash, ok)
+	c.expireAfterRead(key, keyHash, item, ok)
+	c.recordGet(keyHash, conflictHash, ok)
+	return item.value, ok
+}
+
+// GetStale works like Get but also returns values that expired, as long as
+// they haven't been removed from the cache yet, with stale set to true. It lets
+// callers serve an expired value rather than nothing, for example while the
+// source of the values is down. Only values that haven't expired count as hits
+// in the metrics.
+func (c *Cache[K, V]) GetStale(key K) (value V, stale bool, ok bool) {
+	if c == nil || c.isClosed || c.bypassed() {
+		return value, false, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.getBuf.Push(keyHash)
+	item, ok := c.store.GetStale(keyHash, conflictHash, c.wideHash(key))
+	stale = ok && item.expired(time.Now())
+	c.touch(keyHash, ok)
+	c.recordLookup(keyHash, ok && !stale)
+	return item.value, stale, ok
+}
+
+// EntryInfo describes an item of the cache, see GetWithInfo. The times are
+// tracked to the second.
+type EntryInfo struct {
+	// Created is when the key was added to the cache, and Written when the
+	// value was last written. They're the zero time unless Config.TrackWrites
+	// is set.
+	Created time.Time
+	Written time.Time
+	// Accessed is when the value was last read. It's the zero time if it
+	// wasn't read since it was added, or unless Config.TrackAccess is set.
+	Accessed time.Time
+	// Expiration is when the item expires, or the zero time if it doesn't,
+	// and TTL the time it has left, or zero if it doesn't expire.
+	Expiration time.Time
+	TTL        time.Duration
+	// Cost is the cost of the item as accounted by the policy, including its
+	// internal cost unless Config.IgnoreInternalCost is set. It's -1 if the
+	// policy hasn't accounted the item yet, right after it was added.
+	Cost int64
+	// Frequency is the access frequency of the key estimated by the admission
+	// policy, see EstimateFrequency.
+	Frequency int64
+	Meta      uint32
+	Version   uint64
+}
+
+// GetWithInfo works like Get but also returns the EntryInfo of the item, read
+// in one go rather than with separate calls racing with evictions. Its
+// Accessed time is the one of the previous read, so GetWithInfo doesn't hide
+// how long the item sat idle.
+func (c *Cache[K, V]) GetWithInfo(key K) (V, EntryInfo, bool) {
+	if c == nil || c.isClosed || c.bypassed() {
+		var v V
+		return v, EntryInfo{}, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.getBuf.Push(keyHash)
+	item, ok := c.getItem(key, keyHash, conflictHash)
+	accessed := c.touch(keyHash, ok)
+	var info EntryInfo
+	if ok {
+		info = EntryInfo{
+			Created:    storeTime(item.created),
+			Written:    storeTime(item.written),
+			Accessed:   storeTime(accessed),
+			Expiration: item.expirationTime(),
+			Cost:       c.policy.Cost(keyHash),
+			Frequency:  c.policy.Estimate(keyHash),
+			Meta:       item.meta,
+			Version:    item.version,
+		}
+		if !info.Expiration.IsZero() {
+			info.TTL = time.Until(info.Expiration)
+		}
+	}
+	c.expireAfterRead(key, keyHash, item, ok)
+	c.recordGet(keyHash, conflictHash, ok)
+	return item.value, info, ok
+}
+
+// touch records that the item of the key was just read, if it was found and
+// Config.TrackAccess is set. It returns when it was read before, see storeNow.
+func (c *Cache[K, V]) touch(keyHash uint64, found bool) uint32 {
+	if !found || !c.trackAccess {
+		return 0
+	}
+	return c.store.Touch(keyHash)
+}
+
+// getItem returns the item of the key, making sure it's not the one of another
+// key with the same hash with Config.WideConflict.
+func (c *Cache[K, V]) getItem(key K, keyHash, conflictHash uint64) (storeItem[V], bool) {
+	return c.store.GetItem(keyHash, conflictHash, c.wideHash(key))
+}
+
+// wideHash returns the high half of the 128-bit conflict hash of the key, or 0
+// unless Config.WideConflict is set.
+func (c *Cache[K, V]) wideHash(key K) uint64 {
+	if c.conflictHi == nil {
+		return 0
+	}
+	return c.conflictHi(key)
+}
+
+// recordLookup records a hit or a miss in the metrics and Config.Stats.
+func (c *Cache[K, V]) recordLookup(keyHash uint64, found bool) {
+	c.Metrics.trackKey(keyHash)
+	if found {
+		c.Metrics.add(hit, keyHash, 1)
+		if c.stats != nil {
+			c.stats.RecordHit()
+		}
+		return
+	}
+	c.Metrics.add(miss, keyHash, 1)
+	if c.stats != nil {
+		c.stats.RecordMiss()
+	}
+}
+
+// recordGet updates the metrics after a lookup and evicts the item if the
+// lookup missed because it expired.
+func (c *Cache[K, V]) recordGet(keyHash, conflictHash uint64, found bool) {
+	c.recordLookup(keyHash, found)
+	if !found && c.evictExpiredOnGet {
+		c.pushExpired(keyHash, conflictHash)
+	}
+}
+
+// pushExpired asks processItems to remove the item if its expiration has
+// passed, so it's evicted, and the callbacks called, like the other evictions.
+// Nothing is pushed if the Set buffer is full, the cleanup removes the item
+// later anyway.
+func (c *Cache[K, V]) pushExpired(keyHash, conflictHash uint64) {
+	expiration := c.store.Expiration(keyHash)
+	if expiration.IsZero() || time.Now().Before(expiration) {
+		return
+	}
+	select {
+	case c.setBuf <- Item[V]{flag: itemExpire, Key: keyHash, Conflict: conflictHash}:
+	default:
+	}
+}
+
+// evictIfExpired removes the item from the cache and calls onEvict if its
+// expiration has passed.
+func (c *Cache[K, V]) evictIfExpired(keyHash, conflictHash uint64, onEvict itemCallback[V]) {
+	expiration := c.store.Expiration(keyHash)
+	if expiration.IsZero() || time.Now().Before(expiration) {
+		return
+	}
+	item, ok := c.store.DelExpired(keyHash, conflictHash)
+	if !ok {
+		return
+	}
+	cost := c.policy.Cost(keyHash)
+	c.policy.Del(keyHash)
+	onEvict(Item[V]{
+		Key:         keyHash,
+		Conflict:    item.conflict,
+		Value:       item.value,
+		Cost:        cost,
+		Expiration:  item.expirationTime(),
+		Meta:        item.meta,
+		Version:     item.version,
+		EvictReason: EvictExpired,
+		created:     item.created,
+	})
+}
+
 // Set attempts to add the key-value item to the cache. If it returns false,
 // then the Set was dropped and the key-value item isn't added to the cache. If
 // it returns true, there's still a chance it could be dropped by the policy if
@@ -246,91 +1138,551 @@ func (c *Cache[K, V]) Get(key K) (V, bool) {
 // To dynamically evaluate the items cost using the Config.Coster function, set
 // the cost parameter to 0 and Coster will be ran when needed in order to find
 // the items true cost.
+//
+// The item expires after Config.DefaultTTL, if set.
 func (c *Cache[K, V]) Set(key K, value V, cost int64) bool {
-	return c.SetWithTTL(key, value, cost, 0*time.Second)
+	if c == nil {
+		return false
+	}
+	return c.SetWithTTL(key, value, cost, c.current().defaultTTL)
 }
 
 // SetWithTTL works like Set but adds a key-value pair to the cache that will expire
 // after the specified TTL (time to live) has passed. A zero value means the value never
-// expires, which is identical to calling Set. A negative value is a no-op and the value
-// is discarded.
+// expires. A negative value is a no-op and the value is discarded. A TTL larger than
+// Config.MaxTTL is clamped to it.
 func (c *Cache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	_, err := c.set(key, value, cost, ttl, 0)
+	return err == nil
+}
+
+// SetWithMeta works like SetWithTTL but also stores meta alongside the value.
+// meta is opaque to the cache, it can be used for flags or small pieces of
+// metadata and is returned by GetWithMeta and passed to the eviction callbacks
+// in Item.Meta.
+func (c *Cache[K, V]) SetWithMeta(key K, value V, cost int64, ttl time.Duration, meta uint32) bool {
+	_, err := c.set(key, value, cost, ttl, meta)
+	return err == nil
+}
+
+// SetWithVersion works like SetWithTTL but also returns the version given to
+// the value. Versions increase monotonically every time a key is written, so
+// they can be passed to UpdateIfVersion to detect concurrent writes. The
+// version is 0 unless Config.TrackVersions is set.
+func (c *Cache[K, V]) SetWithVersion(key K, value V, cost int64, ttl time.Duration) (uint64, bool) {
+	version, err := c.set(key, value, cost, ttl, 0)
+	return version, err == nil
+}
+
+// set adds the key-value pair to the cache and returns the version given to it.
+// It returns ErrClosed if the cache is closed, ErrSetDropped if the Set buffer
+// is full, and errSetSkipped if the value is discarded for any other reason.
+func (c *Cache[K, V]) set(key K, value V, cost int64, ttl time.Duration, meta uint32) (uint64, error) {
+	if c == nil {
+		return 0, ErrClosed
+	}
+	if c.isClosed {
+		c.Metrics.add(dropSetsClosed, 0, 1)
+		return 0, ErrClosed
+	}
+	if c.readOnly() || c.bypassed() {
+		return 0, errSetSkipped
+	}
+
+	i, ok := c.newSetItem(key, value, cost, ttl, meta)
+	if !ok {
+		return 0, errSetSkipped
+	}
+	keyHash, conflictHash := i.Key, i.Conflict
+	// cost is eventually updated. The expiration must also be immediately updated
+	// to prevent items from being prematurely removed from the map.
+	if prev, ok := c.store.Update(i); ok {
+		c.watchers.call(keyHash, conflictHash, KeyReplaced, prev)
+		c.onExit(prev)
+		i.flag = itemUpdate
+	}
+	// Attempt to send item to policy.
+	select {
+	case c.setBuf <- i:
+		return i.Version, nil
+	default:
+		if i.flag == itemUpdate {
+			// Return true if this was an update operation since we've already
+			// updated the store. For all the other operations (set/delete), we
+			// return false which means the item was not inserted.
+			c.updateCost(i)
+			return i.Version, nil
+		}
+		c.Metrics.add(dropSets, keyHash, 1)
+		atomic.AddUint64(&c.droppedSets, 1)
+		return 0, ErrSetDropped
+	}
+}
+
+// newSetItem returns the item to buffer for a Set of the key, after the checks
+// shared by all the Sets: the TTL computed by Config.Expiry and clamped to
+// Config.MaxTTL, Config.MaxItemCost and the tombstones. It returns false if
+// the value must be discarded, after calling Config.OnReject if it was
+// rejected.
+func (c *Cache[K, V]) newSetItem(key K, value V, cost int64, ttl time.Duration,
+	meta uint32) (Item[V], bool) {
+	keyHash, conflictHash := c.keyToHash(key)
+	if c.expiry != nil {
+		ttl = c.expireAfterWrite(key, value, keyHash, conflictHash, ttl)
+	}
+	expiration, ok := c.expiration(ttl)
+	if !ok {
+		return Item[V]{}, false
+	}
+
+	// If the cost is known, items that are too big can be rejected right away
+	// instead of in processItems, without touching the store.
+	if cost != 0 && c.tooBig(c.itemCost(Item[V]{Cost: cost})) {
+		c.Metrics.add(rejectSetsTooBig, keyHash, 1)
+		c.onReject(Item[V]{
+			Key:          keyHash,
+			Conflict:     conflictHash,
+			Value:        value,
+			Cost:         cost,
+			Expiration:   expiration,
+			Meta:         meta,
+			RejectReason: RejectTooBig,
+		})
+		return Item[V]{}, false
+	}
+	if c.tombstones.has(keyHash) {
+		c.onReject(Item[V]{
+			Key:          keyHash,
+			Conflict:     conflictHash,
+			Value:        value,
+			Cost:         cost,
+			Expiration:   expiration,
+			Meta:         meta,
+			RejectReason: RejectTombstone,
+		})
+		return Item[V]{}, false
+	}
+	return Item[V]{
+		flag:       itemNew,
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		conflictHi: c.wideHash(key),
+		Value:      value,
+		Cost:       cost,
+		Expiration: expiration,
+		Meta:       meta,
+		Version:    c.nextVersion(),
+	}, true
+}
+
+// SetAndWait works like Set but waits for the policy to process the item and
+// returns whether it was admitted, that is, whether the value is in the cache.
+// Set only returns whether the item was buffered. SetAndWait also returns
+// false if another write to the key replaced the value in the meantime, if
+// Config.TrackVersions is set, and
+// without an error if the value is discarded before reaching the policy, for
+// example because the cache is read-only, paused or bypassed, the TTL is
+// negative, the key has a tombstone or the cost is over Config.MaxItemCost. It
+// returns ErrSetDropped if the item was dropped because the Set buffer is
+// full, and ErrClosed if the cache is closed.
+func (c *Cache[K, V]) SetAndWait(key K, value V, cost int64) (bool, error) {
 	if c == nil || c.isClosed {
-		return false
+		return false, ErrClosed
+	}
+	version, err := c.set(key, value, cost, c.current().defaultTTL, 0)
+	if err == errSetSkipped {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	c.Wait()
+	keyHash, conflictHash := c.keyToHash(key)
+	item, found := c.getItem(key, keyHash, conflictHash)
+	return found && item.version == version, nil
+}
+
+// Modify atomically replaces the value of the key with the one returned by fn.
+// fn is called with the current value and whether the key exists, and returns
+// the new value, its cost and whether to write it at all. If the key is
+// missing, it's added with Config.DefaultTTL; otherwise its TTL is kept. Like
+// Set, a cost of 0 makes Config.Cost calculate it.
+//
+// fn runs while holding an internal lock, so it must be fast and must not call
+// any method of the cache. Modify returns the new value and true if it was
+// written.
+func (c *Cache[K, V]) Modify(key K, fn func(old V, exists bool) (V, int64, bool)) (V, bool) {
+	if c == nil {
+		var zero V
+		return zero, false
 	}
+	return c.modify(key, c.current().defaultTTL, fn)
+}
 
-	var expiration time.Time
+// expiration returns the expiration time for an item with the given TTL, and
+// false if the TTL is negative and the item must be discarded.
+func (c *Cache[K, V]) expiration(ttl time.Duration) (time.Time, bool) {
 	switch {
 	case ttl == 0:
 		// No expiration.
-		break
+		return time.Time{}, true
 	case ttl < 0:
 		// Treat this a a no-op.
-		return false
+		return time.Time{}, false
 	default:
-		expiration = time.Now().Add(ttl)
+		if maxTTL := c.current().maxTTL; maxTTL > 0 && ttl > maxTTL {
+			ttl = maxTTL
+		}
+		return time.Now().Add(ttl), true
+	}
+}
+
+// modify atomically replaces the value of the key with the one returned by fn,
+// which is called with the current value, if any, while holding the lock of
+// the key. If the key is missing, it's added with the given TTL; otherwise its
+// TTL is kept. fn also returns the cost of the new value and whether to write
+// it at all. modify returns the new value and whether it was written.
+func (c *Cache[K, V]) modify(key K, ttl time.Duration, fn func(V, bool) (V, int64, bool)) (V, bool) {
+	var zero V
+	if c == nil || c.isClosed || c.readOnly() || c.bypassed() {
+		return zero, false
+	}
+	expiration, ok := c.expiration(ttl)
+	if !ok {
+		return zero, false
 	}
 
+	keyHash, conflictHash := c.keyToHash(key)
+	if c.tombstones.has(keyHash) {
+		return zero, false
+	}
+	var cost int64
+	prev, i, ok := c.store.Upsert(Item[V]{
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		conflictHi: c.wideHash(key),
+		Expiration: expiration,
+		Version:    c.nextVersion(),
+	}, func(old V, exists bool) (V, bool) {
+		var value V
+		var write bool
+		value, cost, write = fn(old, exists)
+		return value, write
+	})
+	if !ok {
+		return zero, false
+	}
+	i.Cost = cost
+
+	if i.flag == itemUpdate {
+		c.watchers.call(keyHash, conflictHash, KeyReplaced, prev)
+		c.onExit(prev)
+		// The store is already updated, so there's no need to report a failure
+		// if the cost update can't be sent to the policy.
+		select {
+		case c.setBuf <- i:
+		default:
+			c.updateCost(i)
+		}
+		return i.Value, true
+	}
+	// The new item is already in the store, so the policy must hear about it
+	// to keep its accounting right.
+	if !c.pushSet(i) {
+		c.dropStored(i)
+		return zero, false
+	}
+	return i.Value, true
+}
+
+// dropStored removes a new item that was added to the store but couldn't be
+// sent to the policy because the cache is paused and setBuf is full, unless it
+// was written again meanwhile, which is only known if Config.TrackVersions is
+// set.
+func (c *Cache[K, V]) dropStored(i Item[V]) {
+	c.store.DelIf(i.Key, i.Conflict, func(si storeItem[V]) bool {
+		return si.version == i.Version
+	})
+	c.Metrics.add(dropSets, i.Key, 1)
+}
+
+// pushDel sends the deletion of a key removed from the store to the policy,
+// or applies it to the policy right away if the cache is paused and setBuf is
+// full.
+func (c *Cache[K, V]) pushDel(i Item[V]) {
+	if !c.pushSet(i) {
+		c.policy.Del(i.Key)
+	}
+}
+
+// UpdateIfVersion replaces the value of an existing key only if its current
+// version is the given one, as returned by SetWithVersion, GetWithVersion or a
+// previous UpdateIfVersion. The expiration and metadata of the key are kept.
+// It returns the new version and true if the value was replaced. It requires
+// Config.TrackVersions.
+func (c *Cache[K, V]) UpdateIfVersion(key K, version uint64, value V, cost int64) (uint64, bool) {
+	if c == nil || c.isClosed || c.readOnly() || c.bypassed() || !c.trackVersions {
+		return 0, false
+	}
 	keyHash, conflictHash := c.keyToHash(key)
 	i := Item[V]{
-		flag:       itemNew,
+		flag:       itemUpdate,
 		Key:        keyHash,
 		Conflict:   conflictHash,
+		conflictHi: c.wideHash(key),
 		Value:      value,
 		Cost:       cost,
-		Expiration: expiration,
+		Version:    c.nextVersion(),
 	}
-	// cost is eventually updated. The expiration must also be immediately updated
-	// to prevent items from being prematurely removed from the map.
-	if prev, ok := c.store.Update(i); ok {
-		c.onExit(prev)
-		i.flag = itemUpdate
+	prev, ok := c.store.UpdateIfVersion(i, version)
+	if !ok {
+		return 0, false
 	}
-	// Attempt to send item to policy.
+	c.watchers.call(keyHash, conflictHash, KeyReplaced, prev)
+	c.onExit(prev)
+	// The store is already updated, so there's no need to report a failure if
+	// the cost update can't be sent to the policy.
 	select {
 	case c.setBuf <- i:
-		return true
 	default:
-		if i.flag == itemUpdate {
-			// Return true if this was an update operation since we've already
-			// updated the store. For all the other operations (set/delete), we
-			// return false which means the item was not inserted.
-			return true
+		c.updateCost(i)
+	}
+	return i.Version, true
+}
+
+// Number is the constraint for the values of a cache that IncrBy works with.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// IncrBy atomically adds delta to the value of the key and returns the new
+// value. If the key is missing, it's added with delta as its value and the
+// given TTL; otherwise its TTL is kept. Decrementing is done by passing a
+// negative delta. The cost of the value is calculated as if it was Set with a
+// cost of 0. It returns false if the cache is closed or the TTL is negative.
+//
+// Like Set, a new key is only kept if the policy lets it in, so a counter can
+// start over from zero after its key is rejected or evicted.
+func IncrBy[K any, V Number](c *Cache[K, V], key K, delta V, ttl time.Duration) (V, bool) {
+	return c.modify(key, ttl, func(old V, _ bool) (V, int64, bool) {
+		return old + delta, 0, true
+	})
+}
+
+// AppendValue atomically appends elems to the slice stored for the key and
+// returns the new slice. If the key is missing, it's added with elems as its
+// value and Config.DefaultTTL; otherwise its TTL is kept. The cost of the new
+// slice is calculated as if it was Set with a cost of 0. It returns false if the
+// cache is closed.
+//
+// The slice is grown with append, so slices returned by Get may share their
+// backing array with the stored one and must not be appended to by callers.
+func AppendValue[K any, T any](c *Cache[K, []T], key K, elems ...T) ([]T, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.modify(key, c.current().defaultTTL, func(old []T, _ bool) ([]T, int64, bool) {
+		return append(old, elems...), 0, true
+	})
+}
+
+// nextVersion returns a new entry version, or 0 if versions aren't tracked.
+func (c *Cache[K, V]) nextVersion() uint64 {
+	if !c.trackVersions {
+		return 0
+	}
+	return atomic.AddUint64(&c.version, 1)
+}
+
+// Del deletes the key-value item from the cache if it exists.
+func (c *Cache[K, V]) Del(key K) {
+	if c == nil || c.isClosed || c.readOnly() {
+		return
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.tombstones.add(keyHash)
+	c.deltas.del(keyHash, conflictHash)
+	// Delete immediately.
+	prev := c.store.Del(keyHash, conflictHash)
+	c.onExit(prev.value)
+	// If we've set an item, it would be applied slightly later.
+	// So we must push the same item to `setBuf` with the deletion flag.
+	// This ensures that if a set is followed by a delete, it will be
+	// applied in the correct order.
+	c.pushDel(Item[V]{
+		flag:     itemDelete,
+		Key:      keyHash,
+		Conflict: conflictHash,
+	})
+}
+
+// Op is a single operation of a batch passed to ApplyBatch.
+type Op[K any, V any] struct {
+	// Key is the key the operation applies to.
+	Key K
+	// Value, Cost and TTL have the same meaning as the arguments of
+	// SetWithTTL. They are ignored for deletes.
+	Value V
+	Cost  int64
+	TTL   time.Duration
+	// Del makes the operation delete the key instead of setting it.
+	Del bool
+}
+
+// ApplyBatch applies a batch of sets and deletes so that concurrent readers see
+// either none or all of them. It returns false, without applying any of them,
+// if the cache is closed, read-only or bypassed, or if any TTL is negative.
+//
+// The sets are checked like the ones of Set: Config.Expiry computes their TTL,
+// and the ones rejected because of Config.MaxItemCost or a tombstone, or
+// discarded by Config.Expiry, are skipped. New keys are added to the cache
+// right away, but like with Set, the policy can still reject or evict them
+// later on.
+func (c *Cache[K, V]) ApplyBatch(ops []Op[K, V]) bool {
+	if c == nil || c.isClosed || c.readOnly() || c.bypassed() {
+		return false
+	}
+	for _, op := range ops {
+		if !op.Del && op.TTL < 0 {
+			return false
 		}
-		c.Metrics.add(dropSets, keyHash, 1)
+	}
+	items := make([]Item[V], 0, len(ops))
+	for _, op := range ops {
+		if op.Del {
+			keyHash, conflictHash := c.keyToHash(op.Key)
+			items = append(items, Item[V]{
+				flag:     itemDelete,
+				Key:      keyHash,
+				Conflict: conflictHash,
+			})
+			continue
+		}
+		// The Sets go through the same checks as Set, and are skipped if
+		// they're rejected.
+		if i, ok := c.newSetItem(op.Key, op.Value, op.Cost, op.TTL, 0); ok {
+			items = append(items, i)
+		}
+	}
+
+	prevs := c.store.ApplyBatch(items)
+	for n, i := range items {
+		switch i.flag {
+		case itemDelete:
+			c.deltas.del(i.Key, i.Conflict)
+			c.onExit(prevs[n])
+			c.pushDel(i)
+		case itemUpdate:
+			c.watchers.call(i.Key, i.Conflict, KeyReplaced, prevs[n])
+			c.onExit(prevs[n])
+			select {
+			case c.setBuf <- i:
+			default:
+				c.updateCost(i)
+			}
+		case itemStored:
+			if !c.pushSet(i) {
+				c.dropStored(i)
+			}
+		}
+	}
+	return true
+}
+
+// DelIf deletes the key-value item from the cache only if fn returns true for
+// its current value. fn runs while holding an internal lock, so it must be fast
+// and must not call any method of the cache. It returns true if the item was
+// deleted.
+func (c *Cache[K, V]) DelIf(key K, fn func(V) bool) bool {
+	return c.delIf(key, func(si storeItem[V]) bool {
+		return fn(si.value)
+	})
+}
+
+// DelIfVersion deletes the key-value item from the cache only if its current
+// version is the given one. It returns true if the item was deleted. It
+// requires Config.TrackVersions.
+func (c *Cache[K, V]) DelIfVersion(key K, version uint64) bool {
+	if c == nil || !c.trackVersions {
+		return false
+	}
+	return c.delIf(key, func(si storeItem[V]) bool {
+		return si.version == version
+	})
+}
+
+// DelIfEquals deletes the key-value item from the cache only if its current
+// value equals expected. It returns true if the item was deleted.
+func DelIfEquals[K any, V comparable](c *Cache[K, V], key K, expected V) bool {
+	return c.DelIf(key, func(value V) bool {
+		return value == expected
+	})
+}
+
+func (c *Cache[K, V]) delIf(key K, fn func(storeItem[V]) bool) bool {
+	if c == nil || c.isClosed || c.readOnly() {
 		return false
 	}
+	keyHash, conflictHash := c.keyToHash(key)
+	prev, ok := c.store.DelIf(keyHash, conflictHash, fn)
+	if !ok {
+		return false
+	}
+	c.tombstones.add(keyHash)
+	c.deltas.del(keyHash, conflictHash)
+	c.mutated(MutationDel, keyHash, conflictHash)
+	c.onExit(prev.value)
+	c.pushDel(Item[V]{
+		flag:     itemDelete,
+		Key:      keyHash,
+		Conflict: conflictHash,
+	})
+	return true
+}
+
+// HashSeed returns the seed mixed into the hashes of the keys, see
+// Config.HashSeed, or 0 if they aren't seeded. With Config.RandomHashSeed, it
+// can be saved along with a snapshot to load it in a cache with the same seed.
+func (c *Cache[K, V]) HashSeed() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hashSeed
 }
 
-// Del deletes the key-value item from the cache if it exists.
-func (c *Cache[K, V]) Del(key K) {
-	if c == nil || c.isClosed {
+// LockKey locks a mutex associated with the key, so callers can serialize
+// work around it, such as computing its value, without keeping their own map
+// of mutexes. It doesn't prevent any cache operation on the key. The mutexes
+// are shared by several keys, so a goroutine must not lock more than one key at
+// a time or it may deadlock.
+func (c *Cache[K, V]) LockKey(key K) {
+	if c == nil {
 		return
 	}
-	keyHash, conflictHash := c.keyToHash(key)
-	// Delete immediately.
-	_, prev := c.store.Del(keyHash, conflictHash)
-	c.onExit(prev)
-	// If we've set an item, it would be applied slightly later.
-	// So we must push the same item to `setBuf` with the deletion flag.
-	// This ensures that if a set is followed by a delete, it will be
-	// applied in the correct order.
-	c.setBuf <- Item[V]{
-		flag:     itemDelete,
-		Key:      keyHash,
-		Conflict: conflictHash,
+	keyHash, _ := c.keyToHash(key)
+	c.keyLocks[keyHash%numKeyLocks].Lock()
+}
+
+// UnlockKey unlocks the mutex locked by LockKey for the key.
+func (c *Cache[K, V]) UnlockKey(key K) {
+	if c == nil {
+		return
 	}
+	keyHash, _ := c.keyToHash(key)
+	c.keyLocks[keyHash%numKeyLocks].Unlock()
 }
 
 // GetTTL returns the TTL for the specified key and a bool that is true if the
 // item was found and is not expired.
 func (c *Cache[K, V]) GetTTL(key K) (time.Duration, bool) {
-	if c == nil {
+	if c == nil || c.bypassed() {
 		return 0, false
 	}
 
 	keyHash, conflictHash := c.keyToHash(key)
-	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+	if _, ok := c.getItem(key, keyHash, conflictHash); !ok {
 		// not found
 		return 0, false
 	}
@@ -354,25 +1706,116 @@ func (c *Cache[K, V]) Close() {
 	if c == nil || c.isClosed {
 		return
 	}
-	c.Clear()
+	// Report the items of earlier Clear calls before the remaining ones.
+	c.waitCleared()
+	c.clear(c.onEvict, c.onEvict, false)
 
-	// Block until processItems goroutine is returned.
-	c.stop <- struct{}{}
+	c.pauseMu.Lock()
+	if !c.isPaused() {
+		// Block until processItems goroutine is returned.
+		c.stop <- struct{}{}
+	}
+	c.pauseMu.Unlock()
 	close(c.stop)
 	close(c.setBuf)
 	c.policy.Close()
+	c.loader.close()
+	c.mutations.closeAll()
 	c.isClosed = true
+	unregister(c)
 }
 
 // Clear empties the hashmap and zeroes all policy counters. Note that this is
 // not an atomic operation (but that shouldn't be a problem as it's assumed that
 // Set/Get calls won't be occurring until after this).
+//
+// Each shard is emptied by swapping its map for a new one, so its lock is only
+// held briefly however many items it holds. Config.OnEvict, Config.OnExit, the
+// listeners and the key watchers are called for the cleared items in the
+// background, after Clear returns; Wait and Close wait for them to be done.
 func (c *Cache[K, V]) Clear() {
+	if c == nil {
+		return
+	}
+	c.clear(c.onEvict, c.onEvict, true)
+}
+
+// ClearContext works like Clear but stops calling Config.OnEvict and the
+// listeners for the cleared items once ctx is done, and then returns
+// ctx.Err(). The cache is cleared anyway, and Config.OnExit is still called
+// for every value so they can be released.
+func (c *Cache[K, V]) ClearContext(ctx context.Context) error {
+	onEvict := func(item Item[V]) {
+		if ctx.Err() != nil {
+			c.onExit(item.Value)
+			return
+		}
+		c.onEvict(item)
+	}
+	c.clear(onEvict, onEvict, false)
+	return ctx.Err()
+}
+
+// ClearContextRate works like ClearContext but calls Config.OnEvict and the
+// listeners for at most perSecond cleared items per second, waiting in between,
+// so flushing a huge cache doesn't cause a spike of work in the callbacks. The
+// cache can be used while it waits. If perSecond is zero or less, the calls
+// aren't limited. Once ctx is done, the remaining items are only passed to
+// Config.OnExit, right away.
+//
+// The items still buffered by Set aren't limited, and neither are the ones of
+// a custom Store, whose shards stay locked while their items are reported.
+func (c *Cache[K, V]) ClearContextRate(ctx context.Context, perSecond int) error {
+	if perSecond <= 0 {
+		return c.ClearContext(ctx)
+	}
+	onEvict := func(item Item[V]) {
+		if ctx.Err() != nil {
+			c.onExit(item.Value)
+			return
+		}
+		c.onEvict(item)
+	}
+	interval := time.Second / time.Duration(perSecond)
+	var timer *time.Timer
+	next := time.Now()
+	c.clear(onEvict, func(item Item[V]) {
+		if wait := time.Until(next); wait > 0 && ctx.Err() == nil {
+			if timer == nil {
+				timer = time.NewTimer(wait)
+			} else {
+				timer.Reset(wait)
+			}
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if now := time.Now(); next.Before(now) {
+			// Don't make up for slow callbacks with a burst.
+			next = now
+		}
+		next = next.Add(interval)
+		onEvict(item)
+	}, false)
+	return ctx.Err()
+}
+
+// clear implements Clear, calling buffered for the items still buffered by Set
+// and onEvict for the items in the store, in the background if background is
+// true.
+func (c *Cache[K, V]) clear(buffered, onEvict itemCallback[V], background bool) {
 	if c == nil || c.isClosed {
 		return
 	}
-	// Block until processItems goroutine is returned.
-	c.stop <- struct{}{}
+	// Block until processItems goroutine is returned, unless the cache is
+	// paused and it isn't running.
+	c.pauseMu.Lock()
+	paused := c.isPaused()
+	if !paused {
+		c.stop <- struct{}{}
+	}
 
 	// Clear out the setBuf channel.
 loop:
@@ -383,10 +1826,14 @@ loop:
 				i.wg.Done()
 				continue
 			}
-			if i.flag != itemUpdate {
-				// In itemUpdate, the value is already set in the store.  So, no need to call
+			switch i.flag {
+			case itemUpdate, itemStored, itemExpire, itemShrink:
+				// In itemUpdate and itemStored, the value is already set in the store,
+				// and itemExpire and itemShrink have no value. So, no need to call
 				// onEvict here.
-				c.onEvict(i)
+			default:
+				i.EvictReason = EvictCleared
+				onEvict(i)
 			}
 		default:
 			break loop
@@ -395,13 +1842,56 @@ loop:
 
 	// Clear value hashmap and policy data.
 	c.policy.Clear()
-	c.store.Clear(c.onEvict)
+	evictCleared := c.store.Clear(onEvict)
+	c.deltas.clear()
+	c.mutated(MutationClear, 0, 0)
 	// Only reset metrics if they're enabled.
 	if c.Metrics != nil {
 		c.Metrics.Clear()
 	}
 	// Restart processItems goroutine.
-	go c.processItems()
+	if !paused {
+		c.goWorker("processItems", c.processItems)
+	}
+	c.pauseMu.Unlock()
+
+	if !background {
+		evictCleared()
+		return
+	}
+	c.clearMu.Lock()
+	prev, done := c.cleared, make(chan struct{})
+	c.cleared = done
+	c.clearMu.Unlock()
+	c.goWorker("clear", func() {
+		if prev != nil {
+			<-prev
+		}
+		evictCleared()
+		close(done)
+	})
+}
+
+// waitCleared waits for the items of earlier Clear calls to be reported.
+func (c *Cache[K, V]) waitCleared() {
+	c.waitClearedContext(context.Background())
+}
+
+// waitClearedContext works like waitCleared but returns ctx.Err() if ctx is
+// done first.
+func (c *Cache[K, V]) waitClearedContext(ctx context.Context) error {
+	c.clearMu.Lock()
+	done := c.cleared
+	c.clearMu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // MaxCost returns the max cost of the cache.
@@ -412,6 +1902,140 @@ func (c *Cache[K, V]) MaxCost() int64 {
 	return c.policy.MaxCost()
 }
 
+// CostUsed returns the sum of the costs of the items currently in the cache,
+// including the internal cost unless Config.IgnoreInternalCost is set. It
+// doesn't require Config.Metrics.
+func (c *Cache[K, V]) CostUsed() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.policy.Used()
+}
+
+// UpdateCost changes the cost of the key without changing its value, for
+// example after a cached buffer grew in place. Unlike Set, it can't be rejected
+// by the policy. The cost must be greater than zero; like Set, the internal
+// cost is added unless Config.IgnoreInternalCost is set. Items aren't evicted
+// right away if the new cost doesn't fit, but on the next Set that needs room.
+//
+// It returns false if the key isn't in the cache or the update was dropped due
+// to contention. Like Set, the update is applied asynchronously.
+func (c *Cache[K, V]) UpdateCost(key K, cost int64) bool {
+	if c == nil || c.isClosed || c.readOnly() || cost <= 0 {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.getItem(key, keyHash, conflictHash); !ok {
+		return false
+	}
+	select {
+	case c.setBuf <- Item[V]{flag: itemUpdate, Key: keyHash, Conflict: conflictHash, Cost: cost}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reserve accounts cost against MaxCost for memory held outside the cache, such
+// as buffers derived from cached values. It returns false if cost doesn't fit
+// in the cache even when empty, in which case nothing is reserved. Reserved
+// cost stays taken until it is given back with Release, even across calls to
+// Clear.
+//
+// Items are evicted to make room for it by the goroutine processing the Set
+// buffer, like any eviction, so OnEvict is never called concurrently. Like
+// Set, the evictions are applied asynchronously, or on the next Set that needs
+// room if the Set buffer is full.
+func (c *Cache[K, V]) Reserve(cost int64) bool {
+	if c == nil || c.isClosed || cost < 0 {
+		return false
+	}
+	if !c.policy.Reserve(cost) {
+		return false
+	}
+	select {
+	case c.setBuf <- Item[V]{flag: itemShrink}:
+	default:
+	}
+	return true
+}
+
+// Release gives back cost previously taken with Reserve.
+func (c *Cache[K, V]) Release(cost int64) {
+	if c == nil || c.isClosed || cost < 0 {
+		return
+	}
+	c.policy.Release(cost)
+}
+
+// EstimateFrequency returns the access frequency of the key as estimated by the
+// TinyLFU admission policy, whether or not the key is in the cache. A Set for a
+// new key is only admitted when the cache is full if its frequency is at least
+// as high as the one of the items it would evict.
+func (c *Cache[K, V]) EstimateFrequency(key K) int64 {
+	if c == nil || c.isClosed {
+		return 0
+	}
+	keyHash, _ := c.keyToHash(key)
+	return c.policy.Estimate(keyHash)
+}
+
+// ExplainSet reports what would happen to an item with the given key and cost
+// if it was passed to Set right now, without changing anything: whether it
+// would be admitted, and which items would be evicted for it, including the
+// ones evicted down to Config.LowWatermark right after, or rejected, and which
+// item made the policy reject it, or dropped. A cost of 0 is
+// reported as is, as Config.Cost can't be called without a value. As eviction
+// candidates are sampled at random, an actual Set may pick different victims
+// and even have a different outcome.
+func (c *Cache[K, V]) ExplainSet(key K, cost int64) SetExplanation {
+	if c == nil || c.isClosed {
+		return SetExplanation{Outcome: SetDropped, Cost: cost}
+	}
+	if !c.ignoreInternalCost {
+		cost += itemSize
+	}
+	keyHash, _ := c.keyToHash(key)
+	// The items evicted down to Config.LowWatermark are reported as well.
+	var drainAbove, drainTo int64
+	if c.highWatermark > 0 {
+		maxCost := float64(c.policy.MaxCost())
+		drainAbove, drainTo = int64(c.highWatermark*maxCost), int64(c.lowWatermark*maxCost)
+	}
+	exp := c.policy.Explain(keyHash, cost, drainAbove, drainTo)
+	if exp.Outcome != SetUpdated && len(c.setBuf) == cap(c.setBuf) {
+		exp.Outcome = SetDropped
+	}
+	return exp
+}
+
+// TopKeys returns up to n keys in the cache with the highest estimated access
+// frequency according to the admission policy, most frequent first, along with
+// their costs. Keys are reported by their hashes, as the cache doesn't store
+// the original keys. It scans every key while holding the policy lock, so it's
+// meant for debugging and occasional reporting rather than frequent use.
+func (c *Cache[K, V]) TopKeys(n int) []KeyFrequency {
+	if c == nil || c.isClosed {
+		return nil
+	}
+	return c.policy.TopKeys(n)
+}
+
+// Sample returns up to n random items in the cache, with their cost and
+// expiration, picked across shards without scanning the whole cache. It can
+// return fewer than n items if the cache holds few of them. Keys are reported
+// by their hashes, as the cache doesn't store the original keys.
+func (c *Cache[K, V]) Sample(n int) []Item[V] {
+	if c == nil || c.isClosed {
+		return nil
+	}
+	items := c.store.Sample(n)
+	for i := range items {
+		items[i].Cost = c.policy.Cost(items[i].Key)
+	}
+	return items
+}
+
 // UpdateMaxCost updates the maxCost of an existing cache.
 func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
 	if c == nil {
@@ -420,6 +2044,85 @@ func (c *Cache[K, V]) UpdateMaxCost(maxCost int64) {
 	c.policy.UpdateMaxCost(maxCost)
 }
 
+// checkHealth reports warnings about the conditions found after a TTL cleanup
+// that took the given time and left the given number of expired items, given
+// the number left by the previous one. saturated tracks whether the sketch
+// saturation was already reported.
+func (c *Cache[K, V]) checkHealth(took time.Duration, left, prevLeft int, saturated *bool) {
+	if took > cleanupInterval() {
+		c.warningf(WarnCleanupOverrun, "ristretto: TTL cleanup took %s, longer than "+
+			"its interval of %s", took, cleanupInterval())
+	}
+	if left > prevLeft {
+		c.warningf(WarnExpiredBacklog, "ristretto: %d expired items are waiting to be "+
+			"removed, up from %d", left, prevLeft)
+	}
+	if n := atomic.SwapUint64(&c.droppedSets, 0); n > droppedSetsWarnThreshold {
+		c.warningf(WarnSetsDropped, "ristretto: %d Sets were dropped in the last %s "+
+			"because the Set buffer was full", n, cleanupInterval())
+	}
+	if n := c.policy.Len(); int64(n) > c.numCounters {
+		if !*saturated {
+			c.warningf(WarnSketchSaturated, "ristretto: the cache holds %d items, more "+
+				"than NumCounters (%d)", n, c.numCounters)
+		}
+		*saturated = true
+	} else {
+		*saturated = false
+	}
+}
+
+// itemCost returns the cost the policy accounts for the item.
+func (c *Cache[K, V]) itemCost(i Item[V]) int64 {
+	cost := i.Cost
+	// Calculate item cost value if new or update.
+	if cost == 0 && c.cost != nil && i.flag != itemDelete {
+		cost = c.cost(i.Value)
+	}
+	if !c.ignoreInternalCost {
+		// Add the cost of internally storing the object.
+		cost += itemSize
+	}
+	return cost
+}
+
+// tooBig returns true if an item with the given cost, including the internal
+// cost, is larger than Config.MaxItemCost.
+func (c *Cache[K, V]) tooBig(cost int64) bool {
+	return c.maxItemCost > 0 && cost > c.maxItemCost
+}
+
+// updateCost updates the cost of an item already updated in the store right
+// away, when the update couldn't be sent through setBuf. Otherwise the cost
+// accounted by the policy would drift from the size of the value.
+func (c *Cache[K, V]) updateCost(i Item[V]) {
+	c.policy.Update(i.Key, c.itemCost(i))
+	c.mutatedSet(i.Key, i.Conflict, true)
+}
+
+// isConflict returns true if the store holds another key with the hash of the
+// item, as told by the conflict hash.
+func (c *Cache[K, V]) isConflict(i Item[V]) bool {
+	if i.Conflict == 0 && i.conflictHi == 0 {
+		return false
+	}
+	return c.store.Conflicts(i)
+}
+
+const (
+	// headroomInterval is how often processItems evicts a batch of items
+	// with Config.HeadroomTarget.
+	headroomInterval = 10 * time.Millisecond
+	// headroomBatch is the share of the max cost evicted at most per batch,
+	// as a divisor.
+	headroomBatch = 100
+)
+
+// cleanupInterval returns how often processItems removes the expired items.
+func cleanupInterval() time.Duration {
+	return time.Duration(bucketDurationSecs) * time.Second / 2
+}
+
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache[K, V]) processItems() {
 	startTs := make(map[uint64]time.Time)
@@ -449,62 +2152,226 @@ func (c *Cache[K, V]) processItems() {
 		}
 	}
 
+	// backlog is the number of expired items the last cleanup left behind and
+	// saturated whether the sketch was reported as saturated, so warnings are
+	// only reported when things get worse.
+	var backlog int
+	var saturated bool
+	var headroom <-chan time.Time
+	if c.headroomTarget > 0 {
+		ticker := time.NewTicker(headroomInterval)
+		defer ticker.Stop()
+		headroom = ticker.C
+	}
+	// expiry fires at the earliest expiration if Config.PreciseExpiration is
+	// set. It starts stopped, until expiryWake is signaled.
+	var expiry <-chan time.Time
+	var expiryTimer *time.Timer
+	if c.expiryWake != nil {
+		expiryTimer = time.NewTimer(time.Hour)
+		expiryTimer.Stop()
+		defer expiryTimer.Stop()
+		expiry = expiryTimer.C
+		// Arm the timer for the items added while processItems wasn't running,
+		// such as while the cache was paused.
+		c.expireDue(expiryTimer, onEvict)
+	}
 	for {
 		select {
 		case i := <-c.setBuf:
+			// Count the item just received too.
+			c.Metrics.max(setBufHighWater, uint64(len(c.setBuf)+1))
 			if i.wg != nil {
 				i.wg.Done()
 				continue
 			}
-			// Calculate item cost value if new or update.
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.Cost = c.cost(i.Value)
+			switch i.flag {
+			case itemExpire:
+				c.evictIfExpired(i.Key, i.Conflict, onEvict)
+				continue
+			case itemShrink:
+				c.evictVictims(c.policy.Shrink(c.policy.MaxCost()), onEvict)
+				continue
 			}
-			if !c.ignoreInternalCost {
-				// Add the cost of internally storing the object.
-				i.Cost += itemSize
+			i.Cost = c.itemCost(i)
+			if i.flag != itemDelete && c.tooBig(i.Cost) {
+				c.Metrics.add(rejectSetsTooBig, i.Key, 1)
+				if i.flag != itemNew {
+					// The item is already in the store.
+					c.policy.Del(i.Key)
+					i.Value = c.store.Del(i.Key, i.Conflict).value
+					c.deltas.del(i.Key, i.Conflict)
+					c.mutated(MutationDel, i.Key, i.Conflict)
+				}
+				i.RejectReason = RejectTooBig
+				c.onReject(i)
+				continue
 			}
 
 			switch i.flag {
 			case itemNew:
+				if c.isConflict(i) {
+					c.Metrics.add(dropSetsConflict, i.Key, 1)
+					i.RejectReason = RejectConflict
+					c.onReject(i)
+					break
+				}
 				victims, added := c.policy.Add(i.Key, i.Cost)
 				if added {
 					c.store.Set(i)
 					c.Metrics.add(keyAdd, i.Key, 1)
 					trackAdmission(i.Key)
 				} else {
+					i.RejectReason = RejectPolicy
+					c.onReject(i)
+				}
+				c.evictVictims(victims, onEvict)
+				if added {
+					c.mutatedSet(i.Key, i.Conflict, false)
+				}
+
+			case itemStored:
+				// The item was added straight to the store, so it must be removed
+				// from it if the policy doesn't let it in. If the policy already
+				// has the key, a Set for it was processed in the meantime.
+				if c.policy.Has(i.Key) {
+					c.policy.Update(i.Key, i.Cost)
+					c.mutatedSet(i.Key, i.Conflict, true)
+					break
+				}
+				victims, added := c.policy.Add(i.Key, i.Cost)
+				if added {
+					c.Metrics.add(keyAdd, i.Key, 1)
+					trackAdmission(i.Key)
+				} else {
+					i.Value = c.store.Del(i.Key, i.Conflict).value
+					i.RejectReason = RejectPolicy
 					c.onReject(i)
 				}
-				for _, victim := range victims {
-					evicted := Item[V]{
-						Key:  victim.key,
-						Cost: victim.cost,
-					}
-					evicted.Conflict, evicted.Value = c.store.Del(victim.key, 0)
-					onEvict(evicted)
+				c.evictVictims(victims, onEvict)
+				if added {
+					c.mutatedSet(i.Key, i.Conflict, false)
 				}
 
 			case itemUpdate:
 				c.policy.Update(i.Key, i.Cost)
+				c.mutatedSet(i.Key, i.Conflict, true)
 
 			case itemDelete:
 				c.policy.Del(i.Key) // Deals with metrics updates.
-				_, val := c.store.Del(i.Key, i.Conflict)
-				c.onExit(val)
+				deleted := c.store.Del(i.Key, i.Conflict)
+				c.mutated(MutationDel, i.Key, i.Conflict)
+				c.onExit(deleted.value)
 			}
+			c.drainWatermark(onEvict)
 		case <-c.cleanupTicker.C:
-			c.store.Cleanup(c.policy, onEvict)
+			end := c.trace(TraceCleanup)
+			start := time.Now()
+			cur := c.current()
+			left := c.store.Cleanup(c.policy, onEvict, cur.maxCleanupItems, cur.cleanupWorkers)
+			c.tombstones.cleanup()
+			c.loader.cleanup(func(key, conflict uint64) bool {
+				_, ok := c.store.Get(key, conflict)
+				return ok
+			})
+			end()
+			c.checkHealth(time.Since(start), left, backlog, &saturated)
+			backlog = left
+		case <-headroom:
+			c.makeHeadroom(onEvict)
+		case <-c.expiryWake:
+			c.expireDue(expiryTimer, onEvict)
+		case <-expiry:
+			c.expireDue(expiryTimer, onEvict)
 		case <-c.stop:
 			return
 		}
 	}
 }
 
+// drainWatermark evicts items down to Config.LowWatermark if the cost used is
+// over Config.HighWatermark.
+func (c *Cache[K, V]) drainWatermark(onEvict itemCallback[V]) {
+	if c.highWatermark == 0 {
+		return
+	}
+	maxCost := float64(c.policy.MaxCost())
+	if float64(c.policy.Used()) <= c.highWatermark*maxCost {
+		return
+	}
+	c.evictVictims(c.policy.Shrink(int64(c.lowWatermark*maxCost)), onEvict)
+}
+
+// makeHeadroom evicts a batch of items if the cost used is over
+// Config.HeadroomTarget and no Sets are waiting.
+func (c *Cache[K, V]) makeHeadroom(onEvict itemCallback[V]) {
+	if len(c.setBuf) > 0 {
+		return
+	}
+	maxCost, used := c.policy.MaxCost(), c.policy.Used()
+	target := int64(c.headroomTarget * float64(maxCost))
+	if used <= target {
+		return
+	}
+	batch := maxCost / headroomBatch
+	if batch < 1 {
+		batch = 1
+	}
+	if used-batch > target {
+		target = used - batch
+	}
+	c.evictVictims(c.policy.Shrink(target), onEvict)
+}
+
+// expireDue removes the items whose expiration has passed, calling onEvict for
+// them, and sets timer to fire at the earliest expiration left.
+func (c *Cache[K, V]) expireDue(timer *time.Timer, onEvict itemCallback[V]) {
+	keys, next := c.store.Due(time.Now())
+	for key, conflict := range keys {
+		c.evictIfExpired(key, conflict, onEvict)
+	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if !next.IsZero() {
+		timer.Reset(time.Until(next))
+	}
+}
+
+// evictVictims removes the victims picked by the policy from the store and calls
+// onEvict for each of them.
+func (c *Cache[K, V]) evictVictims(victims []policyPair, onEvict itemCallback[V]) {
+	if len(victims) == 0 {
+		return
+	}
+	defer c.trace(TraceEvict)()
+	for _, victim := range victims {
+		deleted := c.store.Del(victim.key, 0)
+		onEvict(Item[V]{
+			Key:         victim.key,
+			Conflict:    deleted.conflict,
+			Value:       deleted.value,
+			Cost:        victim.cost,
+			Expiration:  deleted.expirationTime(),
+			Meta:        deleted.meta,
+			Version:     deleted.version,
+			EvictReason: EvictPolicy,
+			created:     deleted.created,
+		})
+	}
+}
+
 // collectMetrics just creates a new *Metrics instance and adds the pointers
 // to the cache and policy instances.
 func (c *Cache[K, V]) collectMetrics() {
 	c.Metrics = newMetrics()
 	c.policy.CollectMetrics(c.Metrics)
+	if b, ok := c.getBuf.(interface{ CollectMetrics(*Metrics) }); ok {
+		b.CollectMetrics(c.Metrics)
+	}
 }
 
 type metricType int
@@ -523,10 +2390,33 @@ const (
 	// The following keep track of how many sets were dropped or rejected later.
 	dropSets
 	rejectSets
+	// The following 2 keep track of how many sets were dropped because the
+	// cache was closed or another key with the same hash was stored.
+	dropSetsClosed
+	dropSetsConflict
+	// The following keeps track of how many sets were rejected because the
+	// item was larger than MaxItemCost.
+	rejectSetsTooBig
 	// The following 2 keep track of how many gets were kept and dropped on the
 	// floor.
 	dropGets
 	keepGets
+	// The following 2 keep track of how many batches of gets the policy
+	// recorded and the nanoseconds it took from receiving them.
+	drainGets
+	drainGetsNanos
+	// The following 2 keep track of how many times the policy lock was taken
+	// and the nanoseconds spent waiting for it.
+	policyLocks
+	policyLockNanos
+	// The following keeps track of the largest number of items seen in the
+	// Set buffer.
+	setBufHighWater
+	// The following 3 keep track of how many snapshots were saved, the
+	// nanoseconds they took and the bytes they wrote.
+	snapshots
+	snapshotNanos
+	snapshotBytes
 	// This should be the final enum. Other enums should be set before this.
 	doNotUse
 )
@@ -551,26 +2441,54 @@ func stringFor(t metricType) string {
 		return "sets-dropped"
 	case rejectSets:
 		return "sets-rejected" // by policy.
+	case dropSetsClosed:
+		return "sets-dropped-closed"
+	case dropSetsConflict:
+		return "sets-dropped-conflict"
+	case rejectSetsTooBig:
+		return "sets-rejected-too-big"
 	case dropGets:
 		return "gets-dropped"
 	case keepGets:
 		return "gets-kept"
+	case drainGets:
+		return "gets-drains"
+	case drainGetsNanos:
+		return "gets-drain-ns"
+	case policyLocks:
+		return "policy-locks"
+	case policyLockNanos:
+		return "policy-lock-wait-ns"
+	case setBufHighWater:
+		return "set-buf-high-water"
+	case snapshots:
+		return "snapshots"
+	case snapshotNanos:
+		return "snapshot-ns"
+	case snapshotBytes:
+		return "snapshot-bytes"
 	default:
 		return "unidentified"
 	}
 }
 
+// distinctKeysPrecision is the precision of the HyperLogLog counting the
+// distinct keys, see Metrics.DistinctKeys.
+const distinctKeysPrecision = 14
+
 // Metrics is a snapshot of performance statistics for the lifetime of a cache instance.
 type Metrics struct {
 	all [doNotUse][]*uint64
 
 	mu   sync.RWMutex
 	life *z.HistogramData // Tracks the life expectancy of a key.
+	keys *z.HyperLogLog   // Tracks the distinct keys requested.
 }
 
 func newMetrics() *Metrics {
 	s := &Metrics{
 		life: z.NewHistogramData(z.HistogramBounds(1, 16)),
+		keys: z.NewHyperLogLog(distinctKeysPrecision),
 	}
 	for i := 0; i < doNotUse; i++ {
 		s.all[i] = make([]*uint64, 256)
@@ -593,6 +2511,21 @@ func (p *Metrics) add(t metricType, hash, delta uint64) {
 	atomic.AddUint64(valp[idx], delta)
 }
 
+// max raises the metric to v if it's lower. Such metrics only use the first
+// counter, so get returns their value as is.
+func (p *Metrics) max(t metricType, v uint64) {
+	if p == nil {
+		return
+	}
+	valp := p.all[t][0]
+	for {
+		old := atomic.LoadUint64(valp)
+		if v <= old || atomic.CompareAndSwapUint64(valp, old, v) {
+			return
+		}
+	}
+}
+
 func (p *Metrics) get(t metricType) uint64 {
 	if p == nil {
 		return 0
@@ -640,19 +2573,45 @@ func (p *Metrics) CostEvicted() uint64 {
 	return p.get(costEvict)
 }
 
-// SetsDropped is the number of Set calls that don't make it into internal
-// buffers (due to contention or some other reason).
+// SetsDropped is the number of Set calls that were dropped by the cache, that
+// is, the sum of SetsDroppedBufferFull, SetsDroppedClosed and
+// SetsDroppedConflict. Sets rejected by the policy are counted by SetsRejected.
 func (p *Metrics) SetsDropped() uint64 {
+	return p.get(dropSets) + p.get(dropSetsClosed) + p.get(dropSetsConflict)
+}
+
+// SetsDroppedBufferFull is the number of Set calls that don't make it into
+// internal buffers due to contention. A large number means the cache can't keep
+// up with the rate of Sets.
+func (p *Metrics) SetsDroppedBufferFull() uint64 {
 	return p.get(dropSets)
 }
 
+// SetsDroppedClosed is the number of Set calls made after the cache was closed.
+func (p *Metrics) SetsDroppedClosed() uint64 {
+	return p.get(dropSetsClosed)
+}
+
+// SetsDroppedConflict is the number of Set calls for a key whose hash was
+// already used by another stored key, detected by the conflict hash.
+func (p *Metrics) SetsDroppedConflict() uint64 {
+	return p.get(dropSetsConflict)
+}
+
 // SetsRejected is the number of Set calls rejected by the policy (TinyLFU).
 func (p *Metrics) SetsRejected() uint64 {
 	return p.get(rejectSets)
 }
 
+// SetsRejectedTooBig is the number of Set calls rejected because the item was
+// larger than Config.MaxItemCost. They aren't counted by SetsRejected.
+func (p *Metrics) SetsRejectedTooBig() uint64 {
+	return p.get(rejectSetsTooBig)
+}
+
 // GetsDropped is the number of Get counter increments that are dropped
-// internally.
+// internally, because the policy was busy when the access buffer holding them
+// was drained. The policy doesn't learn about these accesses.
 func (p *Metrics) GetsDropped() uint64 {
 	return p.get(dropGets)
 }
@@ -662,6 +2621,59 @@ func (p *Metrics) GetsKept() uint64 {
 	return p.get(keepGets)
 }
 
+// GetsDroppedRatio is GetsDropped over all Get counter increments (GetsDropped
+// + GetsKept). A high ratio means the policy sees only part of the accesses and
+// Config.BufferItems should be increased.
+func (p *Metrics) GetsDroppedRatio() float64 {
+	if p == nil {
+		return 0.0
+	}
+	dropped, kept := p.get(dropGets), p.get(keepGets)
+	if dropped == 0 && kept == 0 {
+		return 0.0
+	}
+	return float64(dropped) / float64(dropped+kept)
+}
+
+// GetsDrainLatency is the average time the policy took to record a batch of Get
+// counter increments, from receiving it, including the wait for the policy
+// lock. A growing latency means the policy can't keep up with the Gets, and
+// more of them will be dropped.
+func (p *Metrics) GetsDrainLatency() time.Duration {
+	return p.mean(drainGetsNanos, drainGets)
+}
+
+// PolicyLockWait is the average time spent waiting for the policy lock, which
+// serializes the admission and eviction decisions with the recording of Gets.
+func (p *Metrics) PolicyLockWait() time.Duration {
+	return p.mean(policyLockNanos, policyLocks)
+}
+
+// SetBufHighWater is the largest number of items seen waiting in the Set
+// buffer. Sets are dropped when it's full, which happens when it reaches 32768.
+func (p *Metrics) SetBufHighWater() uint64 {
+	return p.get(setBufHighWater)
+}
+
+// SnapshotDuration is the average time Cache.Save took to write a snapshot.
+func (p *Metrics) SnapshotDuration() time.Duration {
+	return p.mean(snapshotNanos, snapshots)
+}
+
+// SnapshotBytes is the number of bytes written by Cache.Save.
+func (p *Metrics) SnapshotBytes() uint64 {
+	return p.get(snapshotBytes)
+}
+
+// mean returns the metric holding nanoseconds over the metric counting them.
+func (p *Metrics) mean(nanos, count metricType) time.Duration {
+	n := p.get(count)
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(p.get(nanos) / n)
+}
+
 // Ratio is the number of Hits over all accesses (Hits + Misses). This is the
 // percentage of successful Get calls.
 func (p *Metrics) Ratio() float64 {
@@ -684,6 +2696,26 @@ func (p *Metrics) trackEviction(numSeconds int64) {
 	p.life.Update(numSeconds)
 }
 
+// trackKey records the key requested, for DistinctKeys.
+func (p *Metrics) trackKey(hash uint64) {
+	if p == nil {
+		return
+	}
+	p.keys.Add(hash)
+}
+
+// DistinctKeys is the estimated number of distinct keys requested with Get and
+// its variants, whether they were found or not, within about 1%. Compared to
+// the number of items the cache holds, it tells how much of the key space the
+// cache covers, and so how to size NumCounters, which should be about 10 times
+// the number of keys that are worth keeping track of.
+func (p *Metrics) DistinctKeys() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.keys.Count()
+}
+
 func (p *Metrics) LifeExpectancySeconds() *z.HistogramData {
 	if p == nil {
 		return nil
@@ -693,6 +2725,19 @@ func (p *Metrics) LifeExpectancySeconds() *z.HistogramData {
 	return p.life.Copy()
 }
 
+// memoryUsage estimates the memory taken by the metrics in bytes.
+func (p *Metrics) memoryUsage() uint64 {
+	if p == nil {
+		return 0
+	}
+	// Each counter takes a pointer and the value it points to.
+	var usage uint64
+	for i := range p.all {
+		usage += uint64(len(p.all[i])) * 16
+	}
+	return usage + 4<<distinctKeysPrecision
+}
+
 // Clear resets all the metrics.
 func (p *Metrics) Clear() {
 	if p == nil {
@@ -706,6 +2751,32 @@ func (p *Metrics) Clear() {
 	p.mu.Lock()
 	p.life = z.NewHistogramData(z.HistogramBounds(1, 16))
 	p.mu.Unlock()
+	p.keys.Clear()
+}
+
+// ResetAndSnapshot resets all the metrics, like Clear, and returns Metrics
+// holding their values before the reset. Each counter is moved atomically, so
+// an event recorded concurrently is counted either by the snapshot or by the
+// metrics after the reset, never both nor neither. This is what reporting the
+// metrics per interval needs, where reading them and then calling Clear would
+// lose the events recorded in between.
+func (p *Metrics) ResetAndSnapshot() *Metrics {
+	if p == nil {
+		return nil
+	}
+	snap := &Metrics{keys: p.keys.Reset()}
+	for i := 0; i < doNotUse; i++ {
+		snap.all[i] = make([]*uint64, len(p.all[i]))
+		for j := range p.all[i] {
+			v := atomic.SwapUint64(p.all[i][j], 0)
+			snap.all[i][j] = &v
+		}
+	}
+	p.mu.Lock()
+	snap.life = p.life
+	p.life = z.NewHistogramData(z.HistogramBounds(1, 16))
+	p.mu.Unlock()
+	return snap
 }
 
 // String returns a string representation of the metrics.
@@ -719,6 +2790,8 @@ func (p *Metrics) String() string {
 		fmt.Fprintf(&buf, "%s: %d ", stringFor(t), p.get(t))
 	}
 	fmt.Fprintf(&buf, "gets-total: %d ", p.get(hit)+p.get(miss))
-	fmt.Fprintf(&buf, "hit-ratio: %.2f", p.Ratio())
+	fmt.Fprintf(&buf, "distinct-keys: %d ", p.DistinctKeys())
+	fmt.Fprintf(&buf, "hit-ratio: %.2f ", p.Ratio())
+	fmt.Fprintf(&buf, "gets-dropped-ratio: %.2f", p.GetsDroppedRatio())
 	return buf.String()
 }
@@ -1,12 +1,15 @@
 package ristretto
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"runtime"
+	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,6 +42,201 @@ func TestCacheKeyToHash(t *testing.T) {
 	require.Equal(t, 3, keyToHashCount)
 }
 
+func TestCacheHasher(t *testing.T) {
+	type key struct {
+		tenant string
+		id     uint64
+	}
+	c, err := NewCache(&Config[key, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Hasher: HasherFunc[key](func(k key) (uint64, uint64) {
+			var d z.KeyDigest
+			d.String(k.tenant)
+			d.Uint64(k.id)
+			return d.Sum()
+		}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(key{"a", 1}, 1, 1))
+	require.True(t, c.Set(key{"b", 1}, 2, 1))
+	c.Wait()
+	val, ok := c.Get(key{"a", 1})
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	val, ok = c.Get(key{"b", 1})
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	_, ok = c.Get(key{"a", 2})
+	require.False(t, ok)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		KeyToHash:   z.KeyToHash[int],
+		Hasher:      HasherFunc[int](z.KeyToHash[int]),
+	})
+	require.Error(t, err)
+}
+
+// collidingHasher gives every key the same hash and 64-bit conflict hash.
+type collidingHasher struct{}
+
+func (collidingHasher) Hash(string) (uint64, uint64) { return 1, 1 }
+
+func (collidingHasher) ConflictHi(key string) uint64 { return z.KeyToConflictHi(key) }
+
+func TestCacheWideConflict(t *testing.T) {
+	newCache := func(wide bool) *Cache[string, int] {
+		c, err := NewCache(&Config[string, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Hasher:             collidingHasher{},
+			WideConflict:       wide,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	c := newCache(false)
+	require.True(t, c.Set("a", 1, 1))
+	c.Wait()
+	val, ok := c.Get("b")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	c.Close()
+
+	c = newCache(true)
+	defer c.Close()
+	require.True(t, c.Set("a", 1, 1))
+	c.Wait()
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	_, ok = c.GetTTL("b")
+	require.False(t, ok)
+
+	// The other key doesn't replace the value.
+	c.Set("b", 2, 1)
+	c.Wait()
+	val, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+
+	_, err := NewCache(&Config[string, int]{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		KeyToHash:    z.KeyToHash[string],
+		WideConflict: true,
+	})
+	require.Error(t, err)
+	_, err = NewCache(&Config[string, int]{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		Hasher:       HasherFunc[string](z.KeyToHash[string]),
+		WideConflict: true,
+	})
+	require.Error(t, err)
+
+	c2, err := NewCache(&Config[string, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		WideConflict:       true,
+	})
+	require.NoError(t, err)
+	defer c2.Close()
+	require.True(t, c2.Set("a", 1, 1))
+	c2.Wait()
+	val, ok = c2.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheSipHash(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		SipHash:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	keyHash, conflict := c.keyToHash(1)
+	require.NotEqual(t, uint64(1), keyHash)
+	require.Equal(t, uint64(1), conflict)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		KeyToHash:   z.KeyToHash[int],
+		SipHash:     true,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheHashSeed(t *testing.T) {
+	newCache := func(seed uint64, random bool) *Cache[string, int] {
+		c, err := NewCache(&Config[string, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			HashSeed:           seed,
+			RandomHashSeed:     random,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	c1, c2 := newCache(0, true), newCache(0, true)
+	defer c1.Close()
+	defer c2.Close()
+	require.NotZero(t, c1.HashSeed())
+	require.NotEqual(t, c1.HashSeed(), c2.HashSeed())
+	h1, conflict1 := c1.keyToHash("a")
+	h2, conflict2 := c2.keyToHash("a")
+	require.NotEqual(t, h1, h2)
+	require.Equal(t, conflict1, conflict2)
+
+	require.True(t, c1.Set("a", 1, 1))
+	c1.Wait()
+	val, ok := c1.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	// A cache with the same seed hashes the keys the same way.
+	c3 := newCache(c1.HashSeed(), false)
+	defer c3.Close()
+	h3, _ := c3.keyToHash("a")
+	require.Equal(t, h1, h3)
+
+	_, err := NewCache(&Config[string, int]{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    64,
+		HashSeed:       1,
+		RandomHashSeed: true,
+	})
+	require.Error(t, err)
+}
+
 func TestCacheMaxCost(t *testing.T) {
 	charset := "abcdefghijklmnopqrstuvwxyz0123456789"
 	key := func() []byte {
@@ -116,115 +314,189 @@ func TestUpdateMaxCost(t *testing.T) {
 	c.Del(1)
 }
 
-func TestNewCache(t *testing.T) {
-	_, err := NewCache(&Config[int, int]{
-		NumCounters: 0,
+func TestCacheCostUsed(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
 	})
-	require.Error(t, err)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), c.CostUsed())
 
-	_, err = NewCache(&Config[int, int]{
-		NumCounters: 100,
-		MaxCost:     0,
-	})
-	require.Error(t, err)
+	retrySet(t, c, 1, 1, 3, 0)
+	retrySet(t, c, 2, 2, 4, 0)
+	require.Equal(t, int64(7), c.CostUsed())
+	require.Equal(t, int64(10), c.MaxCost())
 
-	_, err = NewCache(&Config[int, int]{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 0,
-	})
-	require.Error(t, err)
+	c.Del(1)
+	c.Wait()
+	require.Equal(t, int64(4), c.CostUsed())
+
+	c.Clear()
+	require.Equal(t, int64(0), c.CostUsed())
+
+	c = nil
+	require.Equal(t, int64(0), c.CostUsed())
+}
 
+func TestCacheUpdateCost(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 64,
-		Metrics:     true,
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
 	})
 	require.NoError(t, err)
-	require.NotNil(t, c)
-}
+	defer c.Close()
 
-func TestNilCache(t *testing.T) {
-	var c *Cache[int, int]
+	retrySet(t, c, 1, 1, 2, 0)
+	require.True(t, c.UpdateCost(1, 5))
+	c.Wait()
+	require.Equal(t, int64(5), c.policy.Cost(1))
+	require.Equal(t, int64(5), c.CostUsed())
 	val, ok := c.Get(1)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
 
-	require.False(t, c.Set(1, 1, 1))
-	c.Del(1)
-	c.Clear()
-	c.Close()
+	require.False(t, c.UpdateCost(1, 0))
+	require.False(t, c.UpdateCost(2, 1))
 }
 
-func TestMultipleClose(t *testing.T) {
-	var c *Cache[int, int]
-	c.Close()
-
-	var err error
-	c, err = NewCache(&Config[int, int]{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 64,
-		Metrics:     true,
+func TestCacheUpdateCostDropped(t *testing.T) {
+	c, err := NewCache(&Config[int, string]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value string) int64 {
+			return int64(len(value))
+		},
 	})
 	require.NoError(t, err)
-	c.Close()
-	c.Close()
-}
 
-func TestSetAfterClose(t *testing.T) {
-	c, err := newTestCache()
-	require.NoError(t, err)
-	require.NotNil(t, c)
+	require.True(t, c.Set(1, "a", 0))
+	c.Wait()
+	require.Equal(t, int64(1), c.policy.Cost(1))
 
-	c.Close()
-	require.False(t, c.Set(1, 1, 1))
+	// Fill up setBuf so the update can't be sent through it.
+	c.stop <- struct{}{}
+	for i := 0; i < setBufSize; i++ {
+		c.setBuf <- Item[string]{flag: itemDelete, Key: 2}
+	}
+	require.True(t, c.Set(1, "abc", 0))
+	require.Equal(t, int64(3), c.policy.Cost(1))
+	require.True(t, c.ApplyBatch([]Op[int, string]{{Key: 1, Value: "abcde"}}))
+	require.Equal(t, int64(5), c.policy.Cost(1))
+	close(c.setBuf)
+	close(c.stop)
 }
 
-func TestClearAfterClose(t *testing.T) {
-	c, err := newTestCache()
+func TestCacheWatermarks(t *testing.T) {
+	var evicted int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		HighWatermark:      0.9,
+		LowWatermark:       0.5,
+		OnEvict:            func(Item[int]) { atomic.AddInt64(&evicted, 1) },
+	})
 	require.NoError(t, err)
-	require.NotNil(t, c)
+	defer c.Close()
 
-	c.Close()
-	c.Clear()
+	for i := 0; i < 90; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+	require.Equal(t, int64(90), c.policy.Used())
+	require.Zero(t, atomic.LoadInt64(&evicted))
+
+	// Going past the high watermark drains the cache to the low one.
+	require.True(t, c.Set(90, 90, 1))
+	c.Wait()
+	require.Equal(t, int64(50), c.policy.Used())
+	require.Equal(t, int64(41), atomic.LoadInt64(&evicted))
+	require.Equal(t, 50, c.policy.Len())
 }
 
-func TestGetAfterClose(t *testing.T) {
-	c, err := newTestCache()
+func TestCacheHeadroom(t *testing.T) {
+	var evicted int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		HeadroomTarget:     0.5,
+		OnEvict:            func(Item[int]) { atomic.AddInt64(&evicted, 1) },
+	})
 	require.NoError(t, err)
-	require.NotNil(t, c)
-
-	require.True(t, c.Set(1, 1, 1))
-	c.Close()
+	defer c.Close()
 
-	_, ok := c.Get(1)
-	require.False(t, ok)
+	for i := 0; i < 90; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	// The items over the target are evicted in the background, a batch at a
+	// time.
+	require.Eventually(t, func() bool {
+		return c.policy.Used() == 50
+	}, time.Second, headroomInterval)
+	time.Sleep(5 * headroomInterval)
+	require.Equal(t, int64(50), c.policy.Used())
+	require.Equal(t, int64(40), atomic.LoadInt64(&evicted))
 }
 
-func TestDelAfterClose(t *testing.T) {
-	c, err := newTestCache()
+func TestCacheMaxItemCost(t *testing.T) {
+	var reasons []RejectReason
+	c, err := NewCache(&Config[int, string]{
+		NumCounters:        100,
+		MaxCost:            100,
+		MaxItemCost:        10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Cost: func(value string) int64 {
+			return int64(len(value))
+		},
+		OnReject: func(item Item[string]) {
+			reasons = append(reasons, item.RejectReason)
+		},
+	})
 	require.NoError(t, err)
-	require.NotNil(t, c)
+	defer c.Close()
 
-	require.True(t, c.Set(1, 1, 1))
-	c.Close()
+	// Rejected right away.
+	require.False(t, c.Set(1, "a", 11))
+	// Rejected once the cost is calculated.
+	require.True(t, c.Set(2, strings.Repeat("a", 11), 0))
+	c.Wait()
+	_, ok := c.Get(2)
+	require.False(t, ok)
 
-	c.Del(1)
+	// Rejected when updated to a value that's too big.
+	require.True(t, c.Set(3, "a", 0))
+	c.Wait()
+	_, ok = c.Get(3)
+	require.True(t, ok)
+	require.True(t, c.Set(3, strings.Repeat("a", 11), 0))
+	c.Wait()
+	_, ok = c.Get(3)
+	require.False(t, ok)
+	require.False(t, c.policy.Has(3))
+
+	require.Equal(t, uint64(3), c.Metrics.SetsRejectedTooBig())
+	require.Equal(t, []RejectReason{RejectTooBig, RejectTooBig, RejectTooBig}, reasons)
 }
 
-func TestCacheProcessItems(t *testing.T) {
+func TestCacheReserve(t *testing.T) {
 	m := &sync.Mutex{}
 	evicted := make(map[uint64]struct{})
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
-		BufferItems:        64,
 		IgnoreInternalCost: true,
-		Cost: func(value int) int64 {
-			return int64(value)
-		},
+		BufferItems:        64,
 		OnEvict: func(item Item[int]) {
 			m.Lock()
 			defer m.Unlock()
@@ -232,367 +504,1888 @@ func TestCacheProcessItems(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	var key uint64
-	var conflict uint64
-
-	key, conflict = z.KeyToHash(1)
-	c.setBuf <- Item[int]{
-		flag:     itemNew,
-		Key:      key,
-		Conflict: conflict,
-		Value:    1,
-		Cost:     0,
+	for i := 0; i < 5; i++ {
+		retrySet(t, c, i, i, 2, 0)
 	}
-	time.Sleep(wait)
-	require.True(t, c.policy.Has(1))
-	require.Equal(t, int64(1), c.policy.Cost(1))
+	require.Equal(t, int64(10), c.CostUsed())
 
-	key, conflict = z.KeyToHash(1)
-	c.setBuf <- Item[int]{
-		flag:     itemUpdate,
-		Key:      key,
-		Conflict: conflict,
-		Value:    2,
-		Cost:     0,
-	}
-	time.Sleep(wait)
-	require.Equal(t, int64(2), c.policy.Cost(1))
+	require.False(t, c.Reserve(11))
+	require.True(t, c.Reserve(3))
+	c.Wait()
+	require.Equal(t, int64(9), c.CostUsed())
+	m.Lock()
+	require.Equal(t, 2, len(evicted))
+	m.Unlock()
 
-	key, conflict = z.KeyToHash(1)
-	c.setBuf <- Item[int]{
-		flag:     itemDelete,
-		Key:      key,
-		Conflict: conflict,
+	// Reserved cost survives a clear and is given back by Release.
+	c.Clear()
+	require.Equal(t, int64(3), c.CostUsed())
+	require.False(t, c.Reserve(8))
+	c.Release(3)
+	require.Equal(t, int64(0), c.CostUsed())
+	c.Release(3)
+	require.Equal(t, int64(0), c.CostUsed())
+}
+
+func TestCacheTopKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        1,
+		KeyToHash: func(key int) (uint64, uint64) {
+			return uint64(key), 0
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	retrySet(t, c, 2, 2, 2, 0)
+	for i := 0; i < 10; i++ {
+		c.Get(2)
 	}
 	time.Sleep(wait)
-	key, conflict = z.KeyToHash(1)
-	val, ok := c.store.Get(key, conflict)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
-	require.False(t, c.policy.Has(1))
 
-	key, conflict = z.KeyToHash(2)
-	c.setBuf <- Item[int]{
-		flag:     itemNew,
-		Key:      key,
-		Conflict: conflict,
-		Value:    2,
-		Cost:     3,
+	top := c.TopKeys(1)
+	require.Equal(t, []KeyFrequency{{Key: 2, Frequency: top[0].Frequency, Cost: 2}}, top)
+	require.Greater(t, top[0].Frequency, int64(1))
+}
+
+func TestCacheEstimateFrequency(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 1,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, int64(0), c.EstimateFrequency(1))
+	// Gets are counted even for keys that aren't in the cache.
+	for i := 0; i < 10; i++ {
+		c.Get(1)
 	}
-	key, conflict = z.KeyToHash(3)
-	c.setBuf <- Item[int]{
-		flag:     itemNew,
-		Key:      key,
-		Conflict: conflict,
-		Value:    3,
-		Cost:     3,
+	time.Sleep(wait)
+	require.Greater(t, c.EstimateFrequency(1), int64(1))
+	require.Equal(t, int64(0), c.EstimateFrequency(2))
+
+	var nilCache *Cache[int, int]
+	require.Equal(t, int64(0), nilCache.EstimateFrequency(1))
+}
+
+func TestCacheExplainSet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, SetAdmitted, c.ExplainSet(1, 1).Outcome)
+	retrySet(t, c, 1, 1, 1, 0)
+	require.Equal(t, SetUpdated, c.ExplainSet(1, 1).Outcome)
+	exp := c.ExplainSet(2, 11)
+	require.Equal(t, SetRejected, exp.Outcome)
+	require.Equal(t, int64(11), exp.Cost)
+
+	c.Close()
+	require.Equal(t, SetDropped, c.ExplainSet(2, 1).Outcome)
+}
+
+func TestCacheSample(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Empty(t, c.Sample(5))
+	for i := 0; i < 500; i++ {
+		c.SetWithTTL(i, i, 1, time.Minute)
 	}
-	key, conflict = z.KeyToHash(4)
-	c.setBuf <- Item[int]{
-		flag:     itemNew,
-		Key:      key,
-		Conflict: conflict,
-		Value:    3,
-		Cost:     3,
+	c.Wait()
+
+	items := c.Sample(10)
+	require.Equal(t, 10, len(items))
+	seen := make(map[uint64]struct{})
+	for _, item := range items {
+		_, dup := seen[item.Key]
+		require.False(t, dup)
+		seen[item.Key] = struct{}{}
+		require.Equal(t, int64(1), item.Cost)
+		require.False(t, item.Expiration.IsZero())
+		val, ok := c.Get(item.Value)
+		require.True(t, ok)
+		require.Equal(t, item.Value, val)
 	}
-	key, conflict = z.KeyToHash(5)
-	c.setBuf <- Item[int]{
-		flag:     itemNew,
-		Key:      key,
-		Conflict: conflict,
-		Value:    3,
-		Cost:     5,
+}
+
+func TestNewCache(t *testing.T) {
+	_, err := NewCache(&Config[int, int]{
+		NumCounters: 0,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     0,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 0,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		MaxCleanupItems: -1,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    64,
+		CleanupWorkers: -1,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		MaxTTL:      -time.Second,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		DefaultTTL:  -time.Second,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:         100,
+		MaxCost:             10,
+		BufferItems:         64,
+		BufferFlushInterval: -time.Second,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxItems:    -1,
+		BufferItems: 64,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxItemCost: -1,
+		BufferItems: 64,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		HighWatermark: 1.5,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		HighWatermark: 0.8,
+		LowWatermark:  0.9,
+	})
+	require.Error(t, err)
+
+	_, err = NewCache(&Config[int, int]{
+		NumCounters:    100,
+		MaxCost:        10,
+		BufferItems:    64,
+		HeadroomTarget: -0.5,
+	})
+	require.Error(t, err)
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, c)
+}
+
+func TestCacheWorkerLabels(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		Name:        "labeled",
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	// Give the goroutines time to start and set their labels.
+	time.Sleep(wait)
+
+	var buf strings.Builder
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	profile := buf.String()
+	require.Contains(t, profile, `"ristretto_cache":"labeled"`)
+	require.Contains(t, profile, `"ristretto_worker":"processItems"`)
+	require.Contains(t, profile, `"ristretto_worker":"policy"`)
+}
+
+func TestCacheTrace(t *testing.T) {
+	m := &sync.Mutex{}
+	started := make(map[TraceOp]int)
+	ended := make(map[TraceOp]int)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Trace: func(op TraceOp) func() {
+			m.Lock()
+			defer m.Unlock()
+			started[op]++
+			return func() {
+				m.Lock()
+				defer m.Unlock()
+				ended[op]++
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	for i := 0; i < 10; i++ {
+		c.Get(2)
 	}
 	time.Sleep(wait)
+	// Key 2 is more frequent than key 1, so key 1 gets evicted.
+	retrySet(t, c, 2, 2, 1, 0)
+	c.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+	require.Equal(t, 1, started[TraceWait])
+	require.Equal(t, 1, ended[TraceWait])
+	require.Equal(t, 1, started[TraceEvict])
+	require.Equal(t, 1, ended[TraceEvict])
+}
+
+func TestCacheGetFresh(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		TrackWrites:        true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	val, ok := c.GetFresh(1, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	// Any write is older than a max age of zero.
+	_, ok = c.GetFresh(1, 0)
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+
+	_, ok = c.GetFresh(2, time.Hour)
+	require.False(t, ok)
+
+	// Without Config.TrackWrites, the write times aren't known.
+	c, err = NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	retrySet(t, c, 1, 1, 1, 0)
+	_, ok = c.GetFresh(1, 0)
+	require.True(t, ok)
+}
+
+func TestCacheGetWithInfo(t *testing.T) {
+	for _, track := range []bool{false, true} {
+		c, err := NewCache(&Config[int, int]{
+			NumCounters:        100,
+			MaxCost:            10,
+			IgnoreInternalCost: true,
+			BufferItems:        64,
+			TrackAccess:        track,
+			TrackVersions:      true,
+			TrackWrites:        true,
+		})
+		require.NoError(t, err)
+
+		now := time.Now()
+		ok, err := c.SetAndWait(1, 1, 1)
+		require.NoError(t, err)
+		require.True(t, ok)
+		val, info, ok := c.GetWithInfo(1)
+		require.True(t, ok)
+		require.Equal(t, 1, val)
+		require.WithinDuration(t, now, info.Created, 2*time.Second)
+		require.Equal(t, info.Created, info.Written)
+		require.True(t, info.Expiration.IsZero())
+		require.Zero(t, info.TTL)
+		require.Equal(t, int64(1), info.Cost)
+		require.Equal(t, c.EstimateFrequency(1), info.Frequency)
+		require.NotZero(t, info.Version)
+		// It wasn't read before.
+		require.True(t, info.Accessed.IsZero())
+
+		_, info, _ = c.GetWithInfo(1)
+		if track {
+			require.WithinDuration(t, now, info.Accessed, 2*time.Second)
+		} else {
+			require.True(t, info.Accessed.IsZero())
+		}
+
+		// Updates keep the access time.
+		ok, err = c.SetAndWait(1, 2, 1)
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, updated, _ := c.GetWithInfo(1)
+		require.Equal(t, info.Accessed, updated.Accessed)
+		require.Equal(t, info.Created, updated.Created)
+
+		_, info, ok = c.GetWithInfo(2)
+		require.False(t, ok)
+		require.Equal(t, EntryInfo{}, info)
+
+		retrySet(t, c, 3, 3, 2, time.Hour)
+		_, info, ok = c.GetWithInfo(3)
+		require.True(t, ok)
+		require.Equal(t, int64(2), info.Cost)
+		require.InDelta(t, time.Hour, info.TTL, float64(time.Second))
+		require.WithinDuration(t, time.Now().Add(time.Hour), info.Expiration, time.Second)
+		c.Close()
+	}
+}
+
+func TestCacheGetStale(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, 1, 1, 50*time.Millisecond))
+	c.Wait()
+	val, stale, ok := c.GetStale(1)
+	require.True(t, ok)
+	require.False(t, stale)
+	require.Equal(t, 1, val)
+
+	time.Sleep(100 * time.Millisecond)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	// The cleanup hasn't removed the item yet.
+	val, stale, ok = c.GetStale(1)
+	require.True(t, ok)
+	require.True(t, stale)
+	require.Equal(t, 1, val)
+	require.Equal(t, uint64(1), c.Metrics.Hits())
+	require.Equal(t, uint64(2), c.Metrics.Misses())
+
+	_, _, ok = c.GetStale(2)
+	require.False(t, ok)
+}
+
+func TestCacheTombstone(t *testing.T) {
+	var rejected int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TombstoneTTL:       50 * time.Millisecond,
+		OnReject: func(item Item[int]) {
+			if item.RejectReason == RejectTombstone {
+				atomic.AddInt64(&rejected, 1)
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	c.Del(1)
+	require.False(t, c.Set(1, 2, 1))
+	_, ok := c.Modify(1, func(int, bool) (int, int64, bool) { return 3, 1, true })
+	require.False(t, ok)
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, int64(1), atomic.LoadInt64(&rejected))
+
+	// Other keys aren't affected.
+	retrySet(t, c, 2, 2, 1, 0)
+
+	time.Sleep(60 * time.Millisecond)
+	retrySet(t, c, 1, 4, 1, 0)
+}
+
+func TestCacheWaitContext(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.NoError(t, c.WaitContext(context.Background()))
+	_, ok := c.Get(1)
+	require.True(t, ok)
+
+	// Stop processItems so the Set buffer isn't drained.
+	c.stop <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, c.WaitContext(ctx))
+	c.goWorker("processItems", c.processItems)
+}
+
+func TestCacheWaitContextCleared(t *testing.T) {
+	release := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict:            func(Item[int]) { <-release },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	c.Clear()
+	// The cleared item isn't reported until release is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, c.WaitContext(ctx))
+	close(release)
+	require.NoError(t, c.WaitContext(context.Background()))
+}
+
+func TestCacheClearContext(t *testing.T) {
+	var evicted, exited int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict:            func(Item[int]) { atomic.AddInt64(&evicted, 1) },
+		OnExit:             func(int) { atomic.AddInt64(&exited, 1) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, c.ClearContext(ctx))
+	require.Equal(t, int64(0), atomic.LoadInt64(&evicted))
+	require.Equal(t, int64(5), atomic.LoadInt64(&exited))
+	for i := 0; i < 5; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+}
+
+func TestCacheClearContextRate(t *testing.T) {
+	var evicted, exited int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict:            func(Item[int]) { atomic.AddInt64(&evicted, 1) },
+		OnExit:             func(int) { atomic.AddInt64(&exited, 1) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+	start := time.Now()
+	require.NoError(t, c.ClearContextRate(context.Background(), 50))
+	require.True(t, time.Since(start) >= 80*time.Millisecond)
+	require.Equal(t, int64(5), atomic.LoadInt64(&evicted))
+	require.Equal(t, int64(5), atomic.LoadInt64(&exited))
+
+	// Once ctx is done, the remaining items are no longer delayed nor evicted.
+	for i := 0; i < 5; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	require.Equal(t, context.DeadlineExceeded, c.ClearContextRate(ctx, 10))
+	require.True(t, time.Since(start) < time.Second)
+	require.Equal(t, int64(6), atomic.LoadInt64(&evicted))
+	require.Equal(t, int64(10), atomic.LoadInt64(&exited))
+	for i := 0; i < 5; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+}
+
+func TestCacheClearBackground(t *testing.T) {
+	var evicted int64
+	unblock := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(Item[int]) {
+			<-unblock
+			atomic.AddInt64(&evicted, 1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+	// Clear returns while the cleared items are still being reported, and the
+	// cache can be used in the meantime.
+	c.Clear()
+	for i := 0; i < 5; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok)
+	}
+	retrySet(t, c, 1, 1, 1, 0)
+	require.Equal(t, int64(0), atomic.LoadInt64(&evicted))
+
+	close(unblock)
+	c.Wait()
+	require.Equal(t, int64(5), atomic.LoadInt64(&evicted))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheSetAndWait(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		IgnoreInternalCost: true,
+		// Get counter increments aren't lost in a stripe dropped by the pool.
+		BufferItems: 1,
+		MaxItemCost: 1,
+	})
+	require.NoError(t, err)
+
+	admitted, err := c.SetAndWait(1, 1, 1)
+	require.NoError(t, err)
+	require.True(t, admitted)
+
+	for i := 0; i < 10; i++ {
+		c.Get(1)
+	}
+	time.Sleep(wait)
+	// Key 1 is more frequent than key 2, so key 2 is rejected.
+	admitted, err = c.SetAndWait(2, 2, 1)
+	require.NoError(t, err)
+	require.False(t, admitted)
+
+	admitted, err = c.SetAndWait(3, 3, 2)
+	require.NoError(t, err)
+	require.False(t, admitted)
+
+	// Values discarded before reaching the policy aren't dropped.
+	c.SetBypass(true)
+	admitted, err = c.SetAndWait(4, 4, 1)
+	require.NoError(t, err)
+	require.False(t, admitted)
+	c.SetBypass(false)
+	c.Pause()
+	admitted, err = c.SetAndWait(4, 4, 1)
+	require.NoError(t, err)
+	require.False(t, admitted)
+	c.Resume()
+
+	c.Close()
+	_, err = c.SetAndWait(1, 1, 1)
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestCacheOnEvictInfo(t *testing.T) {
+	m := &sync.Mutex{}
+	var infos []EvictInfo
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TrackWrites:        true,
+		OnEvictInfo: func(info EvictInfo) {
+			m.Lock()
+			defer m.Unlock()
+			infos = append(infos, info)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, time.Hour)
+	for i := 0; i < 10; i++ {
+		c.Get(2)
+	}
+	time.Sleep(wait)
+	// Key 2 is more frequent than key 1, so key 1 gets evicted.
+	retrySet(t, c, 2, 2, 1, 0)
+	c.Clear()
+	c.Wait()
+
+	key1, conflict1 := z.KeyToHash(1)
+	key2, conflict2 := z.KeyToHash(2)
+	m.Lock()
+	defer m.Unlock()
+	require.Len(t, infos, 2)
+	require.Equal(t, key1, infos[0].Key)
+	require.Equal(t, conflict1, infos[0].Conflict)
+	require.Equal(t, int64(1), infos[0].Cost)
+	require.Equal(t, EvictPolicy, infos[0].Reason)
+	require.InDelta(t, time.Hour, infos[0].TTL, float64(time.Second))
+	require.True(t, infos[0].Age > 0 && infos[0].Age < 2*time.Second)
+
+	require.Equal(t, key2, infos[1].Key)
+	require.Equal(t, conflict2, infos[1].Conflict)
+	require.Equal(t, EvictCleared, infos[1].Reason)
+	require.Zero(t, infos[1].TTL)
+}
+
+func TestCacheListeners(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var first, second int64
+	id := c.AddListener(func(Item[int]) { atomic.AddInt64(&first, 1) })
+	c.AddListener(func(Item[int]) { atomic.AddInt64(&second, 1) })
+
+	retrySet(t, c, 1, 1, 1, 0)
+	c.Clear()
+	c.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&first))
+	require.Equal(t, int64(1), atomic.LoadInt64(&second))
+
+	require.True(t, c.RemoveListener(id))
+	require.False(t, c.RemoveListener(id))
+	retrySet(t, c, 1, 1, 1, 0)
+	c.Clear()
+	c.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&first))
+	require.Equal(t, int64(2), atomic.LoadInt64(&second))
+}
+
+type testLogger struct {
+	sync.Mutex
+	warnings []string
+}
+
+func (l *testLogger) Warningf(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestCacheLogger(t *testing.T) {
+	logger := &testLogger{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Logger:      logger,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	atomic.AddUint64(&c.droppedSets, droppedSetsWarnThreshold+1)
+	time.Sleep(cleanupInterval() + 100*time.Millisecond)
+
+	logger.Lock()
+	defer logger.Unlock()
+	require.Equal(t, 1, len(logger.warnings))
+	require.Contains(t, logger.warnings[0], "1001 Sets were dropped")
+	require.Zero(t, atomic.LoadUint64(&c.droppedSets))
+}
+
+func TestCacheOnWarning(t *testing.T) {
+	var warnings []Warning
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        2,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		OnWarning: func(w Warning) {
+			warnings = append(warnings, w)
+		},
+	})
+	require.NoError(t, err)
+	defer c.policy.Close()
+	for i := 0; i < 3; i++ {
+		retrySet(t, c, i, i, 1, 0)
+	}
+
+	// Stop processItems, which calls checkHealth itself.
+	c.stop <- struct{}{}
+	var saturated bool
+	c.checkHealth(0, 0, 0, &saturated)
+	c.checkHealth(0, 0, 0, &saturated)
+	require.True(t, saturated)
+	c.checkHealth(time.Hour, 2, 1, &saturated)
+	require.Equal(t, []WarningKind{WarnSketchSaturated, WarnCleanupOverrun,
+		WarnExpiredBacklog}, warningKinds(warnings))
+}
+
+func warningKinds(warnings []Warning) []WarningKind {
+	kinds := make([]WarningKind, len(warnings))
+	for i, w := range warnings {
+		kinds[i] = w.Kind
+	}
+	return kinds
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache[int, int]
+	val, ok := c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	require.False(t, c.Set(1, 1, 1))
+	c.Del(1)
+	c.Clear()
+	c.Close()
+}
+
+func TestMultipleClose(t *testing.T) {
+	var c *Cache[int, int]
+	c.Close()
+
+	var err error
+	c, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	c.Close()
+	c.Close()
+}
+
+func TestSetAfterClose(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	c.Close()
+	require.False(t, c.Set(1, 1, 1))
+}
+
+func TestClearAfterClose(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	c.Close()
+	c.Clear()
+}
+
+func TestGetAfterClose(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Close()
+
+	_, ok := c.Get(1)
+	require.False(t, ok)
+}
+
+func TestDelAfterClose(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Close()
+
+	c.Del(1)
+}
+
+func TestCacheProcessItems(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value int) int64 {
+			return int64(value)
+		},
+		OnEvict: func(item Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			evicted[item.Key] = struct{}{}
+		},
+	})
+	require.NoError(t, err)
+
+	var key uint64
+	var conflict uint64
+
+	key, conflict = z.KeyToHash(1)
+	c.setBuf <- Item[int]{
+		flag:     itemNew,
+		Key:      key,
+		Conflict: conflict,
+		Value:    1,
+		Cost:     0,
+	}
+	time.Sleep(wait)
+	require.True(t, c.policy.Has(1))
+	require.Equal(t, int64(1), c.policy.Cost(1))
+
+	key, conflict = z.KeyToHash(1)
+	c.setBuf <- Item[int]{
+		flag:     itemUpdate,
+		Key:      key,
+		Conflict: conflict,
+		Value:    2,
+		Cost:     0,
+	}
+	time.Sleep(wait)
+	require.Equal(t, int64(2), c.policy.Cost(1))
+
+	key, conflict = z.KeyToHash(1)
+	c.setBuf <- Item[int]{
+		flag:     itemDelete,
+		Key:      key,
+		Conflict: conflict,
+	}
+	time.Sleep(wait)
+	key, conflict = z.KeyToHash(1)
+	val, ok := c.store.Get(key, conflict)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+	require.False(t, c.policy.Has(1))
+
+	key, conflict = z.KeyToHash(2)
+	c.setBuf <- Item[int]{
+		flag:     itemNew,
+		Key:      key,
+		Conflict: conflict,
+		Value:    2,
+		Cost:     3,
+	}
+	key, conflict = z.KeyToHash(3)
+	c.setBuf <- Item[int]{
+		flag:     itemNew,
+		Key:      key,
+		Conflict: conflict,
+		Value:    3,
+		Cost:     3,
+	}
+	key, conflict = z.KeyToHash(4)
+	c.setBuf <- Item[int]{
+		flag:     itemNew,
+		Key:      key,
+		Conflict: conflict,
+		Value:    3,
+		Cost:     3,
+	}
+	key, conflict = z.KeyToHash(5)
+	c.setBuf <- Item[int]{
+		flag:     itemNew,
+		Key:      key,
+		Conflict: conflict,
+		Value:    3,
+		Cost:     5,
+	}
+	time.Sleep(wait)
+	m.Lock()
+	require.NotEqual(t, 0, len(evicted))
+	m.Unlock()
+
+	defer func() {
+		require.NotNil(t, recover())
+	}()
+	c.Close()
+	c.setBuf <- Item[int]{flag: itemNew}
+}
+
+func TestCacheGet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	key, conflict := z.KeyToHash(1)
+	i := Item[int]{
+		Key:      key,
+		Conflict: conflict,
+		Value:    1,
+	}
+	c.store.Set(i)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+
+	val, ok = c.Get(2)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	// 0.5 and not 1.0 because we tried Getting each item twice
+	require.Equal(t, 0.5, c.Metrics.Ratio())
+
+	c = nil
+	val, ok = c.Get(0)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+}
+
+// retrySet calls SetWithTTL until the item is accepted by the cache.
+func retrySet(t *testing.T, c *Cache[int, int], key, value int, cost int64, ttl time.Duration) {
+	for {
+		if set := c.SetWithTTL(key, value, cost, ttl); !set {
+			time.Sleep(wait)
+			continue
+		}
+
+		time.Sleep(wait)
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.NotNil(t, val)
+		require.Equal(t, value, val)
+		return
+	}
+}
+
+func TestCacheSet(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, 0)
+
+	c.Set(1, 2, 2)
+	val, ok := c.store.Get(z.KeyToHash(1))
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	c.stop <- struct{}{}
+	for i := 0; i < setBufSize; i++ {
+		key, conflict := z.KeyToHash(1)
+		c.setBuf <- Item[int]{
+			flag:     itemUpdate,
+			Key:      key,
+			Conflict: conflict,
+			Value:    1,
+			Cost:     1,
+		}
+	}
+	require.False(t, c.Set(2, 2, 1))
+	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+	close(c.setBuf)
+	close(c.stop)
+
+	c = nil
+	require.False(t, c.Set(1, 1, 1))
+}
+
+type customKey struct {
+	a int64
+	b int64
+}
+
+func BenchmarkCacheSet(b *testing.B) {
+	b.ReportAllocs()
+
+	c, err := NewCache(&Config[customKey, int64]{
+		NumCounters:        1000000000,
+		MaxCost:            100000000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		KeyToHash: func(key customKey) (uint64, uint64) {
+			return uint64(key.a), uint64(key.b)
+		},
+	})
+	require.NoError(b, err)
+
+	b.SetBytes(1)
+	for i := int64(0); i < 100; i++ {
+		c.Set(customKey{a: i, b: i * 4}, i+i*4, 1)
+	}
+	c.Wait()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var i int64
+		for pb.Next() {
+			j := i % 100
+			v, ok := c.Get(customKey{a: j, b: j * 4})
+			if !ok || v != j+j*4 {
+				b.Error(ok, v, i)
+			}
+			i++
+		}
+	})
+}
+
+func TestCacheGetAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector makes sync.Pool allocate")
+	}
+	c, err := NewCache(&Config[uint64, *int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	v := 1
+	require.True(t, c.Set(1, &v, 1))
+	c.Wait()
+
+	// Warm up the Get buffers so drains reuse the slices given back by the
+	// policy.
+	for i := 0; i < 10000; i++ {
+		c.Get(1)
+	}
+	// Each run drains the buffers many times, so the allocations of a drain
+	// aren't hidden by AllocsPerRun rounding down. Sleeping between drains lets
+	// the policy keep up, so they aren't dropped.
+	allocs := testing.AllocsPerRun(10, func() {
+		for i := 0; i < 1000; i++ {
+			c.Get(1)
+			c.Get(2)
+			if i%32 == 0 {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	})
+	require.Zero(t, allocs)
+}
+
+func TestCacheSetAllocs(t *testing.T) {
+	c, err := NewCache(&Config[uint64, *int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	values := make([]int, 100)
+	for i := range values {
+		require.True(t, c.Set(uint64(i), &values[i], 1))
+	}
+	c.Wait()
+
+	// Updating keys already in the cache doesn't grow the store, so it must not
+	// allocate at all.
+	allocs := testing.AllocsPerRun(10, func() {
+		for i := range values {
+			c.Set(uint64(i), &values[i], 1)
+		}
+		c.Wait()
+	})
+	// Wait allocates its WaitGroup.
+	require.LessOrEqual(t, allocs, float64(1))
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	b.ReportAllocs()
+
+	c, err := NewCache(&Config[uint64, *int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(b, err)
+	defer c.Close()
+	values := make([]int, 100)
+	for i := range values {
+		c.Set(uint64(i), &values[i], 1)
+	}
+	c.Wait()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			c.Get(i % 100)
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentCacheSetNeverEvict(b *testing.B) {
+	b.ReportAllocs()
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 1e7,
+		MaxCost:     1e5,
+		BufferItems: 64,
+	})
+	require.NoError(b, err)
+	b.RunParallel(func(pb *testing.PB) {
+		cnt := rand.Int()
+		for pb.Next() {
+			cnt++
+			c.Set(cnt, cnt, 0)
+		}
+	})
+}
+
+type costerValue []byte
+
+func (v costerValue) Cost() int64 {
+	return int64(len(v))
+}
+
+func TestCacheCoster(t *testing.T) {
+	c, err := NewCache(&Config[int, costerValue]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, costerValue("abc"), 0))
+	require.True(t, c.Set(2, costerValue("ab"), 1))
+	c.Wait()
+	require.Equal(t, int64(3), c.policy.Cost(1))
+	require.Equal(t, int64(1), c.policy.Cost(2))
+
+	// Config.Cost takes precedence.
+	c2, err := NewCache(&Config[int, costerValue]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(costerValue) int64 {
+			return 5
+		},
+	})
+	require.NoError(t, err)
+	defer c2.Close()
+	require.True(t, c2.Set(1, costerValue("abc"), 0))
+	c2.Wait()
+	require.Equal(t, int64(5), c2.policy.Cost(1))
+
+	require.Nil(t, costerCost[int]())
+}
+
+func TestCacheInternalCost(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+
+	// Get should return false because the cache's cost is too small to store the item
+	// when accounting for the internal cost.
+	c.SetWithTTL(1, 1, 1, 0)
+	time.Sleep(wait)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+}
+
+func TestRecacheWithTTL(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+
+	require.NoError(t, err)
+
+	// Set initial value for key = 1
+	insert := c.SetWithTTL(1, 1, 1, 5*time.Second)
+	require.True(t, insert)
+	time.Sleep(2 * time.Second)
+
+	// Get value from cache for key = 1
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+	require.Equal(t, 1, val)
+
+	// Wait for expiration
+	time.Sleep(5 * time.Second)
+
+	// The cached value for key = 1 should be gone
+	val, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	// Set new value for key = 1
+	insert = c.SetWithTTL(1, 2, 1, 5*time.Second)
+	require.True(t, insert)
+	time.Sleep(2 * time.Second)
+
+	// Get value from cache for key = 1
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+	require.Equal(t, 2, val)
+}
+
+func TestCacheSetWithTTL(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		OnEvict: func(item Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			evicted[item.Key] = struct{}{}
+		},
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, time.Second)
+
+	// Sleep to make sure the item has expired after execution resumes.
+	time.Sleep(2 * time.Second)
+	val, ok := c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	// Sleep to ensure that the bucket where the item was stored has been cleared
+	// from the expiraton map.
+	time.Sleep(5 * time.Second)
+	m.Lock()
+	require.Equal(t, 1, len(evicted))
+	_, ok = evicted[1]
+	require.True(t, ok)
+	m.Unlock()
+
+	// Verify that expiration times are overwritten.
+	retrySet(t, c, 2, 1, 1, time.Second)
+	retrySet(t, c, 2, 2, 1, 100*time.Second)
+	time.Sleep(3 * time.Second)
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	// Verify that entries with no expiration are overwritten.
+	retrySet(t, c, 3, 1, 1, 0)
+	retrySet(t, c, 3, 2, 1, time.Second)
+	time.Sleep(3 * time.Second)
+	val, ok = c.Get(3)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+}
+
+func TestCacheEvictExpiredOnGet(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]int64)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		EvictExpiredOnGet:  true,
+		OnEvict: func(item Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			evicted[item.Key] = item.Cost
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 2, 200*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+
+	val, ok := c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	// The expired item must be gone without waiting for the cleanup, once the
+	// Set buffer is processed.
+	c.Wait()
+	key, _ := z.KeyToHash(1)
 	m.Lock()
-	require.NotEqual(t, 0, len(evicted))
+	require.Equal(t, map[uint64]int64{key: 2}, evicted)
 	m.Unlock()
-
-	defer func() {
-		require.NotNil(t, recover())
-	}()
-	c.Close()
-	c.setBuf <- Item[int]{flag: itemNew}
+	require.False(t, c.policy.Has(key))
+	require.True(t, c.store.Expiration(key).IsZero())
 }
 
-func TestCacheGet(t *testing.T) {
+func TestCachePreciseExpiration(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]time.Time)
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
+		IgnoreInternalCost: true,
 		BufferItems:        64,
+		PreciseExpiration:  true,
+		OnEvict: func(item Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			require.Equal(t, EvictExpired, item.EvictReason)
+			evicted[item.Key] = time.Now()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	retrySet(t, c, 1, 1, 1, 100*time.Millisecond)
+	retrySet(t, c, 2, 2, 1, 200*time.Millisecond)
+	retrySet(t, c, 3, 3, 1, 100*time.Millisecond)
+	// Extending the TTL moves the expiration, and deleting cancels it.
+	retrySet(t, c, 3, 3, 1, 300*time.Millisecond)
+	retrySet(t, c, 4, 4, 1, 100*time.Millisecond)
+	c.Del(4)
+
+	// The cleanup runs every few seconds, so the items can only be gone this
+	// soon if they expired on time.
+	key1, _ := z.KeyToHash(1)
+	key2, _ := z.KeyToHash(2)
+	key3, _ := z.KeyToHash(3)
+	require.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return len(evicted) == 3
+	}, time.Second, 5*time.Millisecond)
+
+	m.Lock()
+	defer m.Unlock()
+	require.True(t, evicted[key1].Sub(start) >= 100*time.Millisecond)
+	require.True(t, evicted[key2].Sub(start) >= 200*time.Millisecond)
+	require.True(t, evicted[key3].Sub(start) >= 300*time.Millisecond)
+	require.True(t, evicted[key1].Before(evicted[key2]))
+	require.True(t, evicted[key2].Before(evicted[key3]))
+	require.Zero(t, c.store.ExpiringLen())
+}
+
+func TestCacheMaxTTL(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
 		IgnoreInternalCost: true,
-		Metrics:            true,
+		BufferItems:        64,
+		MaxTTL:             time.Minute,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	key, conflict := z.KeyToHash(1)
-	i := Item[int]{
-		Key:      key,
-		Conflict: conflict,
-		Value:    1,
-	}
-	c.store.Set(i)
-	val, ok := c.Get(1)
+	retrySet(t, c, 1, 1, 1, 24*time.Hour)
+	ttl, ok := c.GetTTL(1)
 	require.True(t, ok)
-	require.NotNil(t, val)
+	require.True(t, ttl <= time.Minute)
 
-	val, ok = c.Get(2)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
+	retrySet(t, c, 2, 2, 1, time.Second)
+	ttl, ok = c.GetTTL(2)
+	require.True(t, ok)
+	require.True(t, ttl <= time.Second)
 
-	// 0.5 and not 1.0 because we tried Getting each item twice
-	require.Equal(t, 0.5, c.Metrics.Ratio())
+	retrySet(t, c, 3, 3, 1, 0)
+	ttl, ok = c.GetTTL(3)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), ttl)
+}
 
-	c = nil
-	val, ok = c.Get(0)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
+func TestCacheDefaultTTL(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		DefaultTTL:         time.Minute,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for !c.Set(1, 1, 1) {
+		time.Sleep(wait)
+	}
+	c.Wait()
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// SetWithTTL is not affected by the default.
+	retrySet(t, c, 2, 2, 1, 0)
+	ttl, ok = c.GetTTL(2)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), ttl)
 }
 
-// retrySet calls SetWithTTL until the item is accepted by the cache.
-func retrySet(t *testing.T, c *Cache[int, int], key, value int, cost int64, ttl time.Duration) {
-	for {
-		if set := c.SetWithTTL(key, value, cost, ttl); !set {
-			time.Sleep(wait)
-			continue
-		}
+func TestCacheSetWithMeta(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]uint32)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(item Item[int]) {
+			m.Lock()
+			defer m.Unlock()
+			evicted[item.Key] = item.Meta
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
 
+	for !c.SetWithMeta(1, 1, 1, 0, 7) {
 		time.Sleep(wait)
-		val, ok := c.Get(key)
-		require.True(t, ok)
-		require.NotNil(t, val)
-		require.Equal(t, value, val)
-		return
 	}
+	c.Wait()
+	val, meta, ok := c.GetWithMeta(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, uint32(7), meta)
+
+	// A plain Set overwrites the metadata.
+	retrySet(t, c, 2, 2, 1, 0)
+	_, meta, ok = c.GetWithMeta(2)
+	require.True(t, ok)
+	require.Equal(t, uint32(0), meta)
+
+	_, meta, ok = c.GetWithMeta(3)
+	require.False(t, ok)
+	require.Equal(t, uint32(0), meta)
+
+	c.Clear()
+	c.Wait()
+	m.Lock()
+	require.Equal(t, map[uint64]uint32{1: 7, 2: 0}, evicted)
+	m.Unlock()
 }
 
-func TestCacheSet(t *testing.T) {
+func TestCacheUpdateIfVersion(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
+		TrackVersions:      true,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	retrySet(t, c, 1, 1, 1, 0)
+	v1, ok := c.SetWithVersion(1, 1, 1, 0)
+	require.True(t, ok)
+	c.Wait()
+	val, version, ok := c.GetWithVersion(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, v1, version)
 
-	c.Set(1, 2, 2)
-	val, ok := c.store.Get(z.KeyToHash(1))
+	v2, ok := c.UpdateIfVersion(1, v1, 2, 1)
+	require.True(t, ok)
+	require.Greater(t, v2, v1)
+
+	// The version is stale now.
+	_, ok = c.UpdateIfVersion(1, v1, 3, 1)
+	require.False(t, ok)
+	val, version, ok = c.GetWithVersion(1)
 	require.True(t, ok)
 	require.Equal(t, 2, val)
+	require.Equal(t, v2, version)
 
-	c.stop <- struct{}{}
-	for i := 0; i < setBufSize; i++ {
-		key, conflict := z.KeyToHash(1)
-		c.setBuf <- Item[int]{
-			flag:     itemUpdate,
-			Key:      key,
-			Conflict: conflict,
-			Value:    1,
-			Cost:     1,
-		}
-	}
-	require.False(t, c.Set(2, 2, 1))
-	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
-	close(c.setBuf)
-	close(c.stop)
+	// A Set also bumps the version.
+	v3, ok := c.SetWithVersion(1, 4, 1, 0)
+	require.True(t, ok)
+	require.Greater(t, v3, v2)
+	_, ok = c.UpdateIfVersion(1, v2, 5, 1)
+	require.False(t, ok)
 
-	c = nil
-	require.False(t, c.Set(1, 1, 1))
-}
+	_, ok = c.UpdateIfVersion(2, v3, 5, 1)
+	require.False(t, ok)
 
-type customKey struct {
-	a int64
-	b int64
+	// Without Config.TrackVersions, the versions are 0 and can't be checked.
+	c, err = NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	v1, ok = c.SetWithVersion(1, 1, 1, 0)
+	require.True(t, ok)
+	require.Zero(t, v1)
+	c.Wait()
+	_, version, ok = c.GetWithVersion(1)
+	require.True(t, ok)
+	require.Zero(t, version)
+	_, ok = c.UpdateIfVersion(1, 0, 2, 1)
+	require.False(t, ok)
+	require.False(t, c.DelIfVersion(1, 0))
 }
 
-func BenchmarkCacheSet(b *testing.B) {
-	b.ReportAllocs()
-
-	c, err := NewCache(&Config[customKey, int64]{
-		NumCounters:        1000000000,
-		MaxCost:            100000000,
+func TestCacheIncrBy(t *testing.T) {
+	c, err := NewCache(&Config[int, int64]{
+		NumCounters:        100,
+		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
-		KeyToHash: func(key customKey) (uint64, uint64) {
-			return uint64(key.a), uint64(key.b)
+		Cost: func(int64) int64 {
+			return 1
 		},
 	})
-	require.NoError(b, err)
+	require.NoError(t, err)
+	defer c.Close()
 
-	b.SetBytes(1)
-	for i := int64(0); i < 100; i++ {
-		c.Set(customKey{a: i, b: i * 4}, i+i*4, 1)
+	val, ok := IncrBy(c, 1, 5, 0)
+	require.True(t, ok)
+	require.Equal(t, int64(5), val)
+	val, ok = IncrBy(c, 1, -2, 0)
+	require.True(t, ok)
+	require.Equal(t, int64(3), val)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				IncrBy(c, 2, 1, 0)
+			}
+		}()
 	}
+	wg.Wait()
 	c.Wait()
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, int64(8000), val)
+	require.Equal(t, int64(2), c.CostUsed())
 
-	b.RunParallel(func(pb *testing.PB) {
-		var i int64
-		for pb.Next() {
-			j := i % 100
-			v, ok := c.Get(customKey{a: j, b: j * 4})
-			if !ok || v != j+j*4 {
-				b.Error(ok, v, i)
-			}
-			i++
-		}
+	_, ok = IncrBy(c, 3, 1, -time.Second)
+	require.False(t, ok)
+}
+
+func TestCacheAppendValue(t *testing.T) {
+	c, err := NewCache(&Config[int, []int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Cost: func(value []int) int64 {
+			return int64(len(value))
+		},
 	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	val, ok := AppendValue(c, 1, 1, 2)
+	require.True(t, ok)
+	require.Equal(t, []int{1, 2}, val)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				AppendValue(c, 1, j)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 42, len(val))
+	require.Equal(t, int64(42), c.CostUsed())
 }
 
-func BenchmarkConcurrentCacheSetNeverEvict(b *testing.B) {
-	b.ReportAllocs()
-	c, err := NewCache(&Config[int, int]{
-		NumCounters: 1e7,
-		MaxCost:     1e5,
-		BufferItems: 64,
+func TestCacheModify(t *testing.T) {
+	c, err := NewCache(&Config[int, string]{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
 	})
-	require.NoError(b, err)
-	b.RunParallel(func(pb *testing.PB) {
-		cnt := rand.Int()
-		for pb.Next() {
-			cnt++
-			c.Set(cnt, cnt, 0)
-		}
+	require.NoError(t, err)
+	defer c.Close()
+
+	val, ok := c.Modify(1, func(old string, exists bool) (string, int64, bool) {
+		require.False(t, exists)
+		return "a", 1, true
+	})
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+
+	val, ok = c.Modify(1, func(old string, exists bool) (string, int64, bool) {
+		require.True(t, exists)
+		return old + "b", 2, true
+	})
+	require.True(t, ok)
+	require.Equal(t, "ab", val)
+
+	_, ok = c.Modify(1, func(old string, exists bool) (string, int64, bool) {
+		return "", 0, false
 	})
+	require.False(t, ok)
+
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "ab", val)
+	require.Equal(t, int64(2), c.CostUsed())
+
+	var nilCache *Cache[int, string]
+	_, ok = nilCache.Modify(1, func(string, bool) (string, int64, bool) {
+		return "", 0, true
+	})
+	require.False(t, ok)
 }
 
-func TestCacheInternalCost(t *testing.T) {
+func TestCacheDel(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
 		MaxCost:     10,
 		BufferItems: 64,
-		Metrics:     true,
 	})
 	require.NoError(t, err)
 
-	// Get should return false because the cache's cost is too small to store the item
-	// when accounting for the internal cost.
-	c.SetWithTTL(1, 1, 1, 0)
-	time.Sleep(wait)
-	_, ok := c.Get(1)
+	c.Set(1, 1, 1)
+	c.Del(1)
+	// The deletes and sets are pushed through the setbuf. It might be possible
+	// that the delete is not processed before the following get is called. So
+	// wait for a millisecond for things to be processed.
+	time.Sleep(time.Millisecond)
+	val, ok := c.Get(1)
 	require.False(t, ok)
+	require.Equal(t, 0, val)
+
+	c = nil
+	defer func() {
+		require.Nil(t, recover())
+	}()
+	c.Del(1)
 }
 
-func TestRecacheWithTTL(t *testing.T) {
+func TestCacheDelIf(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
+		TrackVersions:      true,
 	})
-
 	require.NoError(t, err)
+	defer c.Close()
 
-	// Set initial value for key = 1
-	insert := c.SetWithTTL(1, 1, 1, 5*time.Second)
-	require.True(t, insert)
-	time.Sleep(2 * time.Second)
-
-	// Get value from cache for key = 1
-	val, ok := c.Get(1)
-	require.True(t, ok)
-	require.NotNil(t, val)
-	require.Equal(t, 1, val)
-
-	// Wait for expiration
-	time.Sleep(5 * time.Second)
-
-	// The cached value for key = 1 should be gone
-	val, ok = c.Get(1)
+	retrySet(t, c, 1, 1, 1, 0)
+	require.False(t, DelIfEquals(c, 1, 2))
+	require.True(t, DelIfEquals(c, 1, 1))
+	_, ok := c.Get(1)
 	require.False(t, ok)
-	require.Equal(t, 0, val)
+	require.False(t, DelIfEquals(c, 1, 1))
+	c.Wait()
+	key, _ := z.KeyToHash(1)
+	require.False(t, c.policy.Has(key))
 
-	// Set new value for key = 1
-	insert = c.SetWithTTL(1, 2, 1, 5*time.Second)
-	require.True(t, insert)
-	time.Sleep(2 * time.Second)
+	retrySet(t, c, 2, 2, 1, 0)
+	require.False(t, c.DelIf(2, func(value int) bool { return value > 2 }))
+	require.True(t, c.DelIf(2, func(value int) bool { return value == 2 }))
+	_, ok = c.Get(2)
+	require.False(t, ok)
 
-	// Get value from cache for key = 1
-	val, ok = c.Get(1)
+	version, ok := c.SetWithVersion(3, 3, 1, 0)
 	require.True(t, ok)
-	require.NotNil(t, val)
-	require.Equal(t, 2, val)
+	c.Wait()
+	require.False(t, c.DelIfVersion(3, version+1))
+	require.True(t, c.DelIfVersion(3, version))
+	_, ok = c.Get(3)
+	require.False(t, ok)
 }
 
-func TestCacheSetWithTTL(t *testing.T) {
-	m := &sync.Mutex{}
-	evicted := make(map[uint64]struct{})
+func TestCacheDelIfBeforeProcessed(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
-		NumCounters:        100,
-		MaxCost:            10,
+		NumCounters:        1000,
+		MaxCost:            100,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
-		OnEvict: func(item Item[int]) {
-			m.Lock()
-			defer m.Unlock()
-			evicted[item.Key] = struct{}{}
-		},
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	retrySet(t, c, 1, 1, 1, time.Second)
-
-	// Sleep to make sure the item has expired after execution resumes.
-	time.Sleep(2 * time.Second)
-	val, ok := c.Get(1)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
+	// The items stored by Modify may still be in the Set buffer when DelIf
+	// deletes them, and must not be added to the policy afterwards.
+	for i := 0; i < 50; i++ {
+		c.Modify(i, func(int, bool) (int, int64, bool) { return i, 1, true })
+		require.True(t, c.DelIf(i, func(int) bool { return true }))
+	}
+	c.Wait()
+	require.Equal(t, int64(0), c.CostUsed())
+}
 
-	// Sleep to ensure that the bucket where the item was stored has been cleared
-	// from the expiraton map.
-	time.Sleep(5 * time.Second)
-	m.Lock()
-	require.Equal(t, 1, len(evicted))
-	_, ok = evicted[1]
-	require.True(t, ok)
-	m.Unlock()
+func TestCacheLockKey(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+	defer c.Close()
 
-	// Verify that expiration times are overwritten.
-	retrySet(t, c, 2, 1, 1, time.Second)
-	retrySet(t, c, 2, 2, 1, 100*time.Second)
-	time.Sleep(3 * time.Second)
-	val, ok = c.Get(2)
-	require.True(t, ok)
-	require.Equal(t, 2, val)
+	var wg sync.WaitGroup
+	var counter, loads int
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.LockKey(1)
+			defer c.UnlockKey(1)
+			// Only the first goroutine should compute the value.
+			if counter == 0 {
+				loads++
+			}
+			counter++
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 8, counter)
+	require.Equal(t, 1, loads)
 
-	// Verify that entries with no expiration are overwritten.
-	retrySet(t, c, 3, 1, 1, 0)
-	retrySet(t, c, 3, 2, 1, time.Second)
-	time.Sleep(3 * time.Second)
-	val, ok = c.Get(3)
-	require.False(t, ok)
-	require.Equal(t, 0, val)
+	var nilCache *Cache[int, int]
+	nilCache.LockKey(1)
+	nilCache.UnlockKey(1)
 }
 
-func TestCacheDel(t *testing.T) {
+func TestCacheApplyBatch(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 64,
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	c.Set(1, 1, 1)
-	c.Del(1)
-	// The deletes and sets are pushed through the setbuf. It might be possible
-	// that the delete is not processed before the following get is called. So
-	// wait for a millisecond for things to be processed.
-	time.Sleep(time.Millisecond)
-	val, ok := c.Get(1)
+	retrySet(t, c, 1, 1, 1, 0)
+	require.True(t, c.ApplyBatch([]Op[int, int]{
+		{Key: 1, Del: true},
+		{Key: 2, Value: 2, Cost: 1},
+		{Key: 3, Value: 3, Cost: 1, TTL: time.Minute},
+	}))
+	_, ok := c.Get(1)
 	require.False(t, ok)
-	require.Equal(t, 0, val)
+	val, ok := c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	ttl, ok := c.GetTTL(3)
+	require.True(t, ok)
+	require.True(t, ttl > 0)
 
-	c = nil
-	defer func() {
-		require.Nil(t, recover())
+	c.Wait()
+	require.Equal(t, int64(2), c.CostUsed())
+
+	// Nothing is applied if any operation is invalid.
+	require.False(t, c.ApplyBatch([]Op[int, int]{
+		{Key: 2, Del: true},
+		{Key: 4, Value: 4, Cost: 1, TTL: -time.Second},
+	}))
+	_, ok = c.Get(2)
+	require.True(t, ok)
+
+	// Readers see either all or none of the batch.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.ApplyBatch([]Op[int, int]{
+				{Key: 10, Value: i, Cost: 1},
+				{Key: 20, Value: i, Cost: 1},
+			})
+		}
 	}()
-	c.Del(1)
+	for i := 0; i < 1000; i++ {
+		a, _ := c.Get(10)
+		b, _ := c.Get(20)
+		require.True(t, a <= b)
+	}
+	close(stop)
+	<-done
 }
 
 func TestCacheDelWithTTL(t *testing.T) {
@@ -735,7 +2528,11 @@ func TestNilMetrics(t *testing.T) {
 		m.KeysEvicted,
 		m.CostEvicted,
 		m.SetsDropped,
+		m.SetsDroppedBufferFull,
+		m.SetsDroppedClosed,
+		m.SetsDroppedConflict,
 		m.SetsRejected,
+		m.SetsRejectedTooBig,
 		m.GetsDropped,
 		m.GetsKept,
 	} {
@@ -755,6 +2552,46 @@ func TestMetricsAddGet(t *testing.T) {
 	require.Equal(t, uint64(0), m.Hits())
 }
 
+func TestMetricsSetsDropped(t *testing.T) {
+	m := newMetrics()
+	m.add(dropSets, 1, 1)
+	m.add(dropSetsClosed, 1, 2)
+	m.add(dropSetsConflict, 1, 3)
+	m.add(rejectSets, 1, 4)
+	require.Equal(t, uint64(1), m.SetsDroppedBufferFull())
+	require.Equal(t, uint64(2), m.SetsDroppedClosed())
+	require.Equal(t, uint64(3), m.SetsDroppedConflict())
+	require.Equal(t, uint64(6), m.SetsDropped())
+	require.Equal(t, uint64(4), m.SetsRejected())
+}
+
+func TestCacheSetsDroppedReasons(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		// Every key has the same hash but a different conflict hash.
+		KeyToHash: func(key int) (uint64, uint64) {
+			return 1, uint64(key)
+		},
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, 0)
+	require.True(t, c.Set(2, 2, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, uint64(1), c.Metrics.SetsDroppedConflict())
+
+	c.Close()
+	require.False(t, c.Set(3, 3, 1))
+	require.Equal(t, uint64(1), c.Metrics.SetsDroppedClosed())
+}
+
 func TestMetricsRatio(t *testing.T) {
 	m := newMetrics()
 	require.Equal(t, float64(0), m.Ratio())
@@ -769,6 +2606,47 @@ func TestMetricsRatio(t *testing.T) {
 	require.Equal(t, float64(0), m.Ratio())
 }
 
+func TestMetricsGetsDroppedRatio(t *testing.T) {
+	m := newMetrics()
+	require.Equal(t, float64(0), m.GetsDroppedRatio())
+
+	m.add(dropGets, 1, 1)
+	m.add(keepGets, 1, 3)
+	require.Equal(t, 0.25, m.GetsDroppedRatio())
+
+	m = nil
+	require.Equal(t, float64(0), m.GetsDroppedRatio())
+}
+
+func TestMetricsContention(t *testing.T) {
+	m := newMetrics()
+	require.Equal(t, time.Duration(0), m.GetsDrainLatency())
+	m.add(drainGets, 1, 2)
+	m.add(drainGetsNanos, 1, 300)
+	require.Equal(t, 150*time.Nanosecond, m.GetsDrainLatency())
+	m.max(setBufHighWater, 5)
+	m.max(setBufHighWater, 3)
+	require.Equal(t, uint64(5), m.SetBufHighWater())
+
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        1,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	retrySet(t, c, 1, 1, 1, 0)
+	for i := 0; i < 10; i++ {
+		c.Get(1)
+	}
+	time.Sleep(wait)
+	require.NotZero(t, c.Metrics.get(drainGets))
+	require.NotZero(t, c.Metrics.get(policyLocks))
+	require.NotZero(t, c.Metrics.SetBufHighWater())
+}
+
 func TestMetricsString(t *testing.T) {
 	m := newMetrics()
 	m.add(hit, 1, 1)
@@ -803,6 +2681,75 @@ func TestMetricsString(t *testing.T) {
 	require.Equal(t, "unidentified", stringFor(doNotUse))
 }
 
+func TestMetricsDistinctKeys(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		c.Get(i % 100)
+		c.GetStale(i % 100)
+	}
+	require.InDelta(t, 100, c.Metrics.DistinctKeys(), 3)
+	c.Metrics.Clear()
+	require.Zero(t, c.Metrics.DistinctKeys())
+
+	var m *Metrics
+	require.Zero(t, m.DistinctKeys())
+}
+
+func TestMetricsResetAndSnapshot(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	require.Equal(t, uint64(1), c.Metrics.ResetAndSnapshot().KeysAdded())
+	require.Zero(t, c.Metrics.KeysAdded())
+
+	c.Get(1)
+	c.Get(2)
+	snap := c.Metrics.ResetAndSnapshot()
+	require.Equal(t, uint64(1), snap.Hits())
+	require.Equal(t, uint64(1), snap.Misses())
+	require.Equal(t, uint64(2), snap.DistinctKeys())
+	require.Zero(t, c.Metrics.Hits())
+	require.Zero(t, c.Metrics.DistinctKeys())
+
+	// Every concurrent event is counted by exactly one of the snapshots.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Get(1)
+			}
+		}()
+	}
+	var hits uint64
+	for i := 0; i < 10; i++ {
+		hits += c.Metrics.ResetAndSnapshot().Hits()
+	}
+	wg.Wait()
+	hits += c.Metrics.ResetAndSnapshot().Hits()
+	require.Equal(t, uint64(4000), hits)
+
+	var m *Metrics
+	require.Nil(t, m.ResetAndSnapshot())
+}
+
 func TestCacheMetricsClear(t *testing.T) {
 	c, err := NewCache(&Config[int, int]{
 		NumCounters: 100,
@@ -1053,3 +3000,41 @@ func TestCacheWithTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheApplyBatchChecks(t *testing.T) {
+	var rejected []RejectReason
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		MaxItemCost:        5,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		TombstoneTTL:       time.Minute,
+		Expiry:             valueExpiry{},
+		OnReject: func(item Item[int]) {
+			rejected = append(rejected, item.RejectReason)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Del(1)
+	require.True(t, c.ApplyBatch([]Op[int, int]{
+		{Key: 1, Value: 1, Cost: 1},
+		{Key: 2, Value: 2, Cost: 10},
+		{Key: 3, Value: 60, Cost: 1},
+		{Key: 4, Value: -1, Cost: 1},
+	}))
+	require.Equal(t, []RejectReason{RejectTombstone, RejectTooBig}, rejected)
+	for _, key := range []int{1, 2, 4} {
+		_, ok := c.Get(key)
+		require.False(t, ok)
+	}
+	// Config.Expiry sets the TTL from the value.
+	ttl, ok := c.GetTTL(3)
+	require.True(t, ok)
+	require.True(t, ttl > 59*time.Second && ttl <= time.Minute)
+
+	c.SetBypass(true)
+	require.False(t, c.ApplyBatch([]Op[int, int]{{Key: 5, Value: 5, Cost: 1}}))
+}
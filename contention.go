@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockStats describes the time spent on one kind of wait during a contention
+// profile, see Cache.ProfileContention.
+type LockStats struct {
+	// Count is the number of waits.
+	Count int64
+	// Total and Max are the total and the longest time waited.
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average time waited.
+func (s LockStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// ContentionReport is the result of Cache.ProfileContention.
+type ContentionReport struct {
+	// Duration is how long the profile ran.
+	Duration time.Duration
+	// ShardLockWait is the time spent waiting for the locks of the shards of
+	// the store, by every operation.
+	ShardLockWait LockStats
+	// ExpirationLockHold is the time the lock of the map tracking the items
+	// to expire was held, which other writes with a TTL wait for.
+	ExpirationLockHold LockStats
+	// SetBufferStall is the time spent waiting for room in the Set buffer by
+	// the operations that can't drop their update, such as Del and Wait. Sets
+	// don't wait, they're dropped instead.
+	SetBufferStall LockStats
+}
+
+// lockStats accumulates a LockStats atomically.
+type lockStats struct {
+	count int64
+	total int64
+	max   int64
+}
+
+func (s *lockStats) add(d time.Duration) {
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.total, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *lockStats) reset() {
+	atomic.StoreInt64(&s.count, 0)
+	atomic.StoreInt64(&s.total, 0)
+	atomic.StoreInt64(&s.max, 0)
+}
+
+func (s *lockStats) stats() LockStats {
+	return LockStats{
+		Count: atomic.LoadInt64(&s.count),
+		Total: time.Duration(atomic.LoadInt64(&s.total)),
+		Max:   time.Duration(atomic.LoadInt64(&s.max)),
+	}
+}
+
+// contention records the waits on the internal locks and buffers of a cache
+// while a profile is running. When it isn't, the only cost is an atomic load.
+// A nil *contention records nothing.
+type contention struct {
+	// shardWait, emHold and setBufStall are the first fields so they're 64-bit
+	// aligned for use with atomic.
+	shardWait   lockStats
+	emHold      lockStats
+	setBufStall lockStats
+	// on is 1 while a profile is running.
+	on int32
+	// mu serializes the profiles.
+	mu sync.Mutex
+}
+
+func (p *contention) enabled() bool {
+	return p != nil && atomic.LoadInt32(&p.on) == 1
+}
+
+// profile records the waits for d and returns them.
+func (p *contention) profile(d time.Duration) ContentionReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shardWait.reset()
+	p.emHold.reset()
+	p.setBufStall.reset()
+	start := time.Now()
+	atomic.StoreInt32(&p.on, 1)
+	time.Sleep(d)
+	atomic.StoreInt32(&p.on, 0)
+	return ContentionReport{
+		Duration:           time.Since(start),
+		ShardLockWait:      p.shardWait.stats(),
+		ExpirationLockHold: p.emHold.stats(),
+		SetBufferStall:     p.setBufStall.stats(),
+	}
+}
+
+// ProfileContention records for d how long the internal locks and buffers of
+// the cache make operations wait, and returns a report to find out which one is
+// the bottleneck. It blocks for d, and the operations are a bit slower while it
+// runs. Concurrent calls run one after the other.
+func (c *Cache[K, V]) ProfileContention(d time.Duration) ContentionReport {
+	if c == nil || c.isClosed {
+		return ContentionReport{}
+	}
+	return c.contention.profile(d)
+}
+
+// pushSet sends the item to setBuf, waiting for room if needed, and records
+// the wait if a contention profile is running. While the cache is paused,
+// nothing takes items from setBuf, so it doesn't wait and returns false if
+// there's no room.
+func (c *Cache[K, V]) pushSet(i Item[V]) bool {
+	return c.pushSetUntil(i, nil)
+}
+
+// pushSetUntil works like pushSet, but also gives up and returns false once
+// done is closed, if it's not nil.
+func (c *Cache[K, V]) pushSetUntil(i Item[V], done <-chan struct{}) bool {
+	select {
+	case c.setBuf <- i:
+		return true
+	default:
+	}
+	var start time.Time
+	if c.contention.enabled() {
+		start = time.Now()
+	}
+	select {
+	case c.setBuf <- i:
+	case <-c.pausedChan():
+		return false
+	case <-done:
+		return false
+	}
+	if !start.IsZero() {
+		c.contention.setBufStall.add(time.Since(start))
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheProfileContention(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := g*1000 + i%1000
+				c.SetWithTTL(key, i, 1, time.Hour)
+				c.Get(key)
+				c.Del(key)
+			}
+		}(g)
+	}
+	report := c.ProfileContention(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	require.True(t, report.Duration >= 50*time.Millisecond)
+	require.NotZero(t, report.ShardLockWait.Count)
+	require.NotZero(t, report.ExpirationLockHold.Count)
+	require.True(t, report.ShardLockWait.Max >= report.ShardLockWait.Mean())
+
+	// Nothing is recorded once the profile is over.
+	count := c.contention.shardWait.stats().Count
+	c.Set(1, 1, 1)
+	c.Get(1)
+	require.Equal(t, count, c.contention.shardWait.stats().Count)
+}
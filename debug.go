@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// debugInfo is the JSON document served by DebugHandler.
+type debugInfo struct {
+	// Metrics is only set if Config.Metrics is true.
+	Metrics     map[string]uint64 `json:"metrics,omitempty"`
+	HitRatio    float64           `json:"hit_ratio"`
+	NumCounters int64             `json:"num_counters"`
+	MaxCost     int64             `json:"max_cost"`
+	CostUsed    int64             `json:"cost_used"`
+	Keys        int               `json:"keys"`
+	Shards      []int             `json:"shards"`
+	BufferItems int64             `json:"buffer_items"`
+	SetBufLen   int               `json:"set_buf_len"`
+	SetBufCap   int               `json:"set_buf_cap"`
+	TopKeys     []KeyFrequency    `json:"top_keys,omitempty"`
+}
+
+// DebugHandler returns an http.Handler serving a JSON document describing the
+// state of the cache: its metrics, the number of keys in each shard, the policy
+// parameters and how full the Set buffer is. Passing a "top" query parameter
+// also lists that many of the most frequently accessed keys, see TopKeys.
+//
+// The handler is meant to be mounted on an internal admin mux, for example
+// mux.Handle("/debug/cache", cache.DebugHandler()).
+func (c *Cache[K, V]) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c == nil || c.isClosed {
+			http.Error(w, "cache is closed", http.StatusServiceUnavailable)
+			return
+		}
+		var top int
+		if s := r.URL.Query().Get("top"); s != "" {
+			var err error
+			if top, err = strconv.Atoi(s); err != nil || top < 0 {
+				http.Error(w, "invalid top parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(c.debugInfo(top))
+	})
+}
+
+func (c *Cache[K, V]) debugInfo(top int) debugInfo {
+	info := debugInfo{
+		HitRatio:    c.Metrics.Ratio(),
+		NumCounters: c.numCounters,
+		MaxCost:     c.policy.MaxCost(),
+		CostUsed:    c.policy.Used(),
+		Shards:      c.store.ShardLens(),
+		BufferItems: c.bufferItems,
+		SetBufLen:   len(c.setBuf),
+		SetBufCap:   cap(c.setBuf),
+		TopKeys:     c.policy.TopKeys(top),
+	}
+	for _, n := range info.Shards {
+		info.Keys += n
+	}
+	if c.Metrics != nil {
+		info.Metrics = make(map[string]uint64, doNotUse)
+		for i := 0; i < doNotUse; i++ {
+			t := metricType(i)
+			info.Metrics[stringFor(t)] = c.Metrics.get(t)
+		}
+	}
+	return info
+}
@@ -0,0 +1,49 @@
+package ristretto
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheDebugHandler(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, 0)
+	retrySet(t, c, 2, 2, 2, 0)
+
+	rec := httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?top=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var info debugInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	require.Equal(t, int64(100), info.NumCounters)
+	require.Equal(t, int64(10), info.MaxCost)
+	require.Equal(t, int64(3), info.CostUsed)
+	require.Equal(t, 2, info.Keys)
+	require.Equal(t, int(numShards), len(info.Shards))
+	require.Equal(t, setBufSize, info.SetBufCap)
+	require.Equal(t, uint64(2), info.Metrics["keys-added"])
+	require.Equal(t, 1, len(info.TopKeys))
+
+	rec = httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?top=x", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	c.Close()
+	rec = httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+// Eviction chooses which keys are evicted to make room for new ones. The keys
+// are the hashes of the keys of the cache. The calls are serialized by the
+// cache, so implementations don't need to be safe for concurrent use.
+//
+// The cache keeps track of the keys and their costs itself and tells the
+// Eviction about every change. The Admission still decides whether a new key is
+// worth evicting the victims chosen by the Eviction for.
+//
+// The default Eviction is a sampled LFU, which evicts the least frequent of a
+// few random keys. The evictiontest package has tests any implementation
+// should pass.
+type Eviction interface {
+	// Add is called when a key is added to the cache.
+	Add(keyHash uint64, cost int64)
+	// Update is called when the cost of a key in the cache changes.
+	Update(keyHash uint64, cost int64)
+	// Del is called when a key leaves the cache, whatever the reason.
+	Del(keyHash uint64)
+	// Access is called with the keys read by Get. They might not be in the
+	// cache.
+	Access(keyHash uint64)
+	// Victims calls fn with the keys in the cache in the order they should be
+	// evicted, until fn returns false. fn doesn't delete the keys; Del is
+	// called for the keys that are actually evicted afterwards.
+	Victims(fn func(keyHash uint64) bool)
+	// Clear is called when all the keys are removed from the cache.
+	Clear()
+}
+
+// candidates returns the keys the Eviction would evict, in order, to make room
+// for the given cost, and for a new key if newKey is true.
+func (p *sampledLFU) candidates(cost int64, newKey bool) []policyPair {
+	room := p.roomLeft(cost)
+	items := int64(len(p.keyCosts))
+	fits := func() bool {
+		if newKey && p.maxItems > 0 && items >= p.maxItems {
+			return false
+		}
+		return room >= 0
+	}
+	var victims []policyPair
+	if fits() {
+		return victims
+	}
+	var vetoes int
+	p.eviction.Victims(func(key uint64) bool {
+		cost, ok := p.keyCosts[key]
+		if !ok {
+			// The Eviction isn't in sync with the policy, skip the key.
+			return true
+		}
+		if p.vetoed(key, &vetoes) {
+			return vetoes < maxEvictVetoes
+		}
+		victims = append(victims, policyPair{key, cost})
+		room += cost
+		items--
+		return !fits()
+	})
+	return victims
+}
+
+// addEvicting works like the second half of Add, when there's no room for the
+// key, but with the victims chosen by Config.Eviction.
+func (p *defaultPolicy[V]) addEvicting(key uint64, cost int64, ghost bool) ([]policyPair, bool) {
+	var victims []policyPair
+	for _, victim := range p.evict.candidates(cost, true) {
+		if !ghost && !p.admitOver(key, cost, victim.key) {
+			p.metrics.add(rejectSets, key, 1)
+			return victims, false
+		}
+		p.evict.del(victim.key)
+		p.ghost.add(victim.key)
+		victims = append(victims, victim)
+	}
+	if !p.evict.hasRoom(cost) {
+		p.metrics.add(rejectSets, key, 1)
+		return victims, false
+	}
+	p.evict.add(key, cost)
+	p.ghost.remove(key)
+	p.metrics.add(costAdd, key, uint64(cost))
+	return victims, true
+}
+
+// explainEvicting works like the second half of Explain, but with the victims
+// chosen by Config.Eviction.
+func (p *defaultPolicy[V]) explainEvicting(key uint64, exp SetExplanation, ghost bool,
+	drainAbove, drainTo int64) SetExplanation {
+	victims := p.evict.candidates(exp.Cost, true)
+	for _, victim := range victims {
+		kf := KeyFrequency{
+			Key:       victim.key,
+			Frequency: p.admission.Estimate(victim.key),
+			Cost:      victim.cost,
+		}
+		if !ghost && !p.admitOver(key, exp.Cost, victim.key) {
+			exp.Outcome = SetRejected
+			exp.RejectedBy = kf
+			return exp
+		}
+		exp.Victims = append(exp.Victims, kf)
+	}
+	// Check whether evicting all the candidates made enough room.
+	var freed int64
+	for _, victim := range victims {
+		freed += victim.cost
+	}
+	items := int64(len(p.evict.keyCosts) - len(victims))
+	if p.evict.roomLeft(exp.Cost)+freed < 0 || (p.evict.maxItems > 0 && items >= p.evict.maxItems) {
+		exp.Outcome = SetRejected
+		return exp
+	}
+	exp.Outcome = SetAdmitted
+	if used := p.evict.getUsed() + exp.Cost - freed; drainAbove <= 0 || used <= drainAbove {
+		return exp
+	}
+	// The Eviction goes through the keys in the same order, so the keys
+	// evicted down to the low watermark follow the victims above.
+	drained := p.evict.candidates(p.evict.getMaxCost()-drainTo+exp.Cost, true)
+	for _, victim := range drained[len(victims):] {
+		exp.Victims = append(exp.Victims, KeyFrequency{
+			Key:       victim.key,
+			Frequency: p.admission.Estimate(victim.key),
+			Cost:      victim.cost,
+		})
+	}
+	return exp
+}
+
+// lruEviction is an Eviction evicting the least recently used keys first.
+type lruEviction struct {
+	order *list.List
+	keys  map[uint64]*list.Element
+}
+
+// NewLRUEviction returns an Eviction that evicts the least recently used keys
+// first, where keys are used when added, updated or read. It can be passed in
+// Config.Eviction.
+func NewLRUEviction() Eviction {
+	return &lruEviction{
+		order: list.New(),
+		keys:  make(map[uint64]*list.Element),
+	}
+}
+
+func (e *lruEviction) Add(key uint64, _ int64) {
+	if elem, ok := e.keys[key]; ok {
+		e.order.MoveToFront(elem)
+		return
+	}
+	e.keys[key] = e.order.PushFront(key)
+}
+
+func (e *lruEviction) Update(key uint64, _ int64) {
+	e.Access(key)
+}
+
+func (e *lruEviction) Del(key uint64) {
+	if elem, ok := e.keys[key]; ok {
+		e.order.Remove(elem)
+		delete(e.keys, key)
+	}
+}
+
+func (e *lruEviction) Access(key uint64) {
+	if elem, ok := e.keys[key]; ok {
+		e.order.MoveToFront(elem)
+	}
+}
+
+func (e *lruEviction) Victims(fn func(uint64) bool) {
+	for elem := e.order.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(uint64)) {
+			return
+		}
+	}
+}
+
+func (e *lruEviction) Clear() {
+	e.order.Init()
+	e.keys = make(map[uint64]*list.Element)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package evictiontest implements tests for implementations of
+// ristretto.Eviction.
+package evictiontest
+
+import (
+	"testing"
+
+	"github.com/paivagustavo/ristretto"
+)
+
+// Run runs the tests that every Eviction should pass on the Evictions returned
+// by newEviction, which must return a new empty Eviction on every call.
+func Run(t *testing.T, newEviction func() ristretto.Eviction) {
+	t.Run("Victims", func(t *testing.T) {
+		e := newEviction()
+		for key := uint64(1); key <= 10; key++ {
+			e.Add(key, int64(key))
+		}
+		e.Access(3)
+		e.Update(4, 1)
+		checkVictims(t, e, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	})
+	t.Run("Del", func(t *testing.T) {
+		e := newEviction()
+		e.Add(1, 1)
+		e.Add(2, 1)
+		e.Add(3, 1)
+		e.Del(2)
+		e.Del(4)
+		checkVictims(t, e, 1, 3)
+		e.Del(1)
+		e.Del(3)
+		checkVictims(t, e)
+	})
+	t.Run("AccessMissing", func(t *testing.T) {
+		e := newEviction()
+		e.Add(1, 1)
+		e.Access(2)
+		checkVictims(t, e, 1)
+	})
+	t.Run("Stop", func(t *testing.T) {
+		e := newEviction()
+		e.Add(1, 1)
+		e.Add(2, 1)
+		e.Add(3, 1)
+		var n int
+		e.Victims(func(uint64) bool {
+			n++
+			return n < 2
+		})
+		if n != 2 {
+			t.Errorf("Victims called fn %d times after it returned false, want 2", n)
+		}
+	})
+	t.Run("Clear", func(t *testing.T) {
+		e := newEviction()
+		e.Add(1, 1)
+		e.Add(2, 1)
+		e.Clear()
+		checkVictims(t, e)
+		e.Add(3, 1)
+		checkVictims(t, e, 3)
+	})
+}
+
+// checkVictims checks that the victims of e are exactly the given keys, in any
+// order.
+func checkVictims(t *testing.T, e ristretto.Eviction, keys ...uint64) {
+	t.Helper()
+	want := make(map[uint64]bool, len(keys))
+	for _, key := range keys {
+		want[key] = true
+	}
+	got := make(map[uint64]bool)
+	e.Victims(func(key uint64) bool {
+		if got[key] {
+			t.Errorf("key %d is a victim twice", key)
+		}
+		got[key] = true
+		return true
+	})
+	for key := range got {
+		if !want[key] {
+			t.Errorf("key %d is a victim but isn't in the cache", key)
+		}
+	}
+	for key := range want {
+		if !got[key] {
+			t.Errorf("key %d is in the cache but isn't a victim", key)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package evictiontest
+
+import (
+	"testing"
+
+	"github.com/paivagustavo/ristretto"
+)
+
+func TestLRUEviction(t *testing.T) {
+	Run(t, ristretto.NewLRUEviction)
+}
+
+func TestLIRSEviction(t *testing.T) {
+	Run(t, ristretto.NewLIRSEviction)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "time"
+
+// Expiry computes the TTL of the items of a cache from their keys and values,
+// see Config.Expiry. Each method is passed the current TTL of the item and
+// returns the one it has from then on, with the same meaning as the TTL passed
+// to SetWithTTL: zero means the item doesn't expire, and Config.MaxTTL still
+// applies. Returning currentTTL keeps it.
+//
+// The methods are called from the goroutines calling the cache, so they must
+// be fast and safe for concurrent use, and must not call the cache.
+type Expiry[K any, V any] interface {
+	// ExpireAfterCreate is called when a Set adds the key, with the TTL the
+	// Set was given. A negative TTL discards the value, like SetWithTTL.
+	ExpireAfterCreate(key K, value V, currentTTL time.Duration) time.Duration
+	// ExpireAfterUpdate is called when a Set replaces the value of the key,
+	// with the TTL the previous value had left. A negative TTL discards the
+	// new value.
+	ExpireAfterUpdate(key K, value V, currentTTL time.Duration) time.Duration
+	// ExpireAfterRead is called when a Get finds the key, with the TTL the
+	// value has left. A negative TTL leaves it unchanged.
+	ExpireAfterRead(key K, value V, currentTTL time.Duration) time.Duration
+}
+
+// ttlLeft returns the time the item has left before it expires, or zero if it
+// doesn't expire.
+func ttlLeft[V any](item storeItem[V]) time.Duration {
+	if item.expiration == 0 {
+		return 0
+	}
+	return time.Until(item.expirationTime())
+}
+
+// expireAfterWrite returns the TTL for the value being set, as computed by
+// Config.Expiry, given the TTL it was set with. Whether the key is added or
+// updated is told from the store before the write, so concurrent writes to the
+// same key may be told apart wrongly.
+func (c *Cache[K, V]) expireAfterWrite(key K, value V, keyHash, conflictHash uint64,
+	ttl time.Duration) time.Duration {
+	item, ok := c.getItem(key, keyHash, conflictHash)
+	if !ok {
+		return c.expiry.ExpireAfterCreate(key, value, ttl)
+	}
+	return c.expiry.ExpireAfterUpdate(key, value, ttlLeft(item))
+}
+
+// expireAfterRead updates the expiration of the item found by a Get, if any,
+// to the TTL computed by Config.Expiry.
+func (c *Cache[K, V]) expireAfterRead(key K, keyHash uint64, item storeItem[V], found bool) {
+	if c.expiry == nil || !found || c.readOnly() {
+		return
+	}
+	left := ttlLeft(item)
+	ttl := c.expiry.ExpireAfterRead(key, item.value, left)
+	if ttl == left || ttl < 0 {
+		return
+	}
+	expiration, _ := c.expiration(ttl)
+	c.store.SetExpiration(keyHash, item.conflict, expiration)
+}
@@ -0,0 +1,69 @@
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// valueExpiry makes the items expire after as many seconds as their value on
+// creation, doubles their TTL on update, and makes them never expire once read
+// if their value is negative.
+type valueExpiry struct{}
+
+func (valueExpiry) ExpireAfterCreate(_ int, value int, _ time.Duration) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+func (valueExpiry) ExpireAfterUpdate(_ int, _ int, ttl time.Duration) time.Duration {
+	return ttl * 2
+}
+
+func (valueExpiry) ExpireAfterRead(_ int, value int, ttl time.Duration) time.Duration {
+	if value < 0 {
+		return 0
+	}
+	return ttl
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Expiry:             valueExpiry{},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 100, 1, 0)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > 99*time.Second && ttl <= 100*time.Second)
+
+	require.True(t, c.Set(1, 5, 1))
+	c.Wait()
+	ttl, ok = c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > 199*time.Second && ttl <= 200*time.Second)
+
+	// A negative TTL on creation discards the value.
+	require.False(t, c.Set(2, -1, 1))
+
+	require.True(t, c.SetWithTTL(3, 1, 1, 0))
+	c.Wait()
+	_, ok = c.SetWithVersion(3, -1, 1, 0)
+	require.True(t, ok)
+	c.Wait()
+	ttl, ok = c.GetTTL(3)
+	require.True(t, ok)
+	require.NotZero(t, ttl)
+	val, ok := c.Get(3)
+	require.True(t, ok)
+	require.Equal(t, -1, val)
+	ttl, ok = c.GetTTL(3)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+}
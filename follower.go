@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// ErrMutationGap is returned by ApplyMutation when the sequence number of the
+// mutation doesn't follow the last one applied, so some were missed and the
+// follower may have drifted from its primary. The mutation is applied anyway.
+var ErrMutationGap = errors.New("mutations were missed")
+
+// ApplyMutation applies a mutation of another cache, as reported by its
+// Config.OnMutation or a Subscription, to keep this one a copy of it. It's
+// meant for caches with Config.Follower set, which can serve the items of the
+// primary without computing them. The items set go through the policy, so
+// the follower should have the same MaxCost and cost settings as its primary
+// to keep the same items. To follow a cache in the same process:
+//
+//	sub := primary.Subscribe(nil, ristretto.SubscribeOptions{})
+//	go func() {
+//		for m := range sub.C {
+//			follower.ApplyMutation(m)
+//		}
+//	}()
+//
+// Across processes, the mutations can be sent with a MutationEncoder and
+// received with a MutationDecoder. ApplyMutation must not be called
+// concurrently, so the mutations stay in order.
+func (c *Cache[K, V]) ApplyMutation(m Mutation[V]) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	var err error
+	if c.lastSeq != 0 && m.Seq != c.lastSeq+1 {
+		err = ErrMutationGap
+	}
+	c.lastSeq = m.Seq
+	si := snapshotItem{key: m.Key, conflict: m.Conflict}
+	switch m.Op {
+	case MutationSet:
+		si.cost = m.Cost
+		if !c.ignoreInternalCost && si.cost > itemSize {
+			// The internal cost is added again.
+			si.cost -= itemSize
+		}
+		si.expiration = expirationNanos(m.Expiration)
+		si.meta = m.Meta
+		c.restore(si, m.Value)
+	case MutationDel, MutationExpire, MutationEvict:
+		c.restoreDel(si)
+	case MutationClear:
+		c.Clear()
+	}
+	return err
+}
+
+// MutationEncoder writes mutations to a stream, for a MutationDecoder to read
+// them back, for example to feed a follower in another process.
+type MutationEncoder[V any] struct {
+	w      *bufio.Writer
+	encode func(V) ([]byte, error)
+	buf    []byte
+}
+
+// NewMutationEncoder returns a MutationEncoder writing to w, with encode
+// turning the values into bytes.
+func NewMutationEncoder[V any](w io.Writer, encode func(V) ([]byte, error)) *MutationEncoder[V] {
+	return &MutationEncoder[V]{w: bufio.NewWriter(w), encode: encode}
+}
+
+// Encode writes the mutation. It's buffered until Flush is called.
+func (e *MutationEncoder[V]) Encode(m Mutation[V]) error {
+	si := snapshotItem{
+		key:        m.Key,
+		conflict:   m.Conflict,
+		expiration: expirationNanos(m.Expiration),
+		cost:       m.Cost,
+		meta:       m.Meta,
+		seq:        m.Seq,
+		mutation:   m.Op,
+		update:     m.Update,
+	}
+	if m.Op == MutationSet {
+		var err error
+		if si.value, err = e.encode(m.Value); err != nil {
+			return err
+		}
+	}
+	e.buf = si.encode(e.buf[:0])
+	e.w.Write(appendUvarint(nil, uint64(len(e.buf))))
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// Flush writes the mutations buffered.
+func (e *MutationEncoder[V]) Flush() error {
+	return e.w.Flush()
+}
+
+// MutationDecoder reads the mutations written by a MutationEncoder.
+type MutationDecoder[V any] struct {
+	r      *bufio.Reader
+	decode func([]byte) (V, error)
+}
+
+// NewMutationDecoder returns a MutationDecoder reading from r, with decode
+// turning bytes into values.
+func NewMutationDecoder[V any](r io.Reader, decode func([]byte) (V, error)) *MutationDecoder[V] {
+	return &MutationDecoder[V]{r: bufio.NewReader(r), decode: decode}
+}
+
+// Decode reads the next mutation. It returns io.EOF at the end of the stream,
+// and ErrSnapshotCorrupt if it ends in the middle of a mutation or can't be
+// decoded.
+func (d *MutationDecoder[V]) Decode() (Mutation[V], error) {
+	size, err := binary.ReadUvarint(d.r)
+	if err == io.EOF {
+		return Mutation[V]{}, io.EOF
+	}
+	if err != nil {
+		return Mutation[V]{}, ErrSnapshotCorrupt
+	}
+	if size > math.MaxInt64 {
+		return Mutation[V]{}, ErrSnapshotCorrupt
+	}
+	// Copy rather than allocate size bytes up front, in case it's corrupt.
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, d.r, int64(size)); err != nil {
+		return Mutation[V]{}, ErrSnapshotCorrupt
+	}
+	si, err := decodeSnapshotItem(b.Bytes())
+	if err != nil {
+		return Mutation[V]{}, err
+	}
+	m := Mutation[V]{
+		Seq:      si.seq,
+		Op:       si.mutation,
+		Key:      si.key,
+		Conflict: si.conflict,
+		Update:   si.update,
+		Cost:     si.cost,
+		Meta:     si.meta,
+	}
+	if si.expiration != 0 {
+		m.Expiration = time.Unix(0, si.expiration)
+	}
+	if m.Op == MutationSet {
+		if m.Value, err = d.decode(si.value); err != nil {
+			return Mutation[V]{}, err
+		}
+	}
+	return m, nil
+}
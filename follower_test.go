@@ -0,0 +1,99 @@
+package ristretto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newFollowerCache(t *testing.T, follower bool) *Cache[int, int] {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10000,
+		BufferItems: 64,
+		Follower:    follower,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheFollower(t *testing.T) {
+	primary := newFollowerCache(t, false)
+	defer primary.Close()
+	follower := newFollowerCache(t, true)
+	defer follower.Close()
+
+	sub := primary.Subscribe(nil, SubscribeOptions{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range sub.C {
+			require.NoError(t, follower.ApplyMutation(m))
+		}
+	}()
+
+	require.True(t, primary.SetWithTTL(1, 1, 1, time.Hour))
+	require.True(t, primary.SetWithMeta(2, 2, 1, 0, 7))
+	primary.Wait()
+	require.True(t, primary.Set(2, 20, 1))
+	primary.Wait()
+	primary.Del(1)
+	primary.Wait()
+	require.True(t, primary.Set(3, 3, 1))
+	primary.Wait()
+	sub.Close()
+	<-done
+	follower.Wait()
+
+	_, ok := follower.Get(1)
+	require.False(t, ok)
+	val, ok := follower.Get(2)
+	require.True(t, ok)
+	require.Equal(t, 20, val)
+	val, ok = follower.Get(3)
+	require.True(t, ok)
+	require.Equal(t, 3, val)
+	require.Equal(t, primary.policy.Cost(3), follower.policy.Cost(3))
+
+	// The follower is read-only.
+	require.False(t, follower.Set(4, 4, 1))
+	_, ok = follower.Modify(3, func(old int, _ bool) (int, int64, bool) {
+		return old + 1, 0, true
+	})
+	require.False(t, ok)
+	follower.Del(3)
+	follower.Wait()
+	_, ok = follower.Get(3)
+	require.True(t, ok)
+
+	// Missed mutations are reported.
+	require.Equal(t, ErrMutationGap, follower.ApplyMutation(Mutation[int]{Seq: 100, Op: MutationDel}))
+}
+
+func TestMutationEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewMutationEncoder[int](&buf, encodeInt)
+	muts := []Mutation[int]{
+		{Seq: 1, Op: MutationSet, Key: 1, Conflict: 2, Value: 3, Cost: 4,
+			Expiration: time.Unix(0, 5), Meta: 6},
+		{Seq: 2, Op: MutationSet, Update: true, Key: 1, Value: 7},
+		{Seq: 3, Op: MutationExpire, Key: 1, Conflict: 2},
+		{Seq: 4, Op: MutationClear},
+	}
+	for _, m := range muts {
+		require.NoError(t, enc.Encode(m))
+	}
+	require.NoError(t, enc.Flush())
+
+	dec := NewMutationDecoder[int](&buf, decodeInt)
+	for _, want := range muts {
+		m, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, want, m)
+	}
+	_, err := dec.Decode()
+	require.Equal(t, io.EOF, err)
+}
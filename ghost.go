@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// ghostList remembers the hashes of the last keys evicted by the policy, so a
+// key evicted moments ago and asked for again is admitted without building up
+// its frequency first. It isn't safe for concurrent use, the policy lock
+// guards it. A nil ghostList remembers nothing.
+type ghostList struct {
+	// keys is a ring of the evicted key hashes, next the number of keys added
+	// to it so far.
+	keys []uint64
+	next uint64
+	// seqs maps the keys in the ring to the value of next when they were
+	// added, to tell them apart from keys overwritten or removed since.
+	seqs map[uint64]uint64
+}
+
+func newGhostList(size int64) *ghostList {
+	if size <= 0 {
+		return nil
+	}
+	return &ghostList{
+		keys: make([]uint64, size),
+		seqs: make(map[uint64]uint64, size),
+	}
+}
+
+// add remembers key, forgetting the oldest key if the ring is full.
+func (g *ghostList) add(key uint64) {
+	if g == nil {
+		return
+	}
+	slot := g.next % uint64(len(g.keys))
+	if g.next >= uint64(len(g.keys)) {
+		old := g.keys[slot]
+		if seq, ok := g.seqs[old]; ok && seq == g.next-uint64(len(g.keys)) {
+			delete(g.seqs, old)
+		}
+	}
+	g.keys[slot] = key
+	g.seqs[key] = g.next
+	g.next++
+}
+
+// has returns whether key was evicted recently.
+func (g *ghostList) has(key uint64) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := g.seqs[key]
+	return ok
+}
+
+// remove forgets key, once it's back in the cache.
+func (g *ghostList) remove(key uint64) {
+	if g == nil {
+		return
+	}
+	delete(g.seqs, key)
+}
+
+func (g *ghostList) clear() {
+	if g == nil {
+		return
+	}
+	g.next = 0
+	for key := range g.seqs {
+		delete(g.seqs, key)
+	}
+}
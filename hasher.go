@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"github.com/paivagustavo/ristretto/z"
+)
+
+// Hasher hashes keys of type K, for the key types z.KeyToHash doesn't support,
+// such as structs, UUIDs or composite keys. See Config.Hasher.
+type Hasher[K any] interface {
+	// Hash returns the hash of the key, which identifies it in the cache, and
+	// its conflict hash, which tells apart keys with the same hash. The
+	// conflict hash can be 0 if keys never share a hash. z.KeyDigest can
+	// compute both from the fields of the key.
+	Hash(key K) (keyHash, conflictHash uint64)
+}
+
+// HasherFunc adapts a function to the Hasher interface.
+type HasherFunc[K any] func(key K) (uint64, uint64)
+
+// Hash calls f(key).
+func (f HasherFunc[K]) Hash(key K) (uint64, uint64) {
+	return f(key)
+}
+
+// WideHasher is a Hasher that can also compute the high half of a 128-bit
+// conflict hash, needed by Config.WideConflict.
+type WideHasher[K any] interface {
+	Hasher[K]
+	// ConflictHi returns 64 bits of hash of the key independent of the ones
+	// returned by Hash. It can return 0 for keys that are fully told apart by
+	// Hash, such as integers.
+	ConflictHi(key K) uint64
+}
+
+// seededKeyToHash returns a function mixing the seed into the hashes returned
+// by keyToHash, see Config.HashSeed. The conflict hashes are left alone.
+func seededKeyToHash[K any](keyToHash func(K) (uint64, uint64), seed uint64) func(K) (uint64, uint64) {
+	return func(key K) (uint64, uint64) {
+		keyHash, conflictHash := keyToHash(key)
+		return z.SeedHash(keyHash, seed), conflictHash
+	}
+}
+
+// randomSeed returns a random, non-zero seed for Config.RandomHashSeed.
+func randomSeed() uint64 {
+	for {
+		if seed := z.NewSipKey().K0; seed != 0 {
+			return seed
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build go1.23
+
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "iter"
+
+// All returns an iterator over the key hashes and values in the cache. The
+// cache only stores the hashes of the keys, so the original keys can't be
+// returned. Items that expired are skipped.
+//
+// The cache is iterated shard by shard without blocking other operations, so
+// items set or deleted while iterating may or may not be seen.
+func (c *Cache[K, V]) All() iter.Seq2[uint64, V] {
+	return func(yield func(uint64, V) bool) {
+		if c == nil || c.isClosed {
+			return
+		}
+		c.store.Range(func(key uint64, si storeItem[V]) bool {
+			return yield(key, si.value)
+		})
+	}
+}
+
+// Items works like All but yields the whole Item, including the cost, the
+// expiration and the metadata of each value.
+func (c *Cache[K, V]) Items() iter.Seq2[uint64, Item[V]] {
+	return func(yield func(uint64, Item[V]) bool) {
+		if c == nil || c.isClosed {
+			return
+		}
+		c.store.Range(func(key uint64, si storeItem[V]) bool {
+			return yield(key, Item[V]{
+				Key:        key,
+				Conflict:   si.conflict,
+				Value:      si.value,
+				Cost:       c.policy.Cost(key),
+				Expiration: si.expirationTime(),
+				Meta:       si.meta,
+				Version:    si.version,
+			})
+		})
+	}
+}
@@ -0,0 +1,52 @@
+//go:build go1.23
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheAll(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		KeyToHash: func(key int) (uint64, uint64) {
+			return uint64(key), 0
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 1; i <= 10; i++ {
+		retrySet(t, c, i, i*10, int64(i), 0)
+	}
+
+	values := make(map[uint64]int)
+	for key, value := range c.All() {
+		values[key] = value
+	}
+	require.Equal(t, 10, len(values))
+	for i := 1; i <= 10; i++ {
+		require.Equal(t, i*10, values[uint64(i)])
+	}
+
+	var n int
+	for key, item := range c.Items() {
+		require.Equal(t, key, item.Key)
+		require.Equal(t, int64(key), item.Cost)
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	require.Equal(t, 3, n)
+
+	var nilCache *Cache[int, int]
+	for range nilCache.All() {
+		t.Fatal("nil cache yielded an item")
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+// lirsHIRPercent is the share of the resident keys kept as HIR keys by the
+// LIRS Eviction, which the LIRS paper found to work well at 1%.
+const lirsHIRPercent = 1
+
+// lirsEntry is a key tracked by the LIRS Eviction.
+type lirsEntry struct {
+	key uint64
+	// lir tells whether the key has a low inter-reference recency, and
+	// resident whether it's in the cache.
+	lir      bool
+	resident bool
+	// stack, queue and ghost are the elements of the key in the lists of the
+	// Eviction, or nil if it's not in them.
+	stack *list.Element
+	queue *list.Element
+	ghost *list.Element
+}
+
+// lirsEviction is an Eviction implementing LIRS, the Low Inter-reference
+// Recency Set replacement of Jiang and Zhang. Keys are ranked by the number of
+// distinct keys read between their last two reads instead of since their last
+// read, so keys read once, as in a scan, are evicted before the ones read
+// again, however long ago.
+type lirsEviction struct {
+	// stack holds the LIR keys and the HIR keys, resident or not, read more
+	// recently than the least recent LIR key, most recent first.
+	stack *list.List
+	// queue holds the resident HIR keys, which are evicted first, most recent
+	// first.
+	queue *list.List
+	// ghosts holds the keys that aren't resident but kept in stack, most
+	// recently evicted first. They're bounded by the number of resident keys.
+	ghosts *list.List
+	keys   map[uint64]*lirsEntry
+	lirs   int
+}
+
+// NewLIRSEviction returns an Eviction implementing LIRS, which keeps the keys
+// read repeatedly over the ones read only once, even if they were read more
+// recently. It resists scans, where LRU flushes the keys worth keeping and LFU
+// is slow to adapt to the keys becoming hot, such as in database page caches.
+// Keys are read when added, updated or read. It can be passed in
+// Config.Eviction.
+func NewLIRSEviction() Eviction {
+	return &lirsEviction{
+		stack:  list.New(),
+		queue:  list.New(),
+		ghosts: list.New(),
+		keys:   make(map[uint64]*lirsEntry),
+	}
+}
+
+// maxLIRs returns the number of LIR keys to keep for the given number of
+// resident keys.
+func maxLIRs(resident int) int {
+	hirs := resident * lirsHIRPercent / 100
+	if hirs < 1 {
+		hirs = 1
+	}
+	return resident - hirs
+}
+
+func (e *lirsEviction) resident() int {
+	return e.lirs + e.queue.Len()
+}
+
+func (e *lirsEviction) Add(key uint64, _ int64) {
+	en, ok := e.keys[key]
+	if ok && en.resident {
+		e.Access(key)
+		return
+	}
+	if !ok {
+		en = &lirsEntry{key: key}
+		e.keys[key] = en
+	}
+	en.resident = true
+	if en.ghost != nil {
+		e.ghosts.Remove(en.ghost)
+		en.ghost = nil
+	}
+	switch {
+	case en.stack != nil:
+		// The key was read again while still in the stack, so its
+		// inter-reference recency is lower than the one of the least recent
+		// LIR key.
+		e.stack.MoveToFront(en.stack)
+		e.setLIR(en)
+	case e.lirs < maxLIRs(e.resident()+1):
+		// Warming up.
+		en.stack = e.stack.PushFront(en)
+		e.setLIR(en)
+	default:
+		en.stack = e.stack.PushFront(en)
+		en.queue = e.queue.PushFront(en)
+	}
+	e.balance()
+}
+
+func (e *lirsEviction) Update(key uint64, _ int64) {
+	e.Access(key)
+}
+
+func (e *lirsEviction) Access(key uint64) {
+	en, ok := e.keys[key]
+	if !ok || !en.resident {
+		return
+	}
+	switch {
+	case en.lir:
+		e.stack.MoveToFront(en.stack)
+		e.prune()
+	case en.stack != nil:
+		e.stack.MoveToFront(en.stack)
+		e.queue.Remove(en.queue)
+		en.queue = nil
+		e.setLIR(en)
+		e.balance()
+	default:
+		en.stack = e.stack.PushFront(en)
+		e.queue.MoveToFront(en.queue)
+	}
+}
+
+func (e *lirsEviction) Del(key uint64) {
+	en, ok := e.keys[key]
+	if !ok || !en.resident {
+		return
+	}
+	en.resident = false
+	if en.lir {
+		en.lir = false
+		e.lirs--
+		e.forget(en)
+		e.prune()
+		return
+	}
+	e.queue.Remove(en.queue)
+	en.queue = nil
+	if en.stack == nil {
+		delete(e.keys, key)
+		return
+	}
+	// Keep the key in the stack, as a ghost, to tell whether it's read again
+	// soon enough to become a LIR key.
+	en.ghost = e.ghosts.PushFront(en)
+	for e.ghosts.Len() > e.resident() {
+		e.forget(e.ghosts.Back().Value.(*lirsEntry))
+	}
+}
+
+// Victims returns the resident HIR keys first, least recent first, and then
+// the LIR keys, from the bottom of the stack.
+func (e *lirsEviction) Victims(fn func(uint64) bool) {
+	for elem := e.queue.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(*lirsEntry).key) {
+			return
+		}
+	}
+	for elem := e.stack.Back(); elem != nil; elem = elem.Prev() {
+		if en := elem.Value.(*lirsEntry); en.lir && !fn(en.key) {
+			return
+		}
+	}
+}
+
+func (e *lirsEviction) Clear() {
+	e.stack.Init()
+	e.queue.Init()
+	e.ghosts.Init()
+	e.keys = make(map[uint64]*lirsEntry)
+	e.lirs = 0
+}
+
+// setLIR makes the resident key a LIR key.
+func (e *lirsEviction) setLIR(en *lirsEntry) {
+	if !en.lir {
+		en.lir = true
+		e.lirs++
+	}
+}
+
+// balance turns the least recent LIR keys into HIR keys while there are too
+// many of them.
+func (e *lirsEviction) balance() {
+	for e.lirs > 0 && e.lirs > maxLIRs(e.resident()) {
+		e.prune()
+		en := e.stack.Back().Value.(*lirsEntry)
+		en.lir = false
+		e.lirs--
+		e.stack.Remove(en.stack)
+		en.stack = nil
+		en.queue = e.queue.PushFront(en)
+	}
+	e.prune()
+}
+
+// prune removes the HIR keys from the bottom of the stack, so it's always a
+// LIR key. They can't become LIR keys anymore, as their inter-reference
+// recency is higher than the one of every LIR key.
+func (e *lirsEviction) prune() {
+	for elem := e.stack.Back(); elem != nil; elem = e.stack.Back() {
+		en := elem.Value.(*lirsEntry)
+		if en.lir {
+			return
+		}
+		if en.resident {
+			e.stack.Remove(elem)
+			en.stack = nil
+		} else {
+			e.forget(en)
+		}
+	}
+}
+
+// forget stops tracking the key, which isn't resident.
+func (e *lirsEviction) forget(en *lirsEntry) {
+	if en.stack != nil {
+		e.stack.Remove(en.stack)
+		en.stack = nil
+	}
+	if en.ghost != nil {
+		e.ghosts.Remove(en.ghost)
+		en.ghost = nil
+	}
+	delete(e.keys, en.key)
+}
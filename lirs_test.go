@@ -0,0 +1,125 @@
+package ristretto
+
+import (
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/paivagustavo/ristretto/sim"
+	"github.com/stretchr/testify/require"
+)
+
+// simulateEviction runs the keys through a cache holding up to capacity keys,
+// evicting the victims chosen by e, and returns the hit ratio.
+func simulateEviction(e Eviction, keys []uint64, capacity int) float64 {
+	resident := make(map[uint64]bool, capacity)
+	var hits int
+	for _, key := range keys {
+		if resident[key] {
+			hits++
+			e.Access(key)
+			continue
+		}
+		if len(resident) >= capacity {
+			e.Victims(func(victim uint64) bool {
+				delete(resident, victim)
+				e.Del(victim)
+				return false
+			})
+		}
+		resident[key] = true
+		e.Add(key, 1)
+	}
+	return float64(hits) / float64(len(keys))
+}
+
+// lirsTrace returns the first n keys of the gli trace of the LIRS paper.
+func lirsTrace(tb testing.TB, n int) []uint64 {
+	f, err := os.Open("./sim/gli.lirs.gz")
+	require.NoError(tb, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(tb, err)
+	keys := sim.NewReader(sim.ParseLIRS, r)
+	trace := make([]uint64, 0, n)
+	for len(trace) < n {
+		key, err := keys()
+		if err != nil {
+			break
+		}
+		trace = append(trace, key)
+	}
+	return trace
+}
+
+func TestLIRSEvictionScan(t *testing.T) {
+	// Keys 1 to 90 are read twice, so they become LIR keys, and then a scan
+	// of keys read once goes through the cache before they're read again.
+	var keys []uint64
+	for pass := 0; pass < 3; pass++ {
+		if pass == 2 {
+			for key := uint64(1000); key < 2000; key++ {
+				keys = append(keys, key)
+			}
+		}
+		for key := uint64(1); key <= 90; key++ {
+			keys = append(keys, key)
+		}
+	}
+	n := float64(len(keys))
+	// LRU only hits in the second pass, while LIRS keeps the keys through the
+	// scan, but for the HIR key it keeps while warming up.
+	require.Equal(t, 90/n, simulateEviction(NewLRUEviction(), keys, 100))
+	require.Equal(t, 179/n, simulateEviction(NewLIRSEviction(), keys, 100))
+}
+
+func TestLIRSEvictionGhost(t *testing.T) {
+	e := NewLIRSEviction().(*lirsEviction)
+	for key := uint64(1); key <= 200; key++ {
+		e.Add(key, 1)
+	}
+	// The HIR keys evicted stay in the stack, bounded by the resident keys.
+	var victims []uint64
+	e.Victims(func(key uint64) bool {
+		victims = append(victims, key)
+		return len(victims) < 150
+	})
+	for _, key := range victims {
+		e.Del(key)
+	}
+	require.Equal(t, 50, e.resident())
+	require.LessOrEqual(t, e.ghosts.Len(), 50)
+	require.LessOrEqual(t, len(e.keys), 100)
+
+	// A ghost read again becomes a LIR key.
+	ghost := e.ghosts.Front().Value.(*lirsEntry).key
+	e.Add(ghost, 1)
+	require.True(t, e.keys[ghost].lir)
+}
+
+func TestLIRSEvictionTrace(t *testing.T) {
+	keys := lirsTrace(t, 100000)
+	lirs := simulateEviction(NewLIRSEviction(), keys, 500)
+	lru := simulateEviction(NewLRUEviction(), keys, 500)
+	t.Logf("lirs: %.4f, lru: %.4f", lirs, lru)
+	require.Greater(t, lirs, lru)
+}
+
+func BenchmarkEvictionTrace(b *testing.B) {
+	keys := lirsTrace(b, 100000)
+	for _, bench := range []struct {
+		name        string
+		newEviction func() Eviction
+	}{
+		{"LRU", NewLRUEviction},
+		{"LIRS", NewLIRSEviction},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				ratio = simulateEviction(bench.newEviction(), keys, 500)
+			}
+			b.ReportMetric(ratio, "hit-ratio")
+		})
+	}
+}
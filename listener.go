@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ListenerID identifies a listener added with Cache.AddListener.
+type ListenerID uint64
+
+type listener[V any] struct {
+	id ListenerID
+	fn func(Item[V])
+}
+
+// listeners holds the listeners added to a cache. Adding and removing them
+// copies the list, so calling them doesn't take any lock.
+type listeners[V any] struct {
+	mu   sync.Mutex
+	next ListenerID
+	// list holds a []listener[V].
+	list atomic.Value
+}
+
+func (l *listeners[V]) add(fn func(Item[V])) ListenerID {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	old, _ := l.list.Load().([]listener[V])
+	list := make([]listener[V], 0, len(old)+1)
+	list = append(list, old...)
+	l.list.Store(append(list, listener[V]{id: l.next, fn: fn}))
+	return l.next
+}
+
+func (l *listeners[V]) remove(id ListenerID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, _ := l.list.Load().([]listener[V])
+	for n := range old {
+		if old[n].id != id {
+			continue
+		}
+		list := make([]listener[V], 0, len(old)-1)
+		list = append(list, old[:n]...)
+		l.list.Store(append(list, old[n+1:]...))
+		return true
+	}
+	return false
+}
+
+func (l *listeners[V]) call(item Item[V]) {
+	list, _ := l.list.Load().([]listener[V])
+	for _, ln := range list {
+		ln.fn(item)
+	}
+}
+
+// AddListener adds a function called, like Config.OnEvict, for every item
+// evicted or expired, and returns the ID to remove it with. Any number of
+// listeners can be added and removed while the cache is in use. They're
+// called from internal goroutines, so they must be safe for concurrent use.
+func (c *Cache[K, V]) AddListener(fn func(item Item[V])) ListenerID {
+	if c == nil || fn == nil {
+		return 0
+	}
+	return c.listeners.add(fn)
+}
+
+// RemoveListener removes the listener with the given ID. It returns false if
+// there's no such listener.
+func (c *Cache[K, V]) RemoveListener(id ListenerID) bool {
+	if c == nil {
+		return false
+	}
+	return c.listeners.remove(id)
+}
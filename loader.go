@@ -0,0 +1,420 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrNoLoader is returned by GetOrLoad when Config.Loader isn't set.
+var ErrNoLoader = errors.New("no loader is set")
+
+// Loaded is the value returned by Config.Loader for a key, along with how it's
+// cached, so the freshness rules of each source live with its loader.
+type Loaded[V any] struct {
+	// Value is the value loaded.
+	Value V
+	// Cost is the cost of the value, as passed to Set.
+	Cost int64
+	// TTL is the time to live of the value, as passed to SetWithTTL. If zero,
+	// the value expires after Config.DefaultTTL, as with Set.
+	TTL time.Duration
+	// RefreshAfter, if set, makes GetOrLoad load the value again in the
+	// background once it's been cached that long. The cached value is
+	// returned until the new one replaces it.
+	RefreshAfter time.Duration
+	// NoCache makes GetOrLoad return the value without caching it, for
+	// example for an error page or a partial result.
+	NoCache bool
+}
+
+// loader runs Config.Loader, making sure a single load of each key runs at
+// once. A nil *loader loads nothing.
+type loader[K any, V any] struct {
+	fn func(key K) (Loaded[V], error)
+	// background limits the loads running in the background, see
+	// Config.MaxBackgroundLoads.
+	background chan struct{}
+	mu         sync.Mutex
+	// calls holds the loads running, by key hash.
+	calls map[uint64]*loadCall[V]
+	// refreshAt holds when the keys loaded with Loaded.RefreshAfter are due
+	// to be loaded again, by key hash.
+	refreshAt map[uint64]loadRefresh
+	// periodic holds the keys passed to RefreshEvery, by key hash. wake is
+	// signaled when it changes, and stop is closed by Close.
+	periodic map[uint64]*periodicRefresh[K]
+	wake     chan struct{}
+	stop     chan struct{}
+}
+
+// loadCall is a load of a key, shared by all the callers asking for the key
+// while it runs.
+type loadCall[V any] struct {
+	conflict uint64
+	// again is set by Refresh while the load runs, so the key is loaded
+	// again once it's done, in case it started before the data changed.
+	again bool
+	// done is closed once value and err are set.
+	done  chan struct{}
+	value V
+	err   error
+}
+
+type periodicRefresh[K any] struct {
+	key   K
+	every time.Duration
+	// next is when the key is loaded next.
+	next time.Time
+}
+
+type loadRefresh struct {
+	conflict uint64
+	// at is in Unix nanoseconds.
+	at    int64
+	after time.Duration
+}
+
+func newLoader[K any, V any](fn func(key K) (Loaded[V], error), maxBackground int) *loader[K, V] {
+	if fn == nil {
+		return nil
+	}
+	if maxBackground == 0 {
+		maxBackground = runtime.GOMAXPROCS(0)
+	}
+	return &loader[K, V]{
+		fn:         fn,
+		background: make(chan struct{}, maxBackground),
+		calls:      make(map[uint64]*loadCall[V]),
+		refreshAt:  make(map[uint64]loadRefresh),
+		periodic:   make(map[uint64]*periodicRefresh[K]),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// close stops the periodic refreshes.
+func (l *loader[K, V]) close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+}
+
+// memoryUsage estimates the memory taken by the loader in bytes.
+func (l *loader[K, V]) memoryUsage() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return mapBytes(len(l.calls), 8, 8) + mapBytes(len(l.refreshAt), 8, 24) +
+		mapBytes(len(l.periodic), 8, 8)
+}
+
+// start returns the load of the key running, if any, or starts a new one,
+// in which case it also returns true and the caller must run it.
+func (l *loader[K, V]) start(key, conflict uint64) (*loadCall[V], bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if call, ok := l.calls[key]; ok && call.conflict == conflict {
+		return call, false
+	}
+	call := &loadCall[V]{conflict: conflict, done: make(chan struct{})}
+	l.calls[key] = call
+	return call, true
+}
+
+// restart works like start but if the key is being loaded, it makes it load
+// again once done.
+func (l *loader[K, V]) restart(key, conflict uint64) (*loadCall[V], bool) {
+	l.mu.Lock()
+	if call, ok := l.calls[key]; ok && call.conflict == conflict {
+		call.again = true
+		l.mu.Unlock()
+		return call, false
+	}
+	l.mu.Unlock()
+	return l.start(key, conflict)
+}
+
+// finish removes the load of the key once it's done, and records when it's
+// due to be loaded again. If the load failed, the key is tried again after
+// the RefreshAfter it was loaded with last. It returns true if Refresh asked
+// for the key to be loaded again meanwhile.
+func (l *loader[K, V]) finish(key uint64, call *loadCall[V], refreshAfter time.Duration) bool {
+	l.mu.Lock()
+	if l.calls[key] == call {
+		delete(l.calls, key)
+	}
+	if r, ok := l.refreshAt[key]; ok && call.err != nil && r.conflict == call.conflict {
+		refreshAfter = r.after
+	}
+	if refreshAfter > 0 {
+		l.refreshAt[key] = loadRefresh{
+			conflict: call.conflict,
+			at:       time.Now().Add(refreshAfter).UnixNano(),
+			after:    refreshAfter,
+		}
+	} else {
+		delete(l.refreshAt, key)
+	}
+	again := call.again
+	l.mu.Unlock()
+	close(call.done)
+	return again
+}
+
+// due returns true if the key was loaded with Loaded.RefreshAfter, that long
+// ago, and isn't being loaded already.
+func (l *loader[K, V]) due(key, conflict uint64) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.refreshAt[key]
+	if !ok || r.conflict != conflict || time.Now().UnixNano() < r.at {
+		return false
+	}
+	_, loading := l.calls[key]
+	return !loading
+}
+
+// cleanup forgets when to refresh the keys that aren't cached anymore.
+func (l *loader[K, V]) cleanup(cached func(key, conflict uint64) bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for key, r := range l.refreshAt {
+		if !cached(key, r.conflict) {
+			delete(l.refreshAt, key)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// GetOrLoad returns the value of the key, loading it with Config.Loader if
+// it isn't cached, and caching it as the Loaded returned says. Concurrent
+// calls for a key that isn't cached share a single load. If the value was
+// loaded with Loaded.RefreshAfter and is due, it's loaded again in the
+// background, and the cached value is returned meanwhile.
+//
+// It returns the error of the Loader, or ErrNoLoader if Config.Loader isn't
+// set.
+func (c *Cache[K, V]) GetOrLoad(key K) (V, error) {
+	var zero V
+	if c == nil || c.isClosed {
+		return zero, ErrClosed
+	}
+	if c.loader == nil {
+		return zero, ErrNoLoader
+	}
+	if value, ok := c.Get(key); ok {
+		keyHash, conflictHash := c.keyToHash(key)
+		if c.loader.due(keyHash, conflictHash) {
+			c.loadAsync(key)
+		}
+		return value, nil
+	}
+	call := c.load(key)
+	<-call.done
+	return call.value, call.err
+}
+
+// load starts loading the key, unless it's being loaded already, and returns
+// the load.
+func (c *Cache[K, V]) load(key K) *loadCall[V] {
+	keyHash, conflictHash := c.keyToHash(key)
+	call, ok := c.loader.start(keyHash, conflictHash)
+	if ok {
+		c.runLoad(key, keyHash, call)
+	}
+	return call
+}
+
+// loadAsync works like load but runs the Loader on another goroutine.
+func (c *Cache[K, V]) loadAsync(key K) {
+	keyHash, conflictHash := c.keyToHash(key)
+	call, ok := c.loader.start(keyHash, conflictHash)
+	if ok {
+		c.runLoadAsync(key, keyHash, call)
+	}
+}
+
+// runLoadAsync runs the load started on another goroutine, once fewer than
+// Config.MaxBackgroundLoads are running.
+func (c *Cache[K, V]) runLoadAsync(key K, keyHash uint64, call *loadCall[V]) {
+	c.goWorker("load", func() {
+		c.loader.background <- struct{}{}
+		defer func() { <-c.loader.background }()
+		c.runLoad(key, keyHash, call)
+	})
+}
+
+// Prefetch loads the keys that aren't cached with Config.Loader in the
+// background, so they're likely cached by the time they're needed. The keys
+// being loaded already aren't loaded again, and at most
+// Config.MaxBackgroundLoads loads run at once. It returns ErrNoLoader if
+// Config.Loader isn't set.
+func (c *Cache[K, V]) Prefetch(keys ...K) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	if c.loader == nil {
+		return ErrNoLoader
+	}
+	for _, key := range keys {
+		// Check the store directly, so prefetching isn't counted as a hit
+		// or an access.
+		keyHash, conflictHash := c.keyToHash(key)
+		if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+			c.loadAsync(key)
+		}
+	}
+	return nil
+}
+
+// Refresh loads the key again with Config.Loader in the background, and
+// replaces its value once it's loaded, so a writer can update the cache after
+// changing the data instead of deleting the key and having the readers miss.
+// The old value is kept if the load fails. If the key is being loaded
+// already, it's loaded again once done, as that load may have read the data
+// before the change. Keys that aren't cached aren't loaded, as GetOrLoad
+// loads them when needed. It returns ErrNoLoader if Config.Loader isn't set.
+func (c *Cache[K, V]) Refresh(key K) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	if c.loader == nil {
+		return ErrNoLoader
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		return nil
+	}
+	if call, ok := c.loader.restart(keyHash, conflictHash); ok {
+		c.runLoadAsync(key, keyHash, call)
+	}
+	return nil
+}
+
+// runLoad calls the Loader for the key and caches the value it returns. The
+// cached value is kept if it fails.
+func (c *Cache[K, V]) runLoad(key K, keyHash uint64, call *loadCall[V]) {
+	loaded, err := c.loader.fn(key)
+	call.value, call.err = loaded.Value, err
+	var refreshAfter time.Duration
+	if err == nil && !loaded.NoCache {
+		ttl := loaded.TTL
+		if ttl == 0 {
+			ttl = c.current().defaultTTL
+		}
+		c.SetWithTTL(key, loaded.Value, loaded.Cost, ttl)
+		refreshAfter = loaded.RefreshAfter
+	}
+	if c.loader.finish(keyHash, call, refreshAfter) {
+		c.loadAsync(key)
+	}
+}
+
+// RefreshEvery makes the key load again with Config.Loader in the background
+// every interval, whether it's read or not, like Refresh but also when it
+// isn't cached, so entries such as configurations or dashboards stay fresh
+// without checking them on every read. The first load is after interval. A
+// zero or negative interval stops refreshing the key. To refresh all the keys
+// matching a pattern, call it from Config.Loader for them. It returns
+// ErrNoLoader if Config.Loader isn't set.
+func (c *Cache[K, V]) RefreshEvery(key K, interval time.Duration) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	if c.loader == nil {
+		return ErrNoLoader
+	}
+	keyHash, _ := c.keyToHash(key)
+	l := c.loader
+	l.mu.Lock()
+	if interval > 0 {
+		l.periodic[keyHash] = &periodicRefresh[K]{
+			key:   key,
+			every: interval,
+			next:  time.Now().Add(interval),
+		}
+	} else {
+		delete(l.periodic, keyHash)
+	}
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// refreshPeriodically loads the keys passed to RefreshEvery when they're due,
+// until the cache is closed.
+func (c *Cache[K, V]) refreshPeriodically() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.loader.stop:
+			return
+		case <-c.loader.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next := c.refreshDue(); !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// refreshDue starts loading the keys passed to RefreshEvery that are due, and
+// returns when the next one is due, or the zero time if none is.
+func (c *Cache[K, V]) refreshDue() time.Time {
+	l := c.loader
+	now := time.Now()
+	var due []K
+	var next time.Time
+	l.mu.Lock()
+	for _, p := range l.periodic {
+		if !now.Before(p.next) {
+			due = append(due, p.key)
+			p.next = now.Add(p.every)
+		}
+		if next.IsZero() || p.next.Before(next) {
+			next = p.next
+		}
+	}
+	l.mu.Unlock()
+	for _, key := range due {
+		c.loadAsync(key)
+	}
+	return next
+}
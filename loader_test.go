@@ -0,0 +1,282 @@
+package ristretto
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGetOrLoad(t *testing.T) {
+	var loads int64
+	release := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(key int) (Loaded[int], error) {
+			atomic.AddInt64(&loads, 1)
+			<-release
+			return Loaded[int]{Value: key * 10, Cost: 1, TTL: time.Hour}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The concurrent calls share a single load.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.GetOrLoad(1)
+			require.NoError(t, err)
+			require.Equal(t, 10, value)
+		}()
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&loads))
+
+	c.Wait()
+	value, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, value)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > time.Minute)
+	_, err = c.GetOrLoad(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&loads))
+}
+
+func TestCacheGetOrLoadError(t *testing.T) {
+	errLoad := errors.New("load failed")
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(key int) (Loaded[int], error) {
+			switch key {
+			case 1:
+				return Loaded[int]{}, errLoad
+			default:
+				return Loaded[int]{Value: key, Cost: 1, NoCache: true}, nil
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.GetOrLoad(1)
+	require.Equal(t, errLoad, err)
+	value, err := c.GetOrLoad(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, value)
+	c.Wait()
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+
+	c, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.GetOrLoad(1)
+	require.Equal(t, ErrNoLoader, err)
+}
+
+func TestCacheGetOrLoadRefreshAfter(t *testing.T) {
+	var loads int64
+	c, err := NewCache(&Config[int, int64]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(key int) (Loaded[int64], error) {
+			n := atomic.AddInt64(&loads, 1)
+			return Loaded[int64]{Value: n, Cost: 1, RefreshAfter: wait}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	value, err := c.GetOrLoad(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), value)
+	c.Wait()
+	value, err = c.GetOrLoad(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), value)
+	require.Equal(t, int64(1), atomic.LoadInt64(&loads))
+
+	// Once due, the cached value is returned while it's loaded again.
+	time.Sleep(2 * wait)
+	value, err = c.GetOrLoad(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), value)
+	require.Eventually(t, func() bool {
+		value, ok := c.Get(1)
+		return ok && value == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var loads, running, maxRunning int64
+	release := make(chan struct{})
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		MaxBackgroundLoads: 2,
+		Loader: func(key int) (Loaded[int], error) {
+			atomic.AddInt64(&loads, 1)
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				max := atomic.LoadInt64(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+					break
+				}
+			}
+			<-release
+			return Loaded[int]{Value: key, Cost: 1}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 0, 0, 1, 0)
+	require.NoError(t, c.Prefetch(0, 1, 2, 3, 4))
+	// The keys being loaded aren't loaded again.
+	require.NoError(t, c.Prefetch(1, 2))
+	time.Sleep(wait)
+	require.Equal(t, int64(2), atomic.LoadInt64(&running))
+	close(release)
+	require.Eventually(t, func() bool {
+		c.Wait()
+		for i := 1; i < 5; i++ {
+			if _, ok := c.Get(i); !ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, wait)
+	require.Equal(t, int64(4), atomic.LoadInt64(&loads))
+	require.Equal(t, int64(2), atomic.LoadInt64(&maxRunning))
+
+	c, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, ErrNoLoader, c.Prefetch(1))
+}
+
+func TestCacheRefresh(t *testing.T) {
+	var source int32 = 1
+	fail := int32(0)
+	started := make(chan struct{}, 10)
+	release := make(chan struct{}, 10)
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(key int) (Loaded[int], error) {
+			value := int(atomic.LoadInt32(&source))
+			started <- struct{}{}
+			<-release
+			if atomic.LoadInt32(&fail) == 1 {
+				return Loaded[int]{}, errors.New("load failed")
+			}
+			return Loaded[int]{Value: value, Cost: 1}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	cached := func(value int) func() bool {
+		return func() bool {
+			c.Wait()
+			v, ok := c.Get(1)
+			return ok && v == value
+		}
+	}
+
+	// Keys that aren't cached aren't loaded.
+	require.NoError(t, c.Refresh(1))
+	time.Sleep(wait)
+	require.Len(t, started, 0)
+
+	retrySet(t, c, 1, 0, 1, 0)
+	require.NoError(t, c.Refresh(1))
+	<-started
+	// The data changes while it's loaded, so it's loaded again.
+	atomic.StoreInt32(&source, 2)
+	require.NoError(t, c.Refresh(1))
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	require.Eventually(t, cached(2), time.Second, wait)
+
+	// The old value is kept if the load fails.
+	atomic.StoreInt32(&fail, 1)
+	require.NoError(t, c.Refresh(1))
+	<-started
+	release <- struct{}{}
+	time.Sleep(wait)
+	require.True(t, cached(2)())
+}
+
+func TestCacheRefreshEvery(t *testing.T) {
+	var loads int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Loader: func(key int) (Loaded[int], error) {
+			return Loaded[int]{Value: int(atomic.AddInt64(&loads, 1)), Cost: 1}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The key is loaded without being read.
+	require.NoError(t, c.RefreshEvery(1, wait))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&loads) >= 3
+	}, time.Second, time.Millisecond)
+	c.Wait()
+	value, ok := c.Get(1)
+	require.True(t, ok)
+	require.True(t, value >= 2)
+
+	require.NoError(t, c.RefreshEvery(1, 0))
+	time.Sleep(wait)
+	stopped := atomic.LoadInt64(&loads)
+	time.Sleep(5 * wait)
+	require.Equal(t, stopped, atomic.LoadInt64(&loads))
+
+	c, err = NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, ErrNoLoader, c.RefreshEvery(1, time.Second))
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "fmt"
+
+// Logger is used by the cache to report internal conditions that would
+// otherwise go unnoticed, such as Sets being dropped. *log.Logger from the
+// standard library can be adapted with a one-line wrapper.
+type Logger interface {
+	Warningf(format string, args ...interface{})
+}
+
+// WarningKind identifies the condition reported by a Warning.
+type WarningKind int
+
+const (
+	// WarnSetsDropped means many Sets were dropped because the Set buffer was
+	// full, that is, the cache can't keep up with the rate of Sets.
+	WarnSetsDropped WarningKind = iota
+	// WarnCleanupOverrun means a TTL cleanup took longer than its interval.
+	WarnCleanupOverrun
+	// WarnExpiredBacklog means the expired items waiting to be removed grew
+	// since the last cleanup, see Config.MaxCleanupItems.
+	WarnExpiredBacklog
+	// WarnSketchSaturated means the cache holds more items than
+	// Config.NumCounters, so their access frequencies can't be told apart
+	// and the hit ratio suffers.
+	WarnSketchSaturated
+)
+
+// Warning is passed to Config.OnWarning when the cache detects a condition
+// that degrades it.
+type Warning struct {
+	Kind    WarningKind
+	Message string
+}
+
+// droppedSetsWarnThreshold is the number of Sets dropped between two cleanup
+// ticks above which a warning is reported.
+const droppedSetsWarnThreshold = 1000
+
+// warningf reports a warning to the Logger and the OnWarning callback of the
+// cache, if any.
+func (c *Cache[K, V]) warningf(kind WarningKind, format string, args ...interface{}) {
+	if c.logger == nil && c.onWarning == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if c.logger != nil {
+		c.logger.Warningf("%s", msg)
+	}
+	if c.onWarning != nil {
+		c.onWarning(Warning{Kind: kind, Message: msg})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// MemoryUsage is an estimate of the memory taken by a cache, in bytes, see
+// Cache.EstimatedMemoryUsage.
+type MemoryUsage struct {
+	// Items is the memory taken by the items in the store, including the map
+	// buckets holding them and the values stored inline, such as numbers,
+	// structs and the headers of slices and strings.
+	Items uint64
+	// Expirations is the memory taken by the buckets tracking the items with
+	// a TTL.
+	Expirations uint64
+	// Policy is the memory taken by the admission policy, its sketch and
+	// doorkeeper, and the eviction policy, with the costs of the keys.
+	Policy uint64
+	// Buffers is the memory taken by the Set and Get buffers.
+	Buffers uint64
+	// Other is the memory taken by the metrics, the tombstones, the loader
+	// and the key locks.
+	Other uint64
+}
+
+// Total returns the sum of the estimates.
+func (m MemoryUsage) Total() uint64 {
+	return m.Items + m.Expirations + m.Policy + m.Buffers + m.Other
+}
+
+// EstimatedMemoryUsage estimates the memory taken by the cache, including its
+// internal structures, to reconcile MaxCost with the memory actually used. It
+// doesn't include the memory the values point to, such as the contents of
+// slices, strings and maps: when the costs are the sizes of those, add
+// CostUsed to the Total, less the internal costs counted in it unless
+// Config.IgnoreInternalCost is set. Items in a custom Store are estimated as
+// if they were in a Go map.
+func (c *Cache[K, V]) EstimatedMemoryUsage() MemoryUsage {
+	if c == nil || c.isClosed {
+		return MemoryUsage{}
+	}
+	var items int
+	for _, n := range c.store.ShardLens() {
+		items += n
+	}
+	itemSize := unsafe.Sizeof(mapEntry[V]{})
+	m := MemoryUsage{
+		Items:       mapBytes(items, 8, itemSize),
+		Expirations: mapBytes(c.store.ExpiringLen(), 8, 8),
+		Policy:      c.policy.MemoryUsage(),
+		Buffers: uint64(cap(c.setBuf))*uint64(unsafe.Sizeof(Item[V]{})) +
+			uint64(c.bufferItems)*8*uint64(runtime.GOMAXPROCS(0)),
+		Other: uint64(len(c.keyLocks))*uint64(unsafe.Sizeof(c.keyLocks[0])) +
+			c.tombstones.memoryUsage() + c.loader.memoryUsage() + c.Metrics.memoryUsage(),
+	}
+	if c.conflictHi != nil {
+		// The 128-bit conflict hashes keep their high halves in a map of
+		// their own.
+		m.Items += mapBytes(items, 8, 8)
+	}
+	if c.trackVersions {
+		// The versions are kept in a map of their own.
+		m.Items += mapBytes(items, 8, 8)
+	}
+	if c.trackWrites {
+		// The times the items were added and written are kept in a map of
+		// their own.
+		m.Items += mapBytes(items, 8, 8)
+	}
+	if c.trackAccess {
+		// The access times are kept in a map of their own, and allocated
+		// apart in blocks of 8 bytes at least.
+		m.Items += mapBytes(items, 8, 8) + uint64(items)*8
+	}
+	return m
+}
+
+// mapBytes estimates the memory taken by a Go map holding n entries with keys
+// and values of the given sizes. The buckets hold 8 entries and a byte of hash
+// for each, and are 6.5/8 full on average.
+func mapBytes(n int, keySize, valueSize uintptr) uint64 {
+	return uint64(float64(n) * float64(keySize+valueSize+1) * 8 / 6.5)
+}
@@ -0,0 +1,42 @@
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEstimatedMemoryUsage(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	empty := c.EstimatedMemoryUsage()
+	require.Zero(t, empty.Items)
+	require.Zero(t, empty.Expirations)
+	// The sketch alone takes 4 rows of 500 bytes.
+	require.Greater(t, empty.Policy, uint64(2000))
+	require.NotZero(t, empty.Buffers)
+	require.NotZero(t, empty.Other)
+
+	for i := 0; i < 100; i++ {
+		require.True(t, c.SetWithTTL(i, i, 1, time.Hour))
+	}
+	c.Wait()
+	usage := c.EstimatedMemoryUsage()
+	// Each item takes at least its key and storeItem.
+	require.Greater(t, usage.Items, uint64(100*(8+itemSize)))
+	require.Greater(t, usage.Expirations, uint64(100*16))
+	require.Greater(t, usage.Policy, empty.Policy)
+	require.Equal(t, usage.Items+usage.Expirations+usage.Policy+usage.Buffers+usage.Other, usage.Total())
+
+	var nilCache *Cache[int, int]
+	require.Zero(t, nilCache.EstimatedMemoryUsage().Total())
+}
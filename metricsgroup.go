@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+
+	"github.com/paivagustavo/ristretto/z"
+)
+
+// MetricsGroup combines the Metrics of several caches, such as the caches a
+// bigger one is split into, so they can be reported as a single cache without
+// knowing how it's split.
+type MetricsGroup struct {
+	mu      sync.Mutex
+	metrics []*Metrics
+}
+
+// NewMetricsGroup returns a MetricsGroup combining the given Metrics.
+func NewMetricsGroup(metrics ...*Metrics) *MetricsGroup {
+	g := &MetricsGroup{}
+	for _, m := range metrics {
+		g.Add(m)
+	}
+	return g
+}
+
+// Add adds m to the group. A nil m, the Metrics of a cache created without
+// Config.Metrics, is ignored.
+func (g *MetricsGroup) Add(m *Metrics) {
+	if m == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.metrics = append(g.metrics, m)
+}
+
+// Remove removes m from the group and returns true if it was in it.
+func (g *MetricsGroup) Remove(m *Metrics) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, other := range g.metrics {
+		if other == m {
+			g.metrics = append(g.metrics[:i], g.metrics[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics returns a snapshot of the combined Metrics of the group. Counters
+// are summed, SetBufHighWater is the highest of the group, DistinctKeys counts
+// the keys requested from any of the caches once, and LifeExpectancySeconds
+// merges the histograms of all of them.
+func (g *MetricsGroup) Metrics() *Metrics {
+	g.mu.Lock()
+	metrics := append([]*Metrics(nil), g.metrics...)
+	g.mu.Unlock()
+
+	combined := &Metrics{
+		life: z.NewHistogramData(z.HistogramBounds(1, 16)),
+		keys: z.NewHyperLogLog(distinctKeysPrecision),
+	}
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		var v uint64
+		for _, m := range metrics {
+			if n := m.get(t); t != setBufHighWater {
+				v += n
+			} else if n > v {
+				v = n
+			}
+		}
+		combined.all[i] = []*uint64{&v}
+	}
+	for _, m := range metrics {
+		combined.keys.Merge(m.keys)
+		m.mu.RLock()
+		combined.life.Merge(m.life)
+		m.mu.RUnlock()
+	}
+	return combined
+}
@@ -0,0 +1,45 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsGroup(t *testing.T) {
+	a, b := newMetrics(), newMetrics()
+	a.add(hit, 1, 3)
+	a.add(miss, 1, 1)
+	b.add(hit, 2, 1)
+	b.add(miss, 2, 3)
+	a.max(setBufHighWater, 5)
+	b.max(setBufHighWater, 9)
+	a.trackKey(1)
+	a.trackKey(2)
+	b.trackKey(2)
+	b.trackKey(3)
+	a.trackEviction(1)
+	b.trackEviction(100)
+
+	g := NewMetricsGroup(a, nil, b)
+	m := g.Metrics()
+	require.Equal(t, uint64(4), m.Hits())
+	require.Equal(t, uint64(4), m.Misses())
+	require.Equal(t, 0.5, m.Ratio())
+	require.Equal(t, uint64(9), m.SetBufHighWater())
+	require.Equal(t, uint64(3), m.DistinctKeys())
+	life := m.LifeExpectancySeconds()
+	require.Equal(t, int64(2), life.Count)
+	require.Equal(t, int64(1), life.Min)
+	require.Equal(t, int64(100), life.Max)
+
+	// The snapshot doesn't change with the Metrics of the group.
+	a.add(hit, 1, 1)
+	require.Equal(t, uint64(4), m.Hits())
+	require.Equal(t, uint64(5), g.Metrics().Hits())
+
+	require.True(t, g.Remove(a))
+	require.False(t, g.Remove(a))
+	require.Equal(t, uint64(1), g.Metrics().Hits())
+	require.Zero(t, NewMetricsGroup().Metrics().Hits())
+}
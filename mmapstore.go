@@ -0,0 +1,255 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/bits"
+	"os"
+	"sync"
+
+	"github.com/paivagustavo/ristretto/z"
+)
+
+const (
+	// mmapMinClass is the size class of the smallest blocks, 16 bytes.
+	mmapMinClass = 4
+	// mmapInitialSize is the size the file starts with.
+	mmapInitialSize = 1 << 20
+)
+
+// MmapStore keeps the values of a Cache[K, []byte] in a memory-mapped file, so
+// the cache can hold more data than fits in memory, with the OS paging out the
+// values that aren't read. Only the keys and the metadata of the items stay in
+// the Go heap. Its NewStore method is meant for Config.NewStore:
+//
+//	stores, err := ristretto.NewMmapStore(path)
+//	cache, err := ristretto.NewCache(&ristretto.Config[string, []byte]{
+//		...
+//		NewStore: stores.NewStore,
+//	})
+//
+// The values are copied in and out of the file, so the slices passed to Set
+// can be reused, and the ones returned by Get stay valid after the item is
+// gone. The file is scratch space, it can't be reopened by another cache.
+// Close removes it once the cache is closed.
+//
+// The shards share the file: each value is copied holding a read lock on the
+// mapping, and writes allocating or freeing a block briefly take a lock shared
+// by all the shards. Growing the file blocks every shard while it's remapped.
+type MmapStore struct {
+	// mu guards the mapping of the file, which is remapped when it grows.
+	// The values are copied in and out holding the read lock.
+	mu   sync.RWMutex
+	file *z.MmapFile
+	// allocMu guards end and free. It's taken before mu when both are held.
+	allocMu sync.Mutex
+	// end is where the blocks never allocated start.
+	end int
+	// free has the offsets of the blocks freed, by size class.
+	free [][]int
+}
+
+// NewMmapStore creates the file at path, replacing any file there, and returns
+// the MmapStore keeping values in it.
+func NewMmapStore(path string) (*MmapStore, error) {
+	file, err := z.OpenMmapFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mmapInitialSize)
+	if err != nil && err != z.NewFile {
+		return nil, err
+	}
+	return &MmapStore{file: file}, nil
+}
+
+// NewStore returns a Store for a shard of the cache. Every shard shares the
+// file.
+func (m *MmapStore) NewStore() Store[[]byte] {
+	return &mmapShard{m: m, items: make(map[uint64]mmapItem)}
+}
+
+// Size returns the size of the file.
+func (m *MmapStore) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.file.Data))
+}
+
+// Close unmaps and removes the file. The cache using the MmapStore must be
+// closed first.
+func (m *MmapStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Delete()
+}
+
+// mmapClass returns the size class of the block holding n bytes, which is
+// 1<<class bytes long.
+func mmapClass(n int) int {
+	class := bits.Len(uint(n - 1))
+	if class < mmapMinClass {
+		class = mmapMinClass
+	}
+	return class
+}
+
+// alloc returns the offset of a free block of the size class, growing the file
+// if there's none.
+func (m *MmapStore) alloc(class int) (int, error) {
+	m.allocMu.Lock()
+	defer m.allocMu.Unlock()
+	if class < len(m.free) {
+		if free := m.free[class]; len(free) > 0 {
+			off := free[len(free)-1]
+			m.free[class] = free[:len(free)-1]
+			return off, nil
+		}
+	}
+	size := 1 << class
+	// The file only grows here, so its size can be read holding allocMu.
+	if need := m.end + size; need > len(m.file.Data) {
+		// Double the file, like a slice.
+		grow := len(m.file.Data)
+		for len(m.file.Data)+grow < need {
+			grow *= 2
+		}
+		m.mu.Lock()
+		err := m.file.Truncate(int64(len(m.file.Data) + grow))
+		m.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	off := m.end
+	m.end += size
+	return off, nil
+}
+
+// release adds the block to the free blocks of its class.
+func (m *MmapStore) release(off, class int) {
+	m.allocMu.Lock()
+	defer m.allocMu.Unlock()
+	for len(m.free) <= class {
+		m.free = append(m.free, nil)
+	}
+	m.free[class] = append(m.free[class], off)
+}
+
+// mmapItem is an item of an mmapShard, with the location of its value in the
+// file instead of the value.
+type mmapItem struct {
+	item Item[[]byte]
+	off  int
+	len  int
+}
+
+func (i mmapItem) class() int {
+	return mmapClass(i.len)
+}
+
+// mmapShard is the Store of a shard of a cache using an MmapStore.
+type mmapShard struct {
+	m     *MmapStore
+	items map[uint64]mmapItem
+}
+
+func (s *mmapShard) Get(key uint64) (Item[[]byte], bool) {
+	i, ok := s.items[key]
+	if !ok {
+		return Item[[]byte]{}, false
+	}
+	item := i.item
+	item.Value = s.value(i)
+	return item, true
+}
+
+// value copies the value of the item out of the file.
+func (s *mmapShard) value(i mmapItem) []byte {
+	if i.len == 0 {
+		return nil
+	}
+	value := make([]byte, i.len)
+	s.m.mu.RLock()
+	copy(value, s.m.file.Data[i.off:])
+	s.m.mu.RUnlock()
+	return value
+}
+
+func (s *mmapShard) Set(key uint64, item Item[[]byte]) {
+	prev, has := s.items[key]
+	i := mmapItem{item: item, len: len(item.Value)}
+	i.item.Value = nil
+
+	switch {
+	case has && prev.len > 0 && i.len > 0 && prev.class() == i.class():
+		// The value fits the block of the previous one.
+		i.off = prev.off
+	case i.len > 0:
+		off, err := s.m.alloc(i.class())
+		if err != nil {
+			// There's no way to report the error, so drop the item as if it
+			// had been evicted.
+			s.del(key)
+			return
+		}
+		i.off = off
+		fallthrough
+	default:
+		if has && prev.len > 0 {
+			s.m.release(prev.off, prev.class())
+		}
+	}
+	// The block belongs to the shard, so it can be written while other
+	// shards copy their values.
+	s.m.mu.RLock()
+	copy(s.m.file.Data[i.off:], item.Value)
+	s.m.mu.RUnlock()
+	s.items[key] = i
+}
+
+func (s *mmapShard) Del(key uint64) {
+	s.del(key)
+}
+
+// del removes the item of the key.
+func (s *mmapShard) del(key uint64) {
+	i, ok := s.items[key]
+	if !ok {
+		return
+	}
+	if i.len > 0 {
+		s.m.release(i.off, i.class())
+	}
+	delete(s.items, key)
+}
+
+func (s *mmapShard) Range(fn func(uint64, Item[[]byte]) bool) {
+	for key, i := range s.items {
+		item := i.item
+		item.Value = s.value(i)
+		if !fn(key, item) {
+			return
+		}
+	}
+}
+
+func (s *mmapShard) Len() int {
+	return len(s.items)
+}
+
+func (s *mmapShard) Clear() {
+	for key := range s.items {
+		s.del(key)
+	}
+}
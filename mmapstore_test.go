@@ -0,0 +1,104 @@
+package ristretto
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapStore(t *testing.T) {
+	stores, err := NewMmapStore(filepath.Join(t.TempDir(), "values"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, stores.Close()) }()
+	c, err := NewCache(&Config[int, []byte]{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		NewStore:           stores.NewStore,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	value := bytes.Repeat([]byte{'a'}, 100)
+	require.True(t, c.Set(1, value, 1))
+	require.True(t, c.Set(2, nil, 1))
+	c.Wait()
+	// The value is copied into the file.
+	value[0] = 'b'
+	got, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, bytes.Repeat([]byte{'a'}, 100), got)
+	got, ok = c.Get(2)
+	require.True(t, ok)
+	require.Empty(t, got)
+
+	// The file grows to fit the values.
+	big := bytes.Repeat([]byte{'c'}, 3*mmapInitialSize)
+	require.True(t, c.Set(1, big, 1))
+	c.Wait()
+	got, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, big, got)
+	require.True(t, stores.Size() > 3*mmapInitialSize)
+
+	c.Del(1)
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	c.Clear()
+	_, ok = c.Get(2)
+	require.False(t, ok)
+}
+
+func TestMmapStoreReuse(t *testing.T) {
+	stores, err := NewMmapStore(filepath.Join(t.TempDir(), "values"))
+	require.NoError(t, err)
+	defer stores.Close()
+	s := stores.NewStore()
+
+	s.Set(1, Item[[]byte]{Value: []byte("first")})
+	first := s.(*mmapShard).items[1].off
+	// A value of the same size class is written in place.
+	s.Set(1, Item[[]byte]{Value: []byte("second")})
+	require.Equal(t, first, s.(*mmapShard).items[1].off)
+	item, ok := s.Get(1)
+	require.True(t, ok)
+	require.Equal(t, []byte("second"), item.Value)
+
+	// The block of a deleted value is reused.
+	s.Del(1)
+	s.Set(2, Item[[]byte]{Value: []byte("third")})
+	require.Equal(t, first, s.(*mmapShard).items[2].off)
+	require.Equal(t, 1, s.Len())
+}
+
+func TestMmapStoreConcurrent(t *testing.T) {
+	stores, err := NewMmapStore(filepath.Join(t.TempDir(), "values"))
+	require.NoError(t, err)
+	defer stores.Close()
+
+	// Each shard is used by a single goroutine, like the shards of a cache
+	// under their own locks, while the file grows.
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(s Store[[]byte], b byte) {
+			defer wg.Done()
+			for key := uint64(0); key < 100; key++ {
+				value := bytes.Repeat([]byte{b}, 1<<(key%16))
+				s.Set(key, Item[[]byte]{Value: value})
+				item, ok := s.Get(key)
+				require.True(t, ok)
+				require.Equal(t, value, item.Value)
+				if key%3 == 0 {
+					s.Del(key)
+				}
+			}
+		}(stores.NewStore(), byte(n))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// AccessBuffer selects how Gets are buffered before the policy records them.
+type AccessBuffer byte
+
+const (
+	// AccessBufferLossy buffers Gets in stripes held in a sync.Pool. It's the
+	// default and the fastest, but the stripes the pool drops lose the Gets
+	// they hold, more so under bursty contention.
+	AccessBufferLossy AccessBuffer = iota
+	// AccessBufferMPSC buffers Gets in fixed stripes shared by all the
+	// goroutines. A Get claims a slot with a single atomic add and never
+	// waits; it's only dropped if its stripe is full and being drained, so
+	// the policy sees more of the accesses. Config.BufferFlushInterval
+	// doesn't apply to it, and the stripes don't change size.
+	AccessBufferMPSC
+	// AccessBufferPerP buffers Gets in a stripe per P, the processors running
+	// goroutines, so Gets on different cores never contend. A stripe is sent
+	// to the policy once it's full. Where goroutines can't be pinned to their
+	// P, with the purego build tag or the race detector, it falls back to
+	// AccessBufferMPSC.
+	AccessBufferPerP
+)
+
+// accessBuffer is where Gets are pushed, see AccessBuffer.
+type accessBuffer interface {
+	Push(uint64)
+}
+
+// mpscStripe is a fixed size buffer written by many goroutines. The goroutine
+// writing its last slot sends its contents to the consumer.
+type mpscStripe struct {
+	// tail is the number of slots claimed and written the number of slots
+	// written. They're the first fields so they're 64-bit aligned for use with
+	// atomic.
+	tail    int64
+	written int64
+	data    []uint64
+}
+
+// mpscBuffer is the AccessBufferMPSC buffer. The key hashes are spread over the
+// stripes to lower contention.
+type mpscBuffer struct {
+	cons    ringConsumer
+	capa    int64
+	mask    uint64
+	stripes []*mpscStripe
+	// metrics counts the Gets dropped because their stripe is full, the
+	// consumer counts the others.
+	metrics *Metrics
+}
+
+func newMPSCBuffer(cons ringConsumer, capa int64) *mpscBuffer {
+	n := next2Power(int64(runtime.GOMAXPROCS(0)) * 4)
+	b := &mpscBuffer{
+		cons:    cons,
+		capa:    capa,
+		mask:    uint64(n - 1),
+		stripes: make([]*mpscStripe, n),
+	}
+	for i := range b.stripes {
+		b.stripes[i] = &mpscStripe{data: make([]uint64, capa)}
+	}
+	return b
+}
+
+// CollectMetrics sets the metrics the dropped Gets are counted in.
+func (b *mpscBuffer) CollectMetrics(metrics *Metrics) {
+	b.metrics = metrics
+}
+
+// Push adds the key to its stripe, and drains the stripe if it's the last key
+// it has room for.
+func (b *mpscBuffer) Push(key uint64) {
+	s := b.stripes[key&b.mask]
+	n := atomic.AddInt64(&s.tail, 1) - 1
+	if n >= b.capa {
+		// The stripe is full and being drained.
+		b.metrics.add(dropGets, key, 1)
+		return
+	}
+	atomic.StoreUint64(&s.data[n], key)
+	if atomic.AddInt64(&s.written, 1) < b.capa {
+		return
+	}
+	// Every slot is written and no more can be claimed until tail is reset,
+	// so the data can be read safely.
+	batch := append(newRingData(int(b.capa)), s.data...)
+	atomic.StoreInt64(&s.written, 0)
+	atomic.StoreInt64(&s.tail, 0)
+	if !b.cons.Push(batch) {
+		releaseRingData(batch)
+	}
+}
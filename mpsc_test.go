@@ -0,0 +1,122 @@
+package ristretto
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMPSCBufferDrain(t *testing.T) {
+	var batches [][]uint64
+	b := newMPSCBuffer(&testConsumer{
+		push: func(items []uint64) {
+			batches = append(batches, append([]uint64(nil), items...))
+		},
+		save: true,
+	}, 4)
+	// Keys with the same stripe.
+	stripe := b.mask + 1
+	for i := uint64(0); i < 8; i++ {
+		b.Push(i * stripe)
+	}
+	require.Equal(t, [][]uint64{
+		{0, stripe, 2 * stripe, 3 * stripe},
+		{4 * stripe, 5 * stripe, 6 * stripe, 7 * stripe},
+	}, batches)
+}
+
+func TestMPSCBufferDropped(t *testing.T) {
+	b := newMPSCBuffer(&testConsumer{push: func([]uint64) {}}, 4)
+	b.CollectMetrics(newMetrics())
+	// The stripe of key 0 is full and being drained.
+	b.stripes[0].tail = 4
+	b.Push(0)
+	require.Equal(t, uint64(1), b.metrics.GetsDropped())
+}
+
+func TestMPSCBufferConcurrent(t *testing.T) {
+	var pushed int64
+	b := newMPSCBuffer(&testConsumer{
+		push: func(items []uint64) {
+			atomic.AddInt64(&pushed, int64(len(items)))
+		},
+		save: true,
+	}, 16)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				b.Push(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	// Only full stripes are drained, and few Pushes are dropped.
+	require.Equal(t, int64(0), atomic.LoadInt64(&pushed)%16)
+	require.Greater(t, atomic.LoadInt64(&pushed), int64(8*10000*9/10-16*len(b.stripes)))
+}
+
+func TestPerPBufferConcurrent(t *testing.T) {
+	var pushed int64
+	b := newPerPBuffer(&testConsumer{
+		push: func(items []uint64) {
+			atomic.AddInt64(&pushed, int64(len(items)))
+		},
+		save: true,
+	}, 16)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				b.Push(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	// Only full stripes are sent, and without the fallback no Push is
+	// dropped but those left in the stripes.
+	require.Equal(t, int64(0), atomic.LoadInt64(&pushed)%16)
+	if procPinnable {
+		require.Greater(t, atomic.LoadInt64(&pushed), int64(8*10000-16*len(b.stripes)))
+	}
+}
+
+// BenchmarkCacheAccessBuffer compares the hit ratio reached with each
+// AccessBuffer on a skewed workload, along with the Gets they drop.
+func BenchmarkCacheAccessBuffer(b *testing.B) {
+	for _, kind := range []AccessBuffer{AccessBufferLossy, AccessBufferMPSC, AccessBufferPerP} {
+		b.Run(fmt.Sprintf("buffer=%d", kind), func(b *testing.B) {
+			c, err := NewCache(&Config[int, int]{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				IgnoreInternalCost: true,
+				BufferItems:        64,
+				Metrics:            true,
+				AccessBuffer:       kind,
+			})
+			require.NoError(b, err)
+			defer c.Close()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				z := rand.NewZipf(r, 1.01, 1, 100000)
+				for pb.Next() {
+					key := int(z.Uint64())
+					if _, ok := c.Get(key); !ok {
+						c.Set(key, key, 1)
+					}
+				}
+			})
+			b.ReportMetric(c.Metrics.Ratio(), "hit-ratio")
+			b.ReportMetric(c.Metrics.GetsDroppedRatio(), "gets-dropped-ratio")
+		})
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MutationOp is the kind of change a Mutation reports.
+type MutationOp int
+
+const (
+	// MutationSet means the key was added or its value replaced, and the
+	// Mutation holds the new item.
+	MutationSet MutationOp = iota + 1
+	// MutationDel means the key was deleted.
+	MutationDel
+	// MutationExpire means the key expired and was removed.
+	MutationExpire
+	// MutationEvict means the policy evicted the key to make room.
+	MutationEvict
+	// MutationClear means every item was removed. Its Key is 0.
+	MutationClear
+)
+
+func (o MutationOp) String() string {
+	switch o {
+	case MutationSet:
+		return "set"
+	case MutationDel:
+		return "del"
+	case MutationExpire:
+		return "expire"
+	case MutationEvict:
+		return "evict"
+	case MutationClear:
+		return "clear"
+	default:
+		return "unidentified"
+	}
+}
+
+// Mutation is a change applied to the cache, as passed to Config.OnMutation.
+type Mutation[V any] struct {
+	// Seq numbers the mutations from 1 without gaps, so a consumer can tell
+	// when it missed some.
+	Seq uint64
+	Op  MutationOp
+	// Key and Conflict are the hashes of the key.
+	Key      uint64
+	Conflict uint64
+	// Update, Value, Cost, Expiration and Meta are only set for MutationSet.
+	// Update is true if the key was in the cache already. Cost is as
+	// accounted by the policy, including the internal cost unless
+	// Config.IgnoreInternalCost is set.
+	Update     bool
+	Value      V
+	Cost       int64
+	Expiration time.Time
+	Meta       uint32
+}
+
+// mutations numbers the mutations and passes them to Config.OnMutation and the
+// subscriptions, in order. Nothing is done unless one of them is there.
+type mutations[V any] struct {
+	// subs is the number of subscriptions, read without holding mu.
+	subs int32
+	fn   func(Mutation[V])
+
+	mu            sync.Mutex
+	seq           uint64
+	subscriptions []*Subscription[V]
+}
+
+// active returns whether anything takes the mutations.
+func (m *mutations[V]) active() bool {
+	return m.fn != nil || atomic.LoadInt32(&m.subs) > 0
+}
+
+// emit numbers the mutation and passes it on, holding the lock so the
+// mutations reported from different goroutines are seen in order.
+func (m *mutations[V]) emit(mut Mutation[V]) {
+	m.mu.Lock()
+	m.seq++
+	mut.Seq = m.seq
+	if m.fn != nil {
+		m.fn(mut)
+	}
+	for n := 0; n < len(m.subscriptions); n++ {
+		if s := m.subscriptions[n]; !s.send(mut) {
+			m.remove(s)
+			n--
+		}
+	}
+	m.mu.Unlock()
+}
+
+// mutatedSet reports a MutationSet for the key as it's stored, once the change
+// is applied. Nothing is reported if the key is gone by then, as its removal
+// is reported instead.
+func (c *Cache[K, V]) mutatedSet(key, conflict uint64, update bool) {
+	if !c.mutations.active() {
+		return
+	}
+	si, ok := c.store.GetItem(key, conflict, 0)
+	if !ok {
+		return
+	}
+	c.mutations.emit(Mutation[V]{
+		Op:         MutationSet,
+		Update:     update,
+		Key:        key,
+		Conflict:   si.conflict,
+		Value:      si.value,
+		Cost:       c.policy.Cost(key),
+		Expiration: si.expirationTime(),
+		Meta:       si.meta,
+	})
+}
+
+// mutated reports the removal of the key.
+func (c *Cache[K, V]) mutated(op MutationOp, key, conflict uint64) {
+	if !c.mutations.active() {
+		return
+	}
+	c.mutations.emit(Mutation[V]{Op: op, Key: key, Conflict: conflict})
+}
+
+// evictMutation returns the MutationOp of the eviction reason, or 0 if it's
+// reported otherwise.
+func evictMutation(reason EvictReason) MutationOp {
+	switch reason {
+	case EvictPolicy:
+		return MutationEvict
+	case EvictExpired:
+		return MutationExpire
+	default:
+		// Clear reports a single MutationClear.
+		return 0
+	}
+}
@@ -0,0 +1,128 @@
+package ristretto
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/paivagustavo/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheOnMutation(t *testing.T) {
+	var mu sync.Mutex
+	var muts []Mutation[int]
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            1,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Admission:          &admitAll{},
+		OnMutation: func(m Mutation[int]) {
+			mu.Lock()
+			muts = append(muts, m)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithMeta(1, 1, 1, 0, 7))
+	c.Wait()
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	c.Del(1)
+	c.Wait()
+	require.True(t, c.Set(2, 2, 1))
+	c.Wait()
+	require.True(t, c.Set(3, 3, 1))
+	c.Wait()
+	c.Clear()
+
+	hash := func(key int) uint64 {
+		h, _ := z.KeyToHash(key)
+		return h
+	}
+	type op struct {
+		op    MutationOp
+		key   uint64
+		value int
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var ops []op
+	for n, m := range muts {
+		require.Equal(t, uint64(n+1), m.Seq)
+		ops = append(ops, op{m.Op, m.Key, m.Value})
+	}
+	require.Equal(t, []op{
+		{MutationSet, hash(1), 1},
+		{MutationSet, hash(1), 2},
+		{MutationDel, hash(1), 0},
+		{MutationSet, hash(2), 2},
+		{MutationEvict, hash(2), 0},
+		{MutationSet, hash(3), 3},
+		{MutationClear, 0, 0},
+	}, ops)
+	require.Equal(t, uint32(7), muts[0].Meta)
+	require.Equal(t, int64(1), muts[0].Cost)
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	all := c.Subscribe(nil, SubscribeOptions{})
+	defer all.Close()
+	dels := c.Subscribe(func(m Mutation[int]) bool {
+		return m.Op == MutationDel
+	}, SubscribeOptions{})
+	newest := c.Subscribe(nil, SubscribeOptions{Buffer: 2})
+	oldest := c.Subscribe(nil, SubscribeOptions{Buffer: 2, Overflow: OverflowDropOldest})
+	closing := c.Subscribe(nil, SubscribeOptions{Buffer: 2, Overflow: OverflowClose})
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	c.Del(1)
+	c.Wait()
+
+	m := <-all.C
+	require.Equal(t, MutationSet, m.Op)
+	require.False(t, m.Update)
+	m = <-all.C
+	require.Equal(t, MutationSet, m.Op)
+	require.True(t, m.Update)
+	require.Equal(t, 2, m.Value)
+	require.Equal(t, MutationDel, (<-all.C).Op)
+
+	m = <-dels.C
+	require.Equal(t, MutationDel, m.Op)
+	require.Equal(t, uint64(3), m.Seq)
+	dels.Close()
+	dels.Close()
+	_, ok := <-dels.C
+	require.False(t, ok)
+
+	require.Equal(t, uint64(1), newest.Dropped())
+	require.Equal(t, uint64(1), (<-newest.C).Seq)
+	require.Equal(t, uint64(1), oldest.Dropped())
+	require.Equal(t, uint64(2), (<-oldest.C).Seq)
+	require.Equal(t, uint64(1), (<-closing.C).Seq)
+	require.Equal(t, uint64(2), (<-closing.C).Seq)
+	_, ok = <-closing.C
+	require.False(t, ok)
+
+	// Closing the cache closes the subscriptions.
+	c.Close()
+	for range newest.C {
+	}
+	for range oldest.C {
+	}
+}
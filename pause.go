@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync/atomic"
+
+// Pause stops the maintenance of the cache: no items are admitted or evicted
+// and the expired items are not removed, until Resume is called. The cache can
+// be read as usual meanwhile, so the items can be inspected or snapshotted
+// while they don't change.
+//
+// While the cache is paused, the methods that change items do nothing and
+// return false, like with Config.Follower, unless Config.QueueWritesWhilePaused
+// is set. If it is, they work as usual, but the Sets of new keys are only
+// buffered, to be applied after Resume, and are dropped once the buffer is
+// full, like the Sets of new keys added by Modify and ApplyBatch, which are
+// removed again. The deletes still remove the keys, and are applied to the
+// policy right away if the buffer is full. Wait blocks until Resume is called,
+// unless the buffer is full, in which case it returns right away.
+func (c *Cache[K, V]) Pause() {
+	if c == nil || c.isClosed {
+		return
+	}
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.isPaused() {
+		return
+	}
+	// Block until processItems goroutine is returned.
+	c.stop <- struct{}{}
+	atomic.StoreInt32(&c.paused, 1)
+	close(c.pausedChan())
+}
+
+// Resume restarts the maintenance of the cache stopped by Pause. It does
+// nothing if the cache isn't paused.
+func (c *Cache[K, V]) Resume() {
+	if c == nil || c.isClosed {
+		return
+	}
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if !c.isPaused() {
+		return
+	}
+	atomic.StoreInt32(&c.paused, 0)
+	c.pausedCh.Store(make(chan struct{}))
+	c.goWorker("processItems", c.processItems)
+}
+
+// Paused returns true if the cache was paused by Pause and not resumed yet.
+func (c *Cache[K, V]) Paused() bool {
+	return c != nil && c.isPaused()
+}
+
+// pausedChan returns a channel closed once the cache is paused, to stop waiting
+// for room in setBuf.
+func (c *Cache[K, V]) pausedChan() chan struct{} {
+	return c.pausedCh.Load().(chan struct{})
+}
+
+func (c *Cache[K, V]) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// readOnly returns true if the methods that change items must do nothing,
+// because the cache is a follower or is paused.
+func (c *Cache[K, V]) readOnly() bool {
+	return c.follower || (c.isPaused() && !c.queueWhilePaused)
+}
@@ -0,0 +1,124 @@
+package ristretto
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePause(t *testing.T) {
+	var evicted int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		PreciseExpiration:  true,
+		OnEvict: func(Item[int]) {
+			atomic.AddInt64(&evicted, 1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	retrySet(t, c, 2, 2, 1, 50*time.Millisecond)
+	c.Pause()
+	c.Pause()
+	require.True(t, c.Paused())
+
+	// Reads are served, writes are rejected and the items don't expire.
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.False(t, c.Set(3, 3, 1))
+	c.Del(1)
+	_, ok = c.Get(1)
+	require.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, atomic.LoadInt64(&evicted))
+
+	c.Resume()
+	require.False(t, c.Paused())
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&evicted) == 1
+	}, time.Second, 5*time.Millisecond)
+	retrySet(t, c, 3, 3, 1, 0)
+
+	// Clearing and closing a paused cache don't wait for processItems.
+	c.Pause()
+	c.Clear()
+	_, ok = c.Get(3)
+	require.False(t, ok)
+	c.Resume()
+	retrySet(t, c, 3, 3, 1, 0)
+	c.Pause()
+}
+
+func TestCachePauseQueueWrites(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                10,
+		IgnoreInternalCost:     true,
+		BufferItems:            64,
+		QueueWritesWhilePaused: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Pause()
+	require.True(t, c.Set(1, 1, 1))
+	_, ok := c.Get(1)
+	require.False(t, ok)
+
+	c.Resume()
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCachePauseQueueWritesFull(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:            100,
+		MaxCost:                1 << 20,
+		IgnoreInternalCost:     true,
+		BufferItems:            64,
+		QueueWritesWhilePaused: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, -1, 1, 1, 0)
+	c.Pause()
+	for i := 0; c.Set(i, i, 1); i++ {
+	}
+
+	// None of the writes waits for room in the full buffer.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Del(-1)
+		_, ok := c.Modify(-2, func(int, bool) (int, int64, bool) {
+			return 2, 1, true
+		})
+		require.False(t, ok)
+		require.True(t, c.ApplyBatch([]Op[int, int]{{Key: -3, Value: 3, Cost: 1}}))
+		c.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a write blocked on the full buffer of a paused cache")
+	}
+	for _, key := range []int{-1, -2, -3} {
+		_, ok := c.Get(key)
+		require.False(t, ok)
+	}
+
+	c.Resume()
+	c.Wait()
+	retrySet(t, c, -2, 2, 1, 0)
+}
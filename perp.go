@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "runtime"
+
+// perPStripe is the buffer of a single P. Only the goroutine pinned to the P
+// touches it, so it needs no synchronization.
+type perPStripe struct {
+	data []uint64
+	// Pad to a cache line so the stripes of different Ps don't share one.
+	_ [40]byte
+}
+
+// perPBuffer is the AccessBufferPerP buffer. The key hashes are recorded in
+// the stripe of the P the goroutine runs on, and Gets on different cores
+// never touch the same memory.
+type perPBuffer struct {
+	cons    ringConsumer
+	capa    int
+	stripes []perPStripe
+	// fallback takes the Gets that can't be pinned: all of them if
+	// procPinnable is false, and those running on a P beyond the stripes
+	// after GOMAXPROCS is raised.
+	fallback *mpscBuffer
+}
+
+func newPerPBuffer(cons ringConsumer, capa int64) *perPBuffer {
+	b := &perPBuffer{
+		cons:     cons,
+		capa:     int(capa),
+		fallback: newMPSCBuffer(cons, capa),
+	}
+	if procPinnable {
+		b.stripes = make([]perPStripe, runtime.GOMAXPROCS(0))
+	}
+	return b
+}
+
+// CollectMetrics sets the metrics the Gets dropped by the fallback buffer are
+// counted in.
+func (b *perPBuffer) CollectMetrics(metrics *Metrics) {
+	b.fallback.CollectMetrics(metrics)
+}
+
+// Push adds the key to the stripe of the current P, and sends the stripe to
+// the consumer once it's full.
+func (b *perPBuffer) Push(key uint64) {
+	if !procPinnable {
+		b.fallback.Push(key)
+		return
+	}
+	pid := procPin()
+	if pid >= len(b.stripes) {
+		procUnpin()
+		b.fallback.Push(key)
+		return
+	}
+	s := &b.stripes[pid]
+	if s.data == nil {
+		s.data = newRingData(b.capa)
+	}
+	s.data = append(s.data, key)
+	if len(s.data) < b.capa {
+		procUnpin()
+		return
+	}
+	batch := s.data
+	s.data = nil
+	procUnpin()
+	if !b.cons.Push(batch) {
+		releaseRingData(batch)
+	}
+}
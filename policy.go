@@ -17,9 +17,11 @@
 package ristretto
 
 import (
+	"container/heap"
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/paivagustavo/ristretto/z"
 )
@@ -28,6 +30,10 @@ const (
 	// lfuSample is the number of items to sample when looking at eviction
 	// candidates. 5 seems to be the most optimal number [citation needed].
 	lfuSample = 5
+	// maxEvictVetoes is the max number of keys Config.CanEvict can veto while
+	// filling a sample, or while choosing the victims with Config.Eviction,
+	// so vetoing most keys can't make Set go through the whole cache.
+	maxEvictVetoes = 16
 )
 
 // policy is the interface encapsulating eviction/admission behavior.
@@ -59,35 +65,151 @@ type policy[V any] interface {
 	Clear()
 	// MaxCost returns the current max cost of the cache policy.
 	MaxCost() int64
+	// Used returns the sum of the costs of the keys in the policy.
+	Used() int64
+	// Reserve accounts the cost against the max cost without adding a key. It
+	// returns false if the cost wasn't reserved. It doesn't evict any key,
+	// Shrink does to make room for it.
+	Reserve(int64) bool
+	// Release gives back cost taken with Reserve.
+	Release(int64)
+	// Shrink evicts keys until the used cost is at most the given one. It
+	// returns a slice of evicted keys.
+	Shrink(int64) []policyPair
+	// MemoryUsage estimates the memory taken by the policy in bytes.
+	MemoryUsage() uint64
+	// Estimate returns the estimated access frequency of the key.
+	Estimate(uint64) int64
+	// Explain reports what Add would do with the key-cost pair without
+	// changing anything. If the cost used would then be over drainAbove, the
+	// keys Shrink would evict down to drainTo are reported as victims too.
+	// drainAbove is 0 if there's no high watermark.
+	Explain(key uint64, cost int64, drainAbove, drainTo int64) SetExplanation
+	// TopKeys returns up to n keys in the policy with the highest estimated
+	// access frequency, most frequent first.
+	TopKeys(int) []KeyFrequency
 	// UpdateMaxCost updates the max cost of the cache policy.
 	UpdateMaxCost(int64)
+	// Len returns the number of keys in the policy.
+	Len() int
+	// SaveState returns the state of the admission policy.
+	SaveState() []byte
+	// LoadState replaces the state of the admission policy with the one
+	// returned by SaveState, in the given version of the format.
+	LoadState([]byte, uint64) error
+}
+
+// Admission decides which new keys are let in to the cache when making room for
+// them requires evicting others. The keys are the hashes of the keys of the
+// cache. The calls are serialized by the cache, so implementations don't need
+// to be safe for concurrent use.
+//
+// The default Admission is TinyLFU, which keeps an approximate access count of
+// every key.
+type Admission interface {
+	// Record records an access to the key, either by Get or by Set.
+	Record(keyHash uint64)
+	// Estimate returns the access frequency of the key. It's used to choose the
+	// eviction victims among a sample of keys.
+	Estimate(keyHash uint64) int64
+	// Admit returns true if the candidate key, with the given cost, is worth
+	// evicting the victims for. The victims slice is reused once Admit
+	// returns, so it mustn't be kept.
+	Admit(candidateHash uint64, cost int64, victims []uint64) bool
+	// Clear forgets all the recorded accesses.
+	Clear()
 }
 
-func newPolicy[V any](numCounters, maxCost int64) policy[V] {
-	return newDefaultPolicy[V](numCounters, maxCost)
+// policyOptions holds the optional settings of the policy, taken from Config.
+type policyOptions struct {
+	maxItems  int64
+	admission Admission
+	eviction  Eviction
+	aging     SketchAging
+	// agingInterval, if greater than zero, is how often the access
+	// frequencies are aged instead of every numCounters increments.
+	agingInterval time.Duration
+	// canEvict, if set, can veto the eviction of keys.
+	canEvict func(uint64) bool
+	// ghostItems is the number of evicted keys remembered, see
+	// Config.GhostItems.
+	ghostItems int64
+	// costlierVictims breaks frequency ties between sampled victims in favor
+	// of the costlier one, see Config.EvictCostlierOnTie.
+	costlierVictims bool
+	// randomTies makes the admission of keys as frequent as their victims
+	// random, see Config.RandomTieAdmission.
+	randomTies bool
+}
+
+func newPolicy[V any](numCounters, maxCost int64, opts policyOptions) policy[V] {
+	return newDefaultPolicy[V](numCounters, maxCost, opts)
 }
 
 type defaultPolicy[V any] struct {
 	sync.Mutex
-	admit    *tinyLFU
-	evict    *sampledLFU
-	itemsCh  chan []uint64
-	stop     chan struct{}
-	isClosed bool
-	metrics  *Metrics
-}
-
-func newDefaultPolicy[V any](numCounters, maxCost int64) *defaultPolicy[V] {
+	admit *tinyLFU
+	// admission makes the admission decisions. It's admit unless
+	// Config.Admission is set.
+	admission Admission
+	evict     *sampledLFU
+	// ghost holds the keys evicted last, which are admitted without asking
+	// admission. It's nil unless Config.GhostItems is set.
+	ghost *ghostList
+	// costlierVictims is set by Config.EvictCostlierOnTie.
+	costlierVictims bool
+	// victim holds the victim passed to admission by admitOver, so it doesn't
+	// allocate a slice for every victim.
+	victim  [1]uint64
+	itemsCh chan []uint64
+	// agingTicker ages the access frequencies when they're aged based on
+	// time. It's nil otherwise.
+	agingTicker *time.Ticker
+	stop        chan struct{}
+	isClosed    bool
+	metrics     *Metrics
+}
+
+func newDefaultPolicy[V any](numCounters, maxCost int64, opts policyOptions) *defaultPolicy[V] {
 	p := &defaultPolicy[V]{
 		admit:   newTinyLFU(numCounters),
 		evict:   newSampledLFU(maxCost),
+		ghost:   newGhostList(opts.ghostItems),
 		itemsCh: make(chan []uint64, 3),
 		stop:    make(chan struct{}),
 	}
+	p.evict.maxItems = opts.maxItems
+	p.evict.eviction = opts.eviction
+	p.evict.canEvict = opts.canEvict
+	p.costlierVictims = opts.costlierVictims
+	p.admit.setAging(opts.aging)
+	p.admit.randomTies = opts.randomTies
+	p.admission = p.admit
+	if opts.admission != nil {
+		p.admission = opts.admission
+	}
+	if opts.agingInterval > 0 {
+		// Age on the ticker only, however many increments there are.
+		p.admit.resetAt = 0
+		p.agingTicker = time.NewTicker(opts.agingInterval)
+	}
 	go p.processItems()
 	return p
 }
 
+// Lock locks the policy, recording the wait in the metrics if they're kept.
+func (p *defaultPolicy[V]) Lock() {
+	if p.metrics == nil {
+		p.Mutex.Lock()
+		return
+	}
+	start := time.Now()
+	p.Mutex.Lock()
+	wait := time.Since(start)
+	p.metrics.add(policyLocks, uint64(start.UnixNano()), 1)
+	p.metrics.add(policyLockNanos, uint64(start.UnixNano()), uint64(wait))
+}
+
 func (p *defaultPolicy[V]) CollectMetrics(metrics *Metrics) {
 	p.metrics = metrics
 	p.evict.metrics = metrics
@@ -99,11 +221,33 @@ type policyPair struct {
 }
 
 func (p *defaultPolicy[V]) processItems() {
+	var aging <-chan time.Time
+	if p.agingTicker != nil {
+		aging = p.agingTicker.C
+	}
 	for {
 		select {
 		case items := <-p.itemsCh:
+			var start time.Time
+			if p.metrics != nil {
+				start = time.Now()
+			}
+			p.Lock()
+			for _, key := range items {
+				p.admission.Record(key)
+				if p.evict.eviction != nil {
+					p.evict.eviction.Access(key)
+				}
+			}
+			p.Unlock()
+			if p.metrics != nil && len(items) > 0 {
+				p.metrics.add(drainGets, items[0], 1)
+				p.metrics.add(drainGetsNanos, items[0], uint64(time.Since(start)))
+			}
+			releaseRingData(items)
+		case <-aging:
 			p.Lock()
-			p.admit.Push(items)
+			p.admit.reset()
 			p.Unlock()
 		case <-p.stop:
 			return
@@ -130,6 +274,13 @@ func (p *defaultPolicy[V]) Push(keys []uint64) bool {
 	}
 }
 
+// admitOver returns true if admission admits the key, with the given cost,
+// over the victim. It must be called with the lock held.
+func (p *defaultPolicy[V]) admitOver(key uint64, cost int64, victim uint64) bool {
+	p.victim[0] = victim
+	return p.admission.Admit(key, cost, p.victim[:])
+}
+
 // Add decides whether the item with the given key and cost should be accepted by
 // the policy. It returns the list of victims that have been evicted and a boolean
 // indicating whether the incoming item should be accepted.
@@ -149,18 +300,21 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]policyPair, bool) {
 	}
 
 	// If the execution reaches this point, the key doesn't exist in the cache.
-	// Calculate the remaining room in the cache (usually bytes).
-	room := p.evict.roomLeft(cost)
-	if room >= 0 {
+	// Check whether there's room left in the cache (usually bytes).
+	if p.evict.hasRoom(cost) {
 		// There's enough room in the cache to store the new item without
 		// overflowing. Do that now and stop here.
 		p.evict.add(key, cost)
+		p.ghost.remove(key)
 		p.metrics.add(costAdd, key, uint64(cost))
 		return nil, true
 	}
+	// A key evicted moments ago is let back in without comparing frequencies.
+	ghost := p.ghost.has(key)
+	if p.evict.eviction != nil {
+		return p.addEvicting(key, cost, ghost)
+	}
 
-	// incHits is the hit count for the incoming item.
-	incHits := p.admit.Estimate(key)
 	// sample is the eviction candidate pool to be filled via random sampling.
 	// TODO: perhaps we should use a min heap here. Right now our time
 	// complexity is N for finding the min. Min heap should bring it down to
@@ -171,43 +325,307 @@ func (p *defaultPolicy[V]) Add(key uint64, cost int64) ([]policyPair, bool) {
 
 	// Delete victims until there's enough space or a minKey is found that has
 	// more hits than incoming item.
-	for ; room < 0; room = p.evict.roomLeft(cost) {
+	for !p.evict.hasRoom(cost) {
 		// Fill up empty slots in sample.
 		sample = p.evict.fillSample(sample)
 
-		// Find minimally used item in sample.
-		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
-		for i, pair := range sample {
-			// Look up hit count for sample key.
-			if hits := p.admit.Estimate(pair.key); hits < minHits {
-				minKey, minHits, minId, minCost = pair.key, hits, i, pair.cost
-			}
+		// If there's nothing left to evict, reject.
+		if len(sample) == 0 {
+			p.metrics.add(rejectSets, key, 1)
+			return victims, false
 		}
 
+		// Find minimally used item in sample.
+		minId, _ := p.minSample(sample)
+		victim := sample[minId]
+
 		// If the incoming item isn't worth keeping in the policy, reject.
-		if incHits < minHits {
+		if !ghost && !p.admitOver(key, cost, victim.key) {
 			p.metrics.add(rejectSets, key, 1)
 			return victims, false
 		}
 
 		// Delete the victim from metadata.
-		p.evict.del(minKey)
+		p.evict.del(victim.key)
+		p.ghost.add(victim.key)
 
 		// Delete the victim from sample.
 		sample[minId] = sample[len(sample)-1]
 		sample = sample[:len(sample)-1]
 		// Store victim in evicted victims slice.
-		victims = append(victims, policyPair{
-			key:  minKey,
-			cost: minCost,
-		})
+		victims = append(victims, victim)
 	}
 
 	p.evict.add(key, cost)
+	p.ghost.remove(key)
 	p.metrics.add(costAdd, key, uint64(cost))
 	return victims, true
 }
 
+// minSample returns the index and hit count of the least frequently used
+// key in sample. The hit count is math.MaxInt64 if sample is empty. Among
+// keys used as often, it picks the costliest one if costlierVictims is set,
+// and the first one otherwise.
+func (p *defaultPolicy[V]) minSample(sample []policyPair) (int, int64) {
+	minId, minHits := 0, int64(math.MaxInt64)
+	for i, pair := range sample {
+		// Look up hit count for sample key.
+		hits := p.admission.Estimate(pair.key)
+		if hits < minHits || (hits == minHits && p.costlierVictims && pair.cost > sample[minId].cost) {
+			minId, minHits = i, hits
+		}
+	}
+	return minId, minHits
+}
+
+// Reserve accounts cost against the max cost of the policy without adding a
+// key for it. It returns false if cost doesn't fit even in an empty cache. The
+// cost used can then be over the max cost until Shrink is called.
+func (p *defaultPolicy[V]) Reserve(cost int64) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.evict.reserved+cost > p.evict.getMaxCost() {
+		return false
+	}
+	p.evict.reserve(cost)
+	return true
+}
+
+// MemoryUsage estimates the memory taken by the policy in bytes. The memory
+// taken by Config.Admission and Config.Eviction isn't known, so only the one
+// of the default admission policy and the costs of the keys are counted.
+func (p *defaultPolicy[V]) MemoryUsage() uint64 {
+	p.Lock()
+	defer p.Unlock()
+	usage := p.admit.memoryUsage() + mapBytes(len(p.evict.keyCosts), 8, 8)
+	if p.ghost != nil {
+		usage += uint64(len(p.ghost.keys))*8 + mapBytes(len(p.ghost.seqs), 8, 8)
+	}
+	return usage
+}
+
+// Shrink evicts keys until the used cost is at most the given one, and returns
+// them.
+func (p *defaultPolicy[V]) Shrink(used int64) []policyPair {
+	p.Lock()
+	defer p.Unlock()
+	return p.evictTo(used)
+}
+
+// evictTo evicts keys until the used cost is at most the given one, and
+// returns them. The caller must hold the lock.
+func (p *defaultPolicy[V]) evictTo(used int64) []policyPair {
+	// Evict as if for a key costing the difference with the max cost.
+	extra := p.evict.getMaxCost() - used
+	var victims []policyPair
+	if p.evict.eviction != nil {
+		for _, victim := range p.evict.candidates(extra, false) {
+			p.evict.del(victim.key)
+			p.ghost.add(victim.key)
+			victims = append(victims, victim)
+		}
+		return victims
+	}
+	sample := make([]policyPair, 0, lfuSample)
+	for p.evict.roomLeft(extra) < 0 {
+		sample = p.evict.fillSample(sample)
+		if len(sample) == 0 {
+			break
+		}
+		minId, _ := p.minSample(sample)
+		victim := sample[minId]
+		p.evict.del(victim.key)
+		p.ghost.add(victim.key)
+		sample[minId] = sample[len(sample)-1]
+		sample = sample[:len(sample)-1]
+		victims = append(victims, victim)
+	}
+	return victims
+}
+
+// Release gives back cost previously taken with Reserve.
+func (p *defaultPolicy[V]) Release(cost int64) {
+	p.Lock()
+	if cost > p.evict.reserved {
+		cost = p.evict.reserved
+	}
+	p.evict.reserve(-cost)
+	p.Unlock()
+}
+
+// KeyFrequency is the estimated access frequency and the cost of a key.
+type KeyFrequency struct {
+	// Key is the hash of the key.
+	Key       uint64 `json:"key"`
+	Frequency int64  `json:"frequency"`
+	Cost      int64  `json:"cost"`
+}
+
+// keyFrequencyHeap is a min-heap of KeyFrequency ordered by frequency.
+type keyFrequencyHeap []KeyFrequency
+
+func (h keyFrequencyHeap) Len() int           { return len(h) }
+func (h keyFrequencyHeap) Less(i, j int) bool { return h[i].Frequency < h[j].Frequency }
+func (h keyFrequencyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyFrequencyHeap) Push(x interface{}) {
+	*h = append(*h, x.(KeyFrequency))
+}
+
+func (h *keyFrequencyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func (p *defaultPolicy[V]) Estimate(key uint64) int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.admission.Estimate(key)
+}
+
+// SetOutcome is what happens to an item passed to Set.
+type SetOutcome int
+
+const (
+	// SetAdmitted means the item is added to the cache.
+	SetAdmitted SetOutcome = iota
+	// SetUpdated means the key is already in the cache and its value is
+	// replaced.
+	SetUpdated
+	// SetRejected means the admission policy doesn't let the item in.
+	SetRejected
+	// SetDropped means the item is dropped before reaching the policy, because
+	// the internal buffers are full or the cache is closed.
+	SetDropped
+)
+
+func (o SetOutcome) String() string {
+	switch o {
+	case SetAdmitted:
+		return "admitted"
+	case SetUpdated:
+		return "updated"
+	case SetRejected:
+		return "rejected"
+	case SetDropped:
+		return "dropped"
+	default:
+		return "unidentified"
+	}
+}
+
+// SetExplanation describes what would happen to an item passed to Set, as
+// reported by Cache.ExplainSet.
+type SetExplanation struct {
+	Outcome SetOutcome
+	// Cost is the cost of the item, including the internal cost.
+	Cost int64
+	// Frequency is the estimated access frequency of the key.
+	Frequency int64
+	// Victims are the sampled items that would be evicted to make room for the
+	// item.
+	Victims []KeyFrequency
+	// RejectedBy is the sampled item that is accessed more often than the key
+	// and made the policy reject it. It's the zero value if the item isn't
+	// rejected or is rejected for being bigger than the whole cache.
+	RejectedBy KeyFrequency
+}
+
+func (p *defaultPolicy[V]) Explain(key uint64, cost int64, drainAbove, drainTo int64) SetExplanation {
+	p.Lock()
+	defer p.Unlock()
+
+	exp := SetExplanation{Cost: cost, Frequency: p.admission.Estimate(key)}
+	if cost > p.evict.getMaxCost() {
+		exp.Outcome = SetRejected
+		return exp
+	}
+	if _, has := p.evict.keyCosts[key]; has {
+		exp.Outcome = SetUpdated
+		return exp
+	}
+
+	ghost := p.ghost.has(key)
+	if p.evict.eviction != nil {
+		return p.explainEvicting(key, exp, ghost, drainAbove, drainTo)
+	}
+
+	// Replay the eviction loop of Add, keeping track of the victims instead
+	// of deleting them.
+	room := p.evict.roomLeft(cost)
+	items := int64(len(p.evict.keyCosts))
+	evicted := make(map[uint64]struct{})
+	sample := make([]policyPair, 0, lfuSample)
+	evict := func(minId int, minHits int64) {
+		victim := sample[minId]
+		evicted[victim.key] = struct{}{}
+		room += victim.cost
+		items--
+		exp.Victims = append(exp.Victims, KeyFrequency{Key: victim.key, Frequency: minHits, Cost: victim.cost})
+		sample[minId] = sample[len(sample)-1]
+		sample = sample[:len(sample)-1]
+	}
+	for room < 0 || (p.evict.maxItems > 0 && items >= p.evict.maxItems) {
+		sample = p.evict.fillSampleExcept(sample, evicted)
+		minId, minHits := p.minSample(sample)
+		if len(sample) == 0 || (!ghost && !p.admitOver(key, cost, sample[minId].key)) {
+			exp.Outcome = SetRejected
+			if len(sample) > 0 {
+				victim := sample[minId]
+				exp.RejectedBy = KeyFrequency{Key: victim.key, Frequency: minHits, Cost: victim.cost}
+			}
+			return exp
+		}
+		evict(minId, minHits)
+	}
+	exp.Outcome = SetAdmitted
+
+	// Replay the eviction down to the low watermark, like Shrink, if the key
+	// takes the cost used over the high watermark.
+	used := p.evict.getMaxCost() - room
+	if drainAbove <= 0 || used <= drainAbove {
+		return exp
+	}
+	for ; used > drainTo; used = p.evict.getMaxCost() - room {
+		sample = p.evict.fillSampleExcept(sample, evicted)
+		if len(sample) == 0 {
+			break
+		}
+		evict(p.minSample(sample))
+	}
+	return exp
+}
+
+func (p *defaultPolicy[V]) TopKeys(n int) []KeyFrequency {
+	if n <= 0 {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	top := make(keyFrequencyHeap, 0, n)
+	for key, cost := range p.evict.keyCosts {
+		kf := KeyFrequency{Key: key, Frequency: p.admission.Estimate(key), Cost: cost}
+		if len(top) < n {
+			heap.Push(&top, kf)
+		} else if kf.Frequency > top[0].Frequency {
+			top[0] = kf
+			heap.Fix(&top, 0)
+		}
+	}
+	// Popping from the min-heap yields the least frequent first, so fill the
+	// result from the end.
+	res := make([]KeyFrequency, len(top))
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(&top).(KeyFrequency)
+	}
+	return res
+}
+
 func (p *defaultPolicy[V]) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -234,6 +652,13 @@ func (p *defaultPolicy[V]) Update(key uint64, cost int64) {
 	p.Unlock()
 }
 
+func (p *defaultPolicy[V]) Len() int {
+	p.Lock()
+	n := len(p.evict.keyCosts)
+	p.Unlock()
+	return n
+}
+
 func (p *defaultPolicy[V]) Cost(key uint64) int64 {
 	p.Lock()
 	if cost, found := p.evict.keyCosts[key]; found {
@@ -246,8 +671,9 @@ func (p *defaultPolicy[V]) Cost(key uint64) int64 {
 
 func (p *defaultPolicy[V]) Clear() {
 	p.Lock()
-	p.admit.clear()
+	p.admission.Clear()
 	p.evict.clear()
+	p.ghost.clear()
 	p.Unlock()
 }
 
@@ -258,6 +684,9 @@ func (p *defaultPolicy[V]) Close() {
 
 	// Block until the p.processItems goroutine returns.
 	p.stop <- struct{}{}
+	if p.agingTicker != nil {
+		p.agingTicker.Stop()
+	}
 	close(p.stop)
 	close(p.itemsCh)
 	p.isClosed = true
@@ -270,6 +699,13 @@ func (p *defaultPolicy[V]) MaxCost() int64 {
 	return p.evict.getMaxCost()
 }
 
+func (p *defaultPolicy[V]) Used() int64 {
+	if p == nil || p.evict == nil {
+		return 0
+	}
+	return p.evict.getUsed()
+}
+
 func (p *defaultPolicy[V]) UpdateMaxCost(maxCost int64) {
 	if p == nil || p.evict == nil {
 		return
@@ -285,8 +721,20 @@ type sampledLFU struct {
 	// for 64-bit alignment of 64-bit words accessed atomically.
 	// The first word in a variable or in an allocated struct, array,
 	// or slice can be relied upon to be 64-bit aligned."
-	maxCost  int64
-	used     int64
+	maxCost int64
+	// used is only written while holding the policy lock, but it's written
+	// atomically so it can be read without it.
+	used int64
+	// reserved is the part of used taken by Reserve rather than by keys.
+	reserved int64
+	// maxItems is the max number of keys, or 0 for no limit.
+	maxItems int64
+	// eviction chooses the victims if Config.Eviction is set. Otherwise,
+	// they're chosen by sampling keyCosts.
+	eviction Eviction
+	// canEvict, if set, returns false for the keys that can't be evicted at
+	// the moment. See Config.CanEvict.
+	canEvict func(uint64) bool
 	metrics  *Metrics
 	keyCosts map[uint64]int64
 }
@@ -302,6 +750,10 @@ func (p *sampledLFU) getMaxCost() int64 {
 	return atomic.LoadInt64(&p.maxCost)
 }
 
+func (p *sampledLFU) getUsed() int64 {
+	return atomic.LoadInt64(&p.used)
+}
+
 func (p *sampledLFU) updateMaxCost(maxCost int64) {
 	atomic.StoreInt64(&p.maxCost, maxCost)
 }
@@ -310,11 +762,40 @@ func (p *sampledLFU) roomLeft(cost int64) int64 {
 	return p.getMaxCost() - (p.used + cost)
 }
 
+// hasRoom returns true if a new key with the given cost fits without exceeding
+// the max cost or the max number of keys.
+func (p *sampledLFU) hasRoom(cost int64) bool {
+	if p.maxItems > 0 && int64(len(p.keyCosts)) >= p.maxItems {
+		return false
+	}
+	return p.roomLeft(cost) >= 0
+}
+
 func (p *sampledLFU) fillSample(in []policyPair) []policyPair {
+	return p.fillSampleExcept(in, nil)
+}
+
+// fillSampleExcept works like fillSample, but never samples the keys in skip.
+func (p *sampledLFU) fillSampleExcept(in []policyPair, skip map[uint64]struct{}) []policyPair {
 	if len(in) >= lfuSample {
 		return in
 	}
+	var vetoes int
+	left := in
 	for key, cost := range p.keyCosts {
+		// The keys left from the previous sample can come up again.
+		if hasKey(left, key) {
+			continue
+		}
+		if _, ok := skip[key]; ok {
+			continue
+		}
+		if p.vetoed(key, &vetoes) {
+			if vetoes >= maxEvictVetoes {
+				return in
+			}
+			continue
+		}
 		in = append(in, policyPair{key, cost})
 		if len(in) >= lfuSample {
 			return in
@@ -323,20 +804,51 @@ func (p *sampledLFU) fillSample(in []policyPair) []policyPair {
 	return in
 }
 
+// vetoed returns true if Config.CanEvict vetoes the eviction of the key,
+// counting the veto in vetoes.
+func (p *sampledLFU) vetoed(key uint64, vetoes *int) bool {
+	if p.canEvict == nil || p.canEvict(key) {
+		return false
+	}
+	*vetoes++
+	return true
+}
+
+// hasKey returns true if the key is among the pairs.
+func hasKey(pairs []policyPair, key uint64) bool {
+	for _, pair := range pairs {
+		if pair.key == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *sampledLFU) del(key uint64) {
 	cost, ok := p.keyCosts[key]
 	if !ok {
 		return
 	}
-	p.used -= cost
+	atomic.AddInt64(&p.used, -cost)
 	delete(p.keyCosts, key)
+	if p.eviction != nil {
+		p.eviction.Del(key)
+	}
 	p.metrics.add(costEvict, key, uint64(cost))
 	p.metrics.add(keyEvict, key, 1)
 }
 
 func (p *sampledLFU) add(key uint64, cost int64) {
 	p.keyCosts[key] = cost
-	p.used += cost
+	atomic.AddInt64(&p.used, cost)
+	if p.eviction != nil {
+		p.eviction.Add(key, cost)
+	}
+}
+
+func (p *sampledLFU) reserve(cost int64) {
+	p.reserved += cost
+	atomic.AddInt64(&p.used, cost)
 }
 
 func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
@@ -351,26 +863,55 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 			diff := cost - prev
 			p.metrics.add(costAdd, key, uint64(diff))
 		}
-		p.used += cost - prev
+		atomic.AddInt64(&p.used, cost-prev)
 		p.keyCosts[key] = cost
+		if p.eviction != nil {
+			p.eviction.Update(key, cost)
+		}
 		return true
 	}
 	return false
 }
 
 func (p *sampledLFU) clear() {
-	p.used = 0
+	// Reserved cost is held outside of the cache, so it survives a clear.
+	atomic.StoreInt64(&p.used, p.reserved)
 	p.keyCosts = make(map[uint64]int64)
+	if p.eviction != nil {
+		p.eviction.Clear()
+	}
 }
 
+// SketchAging is how the default admission policy ages the access frequencies
+// it keeps track of, so items popular in the past don't stay in the cache
+// forever.
+type SketchAging byte
+
+const (
+	// SketchHalving halves all the counters every NumCounters increments. It's
+	// the default.
+	SketchHalving SketchAging = iota
+	// SketchWindow keeps two sketches and, every NumCounters increments,
+	// drops the older one and starts a new one. Frequencies only count the
+	// last two windows, so popularity shifts are picked up sooner than with
+	// SketchHalving, at the cost of twice the counters.
+	SketchWindow
+)
+
 // tinyLFU is an admission helper that keeps track of access frequency using
 // tiny (4-bit) counters in the form of a count-min sketch.
 // tinyLFU is NOT thread safe.
 type tinyLFU struct {
-	freq    *cmSketch
+	freq *cmSketch
+	// prev is the sketch of the previous window. It's only set with
+	// SketchWindow.
+	prev    *cmSketch
 	door    *z.Bloom
 	incrs   int64
 	resetAt int64
+	// randomTies makes Admit flip a coin for candidates only as frequent as a
+	// victim, see Config.RandomTieAdmission.
+	randomTies bool
 }
 
 func newTinyLFU(numCounters int64) *tinyLFU {
@@ -381,6 +922,50 @@ func newTinyLFU(numCounters int64) *tinyLFU {
 	}
 }
 
+// setAging sets the aging strategy of the sketch. It must be called before the
+// first increment.
+func (p *tinyLFU) setAging(aging SketchAging) {
+	if aging == SketchWindow {
+		p.prev = newCmSketch(int64(p.freq.mask + 1))
+	} else {
+		p.prev = nil
+	}
+}
+
+// memoryUsage returns the memory taken by the sketches and the doorkeeper in
+// bytes.
+func (p *tinyLFU) memoryUsage() uint64 {
+	usage := p.freq.memoryUsage() + uint64(p.door.TotalSize())
+	if p.prev != nil {
+		usage += p.prev.memoryUsage()
+	}
+	return usage
+}
+
+func (p *tinyLFU) Record(key uint64) {
+	p.Increment(key)
+}
+
+// Admit lets the candidate in if it's at least as frequent as every victim,
+// but only half the time if it's only as frequent as one of them and
+// randomTies is set.
+func (p *tinyLFU) Admit(candidate uint64, _ int64, victims []uint64) bool {
+	hits := p.Estimate(candidate)
+	var tie bool
+	for _, victim := range victims {
+		victimHits := p.Estimate(victim)
+		if hits < victimHits {
+			return false
+		}
+		tie = tie || hits == victimHits
+	}
+	return !tie || !p.randomTies || z.FastRand()&1 == 0
+}
+
+func (p *tinyLFU) Clear() {
+	p.clear()
+}
+
 func (p *tinyLFU) Push(keys []uint64) {
 	for _, key := range keys {
 		p.Increment(key)
@@ -389,6 +974,9 @@ func (p *tinyLFU) Push(keys []uint64) {
 
 func (p *tinyLFU) Estimate(key uint64) int64 {
 	hits := p.freq.Estimate(key)
+	if p.prev != nil {
+		hits += p.prev.Estimate(key)
+	}
 	if p.door.Has(key) {
 		hits++
 	}
@@ -402,7 +990,7 @@ func (p *tinyLFU) Increment(key uint64) {
 		p.freq.Increment(key)
 	}
 	p.incrs++
-	if p.incrs >= p.resetAt {
+	if p.resetAt > 0 && p.incrs >= p.resetAt {
 		p.reset()
 	}
 }
@@ -412,6 +1000,12 @@ func (p *tinyLFU) reset() {
 	p.incrs = 0
 	// clears doorkeeper bits
 	p.door.Clear()
+	if p.prev != nil {
+		// starts a new window, dropping the oldest one
+		p.prev, p.freq = p.freq, p.prev
+		p.freq.Clear()
+		return
+	}
 	// halves count-min counters
 	p.freq.Reset()
 }
@@ -420,4 +1014,7 @@ func (p *tinyLFU) clear() {
 	p.incrs = 0
 	p.door.Clear()
 	p.freq.Clear()
+	if p.prev != nil {
+		p.prev.Clear()
+	}
 }
@@ -11,18 +11,18 @@ func TestPolicy(t *testing.T) {
 	defer func() {
 		require.Nil(t, recover())
 	}()
-	newPolicy[int](100, 10)
+	newPolicy[int](100, 10, policyOptions{})
 }
 
 func TestPolicyMetrics(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.CollectMetrics(newMetrics())
 	require.NotNil(t, p.metrics)
 	require.NotNil(t, p.evict.metrics)
 }
 
 func TestPolicyProcessItems(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.itemsCh <- []uint64{1, 2, 2}
 	time.Sleep(wait)
 	p.Lock()
@@ -39,7 +39,7 @@ func TestPolicyProcessItems(t *testing.T) {
 }
 
 func TestPolicyPush(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	require.True(t, p.Push([]uint64{}))
 
 	keepCount := 0
@@ -52,7 +52,7 @@ func TestPolicyPush(t *testing.T) {
 }
 
 func TestPolicyAdd(t *testing.T) {
-	p := newDefaultPolicy[int](1000, 100)
+	p := newDefaultPolicy[int](1000, 100, policyOptions{})
 	if victims, added := p.Add(1, 101); victims != nil || added {
 		t.Fatal("can't add an item bigger than entire cache")
 	}
@@ -80,15 +80,346 @@ func TestPolicyAdd(t *testing.T) {
 	require.False(t, added)
 }
 
+func TestPolicyMaxItems(t *testing.T) {
+	p := newPolicy[int](100, 100, policyOptions{maxItems: 2}).(*defaultPolicy[int])
+	p.Add(1, 1)
+	p.Add(2, 1)
+	require.Equal(t, SetAdmitted, p.Explain(3, 1, 0, 0).Outcome)
+	require.Equal(t, 1, len(p.Explain(3, 1, 0, 0).Victims))
+
+	victims, added := p.Add(3, 1)
+	require.True(t, added)
+	require.Equal(t, 1, len(victims))
+	require.Equal(t, 2, p.Len())
+	require.Equal(t, int64(2), p.Used())
+}
+
+type testAdmission struct {
+	records []uint64
+}
+
+func (a *testAdmission) Record(key uint64) {
+	a.records = append(a.records, key)
+}
+
+func (a *testAdmission) Estimate(key uint64) int64 {
+	return int64(key)
+}
+
+// Admit lets in the even keys only.
+func (a *testAdmission) Admit(candidate uint64, _ int64, _ []uint64) bool {
+	return candidate%2 == 0
+}
+
+func (a *testAdmission) Clear() {
+	a.records = nil
+}
+
+func TestPolicyAdmission(t *testing.T) {
+	a := &testAdmission{}
+	p := newPolicy[int](100, 2, policyOptions{admission: a}).(*defaultPolicy[int])
+	p.Add(5, 1)
+	p.Add(6, 1)
+
+	victims, added := p.Add(7, 1)
+	require.False(t, added)
+	require.Empty(t, victims)
+	require.Equal(t, SetRejected, p.Explain(7, 1, 0, 0).Outcome)
+
+	// The least frequent key is the smallest one.
+	victims, added = p.Add(8, 1)
+	require.True(t, added)
+	require.Equal(t, []policyPair{{5, 1}}, victims)
+	require.Equal(t, int64(8), p.Estimate(8))
+
+	p.Push([]uint64{1, 2})
+	time.Sleep(wait)
+	p.Lock()
+	require.Equal(t, []uint64{1, 2}, a.records)
+	p.Unlock()
+	p.Clear()
+	require.Nil(t, a.records)
+}
+
+func TestPolicyAdmitOverAllocs(t *testing.T) {
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
+	p.Lock()
+	defer p.Unlock()
+	allocs := testing.AllocsPerRun(100, func() {
+		p.admitOver(1, 1, 2)
+	})
+	require.Zero(t, allocs)
+}
+
+type admitAll struct {
+	testAdmission
+}
+
+func (admitAll) Admit(uint64, int64, []uint64) bool {
+	return true
+}
+
+func TestPolicyEviction(t *testing.T) {
+	p := newPolicy[int](100, 3, policyOptions{admission: &admitAll{}, eviction: NewLRUEviction()}).(*defaultPolicy[int])
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Add(3, 1)
+	p.Push([]uint64{1})
+	time.Sleep(wait)
+
+	// Key 2 is the least recently used one.
+	exp := p.Explain(4, 1, 0, 0)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Equal(t, uint64(2), exp.Victims[0].Key)
+	victims, added := p.Add(4, 1)
+	require.True(t, added)
+	require.Equal(t, []policyPair{{2, 1}}, victims)
+
+	victims, added = p.Add(5, 2)
+	require.True(t, added)
+	require.Equal(t, []policyPair{{3, 1}, {1, 1}}, victims)
+
+	require.True(t, p.Reserve(1))
+	require.Equal(t, []policyPair{{4, 1}}, p.Shrink(p.MaxCost()))
+	require.Equal(t, int64(3), p.Used())
+}
+
+// flatAdmission admits every key and estimates them all as equally frequent.
+type flatAdmission struct {
+	admitAll
+}
+
+func (flatAdmission) Estimate(uint64) int64 {
+	return 0
+}
+
+func TestPolicyCostlierVictims(t *testing.T) {
+	p := newPolicy[int](100, 10, policyOptions{
+		admission:       &flatAdmission{},
+		costlierVictims: true,
+	}).(*defaultPolicy[int])
+	defer p.Close()
+	p.Add(1, 1)
+	p.Add(2, 5)
+	p.Add(3, 4)
+
+	// All the keys are as frequent, so the costliest one is evicted, which
+	// makes enough room on its own.
+	exp := p.Explain(4, 5, 0, 0)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Equal(t, uint64(2), exp.Victims[0].Key)
+	victims, added := p.Add(4, 5)
+	require.True(t, added)
+	require.Equal(t, []policyPair{{2, 5}}, victims)
+}
+
+func TestPolicyCanEvict(t *testing.T) {
+	for _, eviction := range []Eviction{nil, NewLRUEviction(), NewLIRSEviction()} {
+		keep := map[uint64]bool{1: true}
+		p := newPolicy[int](100, 2, policyOptions{
+			admission: &admitAll{},
+			eviction:  eviction,
+			canEvict:  func(key uint64) bool { return !keep[key] },
+		}).(*defaultPolicy[int])
+		p.Add(1, 1)
+		p.Add(2, 1)
+
+		// Key 1 is vetoed, so key 2 is evicted.
+		victims, added := p.Add(3, 1)
+		require.True(t, added)
+		require.Equal(t, []policyPair{{2, 1}}, victims)
+
+		// With every key vetoed, there's no room.
+		keep[3] = true
+		victims, added = p.Add(4, 1)
+		require.False(t, added)
+		require.Empty(t, victims)
+		require.True(t, p.Has(1))
+		require.True(t, p.Has(3))
+		p.Close()
+	}
+}
+
+func TestPolicyGhost(t *testing.T) {
+	for _, ghostItems := range []int64{0, 4} {
+		p := newDefaultPolicy[int](100, 2, policyOptions{ghostItems: ghostItems})
+		p.Add(1, 1)
+		p.Add(2, 1)
+		p.admit.Increment(3)
+		p.admit.Increment(3)
+		victims, added := p.Add(3, 1)
+		require.True(t, added)
+		require.Len(t, victims, 1)
+		victim := victims[0].key
+
+		// The victim is now less frequent than any key left.
+		for _, key := range []uint64{1, 2, 3} {
+			if key != victim {
+				p.admit.Increment(key)
+				p.admit.Increment(key)
+			}
+		}
+		_, added = p.Add(victim, 1)
+		require.Equal(t, ghostItems > 0, added)
+		p.Close()
+	}
+}
+
+func TestGhostList(t *testing.T) {
+	g := newGhostList(2)
+	g.add(1)
+	g.add(2)
+	require.True(t, g.has(1))
+	g.add(3)
+	require.False(t, g.has(1))
+	require.True(t, g.has(2))
+	require.True(t, g.has(3))
+
+	// A key added again outlives its older slot.
+	g.add(2)
+	g.add(4)
+	require.True(t, g.has(2))
+	require.False(t, g.has(3))
+	g.remove(2)
+	require.False(t, g.has(2))
+
+	g.clear()
+	require.False(t, g.has(4))
+	require.False(t, newGhostList(0).has(1))
+}
+
+func TestPolicyReserve(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 100, policyOptions{})
+	p.Add(1, 50)
+	p.Add(2, 40)
+
+	require.False(t, p.Reserve(101))
+	require.True(t, p.Reserve(20))
+	require.Equal(t, int64(110), p.Used())
+	victims := p.Shrink(p.MaxCost())
+	require.Equal(t, 1, len(victims))
+	require.False(t, p.Has(victims[0].key))
+	require.Equal(t, 20+90-victims[0].cost, p.Used())
+
+	p.Release(20)
+	require.Equal(t, 90-victims[0].cost, p.Used())
+}
+
+func TestPolicyShrink(t *testing.T) {
+	for _, eviction := range []Eviction{nil, NewLRUEviction()} {
+		p := newDefaultPolicy[int](1000, 100, policyOptions{eviction: eviction})
+		for key := uint64(1); key <= 100; key++ {
+			p.Add(key, 1)
+		}
+		require.Empty(t, p.Shrink(100))
+
+		// Every key is evicted once only.
+		victims := p.Shrink(20)
+		require.Equal(t, 80, len(victims))
+		seen := make(map[uint64]bool)
+		for _, victim := range victims {
+			require.False(t, seen[victim.key])
+			seen[victim.key] = true
+			require.False(t, p.Has(victim.key))
+		}
+		require.Equal(t, int64(20), p.Used())
+		p.Close()
+	}
+}
+
+func TestPolicyTopKeys(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 100, policyOptions{})
+	for key := uint64(1); key <= 5; key++ {
+		p.Add(key, int64(key))
+		for i := uint64(0); i < key; i++ {
+			p.admit.Increment(key)
+		}
+	}
+
+	top := p.TopKeys(3)
+	require.Equal(t, 3, len(top))
+	require.Equal(t, uint64(5), top[0].Key)
+	require.Equal(t, int64(5), top[0].Cost)
+	require.Equal(t, uint64(4), top[1].Key)
+	require.Equal(t, uint64(3), top[2].Key)
+	require.Equal(t, 5, len(p.TopKeys(10)))
+	require.Nil(t, p.TopKeys(0))
+}
+
+func TestPolicyExplain(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 10, policyOptions{})
+	p.Add(1, 4)
+	p.Add(2, 4)
+	p.admit.Increment(2)
+	p.admit.Increment(2)
+
+	require.Equal(t, SetRejected, p.Explain(3, 11, 0, 0).Outcome)
+	require.Equal(t, SetUpdated, p.Explain(1, 5, 0, 0).Outcome)
+	exp := p.Explain(3, 2, 0, 0)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Empty(t, exp.Victims)
+
+	// Key 3 is as frequent as key 1, so key 1 is evicted.
+	p.admit.Increment(1)
+	p.admit.Increment(3)
+	exp = p.Explain(3, 4, 0, 0)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Equal(t, []KeyFrequency{{Key: 1, Frequency: 1, Cost: 4}}, exp.Victims)
+
+	// Making room for key 3 requires evicting key 2 as well, which is more
+	// frequent than key 3.
+	exp = p.Explain(3, 8, 0, 0)
+	require.Equal(t, SetRejected, exp.Outcome)
+	require.Equal(t, KeyFrequency{Key: 2, Frequency: 2, Cost: 4}, exp.RejectedBy)
+
+	// Nothing was changed.
+	require.True(t, p.Has(1))
+	require.True(t, p.Has(2))
+	require.Equal(t, int64(8), p.Used())
+	require.Equal(t, "rejected", SetRejected.String())
+}
+
+func TestPolicyExplainVetoes(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 10, policyOptions{
+		canEvict: func(key uint64) bool { return key != 1 },
+	})
+	p.Add(1, 4)
+	p.Add(2, 4)
+	p.admit.Increment(3)
+
+	// Key 1 can't be evicted, so key 3 only fits in place of key 2, and
+	// no key is reported twice.
+	exp := p.Explain(3, 4, 0, 0)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Equal(t, []KeyFrequency{{Key: 2, Frequency: 0, Cost: 4}}, exp.Victims)
+	exp = p.Explain(3, 8, 0, 0)
+	require.Equal(t, SetRejected, exp.Outcome)
+	require.Equal(t, []KeyFrequency{{Key: 2, Frequency: 0, Cost: 4}}, exp.Victims)
+}
+
+func TestPolicyExplainWatermark(t *testing.T) {
+	p := newDefaultPolicy[int](1000, 10, policyOptions{})
+	p.Add(1, 2)
+	p.Add(2, 2)
+	p.admit.Increment(2)
+
+	// Key 3 fits, but takes the cost used over 5, so key 1 is evicted down
+	// to 4.
+	exp := p.Explain(3, 2, 5, 4)
+	require.Equal(t, SetAdmitted, exp.Outcome)
+	require.Equal(t, []KeyFrequency{{Key: 1, Frequency: 0, Cost: 2}}, exp.Victims)
+	require.Empty(t, p.Explain(3, 1, 5, 4).Victims)
+}
+
 func TestPolicyHas(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	require.True(t, p.Has(1))
 	require.False(t, p.Has(2))
 }
 
 func TestPolicyDel(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	p.Del(1)
 	p.Del(2)
@@ -97,13 +428,13 @@ func TestPolicyDel(t *testing.T) {
 }
 
 func TestPolicyCap(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	require.Equal(t, int64(9), p.Cap())
 }
 
 func TestPolicyUpdate(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	p.Update(1, 2)
 	p.Lock()
@@ -112,14 +443,14 @@ func TestPolicyUpdate(t *testing.T) {
 }
 
 func TestPolicyCost(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 2)
 	require.Equal(t, int64(2), p.Cost(1))
 	require.Equal(t, int64(-1), p.Cost(2))
 }
 
 func TestPolicyClear(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	p.Add(2, 2)
 	p.Add(3, 3)
@@ -135,20 +466,20 @@ func TestPolicyClose(t *testing.T) {
 		require.NotNil(t, recover())
 	}()
 
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Add(1, 1)
 	p.Close()
 	p.itemsCh <- []uint64{1}
 }
 
 func TestPushAfterClose(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Close()
 	require.False(t, p.Push([]uint64{1, 2}))
 }
 
 func TestAddAfterClose(t *testing.T) {
-	p := newDefaultPolicy[int](100, 10)
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
 	p.Close()
 	p.Add(1, 1)
 }
@@ -250,6 +581,30 @@ func TestTinyLFUPush(t *testing.T) {
 	require.Equal(t, int64(6), a.incrs)
 }
 
+func TestTinyLFURandomTies(t *testing.T) {
+	a := newTinyLFU(16)
+	a.Push([]uint64{1, 2, 3, 3})
+	var admitted int
+	for i := 0; i < 1000; i++ {
+		require.False(t, a.Admit(1, 1, []uint64{3}))
+		if a.Admit(1, 1, []uint64{2}) {
+			admitted++
+		}
+	}
+	require.Equal(t, 1000, admitted)
+
+	a.randomTies = true
+	admitted = 0
+	for i := 0; i < 1000; i++ {
+		require.False(t, a.Admit(1, 1, []uint64{3}))
+		require.True(t, a.Admit(3, 1, []uint64{1}))
+		if a.Admit(1, 1, []uint64{2}) {
+			admitted++
+		}
+	}
+	require.InDelta(t, 500, admitted, 100)
+}
+
 func TestTinyLFUClear(t *testing.T) {
 	a := newTinyLFU(16)
 	a.Push([]uint64{1, 3, 3, 3})
@@ -257,3 +612,49 @@ func TestTinyLFUClear(t *testing.T) {
 	require.Equal(t, int64(0), a.incrs)
 	require.Equal(t, int64(0), a.Estimate(3))
 }
+
+func TestTinyLFUWindow(t *testing.T) {
+	halving := newTinyLFU(64)
+	window := newTinyLFU(64)
+	window.setAging(SketchWindow)
+	for _, a := range []*tinyLFU{halving, window} {
+		for i := 0; i < 64; i++ {
+			a.Increment(1)
+		}
+	}
+	// The counts of the last window are kept whole.
+	require.Equal(t, int64(7), halving.Estimate(1))
+	require.Equal(t, int64(15), window.Estimate(1))
+
+	for _, a := range []*tinyLFU{halving, window} {
+		for i := 0; i < 64; i++ {
+			a.Increment(2)
+		}
+	}
+	// Older windows are forgotten altogether.
+	require.Equal(t, int64(3), halving.Estimate(1))
+	require.Equal(t, int64(0), window.Estimate(1))
+	require.Equal(t, int64(15), window.Estimate(2))
+
+	window.clear()
+	require.Equal(t, int64(0), window.Estimate(2))
+}
+
+func TestPolicyAgingInterval(t *testing.T) {
+	p := newDefaultPolicy[int](16, 10, policyOptions{agingInterval: 20 * time.Millisecond})
+	defer p.Close()
+
+	p.Lock()
+	// Many more increments than counters don't age the frequencies.
+	for i := 0; i < 64; i++ {
+		p.admit.Increment(1)
+	}
+	require.Equal(t, int64(16), p.admit.Estimate(1))
+	p.Unlock()
+
+	// The ticker ages them instead.
+	time.Sleep(50 * time.Millisecond)
+	p.Lock()
+	defer p.Unlock()
+	require.Less(t, p.admit.Estimate(1), int64(16))
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/paivagustavo/ristretto/z"
+)
+
+// ErrPolicyMismatch is returned by LoadPolicy when the policy state was saved
+// by a cache with a different NumCounters.
+var ErrPolicyMismatch = errors.New("policy state doesn't match the cache config")
+
+// The policy state starts with policyStateMagic and the uvarint format
+// version, followed by the uvarint length of the state, the state and its
+// big-endian CRC-32C.
+//
+// The state is the uvarint number of counters and increments since the last
+// aging, the seeds of the rows as big-endian uint64s, the rows, a byte set to 1
+// if the rows of the previous window follow, and the doorkeeper as uvarint
+// length and bytes.
+//
+// Version 2 encodes the doorkeeper with z.Bloom.MarshalBinary rather than
+// z.Bloom.JSONMarshal.
+const policyStateVersion = 2
+
+var policyStateMagic = []byte("ristpolc")
+
+// SavePolicy writes the state of the admission policy to w: the access
+// frequencies the cache learned so far, without the keys and values. Loading
+// it with LoadPolicy in a restarted process lets the cache admit the keys
+// that were hot right away, even if their values are loaded back lazily,
+// instead of learning their frequencies again. Like Save, it can be called
+// while the cache is in use.
+func (c *Cache[K, V]) SavePolicy(w io.Writer) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	state := c.policy.SaveState()
+	bw := bufio.NewWriter(w)
+	var buf [binary.MaxVarintLen64]byte
+	bw.Write(policyStateMagic)
+	bw.Write(buf[:binary.PutUvarint(buf[:], policyStateVersion)])
+	bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(state)))])
+	bw.Write(state)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(state, snapshotCRC))
+	bw.Write(sum[:])
+	return bw.Flush()
+}
+
+// LoadPolicy replaces the state of the admission policy with the one written
+// by SavePolicy. It returns ErrPolicyMismatch if the state was saved by a
+// cache with a different NumCounters, and ErrSnapshotCorrupt or
+// ErrSnapshotVersion if it can't be read, leaving the policy unchanged. The
+// keys and costs of the items in the cache are kept.
+func (c *Cache[K, V]) LoadPolicy(r io.Reader) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(policyStateMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, policyStateMagic) {
+		return ErrSnapshotCorrupt
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return ErrSnapshotCorrupt
+	}
+	if version > policyStateVersion {
+		return ErrSnapshotVersion
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil || size > math.MaxInt64-4 {
+		return ErrSnapshotCorrupt
+	}
+	// Copy rather than allocate size bytes up front, in case it's corrupt.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, br, int64(size)+4); err != nil {
+		return ErrSnapshotCorrupt
+	}
+	state := data.Bytes()[:size]
+	if crc32.Checksum(state, snapshotCRC) != binary.BigEndian.Uint32(data.Bytes()[size:]) {
+		return ErrSnapshotCorrupt
+	}
+	return c.policy.LoadState(state, version)
+}
+
+func (p *defaultPolicy[V]) SaveState() []byte {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.marshal(nil)
+}
+
+func (p *defaultPolicy[V]) LoadState(state []byte, version uint64) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.unmarshal(state, version)
+}
+
+// marshal appends the state of the sketches and the doorkeeper to b.
+func (p *tinyLFU) marshal(b []byte) []byte {
+	b = appendUvarint(b, p.freq.mask+1)
+	b = appendUvarint(b, uint64(p.incrs))
+	b = p.freq.marshal(b)
+	if p.prev != nil {
+		b = append(b, 1)
+		b = p.prev.marshal(b)
+	} else {
+		b = append(b, 0)
+	}
+	door, _ := p.door.MarshalBinary()
+	b = appendUvarint(b, uint64(len(door)))
+	return append(b, door...)
+}
+
+// unmarshal replaces the state with the one appended by marshal, in the given
+// version of the format. The previous
+// window is only loaded if both the saved and the current policy age the
+// frequencies with SketchWindow.
+func (p *tinyLFU) unmarshal(b []byte, version uint64) error {
+	counters, n := binary.Uvarint(b)
+	if n <= 0 {
+		return ErrSnapshotCorrupt
+	}
+	if counters != p.freq.mask+1 {
+		return ErrPolicyMismatch
+	}
+	b = b[n:]
+	incrs, n := binary.Uvarint(b)
+	if n <= 0 || incrs > math.MaxInt64 {
+		return ErrSnapshotCorrupt
+	}
+	b = b[n:]
+	freq := newCmSketch(int64(counters))
+	if b = freq.unmarshal(b); b == nil || len(b) == 0 {
+		return ErrSnapshotCorrupt
+	}
+	var prev *cmSketch
+	window := b[0] == 1
+	b = b[1:]
+	if window {
+		prev = newCmSketch(int64(counters))
+		if b = prev.unmarshal(b); b == nil {
+			return ErrSnapshotCorrupt
+		}
+	}
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size != uint64(len(b)-n) {
+		return ErrSnapshotCorrupt
+	}
+	door := new(z.Bloom)
+	var err error
+	if version < 2 {
+		door, err = z.JSONUnmarshal(b[n:])
+	} else {
+		err = door.UnmarshalBinary(b[n:])
+	}
+	if err != nil || door.TotalSize() != p.door.TotalSize() {
+		return ErrSnapshotCorrupt
+	}
+	p.freq, p.door, p.incrs = freq, door, int64(incrs)
+	if p.prev != nil {
+		if prev == nil {
+			prev = newCmSketch(int64(counters))
+		}
+		p.prev = prev
+	}
+	return nil
+}
+
+// marshal appends the seeds and the rows of the sketch to b.
+func (s *cmSketch) marshal(b []byte) []byte {
+	var buf [8]byte
+	for i := range s.rows {
+		binary.BigEndian.PutUint64(buf[:], s.seed[i])
+		b = append(b, buf[:]...)
+	}
+	for _, r := range s.rows {
+		b = append(b, r...)
+	}
+	return b
+}
+
+// unmarshal reads the seeds and the rows appended by marshal from b, which
+// must be for a sketch of the same size, and returns the rest of b. It returns
+// nil if b is too short.
+func (s *cmSketch) unmarshal(b []byte) []byte {
+	if len(b) < cmDepth*8+cmDepth*len(s.rows[0]) {
+		return nil
+	}
+	for i := range s.seed {
+		s.seed[i] = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+	for _, r := range s.rows {
+		b = b[copy(r, b):]
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+package ristretto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSavePolicy(t *testing.T) {
+	newCache := func(counters int64, aging SketchAging) *Cache[int, int] {
+		c, err := NewCache(&Config[int, int]{
+			NumCounters: counters,
+			MaxCost:     10,
+			BufferItems: 64,
+			SketchAging: aging,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	c := newCache(100, SketchWindow)
+	defer c.Close()
+	admit := c.policy.(*defaultPolicy[int]).admit
+	for i := 0; i < 10; i++ {
+		for j := 0; j < i; j++ {
+			admit.Increment(uint64(i))
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, c.SavePolicy(&buf))
+	state := buf.Bytes()
+
+	for _, aging := range []SketchAging{SketchWindow, SketchHalving} {
+		restored := newCache(100, aging)
+		require.NoError(t, restored.LoadPolicy(bytes.NewReader(state)))
+		for i := 0; i < 10; i++ {
+			require.Equal(t, c.policy.Estimate(uint64(i)), restored.policy.Estimate(uint64(i)))
+		}
+		require.Equal(t, int64(9), restored.policy.Estimate(9))
+		restored.Close()
+	}
+
+	// Version 1 encodes the doorkeeper as JSON.
+	v1 := appendUvarint(nil, admit.freq.mask+1)
+	v1 = appendUvarint(v1, uint64(admit.incrs))
+	v1 = append(admit.freq.marshal(v1), 0)
+	door := admit.door.JSONMarshal()
+	v1 = append(appendUvarint(v1, uint64(len(door))), door...)
+	lfu := newTinyLFU(100)
+	require.NoError(t, lfu.unmarshal(v1, 1))
+	require.Equal(t, int64(9), lfu.Estimate(9))
+
+	other := newCache(1000, SketchWindow)
+	defer other.Close()
+	require.Equal(t, ErrPolicyMismatch, other.LoadPolicy(bytes.NewReader(state)))
+
+	corrupt := append([]byte{}, state...)
+	corrupt[len(corrupt)/2] ^= 1
+	require.Equal(t, ErrSnapshotCorrupt, other.LoadPolicy(bytes.NewReader(corrupt)))
+	require.Equal(t, ErrSnapshotCorrupt, other.LoadPolicy(bytes.NewReader(state[:len(state)-1])))
+}
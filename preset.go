@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "errors"
+
+// Workload is the kind of workload a cache made by WorkloadConfig is tuned
+// for.
+type Workload byte
+
+const (
+	// WorkloadWeb suits caches of responses, sessions or rendered fragments,
+	// whose popularity shifts quickly with trends and time of day. Frequencies
+	// are aged with SketchWindow so the new popular keys get in sooner.
+	WorkloadWeb Workload = iota
+	// WorkloadDBPages suits page caches in front of storage, where the working
+	// set is often slightly bigger than the cache and scans sweep through it.
+	// The policy remembers a quarter of the evicted keys, see
+	// Config.GhostItems, so pages asked for again soon after being evicted are
+	// let back in.
+	WorkloadDBPages
+	// WorkloadSmallObjects suits caches of many small values read at high
+	// rates, such as counters or IDs. The internal cost of each item is
+	// accounted for, and Gets are buffered per P, see AccessBufferPerP.
+	WorkloadSmallObjects
+)
+
+const (
+	// presetBufferItems is the BufferItems of the presets, as recommended by
+	// the documentation of Config.BufferItems.
+	presetBufferItems = 64
+	// presetGhostShare is the share of the items the WorkloadDBPages preset
+	// remembers after they're evicted.
+	presetGhostShare = 4
+)
+
+// WorkloadConfig returns a Config for a cache of maxCost whose items usually
+// cost itemCost, tuned for the given workload. NumCounters and BufferItems are
+// derived from the number of items the cache holds when full, which is
+// estimated including the internal cost of each item. The Config can be
+// changed further, for example to set OnEvict, before it's passed to
+// NewCache.
+func WorkloadConfig[K any, V any](workload Workload, maxCost, itemCost int64) (*Config[K, V], error) {
+	switch {
+	case maxCost <= 0:
+		return nil, errors.New("maxCost must be greater than zero")
+	case itemCost <= 0:
+		return nil, errors.New("itemCost must be greater than zero")
+	case workload > WorkloadSmallObjects:
+		return nil, errors.New("workload is not valid")
+	}
+	items := maxCost / (itemCost + itemSize)
+	if items < 1 {
+		items = 1
+	}
+	config := &Config[K, V]{
+		NumCounters: items * tuneCountersPerItem,
+		MaxCost:     maxCost,
+		BufferItems: presetBufferItems,
+	}
+	switch workload {
+	case WorkloadWeb:
+		config.SketchAging = SketchWindow
+	case WorkloadDBPages:
+		config.GhostItems = items / presetGhostShare
+	case WorkloadSmallObjects:
+		config.AccessBuffer = AccessBufferPerP
+	}
+	return config, nil
+}
+
+// NewCacheForWebWorkload returns a cache of maxCost whose items usually cost
+// itemCost, configured for WorkloadWeb.
+func NewCacheForWebWorkload[K any, V any](maxCost, itemCost int64) (*Cache[K, V], error) {
+	return newWorkloadCache[K, V](WorkloadWeb, maxCost, itemCost)
+}
+
+// NewCacheForDBPageCache returns a cache of maxCost whose items usually cost
+// itemCost, such as the page size, configured for WorkloadDBPages.
+func NewCacheForDBPageCache[K any, V any](maxCost, itemCost int64) (*Cache[K, V], error) {
+	return newWorkloadCache[K, V](WorkloadDBPages, maxCost, itemCost)
+}
+
+// NewCacheForSmallObjects returns a cache of maxCost whose items usually cost
+// itemCost, configured for WorkloadSmallObjects.
+func NewCacheForSmallObjects[K any, V any](maxCost, itemCost int64) (*Cache[K, V], error) {
+	return newWorkloadCache[K, V](WorkloadSmallObjects, maxCost, itemCost)
+}
+
+func newWorkloadCache[K any, V any](workload Workload, maxCost, itemCost int64) (*Cache[K, V], error) {
+	config, err := WorkloadConfig[K, V](workload, maxCost, itemCost)
+	if err != nil {
+		return nil, err
+	}
+	return NewCache(config)
+}
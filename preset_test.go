@@ -0,0 +1,34 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadConfig(t *testing.T) {
+	config, err := WorkloadConfig[int, int](WorkloadDBPages, 100*(4096+itemSize), 4096)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), config.NumCounters)
+	require.Equal(t, int64(presetBufferItems), config.BufferItems)
+	require.Equal(t, int64(25), config.GhostItems)
+
+	config, err = WorkloadConfig[int, int](WorkloadWeb, 1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, int64(tuneCountersPerItem), config.NumCounters)
+	require.Equal(t, SketchWindow, config.SketchAging)
+
+	_, err = WorkloadConfig[int, int](WorkloadWeb, 0, 1)
+	require.Error(t, err)
+	_, err = WorkloadConfig[int, int](WorkloadWeb, 1, 0)
+	require.Error(t, err)
+	_, err = WorkloadConfig[int, int](WorkloadSmallObjects+1, 1, 1)
+	require.Error(t, err)
+}
+
+func TestNewCacheForSmallObjects(t *testing.T) {
+	c, err := NewCacheForSmallObjects[int, int](1<<20, 8)
+	require.NoError(t, err)
+	defer c.Close()
+	retrySet(t, c, 1, 1, 8, 0)
+}
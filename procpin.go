@@ -0,0 +1,36 @@
+//go:build !purego && !race
+
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	_ "unsafe" // for go:linkname
+)
+
+// procPinnable reports whether goroutines can be pinned to their P, see
+// AccessBufferPerP.
+const procPinnable = true
+
+// procPin disables preemption of the calling goroutine and returns the id of
+// the P it runs on, the same way sync.Pool finds its per-P pools.
+//
+//go:linkname procPin runtime.procPin
+func procPin() int
+
+//go:linkname procUnpin runtime.procUnpin
+func procUnpin()
@@ -0,0 +1,28 @@
+//go:build purego || race
+
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// procPinnable is false with the purego tag, where the runtime isn't linked
+// to, and with the race detector, which can't see that goroutines pinned to
+// the same P never run at once.
+const procPinnable = false
+
+func procPin() int { return 0 }
+
+func procUnpin() {}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"time"
+)
+
+// settings are the values of Config that Reconfigure can change. They're
+// replaced as a whole, so the cache always sees a consistent set.
+type settings struct {
+	defaultTTL      time.Duration
+	maxTTL          time.Duration
+	maxCleanupItems int
+	cleanupWorkers  int
+}
+
+// current returns the settings in effect.
+func (c *Cache[K, V]) current() *settings {
+	return c.settings.Load().(*settings)
+}
+
+// ConfigDelta holds the changes applied by Reconfigure. Each field that isn't
+// nil replaces the Config field of the same name; the others are kept.
+//
+// The sizes of the Get buffers and the interval of the TTL cleanup can't be
+// changed: the buffers are shared by the Gets in flight, and the cleanup
+// interval is tied to how the expiring items are bucketed.
+type ConfigDelta struct {
+	MaxCost         *int64
+	DefaultTTL      *time.Duration
+	MaxTTL          *time.Duration
+	MaxCleanupItems *int
+	CleanupWorkers  *int
+}
+
+// Reconfigure applies the changes in delta to the cache while it's in use, for
+// example to follow a dynamic configuration system without a restart. The
+// changes are validated as NewCache would, and either all or none of them are
+// applied. The new TTLs only apply to the items added afterwards, and a lower
+// MaxCost evicts items as new ones are added, like UpdateMaxCost.
+func (c *Cache[K, V]) Reconfigure(delta ConfigDelta) error {
+	if c == nil || c.isClosed {
+		return errors.New("cache is closed")
+	}
+	switch {
+	case delta.MaxCost != nil && *delta.MaxCost <= 0:
+		return errors.New("MaxCost must be greater than zero")
+	case delta.DefaultTTL != nil && *delta.DefaultTTL < 0:
+		return errors.New("DefaultTTL can't be negative")
+	case delta.MaxTTL != nil && *delta.MaxTTL < 0:
+		return errors.New("MaxTTL can't be negative")
+	case delta.MaxCleanupItems != nil && *delta.MaxCleanupItems < 0:
+		return errors.New("MaxCleanupItems can't be negative")
+	case delta.CleanupWorkers != nil && *delta.CleanupWorkers < 0:
+		return errors.New("CleanupWorkers can't be negative")
+	}
+
+	c.reconfigMu.Lock()
+	defer c.reconfigMu.Unlock()
+	s := *c.current()
+	if delta.DefaultTTL != nil {
+		s.defaultTTL = *delta.DefaultTTL
+	}
+	if delta.MaxTTL != nil {
+		s.maxTTL = *delta.MaxTTL
+	}
+	if delta.MaxCleanupItems != nil {
+		s.maxCleanupItems = *delta.MaxCleanupItems
+	}
+	if delta.CleanupWorkers != nil {
+		s.cleanupWorkers = *delta.CleanupWorkers
+	}
+	if delta.MaxCost != nil {
+		c.policy.UpdateMaxCost(*delta.MaxCost)
+	}
+	c.settings.Store(&s)
+	return nil
+}
@@ -0,0 +1,41 @@
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheReconfigure(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	maxCost, ttl, maxTTL := int64(20), time.Hour, time.Minute
+	require.NoError(t, c.Reconfigure(ConfigDelta{MaxCost: &maxCost, DefaultTTL: &ttl}))
+	require.Equal(t, int64(20), c.MaxCost())
+	require.Equal(t, time.Hour, c.current().defaultTTL)
+
+	require.NoError(t, c.Reconfigure(ConfigDelta{MaxTTL: &maxTTL}))
+	require.Equal(t, time.Hour, c.current().defaultTTL)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	left, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, left <= time.Minute)
+
+	// Nothing is applied if any change is invalid.
+	workers, negative := 4, -time.Second
+	require.Error(t, c.Reconfigure(ConfigDelta{CleanupWorkers: &workers, MaxTTL: &negative}))
+	require.Zero(t, c.current().cleanupWorkers)
+	require.Equal(t, time.Minute, c.current().maxTTL)
+
+	c.Close()
+	require.Error(t, c.Reconfigure(ConfigDelta{}))
+}
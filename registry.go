@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Registered is the part of the API of a Cache that doesn't depend on its key
+// and value types. Every *Cache implements it, so the caches listed by Caches
+// can be inspected whatever their types.
+type Registered interface {
+	// Name returns the name passed in Config.Name.
+	Name() string
+	// CacheMetrics returns the Metrics of the cache, which are nil unless
+	// Config.Metrics is set.
+	CacheMetrics() *Metrics
+	MaxCost() int64
+	CostUsed() int64
+	EstimatedMemoryUsage() MemoryUsage
+	DebugHandler() http.Handler
+}
+
+// registry holds the caches that were created and not closed yet, in the
+// order they were created.
+var registry struct {
+	sync.Mutex
+	caches []Registered
+}
+
+// Caches returns the caches of the process that were created by NewCache and
+// not closed yet, in the order they were created, so debug endpoints and
+// metric exporters can find all of them without being handed each one.
+func Caches() []Registered {
+	registry.Lock()
+	defer registry.Unlock()
+	caches := make([]Registered, len(registry.caches))
+	copy(caches, registry.caches)
+	return caches
+}
+
+func register(c Registered) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.caches = append(registry.caches, c)
+}
+
+func unregister(c Registered) {
+	registry.Lock()
+	defer registry.Unlock()
+	caches := registry.caches
+	for i, r := range caches {
+		if r == c {
+			n := len(caches) - 1
+			copy(caches[i:], caches[i+1:])
+			// Don't keep a reference to the closed cache.
+			caches[n] = nil
+			registry.caches = caches[:n]
+			return
+		}
+	}
+}
+
+// Name returns the name of the cache, see Config.Name.
+func (c *Cache[K, V]) Name() string {
+	if c == nil {
+		return ""
+	}
+	return c.name
+}
+
+// CacheMetrics returns c.Metrics. It lets the Metrics be read through the
+// Registered interface.
+func (c *Cache[K, V]) CacheMetrics() *Metrics {
+	if c == nil {
+		return nil
+	}
+	return c.Metrics
+}
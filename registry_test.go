@@ -0,0 +1,49 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaches(t *testing.T) {
+	newNamed := func(name string) *Cache[int, int] {
+		c, err := NewCache(&Config[int, int]{
+			Name:        name,
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			Metrics:     true,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	registered := func() []string {
+		var names []string
+		for _, c := range Caches() {
+			switch c.Name() {
+			case "registry-a", "registry-b", "registry-c":
+				names = append(names, c.Name())
+			}
+		}
+		return names
+	}
+
+	a := newNamed("registry-a")
+	b := newNamed("registry-b")
+	c := newNamed("registry-c")
+	defer c.Close()
+	require.Equal(t, []string{"registry-a", "registry-b", "registry-c"}, registered())
+
+	for _, r := range Caches() {
+		if r.Name() == "registry-a" {
+			require.Equal(t, a.Metrics, r.CacheMetrics())
+			require.Equal(t, int64(10), r.MaxCost())
+		}
+	}
+
+	b.Close()
+	require.Equal(t, []string{"registry-a", "registry-c"}, registered())
+	a.Close()
+	require.Equal(t, []string{"registry-c"}, registered())
+}
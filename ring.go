@@ -18,6 +18,17 @@ package ristretto
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ringMaxGrowth is how many times larger than their initial capacity the
+	// stripes can grow.
+	ringMaxGrowth = 16
+	// ringShrinkAfter is the number of drains in a row without drops after
+	// which the stripes shrink.
+	ringShrinkAfter = 64
 )
 
 // ringConsumer is the user-defined object responsible for receiving and
@@ -26,33 +37,85 @@ type ringConsumer interface {
 	Push([]uint64) bool
 }
 
+// ringFree holds the slices the consumers are done with, so the stripes can
+// reuse them instead of allocating a new one on every drain. It's shared by all
+// the buffers since the slices hold nothing but keys.
+var ringFree = make(chan []uint64, 64)
+
+// releaseRingData gives back a slice received by a consumer once it's done
+// with it. The slice must not be used afterwards.
+func releaseRingData(data []uint64) {
+	select {
+	case ringFree <- data[:0]:
+	default:
+	}
+}
+
+// newRingData returns an empty slice with the given capacity, reusing a
+// released one if possible.
+func newRingData(capa int) []uint64 {
+	select {
+	case data := <-ringFree:
+		if cap(data) == capa {
+			return data
+		}
+	default:
+	}
+	return make([]uint64, 0, capa)
+}
+
 // ringStripe is a singular ring buffer that is not concurrent safe.
 type ringStripe struct {
+	buf  *ringBuffer
 	cons ringConsumer
 	data []uint64
 	capa int
+	// last is when the stripe was last drained. It's only set if the buffer
+	// has a flush interval.
+	last time.Time
 }
 
-func newRingStripe(cons ringConsumer, capa int64) *ringStripe {
-	return &ringStripe{
+func newRingStripe(buf *ringBuffer, cons ringConsumer, capa int64) *ringStripe {
+	s := &ringStripe{
+		buf:  buf,
 		cons: cons,
 		data: make([]uint64, 0, capa),
 		capa: int(capa),
 	}
+	if buf.interval > 0 {
+		s.last = time.Now()
+	}
+	return s
 }
 
 // Push appends an item in the ring buffer and drains (copies items and
-// sends to Consumer) if full.
+// sends to Consumer) if full or if the flush interval of the buffer elapsed
+// since the last drain.
 func (s *ringStripe) Push(item uint64) {
 	s.data = append(s.data, item)
 	// Decide if the ring buffer should be drained.
 	if len(s.data) >= s.capa {
-		// Send elements to consumer and create a new ring stripe.
-		if s.cons.Push(s.data) {
-			s.data = make([]uint64, 0, s.capa)
-		} else {
-			s.data = s.data[:0]
-		}
+		s.drain()
+	} else if s.buf.interval > 0 && time.Since(s.last) >= s.buf.interval {
+		s.drain()
+	}
+}
+
+// drain sends the elements to the consumer and creates a new ring stripe.
+func (s *ringStripe) drain() {
+	kept := s.cons.Push(s.data)
+	s.buf.drained(kept)
+	if s.buf.interval > 0 {
+		s.last = time.Now()
+	}
+	// Pick up the capacity the buffer adjusted to.
+	if capa := s.buf.capacity(); capa != s.capa {
+		s.capa = capa
+		s.data = newRingData(capa)
+	} else if kept {
+		s.data = newRingData(s.capa)
+	} else {
+		s.data = s.data[:0]
 	}
 }
 
@@ -61,23 +124,71 @@ func (s *ringStripe) Push(item uint64) {
 //
 // This implements the "batching" process described in the BP-Wrapper paper
 // (section III part A).
+//
+// The capacity of the stripes adapts to the consumer: it doubles when a drain
+// is dropped, so fewer and larger batches are sent, and halves back after
+// ringShrinkAfter drains in a row are kept, so the consumer is updated sooner.
 type ringBuffer struct {
-	pool *sync.Pool
+	// capa is the current capacity of the stripes and kept the number of
+	// drains in a row that were kept. They're the first fields so they're
+	// 64-bit aligned for use with atomic.
+	capa    int64
+	kept    int64
+	minCapa int64
+	maxCapa int64
+	// interval is the max time a stripe holds elements before draining them
+	// on the next Push, even if it isn't full. Zero means no limit.
+	interval time.Duration
+	pool     *sync.Pool
 }
 
 // newRingBuffer returns a striped ring buffer. The Consumer in ringConfig will
-// be called when individual stripes are full and need to drain their elements.
-func newRingBuffer(cons ringConsumer, capa int64) *ringBuffer {
+// be called when individual stripes are full, or hold elements for longer than
+// interval if it's greater than zero, and need to drain their elements.
+func newRingBuffer(cons ringConsumer, capa int64, interval time.Duration) *ringBuffer {
 	// LOSSY buffers use a very simple sync.Pool for concurrently reusing
 	// stripes. We do lose some stripes due to GC (unheld items in sync.Pool
 	// are cleared), but the performance gains generally outweigh the small
 	// percentage of elements lost. The performance primarily comes from
 	// low-level runtime functions used in the standard library that aren't
 	// available to us (such as runtime_procPin()).
-	return &ringBuffer{
-		pool: &sync.Pool{
-			New: func() interface{} { return newRingStripe(cons, capa) },
-		},
+	b := &ringBuffer{
+		capa:     capa,
+		minCapa:  capa,
+		maxCapa:  capa * ringMaxGrowth,
+		interval: interval,
+	}
+	b.pool = &sync.Pool{
+		New: func() interface{} { return newRingStripe(b, cons, b.capa64()) },
+	}
+	return b
+}
+
+func (b *ringBuffer) capa64() int64 {
+	return atomic.LoadInt64(&b.capa)
+}
+
+// capacity returns the current capacity of the stripes.
+func (b *ringBuffer) capacity() int {
+	return int(b.capa64())
+}
+
+// drained adjusts the capacity of the stripes after a drain, which was kept by
+// the consumer or dropped.
+func (b *ringBuffer) drained(kept bool) {
+	if !kept {
+		atomic.StoreInt64(&b.kept, 0)
+		if capa := b.capa64(); capa < b.maxCapa {
+			atomic.CompareAndSwapInt64(&b.capa, capa, capa*2)
+		}
+		return
+	}
+	if atomic.AddInt64(&b.kept, 1) < ringShrinkAfter {
+		return
+	}
+	atomic.StoreInt64(&b.kept, 0)
+	if capa := b.capa64(); capa > b.minCapa {
+		atomic.CompareAndSwapInt64(&b.capa, capa, capa/2)
 	}
 }
 
@@ -3,6 +3,7 @@ package ristretto
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +28,7 @@ func TestRingDrain(t *testing.T) {
 			drains++
 		},
 		save: true,
-	}, 1)
+	}, 1, 0)
 	for i := 0; i < 100; i++ {
 		r.Push(uint64(i))
 	}
@@ -41,13 +42,59 @@ func TestRingReset(t *testing.T) {
 			drains++
 		},
 		save: false,
-	}, 4)
+	}, 4, 0)
 	for i := 0; i < 100; i++ {
 		r.Push(uint64(i))
 	}
 	require.Equal(t, 0, drains, "testConsumer shouldn't be draining")
 }
 
+func TestRingAdapt(t *testing.T) {
+	r := newRingBuffer(&testConsumer{}, 4, 0)
+	r.drained(false)
+	require.Equal(t, 8, r.capacity())
+	for i := 0; i < 10; i++ {
+		r.drained(false)
+	}
+	require.Equal(t, 4*ringMaxGrowth, r.capacity())
+
+	for i := 0; i < ringShrinkAfter-1; i++ {
+		r.drained(true)
+	}
+	require.Equal(t, 4*ringMaxGrowth, r.capacity())
+	r.drained(true)
+	require.Equal(t, 2*ringMaxGrowth, r.capacity())
+	for i := 0; i < 10*ringShrinkAfter; i++ {
+		r.drained(true)
+	}
+	require.Equal(t, 4, r.capacity())
+
+	// The stripes pick up the new capacity when drained.
+	s := newRingStripe(r, &testConsumer{save: false}, 4)
+	for i := 0; i < 4; i++ {
+		s.Push(uint64(i))
+	}
+	require.Equal(t, 8, s.capa)
+	require.Equal(t, 8, cap(s.data))
+}
+
+func TestRingFlushInterval(t *testing.T) {
+	drains := 0
+	cons := &testConsumer{
+		push: func(items []uint64) {
+			drains++
+		},
+		save: true,
+	}
+	r := newRingBuffer(cons, 64, time.Millisecond)
+	s := newRingStripe(r, cons, 64)
+	s.Push(1)
+	require.Equal(t, 0, drains)
+	time.Sleep(2 * time.Millisecond)
+	s.Push(2)
+	require.Equal(t, 1, drains)
+}
+
 func TestRingConsumer(t *testing.T) {
 	mu := &sync.Mutex{}
 	drainItems := make(map[uint64]struct{})
@@ -60,7 +107,7 @@ func TestRingConsumer(t *testing.T) {
 			}
 		},
 		save: true,
-	}, 4)
+	}, 4, 0)
 	for i := 0; i < 100; i++ {
 		r.Push(uint64(i))
 	}
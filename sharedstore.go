@@ -0,0 +1,333 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/paivagustavo/ristretto/z"
+)
+
+// sharedMagic marks an initialized segment. It's written last, so the other
+// processes wait for it before using the segment.
+const sharedMagic uint64 = 0x7269737473686d31 // "ristshm1"
+
+// The layout of a shared segment: a header, then the slots of an open
+// addressing table using linear probing. The header holds the magic, the lock,
+// the value size, the number of slots and the number of items of each shard.
+const (
+	sharedLockOff   = 8
+	sharedValueOff  = 12
+	sharedSlotsOff  = 16
+	sharedCountsOff = 24
+	sharedHeaderLen = sharedCountsOff + 8*int(numShards)
+)
+
+// The layout of a slot: whether it's used, the length of the value, the key
+// and conflict hashes, the expiration, the metadata and the value.
+const (
+	slotUsedOff       = 0
+	slotLenOff        = 4
+	slotKeyOff        = 8
+	slotConflictOff   = 16
+	slotExpirationOff = 24
+	slotMetaOff       = 32
+	slotValueOff      = 40
+)
+
+// ErrSharedLayout is returned by NewSharedStore when the segment exists with a
+// different number of slots or value size.
+var ErrSharedLayout = errors.New("shared segment has a different layout")
+
+// SharedStore keeps the items of a Cache[K, []byte] in a shared memory segment,
+// so worker processes on the same host, such as those of a prefork server,
+// share a single copy of the hot items instead of each having its own. Its
+// NewStore method is meant for Config.NewStore, in every process.
+//
+// It's experimental. The segment has a fixed layout: a table of slots, each
+// holding a value of up to a fixed size. Values that don't fit, and items
+// that don't find a slot when the table is full, aren't stored. Each process
+// still has its own policy, which only knows about the items the process set,
+// so MaxCost only bounds those and the table size bounds the total. Every
+// access takes a lock shared by the processes, held briefly; a process that
+// dies while holding it blocks the others. The versions of the items aren't
+// shared.
+type SharedStore struct {
+	file      *z.MmapFile
+	data      []byte
+	slots     uint64
+	slotLen   uint64
+	valueSize int
+	// shards counts the Stores created, to give each its shard.
+	shards uint64
+}
+
+// NewSharedStore opens the segment at path, creating it with the given number
+// of slots and value size if it doesn't exist. On Linux, a path under
+// /dev/shm keeps it in memory. The segment outlives the processes, and must
+// be removed once none use it.
+func NewSharedStore(path string, slots, valueSize int) (*SharedStore, error) {
+	if slots <= 0 || valueSize <= 0 || valueSize > 1<<31 {
+		return nil, errors.New("slots and valueSize must be positive")
+	}
+	s := &SharedStore{
+		slots:     uint64(slots),
+		slotLen:   uint64(slotValueOff+valueSize+7) &^ 7,
+		valueSize: valueSize,
+	}
+	size := sharedHeaderLen + int(s.slots*s.slotLen)
+	var err error
+	s.file, err = z.OpenMmapFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, size)
+	switch {
+	case err == z.NewFile:
+		// This process created the segment, so it sets it up.
+		s.data = s.file.Data
+		*s.uint32(sharedValueOff) = uint32(valueSize)
+		*s.uint64(sharedSlotsOff) = s.slots
+		atomic.StoreUint64(s.uint64(0), sharedMagic)
+		return s, nil
+	case errors.Is(err, os.ErrExist):
+		return s.open(path, size)
+	default:
+		return nil, err
+	}
+}
+
+// open maps the segment created by another process.
+func (s *SharedStore) open(path string, size int) (*SharedStore, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	// The file may not have been truncated to its size yet.
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		fi, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if fi.Size() >= int64(sharedHeaderLen) {
+			break
+		}
+		if time.Since(start) > time.Second {
+			fd.Close()
+			return nil, ErrSharedLayout
+		}
+	}
+	if s.file, err = z.OpenMmapFileUsing(fd, 0, true); err != nil {
+		return nil, err
+	}
+	s.data = s.file.Data
+	for start := time.Now(); atomic.LoadUint64(s.uint64(0)) != sharedMagic; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			s.Close()
+			return nil, ErrSharedLayout
+		}
+	}
+	if len(s.data) != size || *s.uint64(sharedSlotsOff) != s.slots ||
+		*s.uint32(sharedValueOff) != uint32(s.valueSize) {
+		s.Close()
+		return nil, ErrSharedLayout
+	}
+	return s, nil
+}
+
+// Close unmaps the segment, leaving it to the other processes. The caches
+// using the SharedStore must be closed first.
+func (s *SharedStore) Close() error {
+	return s.file.Close(-1)
+}
+
+// NewStore returns the Store of the next shard of the cache.
+func (s *SharedStore) NewStore() Store[[]byte] {
+	shard := (atomic.AddUint64(&s.shards, 1) - 1) % numShards
+	return &sharedShard{s: s, shard: shard}
+}
+
+func (s *SharedStore) uint32(off uint64) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.data[off]))
+}
+
+func (s *SharedStore) uint64(off uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.data[off]))
+}
+
+func (s *SharedStore) lock() {
+	for !atomic.CompareAndSwapUint32(s.uint32(sharedLockOff), 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func (s *SharedStore) unlock() {
+	atomic.StoreUint32(s.uint32(sharedLockOff), 0)
+}
+
+// slot returns the offset of the nth slot.
+func (s *SharedStore) slot(n uint64) uint64 {
+	return uint64(sharedHeaderLen) + n*s.slotLen
+}
+
+// find returns the slot of the key, or the empty slot ending its probe
+// sequence and false. The slot is s.slots if the table is full. s.lock must be
+// held.
+func (s *SharedStore) find(key uint64) (uint64, bool) {
+	n := key % s.slots
+	for i := uint64(0); i < s.slots; i++ {
+		off := s.slot(n)
+		if *s.uint32(off + slotUsedOff) == 0 {
+			return n, false
+		}
+		if *s.uint64(off + slotKeyOff) == key {
+			return n, true
+		}
+		if n++; n == s.slots {
+			n = 0
+		}
+	}
+	return s.slots, false
+}
+
+// remove empties the slot, moving back the items after it that would no
+// longer be found. s.lock must be held.
+func (s *SharedStore) remove(n uint64) {
+	key := *s.uint64(s.slot(n) + slotKeyOff)
+	*s.uint64(sharedCountsOff + 8*(key%numShards))--
+	j := n
+	for i := uint64(1); i < s.slots; i++ {
+		if j++; j == s.slots {
+			j = 0
+		}
+		off := s.slot(j)
+		if *s.uint32(off + slotUsedOff) == 0 {
+			break
+		}
+		// Move the item at j to n unless its home slot is cyclically in (n, j].
+		home := *s.uint64(off + slotKeyOff) % s.slots
+		if (n < j && (home <= n || home > j)) || (n > j && home <= n && home > j) {
+			copy(s.data[s.slot(n):s.slot(n)+s.slotLen], s.data[off:off+s.slotLen])
+			n = j
+		}
+	}
+	*s.uint32(s.slot(n) + slotUsedOff) = 0
+}
+
+// item reads the item in the slot. s.lock must be held.
+func (s *SharedStore) item(n uint64) Item[[]byte] {
+	off := s.slot(n)
+	item := Item[[]byte]{
+		Key:      *s.uint64(off + slotKeyOff),
+		Conflict: *s.uint64(off + slotConflictOff),
+		Meta:     *s.uint32(off + slotMetaOff),
+	}
+	if exp := int64(*s.uint64(off + slotExpirationOff)); exp != 0 {
+		item.Expiration = time.Unix(0, exp)
+	}
+	if size := *s.uint32(off + slotLenOff); size > 0 {
+		item.Value = append([]byte(nil), s.data[off+slotValueOff:off+slotValueOff+uint64(size)]...)
+	}
+	return item
+}
+
+// sharedShard is the Store of a shard of a cache using a SharedStore.
+type sharedShard struct {
+	s     *SharedStore
+	shard uint64
+}
+
+func (sh *sharedShard) Get(key uint64) (Item[[]byte], bool) {
+	sh.s.lock()
+	defer sh.s.unlock()
+	n, ok := sh.s.find(key)
+	if !ok {
+		return Item[[]byte]{}, false
+	}
+	return sh.s.item(n), true
+}
+
+func (sh *sharedShard) Set(key uint64, item Item[[]byte]) {
+	s := sh.s
+	s.lock()
+	defer s.unlock()
+	n, ok := s.find(key)
+	if len(item.Value) > s.valueSize || n == s.slots {
+		// The value doesn't fit, or there's no room, so the item is dropped.
+		if ok {
+			s.remove(n)
+		}
+		return
+	}
+	off := s.slot(n)
+	if !ok {
+		*s.uint64(sharedCountsOff + 8*(key%numShards))++
+	}
+	*s.uint64(off + slotKeyOff) = key
+	*s.uint64(off + slotConflictOff) = item.Conflict
+	*s.uint64(off + slotExpirationOff) = uint64(expirationNanos(item.Expiration))
+	*s.uint32(off + slotMetaOff) = item.Meta
+	*s.uint32(off + slotLenOff) = uint32(len(item.Value))
+	copy(s.data[off+slotValueOff:], item.Value)
+	*s.uint32(off + slotUsedOff) = 1
+}
+
+func (sh *sharedShard) Del(key uint64) {
+	sh.s.lock()
+	defer sh.s.unlock()
+	if n, ok := sh.s.find(key); ok {
+		sh.s.remove(n)
+	}
+}
+
+// items returns the items of the shard.
+func (sh *sharedShard) items() []Item[[]byte] {
+	s := sh.s
+	s.lock()
+	defer s.unlock()
+	var items []Item[[]byte]
+	for n := uint64(0); n < s.slots; n++ {
+		off := s.slot(n)
+		if *s.uint32(off + slotUsedOff) != 0 && *s.uint64(off + slotKeyOff)%numShards == sh.shard {
+			items = append(items, s.item(n))
+		}
+	}
+	return items
+}
+
+func (sh *sharedShard) Range(fn func(uint64, Item[[]byte]) bool) {
+	// Don't call fn holding the lock shared with the other processes.
+	for _, item := range sh.items() {
+		if !fn(item.Key, item) {
+			return
+		}
+	}
+}
+
+func (sh *sharedShard) Len() int {
+	sh.s.lock()
+	defer sh.s.unlock()
+	return int(*sh.s.uint64(sharedCountsOff + 8*sh.shard))
+}
+
+func (sh *sharedShard) Clear() {
+	for _, item := range sh.items() {
+		sh.Del(item.Key)
+	}
+}
@@ -0,0 +1,80 @@
+package ristretto
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "segment")
+	newCache := func() (*Cache[int, []byte], *SharedStore) {
+		stores, err := NewSharedStore(path, 64, 16)
+		require.NoError(t, err)
+		c, err := NewCache(&Config[int, []byte]{
+			NumCounters:        1000,
+			MaxCost:            100,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			NewStore:           stores.NewStore,
+		})
+		require.NoError(t, err)
+		return c, stores
+	}
+	// Two caches on the same segment, as in two processes.
+	c1, s1 := newCache()
+	c2, s2 := newCache()
+	defer func() {
+		c1.Close()
+		c2.Close()
+		require.NoError(t, s1.Close())
+		require.NoError(t, s2.Close())
+	}()
+
+	require.True(t, c1.Set(1, []byte("one"), 1))
+	c1.Wait()
+	val, ok := c2.Get(1)
+	require.True(t, ok)
+	require.Equal(t, []byte("one"), val)
+
+	// Values bigger than the slots aren't stored.
+	require.True(t, c1.Set(2, make([]byte, 17), 1))
+	c1.Wait()
+	_, ok = c2.Get(2)
+	require.False(t, ok)
+
+	c2.Del(1)
+	c2.Wait()
+	_, ok = c1.Get(1)
+	require.False(t, ok)
+
+	_, err := NewSharedStore(path, 32, 16)
+	require.Equal(t, ErrSharedLayout, err)
+}
+
+func TestSharedStoreProbing(t *testing.T) {
+	s, err := NewSharedStore(filepath.Join(t.TempDir(), "segment"), 4, 8)
+	require.NoError(t, err)
+	defer s.Close()
+	st := s.NewStore()
+
+	// Keys 1, 5 and 9 share their home slot, and 2 lands after them.
+	for _, key := range []uint64{1, 5, 9, 2} {
+		st.Set(key, Item[[]byte]{Value: []byte{byte(key)}})
+	}
+	// The table is full.
+	st.Set(3, Item[[]byte]{Value: []byte{3}})
+	_, ok := st.Get(3)
+	require.False(t, ok)
+
+	// The keys after a removed one are still found.
+	st.Del(5)
+	for _, key := range []uint64{1, 9, 2} {
+		item, ok := st.Get(key)
+		require.True(t, ok, "key %d", key)
+		require.Equal(t, []byte{byte(key)}, item.Value)
+	}
+	_, ok = st.Get(5)
+	require.False(t, ok)
+}
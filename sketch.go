@@ -95,6 +95,15 @@ func (s *cmSketch) Clear() {
 	}
 }
 
+// memoryUsage returns the memory taken by the counters in bytes.
+func (s *cmSketch) memoryUsage() uint64 {
+	var usage uint64
+	for _, row := range s.rows {
+		usage += uint64(len(row))
+	}
+	return usage
+}
+
 // cmRow is a row of bytes, with each byte holding two counters.
 type cmRow []byte
 
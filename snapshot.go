@@ -0,0 +1,223 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"io"
+	"time"
+)
+
+// snapshotOp is what a record of a snapshot does.
+type snapshotOp byte
+
+const (
+	// snapshotSet sets an item, and is the only op of full snapshots.
+	snapshotSet snapshotOp = iota
+	// snapshotDel removes the key, in deltas.
+	snapshotDel
+	// snapshotClear removes every item, in deltas.
+	snapshotClear
+)
+
+// snapshotItem is a record of a snapshot, usually an item. The key is saved as
+// its hashes, which is all the cache needs to find it again.
+type snapshotItem struct {
+	op       snapshotOp
+	key      uint64
+	conflict uint64
+	// expiration is the absolute expiration in Unix nanoseconds, or 0.
+	expiration int64
+	cost       int64
+	meta       uint32
+	value      []byte
+	// seq, mutation and update are only set for the mutations encoded by
+	// MutationEncoder.
+	seq      uint64
+	mutation MutationOp
+	update   bool
+}
+
+// Save writes a snapshot of the items of the cache to w, which Load can
+// restore, for example into a cache created after a restart. encode turns the
+// values into bytes. The snapshot format is versioned and checksummed, see
+// snapshotVersion. Each item keeps its absolute expiration, so restored items
+// expire when they would have, its cost and its metadata. The access
+// frequencies aren't saved.
+//
+// Save doesn't pause the cache. It copies the items of one shard at a time,
+// holding only the lock of that shard, and writes them without holding any, so
+// Gets and Sets go on meanwhile. Items set or deleted while Save runs may or
+// may not be in the snapshot, and the items of different shards may be saved
+// at slightly different times.
+func (c *Cache[K, V]) Save(w io.Writer, encode func(V) ([]byte, error)) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	// Start the next delta.
+	c.deltas.mark()
+	return c.save(w, encode, nil, nil)
+}
+
+// save writes a snapshot of the items for which keep returns true, or every
+// item if keep is nil, after the records written by before, if not nil.
+func (c *Cache[K, V]) save(w io.Writer, encode func(V) ([]byte, error),
+	before func(*snapshotWriter) error, keep func(storeItem[V]) bool) error {
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	sw := newSnapshotWriter(cw)
+	var err error
+	if before != nil {
+		err = before(sw)
+	}
+	if err == nil {
+		c.store.Range(func(key uint64, si storeItem[V]) bool {
+			if keep != nil && !keep(si) {
+				return true
+			}
+			var value []byte
+			if value, err = encode(si.value); err != nil {
+				return false
+			}
+			err = sw.write(snapshotItem{
+				key:        key,
+				conflict:   si.conflict,
+				expiration: si.expiration,
+				cost:       c.savedCost(key),
+				meta:       si.meta,
+				value:      value,
+			})
+			return err == nil
+		})
+	}
+	if err == nil {
+		err = sw.close()
+	}
+	c.Metrics.add(snapshots, 0, 1)
+	c.Metrics.add(snapshotNanos, 0, uint64(time.Since(start)))
+	c.Metrics.add(snapshotBytes, 0, uint64(cw.n))
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// savedCost returns the cost of the key as passed to Set, without the
+// internal cost, or 0 if the policy doesn't have the key yet, so Load computes
+// it again.
+func (c *Cache[K, V]) savedCost(key uint64) int64 {
+	cost := c.policy.Cost(key)
+	if cost > 0 && !c.ignoreInternalCost {
+		cost -= itemSize
+	}
+	if cost < 0 {
+		return 0
+	}
+	return cost
+}
+
+// Load restores the items of a snapshot written by Save, decoding the values
+// with decode. The items already expired are dropped, and the others are set
+// with their saved expiration, cost and metadata, going through the policy
+// like any Set, so they may be rejected if the cache is too small. Load
+// returns once the items are applied, or with the first error.
+func (c *Cache[K, V]) Load(r io.Reader, decode func([]byte) (V, error)) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	sr, err := newSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		si, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch si.op {
+		case snapshotDel:
+			c.restoreDel(si)
+			continue
+		case snapshotClear:
+			c.Clear()
+			continue
+		}
+		if si.expiration != 0 && time.Now().UnixNano() >= si.expiration {
+			continue
+		}
+		value, err := decode(si.value)
+		if err != nil {
+			return err
+		}
+		c.restore(si, value)
+	}
+	c.Wait()
+	return nil
+}
+
+// restoreDel deletes the key of the record, like Del.
+func (c *Cache[K, V]) restoreDel(si snapshotItem) {
+	prev := c.store.Del(si.key, si.conflict)
+	c.onExit(prev.value)
+	c.pushDel(Item[V]{
+		flag:     itemDelete,
+		Key:      si.key,
+		Conflict: si.conflict,
+	})
+}
+
+// restore sets the item of the snapshot.
+func (c *Cache[K, V]) restore(si snapshotItem, value V) {
+	i := Item[V]{
+		Key:      si.key,
+		Conflict: si.conflict,
+		Value:    value,
+		Cost:     si.cost,
+		Meta:     si.meta,
+		Version:  c.nextVersion(),
+	}
+	if si.expiration != 0 {
+		i.Expiration = time.Unix(0, si.expiration)
+	}
+	// Store the item right away, so a later record for the key finds it even
+	// if this one isn't processed yet.
+	if prev, ok := c.store.Update(i); ok {
+		c.onExit(prev)
+		i.flag = itemUpdate
+	} else {
+		c.store.Set(i)
+		i.flag = itemStored
+	}
+	switch {
+	case c.pushSet(i):
+	case i.flag == itemUpdate:
+		c.updateCost(i)
+	default:
+		c.dropStored(i)
+	}
+}
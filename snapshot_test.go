@@ -0,0 +1,286 @@
+package ristretto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/paivagustavo/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeInt(v int) ([]byte, error) {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, int64(v))], nil
+}
+
+func decodeInt(b []byte) (int, error) {
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, ErrSnapshotCorrupt
+	}
+	return int(v), nil
+}
+
+func newSnapshotCache(t *testing.T) *Cache[int, int] {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters: 100,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	c := newSnapshotCache(t)
+	defer c.Close()
+	require.True(t, c.SetWithTTL(1, 10, 3, time.Hour))
+	require.True(t, c.SetWithMeta(2, 20, 5, 0, 7))
+	require.True(t, c.SetWithTTL(3, 30, 1, 20*time.Millisecond))
+	c.Wait()
+	ttl, _ := c.GetTTL(1)
+	expiration := time.Now().Add(ttl)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.Save(&buf, encodeInt))
+	time.Sleep(50 * time.Millisecond)
+
+	restored := newSnapshotCache(t)
+	defer restored.Close()
+	require.NoError(t, restored.Load(bytes.NewReader(buf.Bytes()), decodeInt))
+
+	val, ok := restored.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	ttl, ok = restored.GetTTL(1)
+	require.True(t, ok)
+	require.WithinDuration(t, expiration, time.Now().Add(ttl), time.Second)
+	require.Equal(t, c.policy.Cost(1), restored.policy.Cost(1))
+
+	val, meta, ok := restored.GetWithMeta(2)
+	require.True(t, ok)
+	require.Equal(t, 20, val)
+	require.Equal(t, uint32(7), meta)
+	ttl, ok = restored.GetTTL(2)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+	require.Equal(t, c.policy.Cost(2), restored.policy.Cost(2))
+
+	// The item that expired since the snapshot is dropped.
+	_, ok = restored.Get(3)
+	require.False(t, ok)
+	require.False(t, restored.policy.Has(3))
+}
+
+func TestCacheLoadCorrupt(t *testing.T) {
+	c := newSnapshotCache(t)
+	defer c.Close()
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	var buf bytes.Buffer
+	require.NoError(t, c.Save(&buf, encodeInt))
+
+	restored := newSnapshotCache(t)
+	defer restored.Close()
+	err := restored.Load(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), decodeInt)
+	require.Equal(t, ErrSnapshotCorrupt, err)
+}
+
+func TestSnapshotFormat(t *testing.T) {
+	c := newSnapshotCache(t)
+	defer c.Close()
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	var buf bytes.Buffer
+	require.NoError(t, c.Save(&buf, encodeInt))
+	snapshot := buf.Bytes()
+	require.Equal(t, snapshotMagic, snapshot[:len(snapshotMagic)])
+
+	load := func(b []byte) error {
+		restored := newSnapshotCache(t)
+		defer restored.Close()
+		return restored.Load(bytes.NewReader(b), decodeInt)
+	}
+	require.NoError(t, load(snapshot))
+
+	// A flipped bit fails the checksum.
+	corrupt := append([]byte(nil), snapshot...)
+	corrupt[len(snapshotMagic)+3] ^= 1
+	require.Equal(t, ErrSnapshotCorrupt, load(corrupt))
+
+	// Newer versions are refused.
+	newer := append([]byte(nil), snapshot...)
+	newer[len(snapshotMagic)] = snapshotVersion + 1
+	require.Equal(t, ErrSnapshotVersion, load(newer))
+}
+
+func TestSnapshotUnknownField(t *testing.T) {
+	var buf bytes.Buffer
+	sw := newSnapshotWriter(&buf)
+	// A field added by a later release is skipped.
+	sw.item = append(sw.item[:0], 15<<3|wireBytes, 2, 'x', 'y')
+	sw.item = append(sw.item, fieldKey<<3|wireVarint, 5)
+	sw.block = append(sw.block, byte(len(sw.item)))
+	sw.block = append(sw.block, sw.item...)
+	require.NoError(t, sw.close())
+
+	sr, err := newSnapshotReader(&buf)
+	require.NoError(t, err)
+	si, err := sr.next()
+	require.NoError(t, err)
+	require.Equal(t, snapshotItem{key: 5}, si)
+	_, err = sr.next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestSnapshotNoMagic(t *testing.T) {
+	// A snapshot missing its header is corrupt rather than read unchecked.
+	_, err := newSnapshotReader(bytes.NewReader([]byte("garbage")))
+	require.Equal(t, ErrSnapshotCorrupt, err)
+	_, err = newSnapshotReader(bytes.NewReader(snapshotMagic[:3]))
+	require.Equal(t, ErrSnapshotCorrupt, err)
+
+	sr, err := newSnapshotReader(bytes.NewReader(nil))
+	require.NoError(t, err)
+	_, err = sr.next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestCacheSaveOnline(t *testing.T) {
+	config := &Config[int, int]{
+		NumCounters:        10000,
+		MaxCost:            100000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 1000; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+
+	// The cache keeps serving while the snapshot is saved.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Set(i%2000, i, 1)
+			c.Get(i % 2000)
+		}
+	}()
+	var buf bytes.Buffer
+	require.NoError(t, c.Save(&buf, encodeInt))
+	close(stop)
+	<-done
+
+	require.Equal(t, uint64(buf.Len()), c.Metrics.SnapshotBytes())
+	require.True(t, c.Metrics.SnapshotDuration() > 0)
+
+	restored, err := NewCache(config)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Load(&buf, decodeInt))
+	_, ok := restored.Get(0)
+	require.True(t, ok)
+}
+
+func TestCacheSaveDelta(t *testing.T) {
+	config := &Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		SnapshotDeltas:     true,
+	}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 1; i <= 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	// Items are tracked by the second, so let one pass for the items not
+	// changed after the full snapshot to be left out of the delta.
+	time.Sleep(1100 * time.Millisecond)
+	var full bytes.Buffer
+	require.NoError(t, c.Save(&full, encodeInt))
+
+	c.Del(2)
+	require.True(t, c.Set(1, 10, 1))
+	require.True(t, c.Set(4, 40, 1))
+	c.Wait()
+	var delta bytes.Buffer
+	require.NoError(t, c.SaveDelta(&delta, encodeInt))
+	// The delta holds the deletion of 2 and the sets of 1 and 4 only.
+	sr, err := newSnapshotReader(bytes.NewReader(delta.Bytes()))
+	require.NoError(t, err)
+	records := make(map[uint64]snapshotOp)
+	for {
+		si, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records[si.key] = si.op
+	}
+	hash := func(key int) uint64 {
+		h, _ := z.KeyToHash(key)
+		return h
+	}
+	require.Equal(t, map[uint64]snapshotOp{
+		hash(1): snapshotSet,
+		hash(2): snapshotDel,
+		hash(4): snapshotSet,
+	}, records)
+
+	c.Clear()
+	require.True(t, c.Set(5, 50, 1))
+	c.Wait()
+	var cleared bytes.Buffer
+	require.NoError(t, c.SaveDelta(&cleared, encodeInt))
+
+	check := func(restored *Cache[int, int], want map[int]int) {
+		for key := 1; key <= 5; key++ {
+			val, ok := restored.Get(key)
+			wantVal, wantOk := want[key]
+			require.Equal(t, wantOk, ok, "key %d", key)
+			require.Equal(t, wantVal, val, "key %d", key)
+		}
+	}
+	restored, err := NewCache(config)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Load(bytes.NewReader(full.Bytes()), decodeInt))
+	require.NoError(t, restored.Load(bytes.NewReader(delta.Bytes()), decodeInt))
+	check(restored, map[int]int{1: 10, 3: 3, 4: 40})
+	require.NoError(t, restored.Load(bytes.NewReader(cleared.Bytes()), decodeInt))
+	check(restored, map[int]int{5: 50})
+
+	// Compacting gives the same result as loading the deltas.
+	var compacted bytes.Buffer
+	require.NoError(t, CompactSnapshots(&compacted, bytes.NewReader(full.Bytes()),
+		bytes.NewReader(delta.Bytes())))
+	restored, err = NewCache(config)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Load(&compacted, decodeInt))
+	check(restored, map[int]int{1: 10, 3: 3, 4: 40})
+
+	config.SnapshotDeltas = false
+	c, err = NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, ErrSnapshotDeltas, c.SaveDelta(&delta, encodeInt))
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotDeltas is returned by SaveDelta when Config.SnapshotDeltas isn't
+// set.
+var ErrSnapshotDeltas = errors.New("snapshot deltas aren't enabled")
+
+// deltaLog remembers the keys removed since the last snapshot, so SaveDelta
+// can write them, see Config.SnapshotDeltas. A nil *deltaLog remembers
+// nothing.
+type deltaLog struct {
+	sync.Mutex
+	// since is when the last snapshot started, in Unix nanoseconds.
+	since int64
+	// cleared is when the cache was last cleared, in Unix nanoseconds.
+	cleared int64
+	// removed maps the hashes of the keys removed to their conflict hash and
+	// when they were removed.
+	removed map[uint64]deltaRemoval
+}
+
+type deltaRemoval struct {
+	conflict uint64
+	at       int64
+}
+
+func newDeltaLog(enabled bool) *deltaLog {
+	if !enabled {
+		return nil
+	}
+	return &deltaLog{
+		since:   time.Now().UnixNano(),
+		removed: make(map[uint64]deltaRemoval),
+	}
+}
+
+// del records the removal of the key, whether deleted, evicted or expired.
+func (d *deltaLog) del(key, conflict uint64) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	d.removed[key] = deltaRemoval{conflict: conflict, at: time.Now().UnixNano()}
+	d.Unlock()
+}
+
+// clear records that the cache was cleared.
+func (d *deltaLog) clear() {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	d.cleared = time.Now().UnixNano()
+	d.removed = make(map[uint64]deltaRemoval)
+	d.Unlock()
+}
+
+// mark starts a snapshot. It returns when the previous one started, whether
+// the cache was cleared since, and the keys removed since, which the next
+// snapshot doesn't need.
+func (d *deltaLog) mark() (since time.Time, cleared bool, removed map[uint64]deltaRemoval) {
+	if d == nil {
+		return time.Time{}, false, nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	since, cleared, removed = time.Unix(0, d.since), d.cleared >= d.since, d.removed
+	d.since = time.Now().UnixNano()
+	d.removed = make(map[uint64]deltaRemoval)
+	return since, cleared, removed
+}
+
+// SaveDelta writes the changes since the last Save or SaveDelta to w, in the
+// same format as Save: the items set since, and the keys deleted, evicted or
+// expired since. Load applies a delta on top of the snapshot it follows, so a
+// cache is restored by loading the last full snapshot and then every delta
+// written after it, in order. CompactSnapshots merges them into a new full
+// snapshot. It requires Config.SnapshotDeltas.
+//
+// Items are tracked with a resolution of a second, so a delta may repeat some
+// items of the snapshot before it, which is harmless.
+func (c *Cache[K, V]) SaveDelta(w io.Writer, encode func(V) ([]byte, error)) error {
+	if c == nil || c.isClosed {
+		return ErrClosed
+	}
+	if c.deltas == nil {
+		return ErrSnapshotDeltas
+	}
+	since, cleared, removed := c.deltas.mark()
+	// The items written since, as the seconds since storeEpoch stored in
+	// storeItem.written.
+	written := uint32(since.Sub(storeEpoch)/time.Second) + 1
+	return c.save(w, encode, func(sw *snapshotWriter) error {
+		if cleared {
+			if err := sw.write(snapshotItem{op: snapshotClear}); err != nil {
+				return err
+			}
+		}
+		for key, r := range removed {
+			err := sw.write(snapshotItem{op: snapshotDel, key: key, conflict: r.conflict})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(si storeItem[V]) bool {
+		return si.written >= written
+	})
+}
+
+// CompactSnapshots merges a full snapshot written by Save with the deltas
+// written after it by SaveDelta, in order, into a new full snapshot written to
+// w, dropping the items that expired. It holds all the items in memory while it
+// runs, but doesn't need a cache.
+func CompactSnapshots(w io.Writer, full io.Reader, deltas ...io.Reader) error {
+	items := make(map[uint64]snapshotItem)
+	now := time.Now().UnixNano()
+	for _, r := range append([]io.Reader{full}, deltas...) {
+		sr, err := newSnapshotReader(r)
+		if err != nil {
+			return err
+		}
+		for {
+			si, err := sr.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			switch si.op {
+			case snapshotSet:
+				items[si.key] = si
+			case snapshotDel:
+				delete(items, si.key)
+			case snapshotClear:
+				items = make(map[uint64]snapshotItem)
+			}
+		}
+	}
+	sw := newSnapshotWriter(w)
+	for _, si := range items {
+		if si.expiration != 0 && now >= si.expiration {
+			continue
+		}
+		if err := sw.write(si); err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
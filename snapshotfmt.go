@@ -0,0 +1,314 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+var (
+	// ErrSnapshotCorrupt is returned by Load when the snapshot can't be
+	// decoded, is truncated or fails its checksum.
+	ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+	// ErrSnapshotVersion is returned by Load when the snapshot was written by a
+	// newer version of the package.
+	ErrSnapshotVersion = errors.New("snapshot version is not supported")
+)
+
+// A snapshot starts with snapshotMagic and the uvarint format version,
+// followed by blocks of items. Each block is its uvarint length, the items and
+// the big-endian CRC-32C of the items. A block of length 0 ends the snapshot,
+// so a truncated one is detected.
+//
+// Each item is its uvarint length followed by fields, each a uvarint tag of
+// the field number shifted left by 3 and its wire type, then a varint or a
+// uvarint length and bytes depending on the wire type. Fields with the zero
+// value are omitted. Loading skips the fields it doesn't know, so fields can be
+// added without a new version; a version is only needed for changes older
+// releases can't just skip.
+//
+// Version 2 adds the op field, as the deletions of deltas can't be skipped.
+const snapshotVersion = 2
+
+var snapshotMagic = []byte("ristsnap")
+
+// snapshotBlockSize is the size past which the items written so far are
+// flushed as a block.
+const snapshotBlockSize = 64 << 10
+
+var snapshotCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// The wire types of the fields.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// The field numbers of a snapshotItem.
+const (
+	fieldKey        = 1
+	fieldConflict   = 2
+	fieldExpiration = 3
+	fieldCost       = 4
+	fieldMeta       = 5
+	fieldValue      = 6
+	fieldOp         = 7
+	// The fields of the mutations encoded by MutationEncoder.
+	fieldSeq      = 8
+	fieldMutation = 9
+	fieldUpdate   = 10
+)
+
+// snapshotWriter writes snapshotItems in the current format.
+type snapshotWriter struct {
+	w     *bufio.Writer
+	block []byte
+	item  []byte
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.w.Write(snapshotMagic)
+	sw.w.Write(sw.uvarint(snapshotVersion))
+	return sw
+}
+
+func (sw *snapshotWriter) uvarint(v uint64) []byte {
+	return sw.buf[:binary.PutUvarint(sw.buf[:], v)]
+}
+
+// appendUvarint appends v to b as a uvarint.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendField appends the varint field to b, unless v is zero.
+func appendField(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(num<<3|wireVarint))
+	return appendUvarint(b, v)
+}
+
+// zigzag encodes v like binary.PutVarint does, so small negative values stay
+// short.
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// encode appends the fields of the item to b.
+func (si snapshotItem) encode(b []byte) []byte {
+	b = appendField(b, fieldOp, uint64(si.op))
+	b = appendField(b, fieldKey, si.key)
+	b = appendField(b, fieldConflict, si.conflict)
+	b = appendField(b, fieldExpiration, zigzag(si.expiration))
+	b = appendField(b, fieldCost, zigzag(si.cost))
+	b = appendField(b, fieldMeta, uint64(si.meta))
+	if len(si.value) > 0 {
+		b = appendUvarint(b, fieldValue<<3|wireBytes)
+		b = appendUvarint(b, uint64(len(si.value)))
+		b = append(b, si.value...)
+	}
+	b = appendField(b, fieldSeq, si.seq)
+	b = appendField(b, fieldMutation, uint64(si.mutation))
+	if si.update {
+		b = appendField(b, fieldUpdate, 1)
+	}
+	return b
+}
+
+func (sw *snapshotWriter) write(si snapshotItem) error {
+	sw.item = si.encode(sw.item[:0])
+	sw.block = append(sw.block, sw.uvarint(uint64(len(sw.item)))...)
+	sw.block = append(sw.block, sw.item...)
+	if len(sw.block) >= snapshotBlockSize {
+		return sw.flush()
+	}
+	return nil
+}
+
+// flush writes the items written since the last block as a block.
+func (sw *snapshotWriter) flush() error {
+	if len(sw.block) == 0 {
+		return nil
+	}
+	sw.w.Write(sw.uvarint(uint64(len(sw.block))))
+	sw.w.Write(sw.block)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(sw.block, snapshotCRC))
+	_, err := sw.w.Write(sum[:])
+	sw.block = sw.block[:0]
+	return err
+}
+
+// close flushes the last block and ends the snapshot.
+func (sw *snapshotWriter) close() error {
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	sw.w.Write(sw.uvarint(0))
+	return sw.w.Flush()
+}
+
+// snapshotReader reads the snapshotItems of a snapshot of any version.
+type snapshotReader struct {
+	r       *bufio.Reader
+	version uint64
+	// block holds the items of the current block not read yet.
+	block []byte
+	done  bool
+}
+
+func newSnapshotReader(r io.Reader) (*snapshotReader, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	magic, err := sr.r.Peek(len(snapshotMagic))
+	if err == io.EOF && len(magic) == 0 {
+		// An empty snapshot is valid and has no items.
+		sr.done = true
+		return sr, nil
+	}
+	if err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, ErrSnapshotCorrupt
+	}
+	sr.r.Discard(len(snapshotMagic))
+	if sr.version, err = binary.ReadUvarint(sr.r); err != nil || sr.version == 0 {
+		return nil, ErrSnapshotCorrupt
+	}
+	if sr.version > snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	return sr, nil
+}
+
+// next returns the next item, or io.EOF once there's none left.
+func (sr *snapshotReader) next() (snapshotItem, error) {
+	for len(sr.block) == 0 {
+		if sr.done {
+			return snapshotItem{}, io.EOF
+		}
+		if err := sr.readBlock(); err != nil {
+			return snapshotItem{}, err
+		}
+	}
+	size, n := binary.Uvarint(sr.block)
+	if n <= 0 || size > uint64(len(sr.block)-n) {
+		return snapshotItem{}, ErrSnapshotCorrupt
+	}
+	item := sr.block[n : n+int(size)]
+	sr.block = sr.block[n+int(size):]
+	return decodeSnapshotItem(item)
+}
+
+// readBlock reads the next block and checks its checksum.
+func (sr *snapshotReader) readBlock() error {
+	size, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return ErrSnapshotCorrupt
+	}
+	if size == 0 {
+		sr.done = true
+		return nil
+	}
+	if size > math.MaxInt64-4 {
+		return ErrSnapshotCorrupt
+	}
+	// Copy rather than allocate size bytes up front, in case it's corrupt.
+	var block bytes.Buffer
+	if _, err := io.CopyN(&block, sr.r, int64(size)+4); err != nil {
+		return ErrSnapshotCorrupt
+	}
+	data := block.Bytes()
+	sr.block = data[:size]
+	if crc32.Checksum(sr.block, snapshotCRC) != binary.BigEndian.Uint32(data[size:]) {
+		return ErrSnapshotCorrupt
+	}
+	return nil
+}
+
+// decodeSnapshotItem decodes the fields of an item, skipping unknown ones.
+func decodeSnapshotItem(b []byte) (snapshotItem, error) {
+	var si snapshotItem
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return si, ErrSnapshotCorrupt
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return si, ErrSnapshotCorrupt
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case wireVarint:
+		case wireBytes:
+			if v > uint64(len(b)) {
+				return si, ErrSnapshotCorrupt
+			}
+			if tag>>3 == fieldValue {
+				si.value = b[:v]
+			}
+			b = b[v:]
+			continue
+		default:
+			return si, ErrSnapshotCorrupt
+		}
+		switch tag >> 3 {
+		case fieldKey:
+			si.key = v
+		case fieldConflict:
+			si.conflict = v
+		case fieldExpiration:
+			si.expiration = unzigzag(v)
+		case fieldCost:
+			si.cost = unzigzag(v)
+		case fieldMeta:
+			if v > math.MaxUint32 {
+				return si, ErrSnapshotCorrupt
+			}
+			si.meta = uint32(v)
+		case fieldOp:
+			if v > uint64(snapshotClear) {
+				return si, ErrSnapshotCorrupt
+			}
+			si.op = snapshotOp(v)
+		case fieldSeq:
+			si.seq = v
+		case fieldMutation:
+			if v > uint64(MutationClear) {
+				return si, ErrSnapshotCorrupt
+			}
+			si.mutation = MutationOp(v)
+		case fieldUpdate:
+			si.update = v != 0
+		}
+	}
+	return si, nil
+}
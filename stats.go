@@ -0,0 +1,34 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// StatsRecorder receives the events of a cache as they happen, see
+// Config.Stats. Its methods are called from the goroutines reading the cache
+// and from internal goroutines, so they must be fast and safe for concurrent
+// use, and must not call the cache.
+type StatsRecorder interface {
+	// RecordHit is called for every lookup that finds its key, including
+	// GetStale finding a value that hasn't expired.
+	RecordHit()
+	// RecordMiss is called for every lookup that doesn't find its key, or
+	// finds it expired.
+	RecordMiss()
+	// RecordEviction is called for every item evicted, expired or cleared,
+	// with the reason and its cost as accounted by the policy. The cost of the
+	// items cleared is zero, as the policy is cleared along with them.
+	RecordEviction(reason EvictReason, cost int64)
+}
@@ -0,0 +1,46 @@
+package ristretto
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingStats struct {
+	hits, misses, evictions int64
+}
+
+func (s *countingStats) RecordHit()  { atomic.AddInt64(&s.hits, 1) }
+func (s *countingStats) RecordMiss() { atomic.AddInt64(&s.misses, 1) }
+
+func (s *countingStats) RecordEviction(EvictReason, int64) {
+	atomic.AddInt64(&s.evictions, 1)
+}
+
+func TestCacheStats(t *testing.T) {
+	stats := &countingStats{}
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Stats:              stats,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 3, 0)
+	c.Get(1)
+	c.Get(2)
+	_, _, ok := c.GetStale(3)
+	require.False(t, ok)
+	require.Equal(t, int64(c.Metrics.Hits()), atomic.LoadInt64(&stats.hits))
+	require.Equal(t, int64(2), atomic.LoadInt64(&stats.misses))
+	require.Equal(t, c.Metrics.Misses(), uint64(atomic.LoadInt64(&stats.misses)))
+
+	c.Clear()
+	c.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&stats.evictions))
+}
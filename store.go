@@ -17,15 +17,106 @@
 package ristretto
 
 import (
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // TODO: Do we need this to be a separate struct from Item?
 type storeItem[V any] struct {
+	conflict uint64
+	value    V
+	// expiration is stored in Unix nanoseconds rather than as a time.Time,
+	// which is three times bigger and holds a pointer. 0 means no expiration.
+	expiration int64
+	meta       uint32
+	// created is when the item was added and written when its value was last
+	// written, see storeNow. They're kept apart from the item, see
+	// stampedItems, and are 0 unless Config.TrackWrites is set.
+	created uint32
+	written uint32
+	// version is kept apart from the item too, and is 0 unless
+	// Config.TrackVersions is set.
+	version uint64
+}
+
+// mapEntry is what mapItems keeps for each item: a storeItem without the
+// fields kept apart by stampedItems, so the items don't pay for them unless
+// they're used.
+type mapEntry[V any] struct {
 	conflict   uint64
 	value      V
-	expiration time.Time
+	expiration int64
+	meta       uint32
+}
+
+func (i storeItem[V]) entry() mapEntry[V] {
+	return mapEntry[V]{
+		conflict:   i.conflict,
+		value:      i.value,
+		expiration: i.expiration,
+		meta:       i.meta,
+	}
+}
+
+func (e mapEntry[V]) item() storeItem[V] {
+	return storeItem[V]{
+		conflict:   e.conflict,
+		value:      e.value,
+		expiration: e.expiration,
+		meta:       e.meta,
+	}
+}
+
+// storeEpoch is the time the creation times of the items are relative to.
+var storeEpoch = time.Now()
+
+// storeNow returns the current time as stored in storeItem.created and
+// storeItem.written, which is the number of seconds since storeEpoch plus one,
+// so 0 means unknown.
+func storeNow() uint32 {
+	return uint32(time.Since(storeEpoch)/time.Second) + 1
+}
+
+// storeAge returns how long ago a time returned by storeNow was, or 0 if it's
+// unknown.
+func storeAge(t uint32, now time.Time) time.Duration {
+	if t == 0 {
+		return 0
+	}
+	return now.Sub(storeEpoch.Add(time.Duration(t-1) * time.Second))
+}
+
+// storeTime returns the time returned by storeNow as a time.Time, or the zero
+// time if it's unknown.
+func storeTime(t uint32) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return storeEpoch.Add(time.Duration(t-1) * time.Second)
+}
+
+// expirationNanos converts an expiration time to how it's stored in storeItem.
+func expirationNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// expirationTime returns the expiration time of the item, which is the zero
+// time if the item doesn't expire.
+func (i storeItem[V]) expirationTime() time.Time {
+	if i.expiration == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, i.expiration)
+}
+
+// expired returns true if the item expires and now is after its expiration.
+func (i storeItem[V]) expired(now time.Time) bool {
+	return i.expiration != 0 && now.UnixNano() > i.expiration
 }
 
 // store is the interface fulfilled by all hash map implementations in this
@@ -37,26 +128,91 @@ type storeItem[V any] struct {
 type store[V any] interface {
 	// Get returns the value associated with the key parameter.
 	Get(uint64, uint64) (V, bool)
+	// GetItem works like Get but returns the whole stored item. Its last
+	// parameter is the high half of the 128-bit conflict hash of the key, see
+	// Config.WideConflict, which is compared too unless it's 0.
+	GetItem(uint64, uint64, uint64) (storeItem[V], bool)
+	// GetStale works like GetItem but also returns the items that expired but
+	// haven't been removed yet.
+	GetStale(uint64, uint64, uint64) (storeItem[V], bool)
+	// Conflicts returns true if the Map holds another key with the hash of the
+	// item, as told by its conflict hashes.
+	Conflicts(Item[V]) bool
 	// Expiration returns the expiration time for this key.
 	Expiration(uint64) time.Time
+	// Touch records that the item of the key was just read, if access times
+	// are tracked, and returns when it was read before, see storeNow, or 0.
+	Touch(uint64) uint32
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
 	// item object.
 	Set(Item[V])
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, uint64) (uint64, V)
+	// Del deletes the key-value pair from the Map and returns the deleted item.
+	Del(uint64, uint64) storeItem[V]
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(Item[V]) (V, bool)
-	// Cleanup removes items that have an expired TTL.
-	Cleanup(policy policy[V], onEvict itemCallback[V])
-	// Clear clears all contents of the store.
-	Clear(onEvict itemCallback[V])
+	// UpdateIfVersion works like Update but only updates the value if the
+	// stored version matches the given one. The expiration and metadata of the
+	// stored item are kept.
+	UpdateIfVersion(Item[V], uint64) (V, bool)
+	// Upsert atomically computes a new value for the key from its current one,
+	// if any, using fn and stores it. If the key is missing or expired, it's
+	// stored with the expiration, metadata and version of the given item;
+	// otherwise only the version is replaced. fn can return false to leave the
+	// Map untouched. Upsert returns the previous value and the stored item,
+	// with its flag set to itemUpdate if the key was in the Map already and to
+	// itemStored otherwise, and true if the item was stored.
+	Upsert(Item[V], func(V, bool) (V, bool)) (V, Item[V], bool)
+	// ApplyBatch atomically applies the items, each either a set or a delete
+	// (flagged itemDelete), holding the locks of all the involved shards at
+	// once. It returns the previous values of the items. The flag of each set
+	// is changed to itemStored if the key was added, to itemUpdate if it was
+	// updated, and left as is if it was skipped because of a conflict.
+	ApplyBatch([]Item[V]) []V
+	// DelIf deletes the key-value pair from the Map only if fn returns true for
+	// the stored item. fn is called while holding the lock. It returns the
+	// deleted item and true if it was deleted.
+	DelIf(uint64, uint64, func(storeItem[V]) bool) (storeItem[V], bool)
+	// DelExpired deletes the key-value pair from the Map only if its expiration
+	// has passed. It returns the deleted item and true if it was deleted.
+	DelExpired(uint64, uint64) (storeItem[V], bool)
+	// SetExpiration replaces the expiration of the key if it's in the Map and
+	// hasn't expired. It returns true if it was replaced.
+	SetExpiration(uint64, uint64, time.Time) bool
+	// Range calls fn for every key and item that hasn't expired, until fn
+	// returns false. Each shard is copied while holding its lock and fn is
+	// called without holding any lock, so items set or deleted concurrently
+	// may or may not be seen.
+	Range(fn func(uint64, storeItem[V]) bool)
+	// Sample returns up to n random items that haven't expired, without
+	// scanning the whole Map. The Cost of the items is not set.
+	Sample(n int) []Item[V]
+	// ShardLens returns the number of items in each shard, including the items
+	// that expired but haven't been removed yet.
+	ShardLens() []int
+	// ExpiringLen returns the number of items with an expiration.
+	ExpiringLen() int
+	// Cleanup removes items that have an expired TTL. If limit is greater than
+	// zero, at most limit items are removed and the rest are left for the next
+	// call. It returns the number of items left. If workers is greater than one,
+	// the items can be removed by up to that many goroutines.
+	Cleanup(policy policy[V], onEvict itemCallback[V], limit, workers int) int
+	// Due returns the keys whose expiration has passed and the earliest
+	// expiration left, if precise expiration is enabled. Each key is only
+	// returned once per expiration.
+	Due(now time.Time) (map[uint64]uint64, time.Time)
+	// Clear clears all contents of the store. The items of each shard are
+	// swapped for an empty map while holding its lock, and the returned
+	// function calls onEvict for them without holding any lock, so it can run
+	// in the background. The items of custom Stores can't be swapped, so
+	// onEvict is called for them right away.
+	Clear(onEvict itemCallback[V]) func()
 }
 
 // newStore returns the default store implementation.
 func newStore[V any]() store[V] {
-	return newShardedMap[V]()
+	return newShardedMap[V](nil, nil)
 }
 
 const numShards uint64 = 256
@@ -66,21 +222,96 @@ type shardedMap[V any] struct {
 	expiryMap *expirationMap[V]
 }
 
-func newShardedMap[V any]() *shardedMap[V] {
+// newShardedMap returns a shardedMap keeping the items of each shard in a
+// Store returned by newStore, or in a Go map if newStore is nil. The waits on
+// its locks are recorded in prof, which can be nil.
+func newShardedMap[V any](newStore func() Store[V], prof *contention) *shardedMap[V] {
 	sm := &shardedMap[V]{
 		shards:    make([]*lockedMap[V], int(numShards)),
 		expiryMap: newExpirationMap[V](),
 	}
+	sm.expiryMap.prof = prof
 	for i := range sm.shards {
-		sm.shards[i] = newLockedMap[V](sm.expiryMap)
+		var data itemMap[V] = make(mapItems[V])
+		if newStore != nil {
+			data = storeItems[V]{newStore()}
+		}
+		sm.shards[i] = newLockedMap[V](sm.expiryMap, data)
+		sm.shards[i].prof = prof
 	}
 	return sm
 }
 
+// wideConflict makes the shards keep the high half of the 128-bit conflict hash
+// of the keys added from now on, see Config.WideConflict.
+func (sm *shardedMap[V]) wideConflict() {
+	for _, m := range sm.shards {
+		m.conflictHi = make(map[uint64]uint64)
+	}
+}
+
+// trackVersions makes the shards keep the versions of the items added from now
+// on, see Config.TrackVersions.
+func (sm *shardedMap[V]) trackVersions() {
+	for _, m := range sm.shards {
+		s := m.stamped()
+		s.versions = make(map[uint64]uint64)
+		m.data = s
+	}
+}
+
+// trackWrites makes the shards record when the items added from now on are
+// added and written, see Config.TrackWrites.
+func (sm *shardedMap[V]) trackWrites() {
+	for _, m := range sm.shards {
+		s := m.stamped()
+		s.times = make(map[uint64]itemTimes)
+		m.data = s
+	}
+}
+
+// trackAccess makes the shards record when the items added from now on are
+// read, see Config.TrackAccess.
+func (sm *shardedMap[V]) trackAccess() {
+	for _, m := range sm.shards {
+		m.accessed = make(map[uint64]*uint32)
+	}
+}
+
+// preciseExpiration makes the store keep track of the exact expiration of the
+// items added from now on, see Config.PreciseExpiration. It returns the channel
+// signaled when the earliest expiration changes.
+func (sm *shardedMap[V]) preciseExpiration() <-chan struct{} {
+	return sm.expiryMap.enablePrecise()
+}
+
 func (sm *shardedMap[V]) Get(key, conflict uint64) (V, bool) {
 	return sm.shards[key%numShards].get(key, conflict)
 }
 
+func (sm *shardedMap[V]) Touch(key uint64) uint32 {
+	return sm.shards[key%numShards].touch(key)
+}
+
+func (sm *shardedMap[V]) GetItem(key, conflict, conflictHi uint64) (storeItem[V], bool) {
+	return sm.shards[key%numShards].getItem(key, conflict, conflictHi)
+}
+
+func (sm *shardedMap[V]) GetStale(key, conflict, conflictHi uint64) (storeItem[V], bool) {
+	return sm.shards[key%numShards].getStale(key, conflict, conflictHi)
+}
+
+func (sm *shardedMap[V]) Conflicts(i Item[V]) bool {
+	m := sm.shards[i.Key%numShards]
+	m.RLock()
+	defer m.RUnlock()
+	item, ok := m.data.get(i.Key)
+	if !ok || (item.conflict == 0 && m.conflictHi[i.Key] == 0) {
+		return false
+	}
+	return m.conflicts(i.Key, item, i)
+}
+
 func (sm *shardedMap[V]) Expiration(key uint64) time.Time {
 	return sm.shards[key%numShards].Expiration(key)
 }
@@ -90,62 +321,302 @@ func (sm *shardedMap[V]) Set(i Item[V]) {
 	sm.shards[i.Key%numShards].Set(i)
 }
 
-func (sm *shardedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (sm *shardedMap[V]) Del(key, conflict uint64) storeItem[V] {
 	return sm.shards[key%numShards].Del(key, conflict)
 }
 
+func (sm *shardedMap[V]) UpdateIfVersion(newItem Item[V], version uint64) (V, bool) {
+	return sm.shards[newItem.Key%numShards].UpdateIfVersion(newItem, version)
+}
+
+func (sm *shardedMap[V]) Upsert(i Item[V], fn func(V, bool) (V, bool)) (V, Item[V], bool) {
+	return sm.shards[i.Key%numShards].Upsert(i, fn)
+}
+
+func (sm *shardedMap[V]) ApplyBatch(items []Item[V]) []V {
+	// Lock the shards in order to avoid deadlocks with concurrent batches.
+	var locked [numShards]bool
+	for _, i := range items {
+		locked[i.Key%numShards] = true
+	}
+	for idx := range locked {
+		if locked[idx] {
+			sm.shards[idx].Lock()
+			defer sm.shards[idx].Unlock()
+		}
+	}
+
+	prevs := make([]V, len(items))
+	for n := range items {
+		i := &items[n]
+		shard := sm.shards[i.Key%numShards]
+		if i.flag == itemDelete {
+			prevs[n] = shard.delLocked(i.Key, i.Conflict).value
+			continue
+		}
+		prev, existed, ok := shard.setLocked(*i)
+		if !ok {
+			continue
+		}
+		prevs[n] = prev.value
+		if existed {
+			i.flag = itemUpdate
+		} else {
+			i.flag = itemStored
+		}
+	}
+	return prevs
+}
+
+func (sm *shardedMap[V]) DelIf(key, conflict uint64, fn func(storeItem[V]) bool) (storeItem[V], bool) {
+	return sm.shards[key%numShards].DelIf(key, conflict, fn)
+}
+
+func (sm *shardedMap[V]) DelExpired(key, conflict uint64) (storeItem[V], bool) {
+	return sm.shards[key%numShards].DelExpired(key, conflict)
+}
+
+func (sm *shardedMap[V]) SetExpiration(key, conflict uint64, expiration time.Time) bool {
+	return sm.shards[key%numShards].SetExpiration(key, conflict, expiration)
+}
+
 func (sm *shardedMap[V]) Update(newItem Item[V]) (V, bool) {
 	return sm.shards[newItem.Key%numShards].Update(newItem)
 }
 
-func (sm *shardedMap[V]) Cleanup(policy policy[V], onEvict itemCallback[V]) {
-	sm.expiryMap.cleanup(sm, policy, onEvict)
+func (sm *shardedMap[V]) Range(fn func(uint64, storeItem[V]) bool) {
+	var keys []uint64
+	var items []storeItem[V]
+	for _, shard := range sm.shards {
+		keys, items = shard.copyItems(keys[:0], items[:0])
+		for n := range keys {
+			if !fn(keys[n], items[n]) {
+				return
+			}
+		}
+	}
+}
+
+func (sm *shardedMap[V]) Sample(n int) []Item[V] {
+	if n <= 0 {
+		return nil
+	}
+	res := make([]Item[V], 0, n)
+	seen := make(map[uint64]struct{}, n)
+	// Give up after a few misses per wanted item, as the Map may hold fewer
+	// than n items.
+	for tries := 0; len(res) < n && tries < 4*n; tries++ {
+		// Cryptographic precision not needed
+		shard := sm.shards[rand.Intn(int(numShards))] //nolint:gosec
+		key, item, ok := shard.randomItem()
+		if !ok {
+			continue
+		}
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		res = append(res, Item[V]{
+			Key:        key,
+			Conflict:   item.conflict,
+			Value:      item.value,
+			Expiration: item.expirationTime(),
+			Meta:       item.meta,
+			Version:    item.version,
+		})
+	}
+	return res
+}
+
+func (sm *shardedMap[V]) ShardLens() []int {
+	lens := make([]int, len(sm.shards))
+	for i, shard := range sm.shards {
+		shard.RLock()
+		lens[i] = shard.data.len()
+		shard.RUnlock()
+	}
+	return lens
+}
+
+func (sm *shardedMap[V]) ExpiringLen() int {
+	return sm.expiryMap.len()
+}
+
+func (sm *shardedMap[V]) Cleanup(policy policy[V], onEvict itemCallback[V], limit, workers int) int {
+	return sm.expiryMap.cleanup(sm, policy, onEvict, limit, workers)
 }
 
-func (sm *shardedMap[V]) Clear(onEvict itemCallback[V]) {
+func (sm *shardedMap[V]) Due(now time.Time) (map[uint64]uint64, time.Time) {
+	return sm.expiryMap.due(now)
+}
+
+func (sm *shardedMap[V]) Clear(onEvict itemCallback[V]) func() {
+	var old []itemMap[V]
 	for i := uint64(0); i < numShards; i++ {
-		sm.shards[i].Clear(onEvict)
+		if data := sm.shards[i].Clear(onEvict); data != nil {
+			old = append(old, data)
+		}
+	}
+	return func() {
+		for _, data := range old {
+			data.rangeItems(func(key uint64, si storeItem[V]) bool {
+				onEvict(si.clearedItem(key))
+				return true
+			})
+		}
 	}
 }
 
 type lockedMap[V any] struct {
 	sync.RWMutex
-	data map[uint64]storeItem[V]
+	data itemMap[V]
 	em   *expirationMap[V]
+	// prof records the waits on the lock during contention profiles.
+	prof *contention
+	// accessed holds when each item was last read, see storeNow, if
+	// Config.TrackAccess is set, and is nil otherwise. The times are kept
+	// apart from the items so they take no memory unless they're tracked, and
+	// behind pointers so reads can update them holding only the read lock.
+	accessed map[uint64]*uint32
+	// conflictHi holds the high half of the 128-bit conflict hash of each key
+	// that has one if Config.WideConflict is set, and is nil otherwise, so
+	// the items don't pay for it unless it's used.
+	conflictHi map[uint64]uint64
 }
 
-func newLockedMap[V any](em *expirationMap[V]) *lockedMap[V] {
+func newLockedMap[V any](em *expirationMap[V], data itemMap[V]) *lockedMap[V] {
 	return &lockedMap[V]{
-		data: make(map[uint64]storeItem[V]),
+		data: data,
 		em:   em,
 	}
 }
 
+// stamped returns the items of the map as stampedItems, to keep more fields
+// apart from them.
+func (m *lockedMap[V]) stamped() stampedItems[V] {
+	if s, ok := m.data.(stampedItems[V]); ok {
+		return s
+	}
+	return stampedItems[V]{itemMap: m.data}
+}
+
+// Lock locks the map for writing, recording the wait if a contention profile
+// is running.
+func (m *lockedMap[V]) Lock() {
+	if !m.prof.enabled() {
+		m.RWMutex.Lock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.Lock()
+	m.prof.shardWait.add(time.Since(start))
+}
+
+// RLock locks the map for reading, recording the wait if a contention profile
+// is running.
+func (m *lockedMap[V]) RLock() {
+	if !m.prof.enabled() {
+		m.RWMutex.RLock()
+		return
+	}
+	start := time.Now()
+	m.RWMutex.RLock()
+	m.prof.shardWait.add(time.Since(start))
+}
+
 func (m *lockedMap[V]) get(key, conflict uint64) (V, bool) {
+	item, ok := m.getItem(key, conflict, 0)
+	return item.value, ok
+}
+
+func (m *lockedMap[V]) getItem(key, conflict, conflictHi uint64) (storeItem[V], bool) {
+	item, ok := m.getStale(key, conflict, conflictHi)
+	// Handle expired items.
+	if !ok || item.expired(time.Now()) {
+		return storeItem[V]{}, false
+	}
+	return item, true
+}
+
+func (m *lockedMap[V]) getStale(key, conflict, conflictHi uint64) (storeItem[V], bool) {
 	m.RLock()
-	item, ok := m.data[key]
+	item, ok := m.data.get(key)
+	hi := m.conflictHi[key]
 	m.RUnlock()
 	if !ok {
-		var zero V
-		return zero, false
+		return storeItem[V]{}, false
 	}
 	if conflict != 0 && (conflict != item.conflict) {
-		var zero V
-		return zero, false
+		return storeItem[V]{}, false
 	}
+	if conflictHi != 0 && hi != 0 && conflictHi != hi {
+		return storeItem[V]{}, false
+	}
+	return item, true
+}
 
-	// Handle expired items.
-	if !item.expiration.IsZero() && time.Now().After(item.expiration) {
-		var zero V
-		return zero, false
+// conflicts returns true if the stored item of the key belongs to another key
+// than i, as told by their conflict hashes. Hashes that are 0 aren't compared.
+// The caller must hold the lock.
+func (m *lockedMap[V]) conflicts(key uint64, item storeItem[V], i Item[V]) bool {
+	if i.Conflict != 0 && i.Conflict != item.conflict {
+		return true
+	}
+	hi := m.conflictHi[key]
+	return i.conflictHi != 0 && hi != 0 && i.conflictHi != hi
+}
+
+// setConflictHi records the high half of the 128-bit conflict hash of the key,
+// just written. The caller must hold the lock.
+func (m *lockedMap[V]) setConflictHi(key, conflictHi uint64) {
+	switch {
+	case m.conflictHi == nil:
+	case conflictHi == 0:
+		delete(m.conflictHi, key)
+	default:
+		m.conflictHi[key] = conflictHi
+	}
+}
+
+func (m *lockedMap[V]) touch(key uint64) uint32 {
+	if m.accessed == nil {
+		return 0
+	}
+	m.RLock()
+	t := m.accessed[key]
+	m.RUnlock()
+	if t == nil {
+		return 0
+	}
+	// Avoid writing the shared cache line when nothing changes.
+	prev := atomic.LoadUint32(t)
+	if now := storeNow(); prev != now {
+		atomic.StoreUint32(t, now)
+	}
+	return prev
+}
+
+// resetAccessed records that the item of the key, just added, was never read.
+// The caller must hold the lock.
+func (m *lockedMap[V]) resetAccessed(key uint64) {
+	if m.accessed != nil {
+		m.accessed[key] = new(uint32)
+	}
+}
+
+// delAccessed forgets when the item of the key, just removed, was read. The
+// caller must hold the lock.
+func (m *lockedMap[V]) delAccessed(key uint64) {
+	if m.accessed != nil {
+		delete(m.accessed, key)
 	}
-	return item.value, true
 }
 
 func (m *lockedMap[V]) Expiration(key uint64) time.Time {
 	m.RLock()
 	defer m.RUnlock()
-	return m.data[key].expiration
+	item, _ := m.data.get(key)
+	return item.expirationTime()
 }
 
 func (m *lockedMap[V]) Set(i Item[V]) {
@@ -153,87 +624,517 @@ func (m *lockedMap[V]) Set(i Item[V]) {
 
 	m.Lock()
 	defer m.Unlock()
-	item, ok := m.data[i.Key]
+	m.setLocked(i)
+}
+
+// setLocked adds or updates the item. It returns the previous item, whether
+// there was one, and false if the item wasn't set because of a conflict. The
+// caller must hold the lock.
+func (m *lockedMap[V]) setLocked(i Item[V]) (storeItem[V], bool, bool) {
+	item, ok := m.data.get(i.Key)
 
+	now := storeNow()
+	created := item.created
 	if ok {
 		// The item existed already. We need to check the conflict key and reject the
 		// update if they do not match. Only after that the expiration map is updated.
-		if i.Conflict != 0 && (i.Conflict != item.conflict) {
-			return
+		if m.conflicts(i.Key, item, i) {
+			return item, true, false
 		}
-		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
+		m.em.update(i.Key, i.Conflict, item.expirationTime(), i.Expiration)
 	} else {
 		// The value is not in the map already. There's no need to return anything.
 		// Simply add the expiration map.
 		m.em.add(i.Key, i.Conflict, i.Expiration)
+		m.resetAccessed(i.Key)
+		created = now
 	}
 
-	m.data[i.Key] = storeItem[V]{
+	m.setConflictHi(i.Key, i.conflictHi)
+	m.data.set(i.Key, storeItem[V]{
 		conflict:   i.Conflict,
 		value:      i.Value,
-		expiration: i.Expiration,
-	}
+		expiration: expirationNanos(i.Expiration),
+		meta:       i.Meta,
+		created:    created,
+		written:    now,
+		version:    i.Version,
+	})
+	return item, ok, true
 }
 
-func (m *lockedMap[V]) Del(key, conflict uint64) (uint64, V) {
+func (m *lockedMap[V]) Del(key, conflict uint64) storeItem[V] {
 	m.Lock()
-	item, ok := m.data[key]
+	defer m.Unlock()
+	return m.delLocked(key, conflict)
+}
+
+// delLocked deletes the item and returns it. The caller must hold the lock.
+func (m *lockedMap[V]) delLocked(key, conflict uint64) storeItem[V] {
+	item, ok := m.data.get(key)
 	if !ok {
-		m.Unlock()
-		var zero V
-		return 0, zero
+		return storeItem[V]{}
 	}
 	if conflict != 0 && (conflict != item.conflict) {
-		m.Unlock()
-		var zero V
-		return 0, zero
+		return storeItem[V]{}
 	}
 
-	if !item.expiration.IsZero() {
-		m.em.del(key, item.expiration)
+	if item.expiration != 0 {
+		m.em.del(key, item.expirationTime())
 	}
 
-	delete(m.data, key)
-	m.Unlock()
-	return item.conflict, item.value
+	m.data.del(key)
+	m.delAccessed(key)
+	m.setConflictHi(key, 0)
+	return item
+}
+
+func (m *lockedMap[V]) DelIf(key, conflict uint64, fn func(storeItem[V]) bool) (storeItem[V], bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data.get(key)
+	if !ok || (conflict != 0 && (conflict != item.conflict)) {
+		return storeItem[V]{}, false
+	}
+	if item.expired(time.Now()) {
+		return storeItem[V]{}, false
+	}
+	if !fn(item) {
+		return storeItem[V]{}, false
+	}
+
+	if item.expiration != 0 {
+		m.em.del(key, item.expirationTime())
+	}
+	m.data.del(key)
+	m.delAccessed(key)
+	m.setConflictHi(key, 0)
+	return item, true
+}
+
+func (m *lockedMap[V]) DelExpired(key, conflict uint64) (storeItem[V], bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data.get(key)
+	if !ok || (conflict != 0 && (conflict != item.conflict)) {
+		return storeItem[V]{}, false
+	}
+	if !item.expired(time.Now()) {
+		return storeItem[V]{}, false
+	}
+
+	m.em.del(key, item.expirationTime())
+	m.data.del(key)
+	m.delAccessed(key)
+	m.setConflictHi(key, 0)
+	return item, true
+}
+
+func (m *lockedMap[V]) SetExpiration(key, conflict uint64, expiration time.Time) bool {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data.get(key)
+	if !ok || (conflict != 0 && (conflict != item.conflict)) {
+		return false
+	}
+	if item.expired(time.Now()) {
+		return false
+	}
+
+	m.em.update(key, item.conflict, item.expirationTime(), expiration)
+	item.expiration = expirationNanos(expiration)
+	m.data.set(key, item)
+	return true
 }
 
 func (m *lockedMap[V]) Update(newItem Item[V]) (V, bool) {
 	m.Lock()
-	item, ok := m.data[newItem.Key]
+	item, ok := m.data.get(newItem.Key)
 	if !ok {
 		m.Unlock()
 		var zero V
 		return zero, false
 	}
-	if newItem.Conflict != 0 && (newItem.Conflict != item.conflict) {
+	if m.conflicts(newItem.Key, item, newItem) {
 		m.Unlock()
 		var zero V
 		return zero, false
 	}
 
-	m.em.update(newItem.Key, newItem.Conflict, item.expiration, newItem.Expiration)
-	m.data[newItem.Key] = storeItem[V]{
+	m.em.update(newItem.Key, newItem.Conflict, item.expirationTime(), newItem.Expiration)
+	m.setConflictHi(newItem.Key, newItem.conflictHi)
+	m.data.set(newItem.Key, storeItem[V]{
 		conflict:   newItem.Conflict,
 		value:      newItem.Value,
-		expiration: newItem.Expiration,
-	}
+		expiration: expirationNanos(newItem.Expiration),
+		meta:       newItem.Meta,
+		created:    item.created,
+		written:    storeNow(),
+		version:    newItem.Version,
+	})
 
 	m.Unlock()
 	return item.value, true
 }
 
-func (m *lockedMap[V]) Clear(onEvict itemCallback[V]) {
+func (m *lockedMap[V]) UpdateIfVersion(newItem Item[V], version uint64) (V, bool) {
 	m.Lock()
-	if onEvict != nil {
-		for key, si := range m.data {
-			onEvict(Item[V]{
-				Key:      key,
-				Conflict: si.conflict,
-				Value:    si.value,
-			})
+	defer m.Unlock()
+	item, ok := m.data.get(newItem.Key)
+	if !ok || item.version != version {
+		var zero V
+		return zero, false
+	}
+	if m.conflicts(newItem.Key, item, newItem) {
+		var zero V
+		return zero, false
+	}
+	if item.expired(time.Now()) {
+		var zero V
+		return zero, false
+	}
+
+	prev := item.value
+	item.value = newItem.Value
+	item.written = storeNow()
+	item.version = newItem.Version
+	m.data.set(newItem.Key, item)
+	return prev, true
+}
+
+func (m *lockedMap[V]) Upsert(i Item[V], fn func(V, bool) (V, bool)) (V, Item[V], bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data.get(i.Key)
+	if ok && m.conflicts(i.Key, item, i) {
+		var zero V
+		return zero, i, false
+	}
+	expired := ok && item.expired(time.Now())
+
+	var prev V
+	if ok && !expired {
+		prev = item.value
+	}
+	value, write := fn(prev, ok && !expired)
+	if !write {
+		var zero V
+		return zero, i, false
+	}
+
+	i.Value = value
+	now := storeNow()
+	created := now
+	switch {
+	case !ok:
+		i.flag = itemStored
+		m.em.add(i.Key, i.Conflict, i.Expiration)
+		m.resetAccessed(i.Key)
+	case expired:
+		i.flag = itemUpdate
+		m.em.update(i.Key, i.Conflict, item.expirationTime(), i.Expiration)
+		m.resetAccessed(i.Key)
+	default:
+		i.flag = itemUpdate
+		i.Expiration = item.expirationTime()
+		i.Meta = item.meta
+		created = item.created
+	}
+	m.setConflictHi(i.Key, i.conflictHi)
+	m.data.set(i.Key, storeItem[V]{
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: expirationNanos(i.Expiration),
+		meta:       i.Meta,
+		created:    created,
+		written:    now,
+		version:    i.Version,
+	})
+	return item.value, i, true
+}
+
+// copyItems appends the keys and items that haven't expired to the given
+// slices.
+func (m *lockedMap[V]) copyItems(keys []uint64, items []storeItem[V]) ([]uint64, []storeItem[V]) {
+	now := time.Now()
+	m.RLock()
+	defer m.RUnlock()
+	m.data.rangeItems(func(key uint64, item storeItem[V]) bool {
+		if !item.expired(now) {
+			keys = append(keys, key)
+			items = append(items, item)
+		}
+		return true
+	})
+	return keys, items
+}
+
+// randomItem returns an item that hasn't expired from a random position of the
+// map, relying on the random iteration order of Go maps. Items in a custom Store
+// are only as random as its Range.
+func (m *lockedMap[V]) randomItem() (uint64, storeItem[V], bool) {
+	now := time.Now()
+	m.RLock()
+	defer m.RUnlock()
+	var key uint64
+	var item storeItem[V]
+	var found bool
+	m.data.rangeItems(func(k uint64, i storeItem[V]) bool {
+		if i.expired(now) {
+			return true
+		}
+		key, item, found = k, i, true
+		return false
+	})
+	return key, item, found
+}
+
+// Clear removes all the items. If onEvict isn't nil, it returns the removed
+// items for the caller to call onEvict for them, unless they're held by a
+// custom Store, for which it calls onEvict itself and returns nil.
+func (m *lockedMap[V]) Clear(onEvict itemCallback[V]) itemMap[V] {
+	m.Lock()
+	defer m.Unlock()
+	if m.accessed != nil {
+		m.accessed = make(map[uint64]*uint32)
+	}
+	if m.conflictHi != nil {
+		m.conflictHi = make(map[uint64]uint64)
+	}
+	old := m.data
+	if inMemory(old) || onEvict == nil {
+		m.data = m.data.clear()
+		if onEvict == nil {
+			return nil
 		}
+		return old
+	}
+	m.data.rangeItems(func(key uint64, si storeItem[V]) bool {
+		onEvict(si.clearedItem(key))
+		return true
+	})
+	m.data = m.data.clear()
+	return nil
+}
+
+// clearedItem returns the item passed to onEvict when it's cleared.
+func (i storeItem[V]) clearedItem(key uint64) Item[V] {
+	return Item[V]{
+		Key:         key,
+		Conflict:    i.conflict,
+		Value:       i.value,
+		Expiration:  i.expirationTime(),
+		Meta:        i.meta,
+		Version:     i.version,
+		EvictReason: EvictCleared,
+		created:     i.created,
+	}
+}
+
+// Store holds the items of one shard of the cache, keyed by the hashes of the
+// keys. It can be used through Config.NewStore to keep the items somewhere
+// other than a Go map, for example to instrument it. The Cost of the items is
+// always zero.
+//
+// The cache locks each Store, so calls that change it are never concurrent with
+// any other call, but Get, Len and Range can be called concurrently with each
+// other, as with a Go map.
+type Store[V any] interface {
+	// Get returns the item of the key.
+	Get(keyHash uint64) (Item[V], bool)
+	// Set adds the item of the key, replacing any previous one.
+	Set(keyHash uint64, item Item[V])
+	// Del removes the item of the key, if any.
+	Del(keyHash uint64)
+	// Range calls fn for every item until fn returns false. The order of the
+	// items should be random for Cache.Sample to be random.
+	Range(fn func(keyHash uint64, item Item[V]) bool)
+	// Len returns the number of items.
+	Len() int
+	// Clear removes all the items.
+	Clear()
+}
+
+// itemMap is the map of a lockedMap.
+type itemMap[V any] interface {
+	get(key uint64) (storeItem[V], bool)
+	set(key uint64, item storeItem[V])
+	del(key uint64)
+	rangeItems(fn func(uint64, storeItem[V]) bool)
+	len() int
+	// clear removes all the items and returns the itemMap to use from then on.
+	clear() itemMap[V]
+}
+
+// inMemory returns true if the items of the itemMap are held in a Go map, so
+// they can be ranged over after they're swapped for an empty map.
+func inMemory[V any](m itemMap[V]) bool {
+	if s, ok := m.(stampedItems[V]); ok {
+		m = s.itemMap
+	}
+	_, ok := m.(mapItems[V])
+	return ok
+}
+
+// mapItems is the default itemMap.
+type mapItems[V any] map[uint64]mapEntry[V]
+
+func (m mapItems[V]) get(key uint64) (storeItem[V], bool) {
+	e, ok := m[key]
+	return e.item(), ok
+}
+
+func (m mapItems[V]) set(key uint64, item storeItem[V]) {
+	m[key] = item.entry()
+}
+
+func (m mapItems[V]) del(key uint64) {
+	delete(m, key)
+}
+
+func (m mapItems[V]) rangeItems(fn func(uint64, storeItem[V]) bool) {
+	for key, e := range m {
+		if !fn(key, e.item()) {
+			return
+		}
+	}
+}
+
+func (m mapItems[V]) len() int {
+	return len(m)
+}
+
+func (m mapItems[V]) clear() itemMap[V] {
+	// Allocate a new map to release the memory of the old one.
+	return make(mapItems[V])
+}
+
+// stampedItems is an itemMap keeping the versions and the write times of the
+// items apart from them, in maps of their own, so they take no memory unless
+// Config.TrackVersions and Config.TrackWrites are set. Either map can be nil.
+type stampedItems[V any] struct {
+	itemMap[V]
+	versions map[uint64]uint64
+	times    map[uint64]itemTimes
+}
+
+// itemTimes are the storeItem.created and storeItem.written of an item.
+type itemTimes struct {
+	created uint32
+	written uint32
+}
+
+// stamp sets the fields of the item kept apart.
+func (m stampedItems[V]) stamp(key uint64, item *storeItem[V]) {
+	if m.versions != nil {
+		item.version = m.versions[key]
+	}
+	if m.times != nil {
+		t := m.times[key]
+		item.created, item.written = t.created, t.written
+	}
+}
+
+func (m stampedItems[V]) get(key uint64) (storeItem[V], bool) {
+	item, ok := m.itemMap.get(key)
+	if ok {
+		m.stamp(key, &item)
+	}
+	return item, ok
+}
+
+func (m stampedItems[V]) set(key uint64, item storeItem[V]) {
+	m.itemMap.set(key, item)
+	if m.versions != nil {
+		m.versions[key] = item.version
+	}
+	if m.times != nil {
+		m.times[key] = itemTimes{created: item.created, written: item.written}
+	}
+}
+
+func (m stampedItems[V]) del(key uint64) {
+	m.itemMap.del(key)
+	delete(m.versions, key)
+	delete(m.times, key)
+}
+
+func (m stampedItems[V]) rangeItems(fn func(uint64, storeItem[V]) bool) {
+	m.itemMap.rangeItems(func(key uint64, item storeItem[V]) bool {
+		m.stamp(key, &item)
+		return fn(key, item)
+	})
+}
+
+func (m stampedItems[V]) clear() itemMap[V] {
+	// Allocate new maps, the old ones may still be ranged over.
+	s := stampedItems[V]{itemMap: m.itemMap.clear()}
+	if m.versions != nil {
+		s.versions = make(map[uint64]uint64)
+	}
+	if m.times != nil {
+		s.times = make(map[uint64]itemTimes)
+	}
+	return s
+}
+
+// storeItems is the itemMap of a custom Store.
+type storeItems[V any] struct {
+	s Store[V]
+}
+
+func (m storeItems[V]) get(key uint64) (storeItem[V], bool) {
+	item, ok := m.s.Get(key)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+	return toStoreItem(item), true
+}
+
+func (m storeItems[V]) set(key uint64, item storeItem[V]) {
+	m.s.Set(key, item.toItem(key))
+}
+
+func (m storeItems[V]) del(key uint64) {
+	m.s.Del(key)
+}
+
+func (m storeItems[V]) rangeItems(fn func(uint64, storeItem[V]) bool) {
+	m.s.Range(func(key uint64, item Item[V]) bool {
+		return fn(key, toStoreItem(item))
+	})
+}
+
+func (m storeItems[V]) len() int {
+	return m.s.Len()
+}
+
+func (m storeItems[V]) clear() itemMap[V] {
+	m.s.Clear()
+	return m
+}
+
+func toStoreItem[V any](i Item[V]) storeItem[V] {
+	return storeItem[V]{
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: expirationNanos(i.Expiration),
+		meta:       i.Meta,
+		created:    i.created,
+		written:    i.written,
+		version:    i.Version,
+	}
+}
+
+func (i storeItem[V]) toItem(key uint64) Item[V] {
+	return Item[V]{
+		Key:        key,
+		Conflict:   i.conflict,
+		Value:      i.value,
+		Expiration: i.expirationTime(),
+		Meta:       i.meta,
+		Version:    i.version,
+		created:    i.created,
+		written:    i.written,
 	}
-	m.data = make(map[uint64]storeItem[V])
-	m.Unlock()
 }
@@ -4,6 +4,7 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/paivagustavo/ristretto/z"
 	"github.com/stretchr/testify/require"
@@ -119,13 +120,114 @@ func TestStoreUpdate(t *testing.T) {
 	require.Equal(t, val, 0)
 }
 
+func TestStoreUpsert(t *testing.T) {
+	s := newStore[int]()
+	key, conflict := z.KeyToHash(1)
+	add := func(old int, _ bool) (int, bool) { return old + 1, true }
+
+	_, i, ok := s.Upsert(Item[int]{Key: key, Conflict: conflict, Meta: 1}, add)
+	require.True(t, ok)
+	require.Equal(t, itemStored, i.flag)
+	require.Equal(t, 1, i.Value)
+
+	prev, i, ok := s.Upsert(Item[int]{Key: key, Conflict: conflict, Meta: 2}, add)
+	require.True(t, ok)
+	require.Equal(t, itemUpdate, i.flag)
+	require.Equal(t, 1, prev)
+	require.Equal(t, 2, i.Value)
+	// The metadata of an existing item is kept.
+	require.Equal(t, uint32(1), i.Meta)
+
+	_, _, ok = s.Upsert(Item[int]{Key: key, Conflict: conflict}, func(int, bool) (int, bool) {
+		return 0, false
+	})
+	require.False(t, ok)
+	val, ok := s.Get(key, conflict)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+
+	_, _, ok = s.Upsert(Item[int]{Key: key, Conflict: conflict + 1}, add)
+	require.False(t, ok)
+}
+
+// testStore is a Store counting the items set.
+type testStore struct {
+	items map[uint64]Item[int]
+	sets  *int64
+}
+
+func (s testStore) Get(key uint64) (Item[int], bool) {
+	item, ok := s.items[key]
+	return item, ok
+}
+
+func (s testStore) Set(key uint64, item Item[int]) {
+	atomic.AddInt64(s.sets, 1)
+	s.items[key] = item
+}
+
+func (s testStore) Del(key uint64) {
+	delete(s.items, key)
+}
+
+func (s testStore) Range(fn func(uint64, Item[int]) bool) {
+	for key, item := range s.items {
+		if !fn(key, item) {
+			return
+		}
+	}
+}
+
+func (s testStore) Len() int {
+	return len(s.items)
+}
+
+func (s testStore) Clear() {
+	for key := range s.items {
+		delete(s.items, key)
+	}
+}
+
+func TestStoreCustom(t *testing.T) {
+	var sets int64
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		NewStore: func() Store[int] {
+			return testStore{items: make(map[uint64]Item[int]), sets: &sets}
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	expiration := time.Now().Add(time.Hour)
+	require.True(t, c.SetWithMeta(1, 1, 1, time.Hour, 7))
+	c.Wait()
+	val, meta, ok := c.GetWithMeta(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, uint32(7), meta)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.WithinDuration(t, expiration, time.Now().Add(ttl), time.Second)
+	require.Equal(t, int64(1), atomic.LoadInt64(&sets))
+
+	c.Del(1)
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 0, c.store.ShardLens()[1])
+}
+
 func TestStoreCollision(t *testing.T) {
-	s := newShardedMap[int]()
+	s := newShardedMap[int](nil, nil)
 	s.shards[1].Lock()
-	s.shards[1].data[1] = storeItem[int]{
+	s.shards[1].data.set(1, storeItem[int]{
 		conflict: 0,
 		value:    1,
-	}
+	})
 	s.shards[1].Unlock()
 	val, ok := s.Get(1, 1)
 	require.False(t, ok)
@@ -168,8 +270,9 @@ func TestStoreExpiration(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, 1, val)
 
+	// The monotonic clock reading isn't stored, so compare the instants only.
 	ttl := s.Expiration(key)
-	require.Equal(t, expiration, ttl)
+	require.True(t, expiration.Equal(ttl))
 
 	s.Del(key, conflict)
 
@@ -183,6 +286,67 @@ func TestStoreExpiration(t *testing.T) {
 	require.True(t, ttl.IsZero())
 }
 
+func TestStoreCleanupLimit(t *testing.T) {
+	s := newStore[int]()
+	p := newDefaultPolicy[int](100, 10, policyOptions{})
+	defer p.Close()
+
+	// Put the items in the bucket picked by the next cleanup pass.
+	expiration := time.Now().Add(-time.Duration(bucketDurationSecs) * time.Second)
+	for i := 0; i < 10; i++ {
+		key, conflict := z.KeyToHash(i)
+		s.Set(Item[int]{
+			Key:        key,
+			Conflict:   conflict,
+			Value:      i,
+			Expiration: expiration,
+		})
+	}
+
+	var evicted int
+	onEvict := func(Item[int]) { evicted++ }
+	s.Cleanup(p, onEvict, 4, 0)
+	require.Equal(t, 4, evicted)
+	s.Cleanup(p, onEvict, 4, 0)
+	require.Equal(t, 8, evicted)
+	s.Cleanup(p, onEvict, 4, 0)
+	require.Equal(t, 10, evicted)
+	s.Cleanup(p, onEvict, 4, 0)
+	require.Equal(t, 10, evicted)
+}
+
+func TestStoreCleanupWorkers(t *testing.T) {
+	s := newStore[int]()
+	p := newDefaultPolicy[int](10000, 10000, policyOptions{})
+	defer p.Close()
+
+	const n = 4 * minCleanupWorkerItems
+	expiration := time.Now().Add(-time.Duration(bucketDurationSecs) * time.Second)
+	for i := 0; i < n; i++ {
+		key, conflict := z.KeyToHash(i)
+		p.Add(key, 1)
+		s.Set(Item[int]{
+			Key:        key,
+			Conflict:   conflict,
+			Value:      i,
+			Expiration: expiration,
+		})
+	}
+
+	// onEvict is called from this goroutine only, so it needs no lock.
+	evicted := make(map[int]bool)
+	onEvict := func(item Item[int]) {
+		require.Equal(t, int64(1), item.Cost)
+		evicted[item.Value] = true
+	}
+	require.Equal(t, n-101, s.Cleanup(p, onEvict, 101, 4))
+	require.Len(t, evicted, 101)
+	require.Zero(t, s.Cleanup(p, onEvict, 0, 4))
+	require.Len(t, evicted, n)
+	require.Zero(t, p.Used())
+	require.Zero(t, s.ExpiringLen())
+}
+
 func BenchmarkStoreGet(b *testing.B) {
 	b.ReportAllocs()
 	s := newStore[int]()
@@ -243,3 +407,65 @@ func BenchmarkStoreUpdate(b *testing.B) {
 		}
 	})
 }
+
+func TestStoreCreated(t *testing.T) {
+	s := newShardedMap[int](nil, nil)
+	s.trackWrites()
+	key, conflict := z.KeyToHash(1)
+	s.Set(Item[int]{Key: key, Conflict: conflict, Value: 1})
+	item, ok := s.GetItem(key, conflict, 0)
+	require.True(t, ok)
+	require.NotZero(t, item.created)
+	age := storeAge(item.created, time.Now())
+	require.True(t, age >= 0 && age <= time.Second)
+
+	// Updates keep the creation time.
+	created := item.created
+	s.Set(Item[int]{Key: key, Conflict: conflict, Value: 2})
+	item, _ = s.GetItem(key, conflict, 0)
+	require.Equal(t, created, item.created)
+	require.NotZero(t, item.written)
+
+	require.Zero(t, storeAge(0, time.Now()))
+}
+
+func TestStoreTouch(t *testing.T) {
+	s := newShardedMap[int](nil, nil)
+	key, conflict := z.KeyToHash(1)
+	s.Set(Item[int]{Key: key, Conflict: conflict, Value: 1})
+	// Nothing is recorded unless access times are tracked.
+	require.Zero(t, s.Touch(key))
+	require.Zero(t, s.Touch(key))
+
+	s.trackAccess()
+	key, conflict = z.KeyToHash(2)
+	s.Set(Item[int]{Key: key, Conflict: conflict, Value: 2})
+	require.Zero(t, s.Touch(key))
+	require.Equal(t, storeNow(), s.Touch(key))
+
+	// The access time is kept by updates and dropped with the item.
+	s.Set(Item[int]{Key: key, Conflict: conflict, Value: 3})
+	require.Equal(t, storeNow(), s.Touch(key))
+	s.Del(key, conflict)
+	require.Empty(t, s.shards[key%numShards].accessed)
+}
+
+func TestStoreItemSize(t *testing.T) {
+	// The 128-bit conflict hashes, the access, creation and write times and
+	// the versions are kept apart, so the items don't grow when they aren't
+	// used.
+	require.Equal(t, uintptr(24), unsafe.Sizeof(mapEntry[struct{}]{}))
+	require.Equal(t, int64(24), itemSize)
+
+	s := newShardedMap[int](nil, nil)
+	s.wideConflict()
+	key, conflict := z.KeyToHash(1)
+	s.Set(Item[int]{Key: key, Conflict: conflict, conflictHi: 1, Value: 1})
+	_, ok := s.GetItem(key, conflict, 2)
+	require.False(t, ok)
+	require.True(t, s.Conflicts(Item[int]{Key: key, Conflict: conflict, conflictHi: 2}))
+	_, ok = s.GetItem(key, conflict, 1)
+	require.True(t, ok)
+	s.Del(key, conflict)
+	require.Empty(t, s.shards[key%numShards].conflictHi)
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync/atomic"
+
+// Overflow says what a Subscription does when its buffer is full.
+type Overflow int
+
+const (
+	// OverflowDropNewest drops the mutations that don't fit. It's the default.
+	OverflowDropNewest Overflow = iota
+	// OverflowDropOldest drops the oldest mutation buffered to make room.
+	OverflowDropOldest
+	// OverflowClose closes the subscription, for consumers that can't miss
+	// any mutation and would rather start over, for example by rebuilding
+	// from the cache and subscribing again.
+	OverflowClose
+)
+
+// SubscribeOptions are the options of Cache.Subscribe.
+type SubscribeOptions struct {
+	// Buffer is the number of mutations buffered for the subscriber. It
+	// defaults to 1024.
+	Buffer int
+	// Overflow says what to do when the buffer is full.
+	Overflow Overflow
+}
+
+// Subscription is a stream of the mutations of a cache, returned by
+// Cache.Subscribe.
+type Subscription[V any] struct {
+	// dropped is the number of mutations dropped. It's the first field so
+	// it's aligned for use with atomic.
+	dropped uint64
+	// C receives the mutations, in order. It's closed when the subscription
+	// is closed.
+	C <-chan Mutation[V]
+
+	ch       chan Mutation[V]
+	filter   func(Mutation[V]) bool
+	overflow Overflow
+	m        *mutations[V]
+	closed   bool
+}
+
+// Subscribe returns a Subscription receiving the mutations of the cache for
+// which filter returns true, or all of them if filter is nil, like
+// Config.OnMutation. Their sequence numbers have gaps where filter dropped
+// mutations, and where the subscription did if its buffer overflowed.
+// filter is called while holding a lock, so it must be fast and must not call
+// the cache. The subscription must be closed once it isn't needed.
+func (c *Cache[K, V]) Subscribe(filter func(Mutation[V]) bool, opts SubscribeOptions) *Subscription[V] {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 1024
+	}
+	ch := make(chan Mutation[V], opts.Buffer)
+	s := &Subscription[V]{
+		C:        ch,
+		ch:       ch,
+		filter:   filter,
+		overflow: opts.Overflow,
+		m:        &mutations[V]{},
+	}
+	if c == nil || c.isClosed {
+		// Nothing will ever be sent.
+		s.closed = true
+		close(ch)
+		return s
+	}
+	s.m = c.mutations
+	s.m.mu.Lock()
+	s.m.subscriptions = append(s.m.subscriptions, s)
+	atomic.AddInt32(&s.m.subs, 1)
+	s.m.mu.Unlock()
+	return s
+}
+
+// Dropped returns the number of mutations dropped because the buffer was
+// full.
+func (s *Subscription[V]) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the subscription and closes C. It can be called more than once.
+func (s *Subscription[V]) Close() {
+	s.m.mu.Lock()
+	s.m.remove(s)
+	s.m.mu.Unlock()
+}
+
+// send buffers the mutation if the filter takes it. It returns false if the
+// subscription must be closed. It's called with s.m.mu held.
+func (s *Subscription[V]) send(mut Mutation[V]) bool {
+	if s.filter != nil && !s.filter(mut) {
+		return true
+	}
+	select {
+	case s.ch <- mut:
+		return true
+	default:
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	switch s.overflow {
+	case OverflowDropOldest:
+		// The consumer may take a mutation meanwhile, so don't wait for
+		// either.
+		select {
+		case <-s.ch:
+		default:
+		}
+		select {
+		case s.ch <- mut:
+		default:
+		}
+	case OverflowClose:
+		return false
+	}
+	return true
+}
+
+// closeAll closes every subscription, when the cache is closed.
+func (m *mutations[V]) closeAll() {
+	m.mu.Lock()
+	for len(m.subscriptions) > 0 {
+		m.remove(m.subscriptions[0])
+	}
+	m.mu.Unlock()
+}
+
+// remove removes the subscription and closes its channel, if it's not closed
+// already. m.mu must be held.
+func (m *mutations[V]) remove(s *Subscription[V]) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	for n, sub := range m.subscriptions {
+		if sub == s {
+			m.subscriptions = append(m.subscriptions[:n], m.subscriptions[n+1:]...)
+			break
+		}
+	}
+	atomic.AddInt32(&m.subs, -1)
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"time"
+)
+
+// tombstones remembers the keys deleted recently, see Config.TombstoneTTL. A
+// nil *tombstones remembers nothing.
+type tombstones struct {
+	sync.RWMutex
+	ttl time.Duration
+	// keys maps the hashes of the keys to the time their tombstone expires,
+	// in Unix nanoseconds.
+	keys map[uint64]int64
+}
+
+func newTombstones(ttl time.Duration) *tombstones {
+	if ttl <= 0 {
+		return nil
+	}
+	return &tombstones{
+		ttl:  ttl,
+		keys: make(map[uint64]int64),
+	}
+}
+
+// memoryUsage estimates the memory taken by the tombstones in bytes.
+func (t *tombstones) memoryUsage() uint64 {
+	if t == nil {
+		return 0
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return mapBytes(len(t.keys), 8, 8)
+}
+
+// add leaves a tombstone for the key.
+func (t *tombstones) add(key uint64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	t.keys[key] = time.Now().Add(t.ttl).UnixNano()
+	t.Unlock()
+}
+
+// has returns true if the key has a tombstone that hasn't expired.
+func (t *tombstones) has(key uint64) bool {
+	if t == nil {
+		return false
+	}
+	t.RLock()
+	expiration, ok := t.keys[key]
+	t.RUnlock()
+	return ok && time.Now().UnixNano() <= expiration
+}
+
+// cleanup removes the tombstones that expired.
+func (t *tombstones) cleanup() {
+	if t == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	t.Lock()
+	for key, expiration := range t.keys {
+		if now > expiration {
+			delete(t.keys, key)
+		}
+	}
+	t.Unlock()
+}
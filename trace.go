@@ -0,0 +1,45 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// TraceOp names an internal operation reported to Config.Trace.
+type TraceOp string
+
+const (
+	// TraceWait is a call to Wait, blocked until the Set buffer is drained.
+	TraceWait TraceOp = "wait"
+	// TraceCleanup is a pass of the TTL cleanup removing expired items.
+	TraceCleanup TraceOp = "cleanup"
+	// TraceEvict is the removal of the items the policy evicted to make room
+	// for a new one.
+	TraceEvict TraceOp = "evict"
+)
+
+// noopTrace is returned by trace when there's no Config.Trace.
+func noopTrace() {}
+
+// trace reports the start of op to Config.Trace and returns the function to
+// call when op ends.
+func (c *Cache[K, V]) trace(op TraceOp) func() {
+	if c.onTrace == nil {
+		return noopTrace
+	}
+	if end := c.onTrace(op); end != nil {
+		return end
+	}
+	return noopTrace
+}
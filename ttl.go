@@ -17,6 +17,7 @@
 package ristretto
 
 import (
+	"container/heap"
 	"sync"
 	"time"
 )
@@ -26,6 +27,10 @@ var (
 	bucketDurationSecs = int64(5)
 )
 
+// minCleanupWorkerItems is the least number of expired items given to each
+// cleanup worker, so that small cleanups don't pay for starting goroutines.
+const minCleanupWorkerItems = 256
+
 func storageBucket(t time.Time) int64 {
 	return (t.Unix() / bucketDurationSecs) + 1
 }
@@ -43,6 +48,17 @@ type bucket map[uint64]uint64
 type expirationMap[V any] struct {
 	sync.RWMutex
 	buckets map[int64]bucket
+	// pending holds the expired keys a previous cleanup pass didn't get to
+	// because it reached its limit. They are carried over to the next pass.
+	pending bucket
+	// queue orders the keys by expiration when precise expiration is enabled,
+	// and wake is signaled when the earliest expiration in it changes.
+	queue *expiryQueue
+	wake  chan struct{}
+	// prof records how long the lock is held during contention profiles, and
+	// locked is when it was locked if a profile was running then.
+	prof   *contention
+	locked time.Time
 }
 
 func newExpirationMap[V any]() *expirationMap[V] {
@@ -51,6 +67,85 @@ func newExpirationMap[V any]() *expirationMap[V] {
 	}
 }
 
+// Lock locks the map, noting the time if a contention profile is running.
+func (m *expirationMap[V]) Lock() {
+	m.RWMutex.Lock()
+	if m.prof.enabled() {
+		m.locked = time.Now()
+	}
+}
+
+// Unlock unlocks the map, recording how long it was held if it was locked
+// during a contention profile.
+func (m *expirationMap[V]) Unlock() {
+	if !m.locked.IsZero() {
+		m.prof.emHold.add(time.Since(m.locked))
+		m.locked = time.Time{}
+	}
+	m.RWMutex.Unlock()
+}
+
+// enablePrecise makes the map order the keys by their exact expiration, see
+// Config.PreciseExpiration. It returns the channel signaled when the earliest
+// expiration changes.
+func (m *expirationMap[V]) enablePrecise() <-chan struct{} {
+	m.queue = &expiryQueue{pos: make(map[uint64]int)}
+	m.wake = make(chan struct{}, 1)
+	return m.wake
+}
+
+// schedule puts the key in the queue, if any, at its new expiration. It must
+// be called while holding the lock.
+func (m *expirationMap[V]) schedule(key, conflict uint64, expiration time.Time) {
+	if m.queue == nil {
+		return
+	}
+	if expiration.IsZero() {
+		m.queue.remove(key)
+		return
+	}
+	if m.queue.set(key, conflict, expiration.UnixNano()) == 0 {
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due removes from the queue the keys whose expiration has passed and returns
+// them, along with the earliest expiration left or the zero time if none is.
+func (m *expirationMap[V]) due(now time.Time) (bucket, time.Time) {
+	if m == nil || m.queue == nil {
+		return nil, time.Time{}
+	}
+	m.Lock()
+	defer m.Unlock()
+	var keys bucket
+	nanos := now.UnixNano()
+	for m.queue.Len() > 0 && m.queue.entries[0].expiration < nanos {
+		e := heap.Pop(m.queue).(expiryEntry)
+		if keys == nil {
+			keys = make(bucket)
+		}
+		keys[e.key] = e.conflict
+	}
+	if m.queue.Len() == 0 {
+		return keys, time.Time{}
+	}
+	return keys, time.Unix(0, m.queue.entries[0].expiration)
+}
+
+// len returns the number of keys with an expiration.
+func (m *expirationMap[V]) len() int {
+	m.RLock()
+	defer m.RUnlock()
+	n := len(m.pending)
+	for _, b := range m.buckets {
+		n += len(b)
+	}
+	return n
+}
+
 func (m *expirationMap[V]) add(key, conflict uint64, expiration time.Time) {
 	if m == nil {
 		return
@@ -71,6 +166,7 @@ func (m *expirationMap[V]) add(key, conflict uint64, expiration time.Time) {
 		m.buckets[bucketNum] = b
 	}
 	b[key] = conflict
+	m.schedule(key, conflict, expiration)
 }
 
 func (m *expirationMap[V]) update(key, conflict uint64, oldExpTime, newExpTime time.Time) {
@@ -94,6 +190,7 @@ func (m *expirationMap[V]) update(key, conflict uint64, oldExpTime, newExpTime t
 		m.buckets[newBucketNum] = newBucket
 	}
 	newBucket[key] = conflict
+	m.schedule(key, conflict, newExpTime)
 }
 
 func (m *expirationMap[V]) del(key uint64, expiration time.Time) {
@@ -104,6 +201,9 @@ func (m *expirationMap[V]) del(key uint64, expiration time.Time) {
 	bucketNum := storageBucket(expiration)
 	m.Lock()
 	defer m.Unlock()
+	if m.queue != nil {
+		m.queue.remove(key)
+	}
 	_, ok := m.buckets[bucketNum]
 	if !ok {
 		return
@@ -114,9 +214,17 @@ func (m *expirationMap[V]) del(key uint64, expiration time.Time) {
 // cleanup removes all the items in the bucket that was just completed. It deletes
 // those items from the store, and calls the onEvict function on those items.
 // This function is meant to be called periodically.
-func (m *expirationMap[V]) cleanup(store store[V], policy policy[V], onEvict itemCallback[V]) {
+//
+// If limit is greater than zero, at most limit items are removed and the rest
+// are carried over to the next call. It returns the number of items carried over.
+//
+// If workers is greater than one and there are enough items, they are removed
+// by that many goroutines, each taking a share of the items and of the limit.
+// onEvict is still called from the calling goroutine only.
+func (m *expirationMap[V]) cleanup(store store[V], policy policy[V], onEvict itemCallback[V],
+	limit, workers int) int {
 	if m == nil {
-		return
+		return 0
 	}
 
 	m.Lock()
@@ -124,24 +232,175 @@ func (m *expirationMap[V]) cleanup(store store[V], policy policy[V], onEvict ite
 	bucketNum := cleanupBucket(now)
 	keys := m.buckets[bucketNum]
 	delete(m.buckets, bucketNum)
+	if len(m.pending) > 0 {
+		for key, conflict := range keys {
+			m.pending[key] = conflict
+		}
+		keys = m.pending
+	}
+	m.pending = nil
 	m.Unlock()
 
+	if n := len(keys) / minCleanupWorkerItems; workers > n {
+		workers = n
+	}
+	if limit > 0 && workers > limit {
+		workers = limit
+	}
+	var leftover bucket
+	if workers <= 1 {
+		leftover = expireKeys(keys, now, store, policy, onEvict, limit)
+	} else {
+		parts := make([]bucket, workers)
+		for i := range parts {
+			parts[i] = make(bucket, len(keys)/workers+1)
+		}
+		for key, conflict := range keys {
+			parts[key%uint64(workers)][key] = conflict
+		}
+		expired := make([][]Item[V], workers)
+		leftovers := make([]bucket, workers)
+		var wg sync.WaitGroup
+		for i := range parts {
+			// Spread the limit so the shares add up to it.
+			partLimit := 0
+			if limit > 0 {
+				partLimit = limit / workers
+				if i < limit%workers {
+					partLimit++
+				}
+			}
+			wg.Add(1)
+			go func(i, partLimit int) {
+				defer wg.Done()
+				leftovers[i] = expireKeys(parts[i], now, store, policy, func(item Item[V]) {
+					expired[i] = append(expired[i], item)
+				}, partLimit)
+			}(i, partLimit)
+		}
+		wg.Wait()
+		for i := range parts {
+			if onEvict != nil {
+				for _, item := range expired[i] {
+					onEvict(item)
+				}
+			}
+			for key, conflict := range leftovers[i] {
+				if leftover == nil {
+					leftover = make(bucket)
+				}
+				leftover[key] = conflict
+			}
+		}
+	}
+
+	if len(leftover) > 0 {
+		m.Lock()
+		m.pending = leftover
+		m.Unlock()
+	}
+	return len(leftover)
+}
+
+// expireKeys removes the keys whose expiration has passed by now from the
+// store and the policy and calls onEvict for them. If limit is greater than
+// zero, at most limit items are removed, and it returns the keys left.
+func expireKeys[V any](keys bucket, now time.Time, store store[V], policy policy[V],
+	onEvict itemCallback[V], limit int) bucket {
+	var removed int
+	var leftover bucket
 	for key, conflict := range keys {
+		if limit > 0 && removed >= limit {
+			if leftover == nil {
+				leftover = make(bucket, len(keys)-removed)
+			}
+			leftover[key] = conflict
+			continue
+		}
+
 		// Sanity check. Verify that the store agrees that this key is expired.
-		if store.Expiration(key).After(now) {
+		// A zero expiration means the key was deleted or its TTL removed since
+		// it was put in the bucket.
+		if expiration := store.Expiration(key); expiration.IsZero() || expiration.After(now) {
 			continue
 		}
 
 		cost := policy.Cost(key)
 		policy.Del(key)
-		_, value := store.Del(key, conflict)
+		item := store.Del(key, conflict)
+		removed++
 
 		if onEvict != nil {
 			onEvict(Item[V]{Key: key,
-				Conflict: conflict,
-				Value:    value,
-				Cost:     cost,
+				Conflict:    conflict,
+				Value:       item.value,
+				Cost:        cost,
+				Meta:        item.meta,
+				Version:     item.version,
+				EvictReason: EvictExpired,
+				created:     item.created,
 			})
 		}
 	}
+	return leftover
+}
+
+// expiryEntry is a key in an expiryQueue.
+type expiryEntry struct {
+	key, conflict uint64
+	// expiration is in Unix nanoseconds, like storeItem.expiration.
+	expiration int64
+}
+
+// expiryQueue is a min-heap of keys ordered by expiration, keeping track of
+// the position of each key so it can be moved or removed.
+type expiryQueue struct {
+	entries []expiryEntry
+	pos     map[uint64]int
+}
+
+func (q *expiryQueue) Len() int { return len(q.entries) }
+
+func (q *expiryQueue) Less(i, j int) bool {
+	return q.entries[i].expiration < q.entries[j].expiration
+}
+
+func (q *expiryQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.pos[q.entries[i].key] = i
+	q.pos[q.entries[j].key] = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(expiryEntry)
+	q.pos[e.key] = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	n := len(q.entries) - 1
+	e := q.entries[n]
+	q.entries = q.entries[:n]
+	delete(q.pos, e.key)
+	return e
+}
+
+// set adds the key to the queue or moves it to its new expiration, and
+// returns its position.
+func (q *expiryQueue) set(key, conflict uint64, expiration int64) int {
+	if i, ok := q.pos[key]; ok {
+		q.entries[i].conflict = conflict
+		q.entries[i].expiration = expiration
+		heap.Fix(q, i)
+	} else {
+		heap.Push(q, expiryEntry{key: key, conflict: conflict, expiration: expiration})
+	}
+	return q.pos[key]
+}
+
+// remove removes the key from the queue, if it's there.
+func (q *expiryQueue) remove(key uint64) {
+	if i, ok := q.pos[key]; ok {
+		heap.Remove(q, i)
+	}
 }
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "fmt"
+
+const (
+	// tuneCountersPerItem is the number of counters recommended per item, as
+	// per the documentation of Config.NumCounters.
+	tuneCountersPerItem = 10
+	// tuneGetsDroppedRatio is the GetsDroppedRatio above which a larger
+	// BufferItems is recommended.
+	tuneGetsDroppedRatio = 0.1
+	// tuneFullRatio is the part of MaxCost above which the cache is considered
+	// full.
+	tuneFullRatio = 0.9
+	// tuneHitRatio is the hit ratio below which a full cache that evicts items
+	// is recommended a larger MaxCost.
+	tuneHitRatio = 0.5
+)
+
+// Tuning holds the Config values recommended by Tune. Values that don't need to
+// change are the current ones.
+type Tuning struct {
+	NumCounters int64
+	BufferItems int64
+	MaxCost     int64
+	// Reasons explains each recommended change, one sentence per change.
+	Reasons []string
+}
+
+// Tune analyzes the current state and metrics of the cache and recommends
+// Config values for the workload it has seen so far. It's advisory only: the
+// cache isn't changed. The recommendations based on metrics are only made if
+// Config.Metrics is true, and they're only meaningful after the cache has seen
+// a representative amount of traffic.
+func (c *Cache[K, V]) Tune() Tuning {
+	if c == nil || c.isClosed {
+		return Tuning{}
+	}
+	t := Tuning{
+		NumCounters: c.numCounters,
+		BufferItems: c.bufferItems,
+		MaxCost:     c.policy.MaxCost(),
+	}
+
+	// Estimate the number of items the cache holds when full.
+	items := int64(c.policy.Len())
+	if used := c.policy.Used(); used > 0 && used < t.MaxCost {
+		items = items * t.MaxCost / used
+	}
+	if n := items * tuneCountersPerItem; n > t.NumCounters {
+		t.NumCounters = n
+		t.Reasons = append(t.Reasons, fmt.Sprintf("The cache holds about %d items "+
+			"when full, so NumCounters should be %d times that.", items,
+			tuneCountersPerItem))
+	}
+
+	if c.Metrics == nil {
+		return t
+	}
+	if ratio := c.Metrics.GetsDroppedRatio(); ratio > tuneGetsDroppedRatio {
+		t.BufferItems *= 2
+		t.Reasons = append(t.Reasons, fmt.Sprintf("%.0f%% of the Get counter "+
+			"increments are dropped, so BufferItems should be larger.", ratio*100))
+	}
+	full := float64(c.policy.Used()) >= float64(t.MaxCost)*tuneFullRatio
+	if ratio := c.Metrics.Ratio(); full && c.Metrics.KeysEvicted() > 0 &&
+		ratio < tuneHitRatio {
+		t.MaxCost *= 2
+		t.Reasons = append(t.Reasons, fmt.Sprintf("The cache is full and evicts "+
+			"items with a hit ratio of %.0f%%, so a larger MaxCost may help.",
+			ratio*100))
+	}
+	return t
+}
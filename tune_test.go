@@ -0,0 +1,37 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheTune(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        10,
+		MaxCost:            4,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	retrySet(t, c, 1, 1, 1, 0)
+	retrySet(t, c, 2, 2, 1, 0)
+	tuning := c.Tune()
+	// Two items take half of MaxCost, so the cache holds about four.
+	require.Equal(t, int64(40), tuning.NumCounters)
+	require.Equal(t, int64(64), tuning.BufferItems)
+	require.Equal(t, int64(4), tuning.MaxCost)
+	require.Len(t, tuning.Reasons, 1)
+
+	for i := 3; i < 20; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+		c.Get(100 + i)
+	}
+	tuning = c.Tune()
+	require.Equal(t, int64(8), tuning.MaxCost)
+	require.Len(t, tuning.Reasons, 2)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// KeyEvent tells why the value of a key watched with Cache.WatchKey went away.
+type KeyEvent byte
+
+const (
+	// KeyEvicted means the eviction policy evicted the key to make room.
+	KeyEvicted KeyEvent = iota + 1
+	// KeyExpired means the TTL of the key passed.
+	KeyExpired
+	// KeyCleared means the cache was cleared.
+	KeyCleared
+	// KeyReplaced means the key was written with a new value.
+	KeyReplaced
+)
+
+// keyEvent returns the KeyEvent of the eviction reason.
+func keyEvent(reason EvictReason) KeyEvent {
+	switch reason {
+	case EvictExpired:
+		return KeyExpired
+	case EvictCleared:
+		return KeyCleared
+	default:
+		return KeyEvicted
+	}
+}
+
+// WatchID identifies a watcher added with Cache.WatchKey.
+type WatchID uint64
+
+type keyWatcher[V any] struct {
+	id       WatchID
+	conflict uint64
+	fn       func(KeyEvent, V)
+}
+
+// keyWatchers holds the watchers added to a cache by key hash.
+type keyWatchers[V any] struct {
+	// n is the number of watchers, read without holding mu so caches without
+	// watchers don't take the lock.
+	n     int32
+	mu    sync.RWMutex
+	next  WatchID
+	byKey map[uint64][]keyWatcher[V]
+	keys  map[WatchID]uint64
+}
+
+func (w *keyWatchers[V]) add(key, conflict uint64, fn func(KeyEvent, V)) WatchID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.byKey == nil {
+		w.byKey = make(map[uint64][]keyWatcher[V])
+		w.keys = make(map[WatchID]uint64)
+	}
+	w.next++
+	w.byKey[key] = append(w.byKey[key], keyWatcher[V]{id: w.next, conflict: conflict, fn: fn})
+	w.keys[w.next] = key
+	atomic.AddInt32(&w.n, 1)
+	return w.next
+}
+
+func (w *keyWatchers[V]) remove(id WatchID) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key, ok := w.keys[id]
+	if !ok {
+		return false
+	}
+	delete(w.keys, id)
+	old := w.byKey[key]
+	list := make([]keyWatcher[V], 0, len(old)-1)
+	for _, kw := range old {
+		if kw.id != id {
+			list = append(list, kw)
+		}
+	}
+	if len(list) == 0 {
+		delete(w.byKey, key)
+	} else {
+		w.byKey[key] = list
+	}
+	atomic.AddInt32(&w.n, -1)
+	return true
+}
+
+// call calls the watchers of the key. The lists are replaced rather than
+// changed, so the watchers are called without holding the lock and can remove
+// themselves.
+func (w *keyWatchers[V]) call(key, conflict uint64, event KeyEvent, old V) {
+	if atomic.LoadInt32(&w.n) == 0 {
+		return
+	}
+	w.mu.RLock()
+	list := w.byKey[key]
+	w.mu.RUnlock()
+	for _, kw := range list {
+		if conflict == 0 || kw.conflict == 0 || kw.conflict == conflict {
+			kw.fn(event, old)
+		}
+	}
+}
+
+// WatchKey adds a function called with the previous value of the key whenever
+// it's evicted, expires, is cleared or is replaced by a new value, and returns
+// the ID to remove it with. Deleting the key doesn't call it. Unlike
+// AddListener, only the changes to the given key are reported, so components
+// can follow the few keys they depend on. The watcher stays until it's
+// removed with Unwatch, even if the key leaves the cache.
+//
+// fn is called from internal goroutines and from the ones writing the key, so
+// it must be fast and safe for concurrent use, and must not write the key.
+func (c *Cache[K, V]) WatchKey(key K, fn func(event KeyEvent, old V)) WatchID {
+	if c == nil || fn == nil {
+		return 0
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.watchers.add(keyHash, conflictHash, fn)
+}
+
+// Unwatch removes the watcher with the given ID. It returns false if there's
+// no such watcher.
+func (c *Cache[K, V]) Unwatch(id WatchID) bool {
+	if c == nil {
+		return false
+	}
+	return c.watchers.remove(id)
+}
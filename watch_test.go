@@ -0,0 +1,84 @@
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheWatchKey(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	type event struct {
+		event KeyEvent
+		old   int
+	}
+	var mu sync.Mutex
+	var events []event
+	id := c.WatchKey(1, func(e KeyEvent, old int) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event{e, old})
+	})
+	watched := func() []event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]event(nil), events...)
+	}
+
+	retrySet(t, c, 1, 1, 1, 0)
+	retrySet(t, c, 2, 2, 1, 0)
+	require.Empty(t, watched())
+
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	require.Equal(t, []event{{KeyReplaced, 1}}, watched())
+
+	c.Set(2, 20, 1)
+	c.Wait()
+	c.Clear()
+	c.Wait()
+	require.Equal(t, []event{{KeyReplaced, 1}, {KeyCleared, 10}}, watched())
+
+	require.True(t, c.Unwatch(id))
+	require.False(t, c.Unwatch(id))
+	retrySet(t, c, 1, 1, 1, 0)
+	require.True(t, c.Set(1, 2, 1))
+	c.Wait()
+	require.Len(t, watched(), 2)
+}
+
+func TestCacheWatchKeyExpired(t *testing.T) {
+	c, err := NewCache(&Config[int, int]{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		PreciseExpiration:  true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	expired := make(chan int, 1)
+	c.WatchKey(1, func(e KeyEvent, old int) {
+		if e == KeyExpired {
+			expired <- old
+		}
+	})
+	require.True(t, c.SetWithTTL(1, 1, 1, 10*time.Millisecond))
+	select {
+	case old := <-expired:
+		require.Equal(t, 1, old)
+	case <-time.After(time.Second):
+		t.Fatal("the watcher wasn't called")
+	}
+}
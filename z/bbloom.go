@@ -22,7 +22,9 @@ package z
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"math"
 	"unsafe"
 
@@ -75,6 +77,15 @@ func NewBloomFilter(params ...float64) (bloomfilter *Bloom) {
 	return bloomfilter
 }
 
+// NewCountingBloomFilter returns a new bloomfilter that also keeps a count for
+// each bit, so hashes can be removed with Remove. It takes the same parameters
+// as NewBloomFilter and uses a byte per bit on top of the bitset.
+func NewCountingBloomFilter(params ...float64) *Bloom {
+	bloomfilter := NewBloomFilter(params...)
+	bloomfilter.counts = make([]uint8, bloomfilter.size+1)
+	return bloomfilter
+}
+
 // Bloom filter
 type Bloom struct {
 	bitset  []uint64
@@ -83,8 +94,20 @@ type Bloom struct {
 	size    uint64
 	setLocs uint64
 	shift   uint64
+	// counts holds the number of hashes setting each bit, for counting
+	// filters only. Counts stop at 255, and such bits are never unset.
+	counts []uint8
 }
 
+var (
+	// ErrBloomMismatch is returned by Merge when the filters don't have the
+	// same size and number of hash locations.
+	ErrBloomMismatch = errors.New("bloom filters have different sizes or hash locations")
+	// ErrBloomCorrupt is returned by UnmarshalBinary when the data isn't a
+	// filter encoded by MarshalBinary.
+	ErrBloomCorrupt = errors.New("bloom filter data is corrupt")
+)
+
 // <--- http://www.cse.yorku.ca/~oz/hash.html
 // modified Berkeley DB Hash (32bit)
 // hash is casted to l, h = 16bit fragments
@@ -103,11 +126,73 @@ func (bl *Bloom) Add(hash uint64) {
 	h := hash >> bl.shift
 	l := hash << bl.shift >> bl.shift
 	for i := uint64(0); i < bl.setLocs; i++ {
-		bl.Set((h + i*l) & bl.size)
+		idx := (h + i*l) & bl.size
+		bl.Set(idx)
+		if bl.counts != nil && bl.counts[idx] < math.MaxUint8 {
+			bl.counts[idx]++
+		}
 		bl.ElemNum++
 	}
 }
 
+// Remove removes a hash added to a counting bloomfilter, returned by
+// NewCountingBloomFilter. It returns false, leaving the filter unchanged, if
+// the filter isn't counting or doesn't have the hash. Removing a hash that
+// wasn't added, but that the filter has as a false positive, removes the
+// hashes sharing its bits instead.
+func (bl *Bloom) Remove(hash uint64) bool {
+	if bl.counts == nil || !bl.Has(hash) {
+		return false
+	}
+	h := hash >> bl.shift
+	l := hash << bl.shift >> bl.shift
+	for i := uint64(0); i < bl.setLocs; i++ {
+		idx := (h + i*l) & bl.size
+		switch bl.counts[idx] {
+		case math.MaxUint8:
+			// The count is lost, so keep the bit set.
+		case 1:
+			bl.counts[idx] = 0
+			bl.unset(idx)
+		default:
+			bl.counts[idx]--
+		}
+		bl.ElemNum--
+	}
+	return true
+}
+
+// IsCounting returns true if the filter was returned by
+// NewCountingBloomFilter and supports Remove.
+func (bl *Bloom) IsCounting() bool {
+	return bl.counts != nil
+}
+
+// Merge adds the hashes of other to the filter, so it has the hashes either of
+// them has. Both filters must have been created with the same parameters,
+// otherwise ErrBloomMismatch is returned. The filter only stays counting if
+// both are.
+func (bl *Bloom) Merge(other *Bloom) error {
+	if len(bl.bitset) != len(other.bitset) || bl.setLocs != other.setLocs {
+		return ErrBloomMismatch
+	}
+	for i, word := range other.bitset {
+		bl.bitset[i] |= word
+	}
+	if bl.counts != nil && other.counts == nil {
+		bl.counts = nil
+	}
+	for i, count := range bl.counts {
+		if sum := int(count) + int(other.counts[i]); sum < math.MaxUint8 {
+			bl.counts[i] = uint8(sum)
+		} else {
+			bl.counts[i] = math.MaxUint8
+		}
+	}
+	bl.ElemNum += other.ElemNum
+	return nil
+}
+
 // Has checks if bit(s) for entry hash is/are set,
 // returns true if the hash was added to the Bloom Filter.
 func (bl Bloom) Has(hash uint64) bool {
@@ -135,8 +220,8 @@ func (bl *Bloom) AddIfNotHas(hash uint64) bool {
 // TotalSize returns the total size of the bloom filter.
 func (bl *Bloom) TotalSize() int {
 	// The bl struct has 5 members and each one is 8 byte. The bitset is a
-	// uint64 byte slice.
-	return len(bl.bitset)*8 + 5*8
+	// uint64 byte slice and counts, if set, a byte slice.
+	return len(bl.bitset)*8 + len(bl.counts) + 5*8
 }
 
 // Size makes Bloom filter with as bitset of size sz.
@@ -149,6 +234,9 @@ func (bl *Bloom) Clear() {
 	for i := range bl.bitset {
 		bl.bitset[i] = 0
 	}
+	for i := range bl.counts {
+		bl.counts[i] = 0
+	}
 }
 
 // Set sets the bit[idx] of bitset.
@@ -157,6 +245,17 @@ func (bl *Bloom) Set(idx uint64) {
 	*(*uint8)(ptr) |= mask[idx%8]
 }
 
+// unset clears the bit[idx] of bitset.
+func (bl *Bloom) unset(idx uint64) {
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(&bl.bitset[idx>>6])) + uintptr((idx%64)>>3))
+	*(*uint8)(ptr) &^= mask[idx%8]
+}
+
+// bytes returns the bitset as the bytes Set and IsSet address.
+func (bl *Bloom) bytes() []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(&bl.bitset[0])), len(bl.bitset)*8)
+}
+
 // IsSet checks if bit[idx] of bitset is set, returns true/false.
 func (bl *Bloom) IsSet(idx uint64) bool {
 	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(&bl.bitset[idx>>6])) + uintptr((idx%64)>>3))
@@ -209,3 +308,66 @@ func (bl Bloom) JSONMarshal() []byte {
 	}
 	return data
 }
+
+// MarshalBinary encodes the filter, counts included if it's counting, in a
+// compact form that doesn't depend on the byte order of the machine. It never
+// returns an error.
+//
+// The encoding is the uvarint number of bits, hash locations and elements, a
+// byte set to 1 if the filter is counting, the bitset and the counts, if any.
+func (bl *Bloom) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 3*binary.MaxVarintLen64+1+len(bl.bitset)*8+len(bl.counts))
+	var buf [binary.MaxVarintLen64]byte
+	for _, v := range []uint64{bl.size + 1, bl.setLocs, bl.ElemNum} {
+		data = append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	if bl.counts != nil {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = append(data, bl.bytes()...)
+	return append(data, bl.counts...), nil
+}
+
+// UnmarshalBinary replaces the filter with the one encoded by MarshalBinary.
+// It returns ErrBloomCorrupt, leaving the filter unchanged, if data can't be
+// decoded.
+func (bl *Bloom) UnmarshalBinary(data []byte) error {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrBloomCorrupt
+		}
+		fields[i], data = v, data[n:]
+	}
+	bits, locs, elems := fields[0], fields[1], fields[2]
+	if bits < 512 || bits&(bits-1) != 0 || bits > math.MaxInt32*64 || locs == 0 ||
+		len(data) < 1 || data[0] > 1 {
+		return ErrBloomCorrupt
+	}
+	counting := data[0] == 1
+	data = data[1:]
+	size := bits / 64 * 8
+	if counting {
+		size += bits
+	}
+	if uint64(len(data)) != size {
+		return ErrBloomCorrupt
+	}
+	_, exponent := getSize(bits)
+	*bl = Bloom{
+		bitset:  make([]uint64, bits/64),
+		ElemNum: elems,
+		sizeExp: exponent,
+		size:    bits - 1,
+		setLocs: locs,
+		shift:   64 - exponent,
+	}
+	copy(bl.bytes(), data)
+	if counting {
+		bl.counts = append([]uint8{}, data[bits/8:]...)
+	}
+	return nil
+}
@@ -71,6 +71,69 @@ func TestM_JSON(t *testing.T) {
 	require.Equal(t, shallBe, cnt2)
 }
 
+func TestBloomRemove(t *testing.T) {
+	bf := NewCountingBloomFilter(1000, 0.01)
+	require.True(t, bf.IsCounting())
+	for i := range wordlist1[:100] {
+		bf.Add(MemHash(wordlist1[i]))
+	}
+	// Adding a hash twice takes two removals.
+	hash := MemHash(wordlist1[0])
+	bf.Add(hash)
+	require.True(t, bf.Remove(hash))
+	require.True(t, bf.Has(hash))
+	require.True(t, bf.Remove(hash))
+	require.False(t, bf.Has(hash))
+	require.False(t, bf.Remove(hash))
+	for i := range wordlist1[1:100] {
+		require.True(t, bf.Has(MemHash(wordlist1[i+1])))
+	}
+
+	plain := NewBloomFilter(1000, 0.01)
+	plain.Add(hash)
+	require.False(t, plain.IsCounting())
+	require.False(t, plain.Remove(hash))
+	require.True(t, plain.Has(hash))
+}
+
+func TestBloomMerge(t *testing.T) {
+	a, b := NewCountingBloomFilter(1000, 0.01), NewCountingBloomFilter(1000, 0.01)
+	for i := range wordlist1[:200] {
+		if i%2 == 0 {
+			a.Add(MemHash(wordlist1[i]))
+		} else {
+			b.Add(MemHash(wordlist1[i]))
+		}
+	}
+	require.NoError(t, a.Merge(b))
+	for i := range wordlist1[:200] {
+		require.True(t, a.Has(MemHash(wordlist1[i])))
+	}
+	require.True(t, a.IsCounting())
+	require.True(t, a.Remove(MemHash(wordlist1[1])))
+
+	require.NoError(t, a.Merge(NewBloomFilter(1000, 0.01)))
+	require.False(t, a.IsCounting())
+	require.Equal(t, ErrBloomMismatch, a.Merge(NewBloomFilter(100000, 0.01)))
+}
+
+func TestBloomBinary(t *testing.T) {
+	for _, bf := range []*Bloom{NewBloomFilter(1000, 0.01), NewCountingBloomFilter(1000, 0.01)} {
+		for i := range wordlist1[:100] {
+			bf.Add(MemHash(wordlist1[i]))
+		}
+		data, err := bf.MarshalBinary()
+		require.NoError(t, err)
+		var bf2 Bloom
+		require.NoError(t, bf2.UnmarshalBinary(data))
+		require.Equal(t, bf, &bf2)
+
+		require.Equal(t, ErrBloomCorrupt, bf2.UnmarshalBinary(data[:len(data)-1]))
+		require.Equal(t, ErrBloomCorrupt, bf2.UnmarshalBinary(nil))
+		require.Equal(t, bf, &bf2)
+	}
+}
+
 func BenchmarkM_New(b *testing.B) {
 	for r := 0; r < b.N; r++ {
 		_ = NewBloomFilter(float64(n*10), float64(7))
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// DeepSize estimates the memory taken by v in bytes, including the memory it
+// references through pointers, slices, strings, maps, channels and interfaces,
+// each counted once however many times it's referenced. It can be passed as
+// the Cost of a cache, such as ristretto.Config.Cost, to weigh the values by
+// their actual size rather than by the size of their top level.
+//
+// Map sizes are estimated from their number of entries, and functions and
+// unsafe pointers are assumed to reference nothing. DeepSize uses reflection,
+// but the layout of each type is only analyzed once, so values without any
+// reference, like numbers and structs of numbers, are sized right away.
+func DeepSize[T any](v T) int64 {
+	s := sizer{seen: make(map[uintptr]struct{})}
+	return int64(unsafe.Sizeof(v)) + s.indirect(reflect.ValueOf(&v).Elem())
+}
+
+// typeLayout is what DeepSize needs to know about a type.
+type typeLayout struct {
+	// flat is true if the values of the type don't reference any memory.
+	flat bool
+	// fields are the indexes of the fields of a struct that aren't flat.
+	fields []int
+}
+
+// layouts caches the typeLayout of each reflect.Type.
+var layouts sync.Map
+
+func layoutOf(t reflect.Type) *typeLayout {
+	if l, ok := layouts.Load(t); ok {
+		return l.(*typeLayout)
+	}
+	l := &typeLayout{}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.String, reflect.Map, reflect.Chan, reflect.Interface:
+	case reflect.Array:
+		l.flat = t.Len() == 0 || layoutOf(t.Elem()).flat
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !layoutOf(t.Field(i).Type).flat {
+				l.fields = append(l.fields, i)
+			}
+		}
+		l.flat = len(l.fields) == 0
+	default:
+		// Numbers, functions and unsafe pointers.
+		l.flat = true
+	}
+	layouts.Store(t, l)
+	return l
+}
+
+// sizer sizes the memory referenced by values, keeping track of the memory
+// already counted.
+type sizer struct {
+	seen map[uintptr]struct{}
+}
+
+// visit returns true if the memory at p wasn't counted yet.
+func (s *sizer) visit(p uintptr) bool {
+	if _, ok := s.seen[p]; ok {
+		return false
+	}
+	s.seen[p] = struct{}{}
+	return true
+}
+
+// indirect returns the memory referenced by v, not counting v itself.
+func (s *sizer) indirect(v reflect.Value) int64 {
+	l := layoutOf(v.Type())
+	if l.flat {
+		return 0
+	}
+	var size int64
+	switch v.Kind() {
+	case reflect.String:
+		size = int64(v.Len())
+	case reflect.Ptr:
+		if v.IsNil() || !s.visit(v.Pointer()) {
+			return 0
+		}
+		elem := v.Elem()
+		size = int64(elem.Type().Size()) + s.indirect(elem)
+	case reflect.Slice:
+		if v.IsNil() || !s.visit(v.Pointer()) {
+			return 0
+		}
+		size = int64(v.Cap()) * int64(v.Type().Elem().Size())
+		if !layoutOf(v.Type().Elem()).flat {
+			for i := 0; i < v.Len(); i++ {
+				size += s.indirect(v.Index(i))
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			size += s.indirect(v.Index(i))
+		}
+	case reflect.Struct:
+		for _, i := range l.fields {
+			size += s.indirect(v.Field(i))
+		}
+	case reflect.Map:
+		if v.IsNil() || !s.visit(v.Pointer()) {
+			return 0
+		}
+		key, elem := v.Type().Key(), v.Type().Elem()
+		size = mapSize(v.Len(), key.Size(), elem.Size())
+		if !layoutOf(key).flat || !layoutOf(elem).flat {
+			iter := v.MapRange()
+			for iter.Next() {
+				size += s.indirect(iter.Key()) + s.indirect(iter.Value())
+			}
+		}
+	case reflect.Chan:
+		if v.IsNil() || !s.visit(v.Pointer()) {
+			return 0
+		}
+		size = int64(v.Cap()) * int64(v.Type().Elem().Size())
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		size = s.indirect(elem)
+		if elem.Kind() != reflect.Ptr {
+			// The value is boxed, unless it's a pointer.
+			size += int64(elem.Type().Size())
+		}
+	}
+	return size
+}
+
+// mapSize estimates the memory taken by a Go map holding n entries with keys
+// and values of the given sizes. The buckets hold 8 entries and a byte of hash
+// for each, and are 6.5/8 full on average.
+func mapSize(n int, keySize, valueSize uintptr) int64 {
+	return int64(float64(n) * float64(keySize+valueSize+1) * 8 / 6.5)
+}
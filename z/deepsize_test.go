@@ -0,0 +1,54 @@
+package z
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+type deepSizeNode struct {
+	Name string
+	Next *deepSizeNode
+}
+
+func TestDeepSize(t *testing.T) {
+	type flat struct {
+		A int64
+		B [4]int32
+	}
+	require.Equal(t, int64(unsafe.Sizeof(flat{})), DeepSize(flat{A: 1}))
+	require.Equal(t, int64(8), DeepSize(int64(1)))
+
+	require.Equal(t, int64(unsafe.Sizeof(""))+5, DeepSize("hello"))
+
+	b := make([]byte, 3, 10)
+	require.Equal(t, int64(unsafe.Sizeof(b))+10, DeepSize(b))
+	strs := []string{"ab", "cde"}
+	require.Equal(t, int64(unsafe.Sizeof(strs))+2*int64(unsafe.Sizeof(""))+5, DeepSize(strs))
+
+	// The memory shared by the elements is counted once.
+	v := new(int64)
+	ptrs := []*int64{v, v}
+	require.Equal(t, int64(unsafe.Sizeof(ptrs))+2*8+8, DeepSize(ptrs))
+
+	m := map[int64]string{1: "a", 2: "bc"}
+	require.Equal(t, int64(unsafe.Sizeof(m))+mapSize(2, 8, unsafe.Sizeof(""))+3, DeepSize(m))
+
+	var i interface{} = "abc"
+	require.Equal(t, int64(unsafe.Sizeof(i))+int64(unsafe.Sizeof(""))+3, DeepSize(i))
+
+	// Nil values reference nothing.
+	require.Equal(t, int64(unsafe.Sizeof(ptrs)), DeepSize([]*int64(nil)))
+	require.Equal(t, int64(unsafe.Sizeof(m)), DeepSize(map[int64]string(nil)))
+	require.Equal(t, int64(unsafe.Sizeof(i)), DeepSize[interface{}](nil))
+	require.Equal(t, int64(8), DeepSize((*deepSizeNode)(nil)))
+}
+
+func TestDeepSizeCycle(t *testing.T) {
+	a := &deepSizeNode{Name: "a"}
+	b := &deepSizeNode{Name: "b", Next: a}
+	a.Next = b
+	node := int64(unsafe.Sizeof(deepSizeNode{}))
+	require.Equal(t, int64(8)+2*node+2, DeepSize(a))
+}
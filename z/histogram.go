@@ -109,6 +109,26 @@ func (histogram *HistogramData) Update(value int64) {
 	}
 }
 
+// Merge adds the values recorded by other, which must have the same bounds, as
+// if they had been recorded by histogram.
+func (histogram *HistogramData) Merge(other *HistogramData) {
+	if histogram == nil || other == nil || other.Count == 0 {
+		return
+	}
+	assert(len(histogram.Bounds) == len(other.Bounds))
+	if other.Max > histogram.Max {
+		histogram.Max = other.Max
+	}
+	if other.Min < histogram.Min {
+		histogram.Min = other.Min
+	}
+	histogram.Sum += other.Sum
+	histogram.Count += other.Count
+	for i, n := range other.CountPerBucket {
+		histogram.CountPerBucket[i] += n
+	}
+}
+
 // Mean returns the mean value for the histogram.
 func (histogram *HistogramData) Mean() float64 {
 	if histogram.Count == 0 {
@@ -78,3 +78,23 @@ func TestPercentile100(t *testing.T) {
 	}
 	require.Equal(t, h.Percentile(1.0), 514.0)
 }
+
+func TestHistogramMerge(t *testing.T) {
+	h := NewHistogramData(HistogramBounds(1, 4))
+	other := NewHistogramData(HistogramBounds(1, 4))
+	all := NewHistogramData(HistogramBounds(1, 4))
+	for _, v := range []int64{1, 3, 7} {
+		h.Update(v)
+		all.Update(v)
+	}
+	for _, v := range []int64{0, 12, 20} {
+		other.Update(v)
+		all.Update(v)
+	}
+	h.Merge(other)
+	require.Equal(t, all, h)
+
+	// Merging an empty histogram keeps Min.
+	h.Merge(NewHistogramData(HistogramBounds(1, 4)))
+	require.Equal(t, all, h)
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// HyperLogLog estimates the number of distinct hashes added to it, using a
+// fixed amount of memory whatever their number. It's safe for concurrent use.
+type HyperLogLog struct {
+	precision uint8
+	// registers holds, for each group of hashes, the longest run of leading
+	// zeros seen plus one.
+	registers []uint32
+}
+
+// NewHyperLogLog returns a HyperLogLog with 2^precision registers, where
+// precision is clamped to [4, 18]. The standard error of the estimates is
+// about 1.04/sqrt(2^precision), so 14 gives about 0.8% with 64KB of registers.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 {
+		precision = 4
+	}
+	if precision > 18 {
+		precision = 18
+	}
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint32, 1<<precision),
+	}
+}
+
+// Add records the hash. Hashes are mixed again, so hashes that aren't well
+// distributed, like the ones of integer keys, are estimated as well.
+func (h *HyperLogLog) Add(hash uint64) {
+	hash = mix64(hash)
+	idx := hash >> (64 - h.precision)
+	// Make sure the rank stops at the last bit.
+	w := hash<<h.precision | 1<<(h.precision-1)
+	rank := uint32(bits.LeadingZeros64(w)) + 1
+	reg := &h.registers[idx]
+	for {
+		old := atomic.LoadUint32(reg)
+		if rank <= old || atomic.CompareAndSwapUint32(reg, old, rank) {
+			return
+		}
+	}
+}
+
+// Count returns the estimated number of distinct hashes added.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for i := range h.registers {
+		r := atomic.LoadUint32(&h.registers[i])
+		if r == 0 {
+			zeros++
+		}
+		sum += math.Ldexp(1, -int(r))
+	}
+	estimate := hllAlpha(m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Merge adds the hashes recorded by other, which must have the same
+// precision, as if they had been added to h.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	assert(h.precision == other.precision)
+	for i := range other.registers {
+		rank := atomic.LoadUint32(&other.registers[i])
+		reg := &h.registers[i]
+		for {
+			old := atomic.LoadUint32(reg)
+			if rank <= old || atomic.CompareAndSwapUint32(reg, old, rank) {
+				break
+			}
+		}
+	}
+}
+
+// Clear forgets all the hashes added.
+func (h *HyperLogLog) Clear() {
+	for i := range h.registers {
+		atomic.StoreUint32(&h.registers[i], 0)
+	}
+}
+
+// Reset clears h and returns a HyperLogLog holding the hashes it recorded.
+// Each register is moved atomically, so a concurrent Add is recorded by one of
+// them only.
+func (h *HyperLogLog) Reset() *HyperLogLog {
+	old := NewHyperLogLog(h.precision)
+	for i := range h.registers {
+		old.registers[i] = atomic.SwapUint32(&h.registers[i], 0)
+	}
+	return old
+}
+
+func hllAlpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/m)
+}
+
+// mix64 is the finalizer of MurmurHash3, spreading the bits of x over the
+// whole result.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,32 @@
+package z
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	h := NewHyperLogLog(14)
+	require.Zero(t, h.Count())
+	for _, n := range []uint64{10, 1000, 100000} {
+		h.Clear()
+		for i := uint64(0); i < n; i++ {
+			// Adding the same hashes again doesn't change the estimate.
+			h.Add(i)
+			h.Add(i)
+		}
+		require.InDelta(t, n, h.Count(), float64(n)*0.03, "n = %d", n)
+	}
+
+	other := NewHyperLogLog(14)
+	for i := uint64(100000); i < 200000; i++ {
+		other.Add(i)
+	}
+	h.Merge(other)
+	require.InDelta(t, 200000, h.Count(), 200000*0.03)
+
+	old := h.Reset()
+	require.InDelta(t, 200000, old.Count(), 200000*0.03)
+	require.Zero(t, h.Count())
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeyDigest computes the hash and the conflict hash of a composite key from
+// its fields, without encoding them into a buffer first. Fields are added in
+// order, so keys with the same fields in a different order hash differently.
+//
+//	var d z.KeyDigest
+//	d.String(k.Tenant)
+//	d.Uint64(k.ID)
+//	return d.Sum()
+//
+// The zero value is ready to use.
+type KeyDigest struct {
+	key      uint64
+	conflict uint64
+}
+
+const (
+	digestPrime1 = 0x9e3779b185ebca87
+	digestPrime2 = 0xc2b2ae3d27d4eb4f
+)
+
+// add mixes the hashes of a field into the digest.
+func (d *KeyDigest) add(key, conflict uint64) {
+	d.key = (d.key^key)*digestPrime1 + digestPrime2
+	d.key = d.key<<31 | d.key>>33
+	d.conflict = (d.conflict^conflict)*digestPrime2 + digestPrime1
+	d.conflict = d.conflict<<27 | d.conflict>>37
+}
+
+// Uint64 adds an integer field, such as an ID or a half of a UUID.
+func (d *KeyDigest) Uint64(v uint64) {
+	d.add(v, ^v)
+}
+
+// String adds a string field.
+func (d *KeyDigest) String(s string) {
+	d.add(MemHashString(s), xxhash.Sum64String(s))
+	// Also add the length so adjacent strings can't swap bytes.
+	d.Uint64(uint64(len(s)))
+}
+
+// Bytes adds a byte slice field, such as a UUID.
+func (d *KeyDigest) Bytes(b []byte) {
+	d.add(MemHash(b), xxhash.Sum64(b))
+	d.Uint64(uint64(len(b)))
+}
+
+// Sum returns the hash and the conflict hash of the fields added so far.
+func (d *KeyDigest) Sum() (uint64, uint64) {
+	return mix64(d.key), mix64(d.conflict ^ digestPrime1)
+}
@@ -0,0 +1,36 @@
+package z
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyDigest(t *testing.T) {
+	sum := func(fields ...interface{}) [2]uint64 {
+		var d KeyDigest
+		for _, f := range fields {
+			switch f := f.(type) {
+			case string:
+				d.String(f)
+			case uint64:
+				d.Uint64(f)
+			case []byte:
+				d.Bytes(f)
+			}
+		}
+		key, conflict := d.Sum()
+		return [2]uint64{key, conflict}
+	}
+	require.Equal(t, sum("a", uint64(1)), sum("a", uint64(1)))
+	require.Equal(t, sum([]byte("a")), sum("a"))
+	seen := make(map[[2]uint64]bool)
+	for _, fields := range [][]interface{}{
+		{}, {"a"}, {"ab"}, {"a", "b"}, {"ab", ""}, {"", "ab"},
+		{uint64(1)}, {uint64(1), uint64(2)}, {uint64(2), uint64(1)},
+	} {
+		s := sum(fields...)
+		require.False(t, seen[s], "%v", fields)
+		seen[s] = true
+	}
+}
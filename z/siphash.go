@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// SipKey is a 128-bit SipHash key.
+type SipKey struct {
+	K0, K1 uint64
+}
+
+// NewSipKey returns a random SipKey.
+func NewSipKey() SipKey {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return SipKey{
+		K0: binary.LittleEndian.Uint64(b[:8]),
+		K1: binary.LittleEndian.Uint64(b[8:]),
+	}
+}
+
+var (
+	processSipKey     SipKey
+	processSipKeyOnce sync.Once
+)
+
+// ProcessSipKey returns the random SipKey of the process, created on the first
+// call.
+func ProcessSipKey() SipKey {
+	processSipKeyOnce.Do(func() {
+		processSipKey = NewSipKey()
+	})
+	return processSipKey
+}
+
+// SipKeyToHash works like KeyToHash, for the same key types, but the hash of
+// the keys is their SipHash-2-4 with the key k. Unlike with KeyToHash, whose
+// hashes can be predicted, keys chosen by an attacker who doesn't know k can't
+// be made to share a hash or a shard on purpose to slow down the cache. Integer
+// keys have their value as conflict hash, as their hash doesn't identify them
+// anymore.
+func SipKeyToHash[K any](k SipKey, key K) (uint64, uint64) {
+	switch key := any(key).(type) {
+	case uint64:
+		return k.sum64(key), key
+	case string:
+		return sipHash(k, key), xxhash.Sum64String(key)
+	case []byte:
+		if key == nil {
+			return 0, 0
+		}
+		return sipHash(k, key), xxhash.Sum64(key)
+	case byte:
+		return k.sum64(uint64(key)), uint64(key)
+	case int:
+		return k.sum64(uint64(key)), uint64(key)
+	case int32:
+		return k.sum64(uint64(key)), uint64(key)
+	case uint32:
+		return k.sum64(uint64(key)), uint64(key)
+	case int64:
+		return k.sum64(uint64(key)), uint64(key)
+	default:
+		panic("Key type not supported")
+	}
+}
+
+// SipHash returns the SipHash-2-4 of b with the key k.
+func (k SipKey) SipHash(b []byte) uint64 {
+	return sipHash(k, b)
+}
+
+// sipState holds the four words of the SipHash state.
+type sipState struct {
+	v0, v1, v2, v3 uint64
+}
+
+func newSipState(k SipKey) sipState {
+	return sipState{
+		v0: k.K0 ^ 0x736f6d6570736575,
+		v1: k.K1 ^ 0x646f72616e646f6d,
+		v2: k.K0 ^ 0x6c7967656e657261,
+		v3: k.K1 ^ 0x7465646279746573,
+	}
+}
+
+func (s *sipState) round() {
+	s.v0 += s.v1
+	s.v1 = bits.RotateLeft64(s.v1, 13)
+	s.v1 ^= s.v0
+	s.v0 = bits.RotateLeft64(s.v0, 32)
+	s.v2 += s.v3
+	s.v3 = bits.RotateLeft64(s.v3, 16)
+	s.v3 ^= s.v2
+	s.v0 += s.v3
+	s.v3 = bits.RotateLeft64(s.v3, 21)
+	s.v3 ^= s.v0
+	s.v2 += s.v1
+	s.v1 = bits.RotateLeft64(s.v1, 17)
+	s.v1 ^= s.v2
+	s.v2 = bits.RotateLeft64(s.v2, 32)
+}
+
+// block compresses a message word with 2 rounds.
+func (s *sipState) block(m uint64) {
+	s.v3 ^= m
+	s.round()
+	s.round()
+	s.v0 ^= m
+}
+
+// final finishes the hash with 4 rounds.
+func (s *sipState) final() uint64 {
+	s.v2 ^= 0xff
+	s.round()
+	s.round()
+	s.round()
+	s.round()
+	return s.v0 ^ s.v1 ^ s.v2 ^ s.v3
+}
+
+// sipHash returns the SipHash-2-4 of b.
+func sipHash[T string | []byte](k SipKey, b T) uint64 {
+	s := newSipState(k)
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		s.block(uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+			uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56)
+	}
+	last := uint64(n) << 56
+	for i := 0; i < len(b); i++ {
+		last |= uint64(b[i]) << (8 * i)
+	}
+	s.block(last)
+	return s.final()
+}
+
+// sum64 returns the SipHash-2-4 of the little-endian bytes of v.
+func (k SipKey) sum64(v uint64) uint64 {
+	s := newSipState(k)
+	s.block(v)
+	s.block(8 << 56)
+	return s.final()
+}
@@ -0,0 +1,31 @@
+package z
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSipHash(t *testing.T) {
+	// The test vectors of the SipHash paper.
+	k := SipKey{K0: 0x0706050403020100, K1: 0x0f0e0d0c0b0a0908}
+	msg := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+	require.Equal(t, uint64(0x726fdb47dd0e0e31), k.SipHash(nil))
+	require.Equal(t, uint64(0xa129ca6149be45e5), k.SipHash(msg))
+	require.Equal(t, k.SipHash(msg), sipHash(k, string(msg)))
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 12345)
+	key, conflict := SipKeyToHash(k, 12345)
+	require.Equal(t, k.SipHash(b[:]), key)
+	require.Equal(t, uint64(12345), conflict)
+
+	// Keys hash differently with another key.
+	other := NewSipKey()
+	h1, c1 := SipKeyToHash(k, "key")
+	h2, c2 := SipKeyToHash(other, "key")
+	require.NotEqual(t, h1, h2)
+	require.Equal(t, c1, c2)
+	require.Equal(t, ProcessSipKey(), ProcessSipKey())
+}
@@ -58,6 +58,44 @@ func KeyToHash[K any](key K) (uint64, uint64) {
 	}
 }
 
+// SeedHash mixes a key hash with the seed, so the same keys hash differently
+// with different seeds. For a given seed it's a bijection, so keys told apart
+// by their hashes still are.
+func SeedHash(hash, seed uint64) uint64 {
+	return mix64(hash ^ seed)
+}
+
+// KeyToConflictHi returns 64 bits of hash of the key independent of the ones
+// returned by KeyToHash, for the same key types, which makes the conflict hash
+// 128 bits wide. Integer keys are fully told apart by KeyToHash, so it returns
+// 0 for them.
+func KeyToConflictHi[K any](key K) uint64 {
+	switch k := any(key).(type) {
+	case string:
+		return fnv64a(k)
+	case []byte:
+		if k == nil {
+			return 0
+		}
+		return fnv64a(k)
+	case uint64, byte, int, int32, uint32, int64:
+		return 0
+	default:
+		panic("Key type not supported")
+	}
+}
+
+// fnv64a returns the FNV-1a hash of s, which is unrelated to the hashes used by
+// KeyToHash.
+func fnv64a[T string | []byte](s T) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
 var (
 	dummyCloserChan <-chan struct{}
 	tmpDir          string